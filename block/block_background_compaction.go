@@ -0,0 +1,66 @@
+package block
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StartBackgroundCompaction starts compacting index blocks every interval in the background until the manager
+// is closed or the provided context is canceled. Each run compacts small index blocks once there are at least
+// opt.MinSmallBlocks of them, exactly like CompactIndexes(ctx, opt).
+//
+// Background compaction and Flush() never run concurrently: a compaction is not started while a flush is
+// in progress and a flush waits for a running compaction to finish.
+func (bm *Manager) StartBackgroundCompaction(ctx context.Context, interval time.Duration, opt CompactOptions) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid compaction interval: %v", interval)
+	}
+
+	if opt.MaxSmallBlocks < opt.MinSmallBlocks {
+		return fmt.Errorf("invalid block counts")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	bm.backgroundTasks.Add(1)
+	go func() {
+		defer bm.backgroundTasks.Done()
+		defer cancel()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				bm.compactInBackground(ctx, opt)
+
+			case <-ctx.Done():
+				return
+
+			case <-bm.closed:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (bm *Manager) compactInBackground(ctx context.Context, opt CompactOptions) {
+	bm.flushCompactionMutex.Lock()
+	defer bm.flushCompactionMutex.Unlock()
+
+	select {
+	case <-bm.closed:
+		// don't start compacting after the manager has been closed while waiting for a flush.
+		return
+	default:
+	}
+
+	log.Debugf("compacting indexes in the background")
+	if err := bm.CompactIndexes(ctx, opt); err != nil {
+		log.Warningf("background compaction failed: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package block
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// queuedPack is a finished pack waiting to be uploaded in the background.
+type queuedPack struct {
+	packFile string
+	data     []byte
+	index    packIndexBuilder // index entries of the blocks in the pack
+	items    map[string]Info  // pending blocks in the pack, restored if the upload fails
+}
+
+func (bm *Manager) maybeStartBackgroundUploads() {
+	queueSize := bm.caching.BackgroundFlushQueue
+	workers := bm.caching.ParallelPackUploads
+	if workers < 1 {
+		workers = 1
+	}
+
+	if workers > 1 && queueSize < workers {
+		// parallel uploads require as many queued packs as there are workers.
+		queueSize = workers
+	}
+
+	if queueSize > 0 {
+		bm.startBackgroundUploads(queueSize, workers)
+	}
+}
+
+// startBackgroundUploads starts the workers uploading finished packs in the background. Writes that finish
+// a pack while queueSize packs are already waiting for upload block until one of them has been uploaded.
+// Packs are uploaded using a context owned by the manager rather than the contexts of the writes that finished them,
+// which may be canceled as soon as the writes return. Close() cancels the context and waits for the workers.
+func (bm *Manager) startBackgroundUploads(queueSize, workers int) {
+	bm.uploadQueue = make(chan *queuedPack, queueSize)
+	bm.uploadsDone = sync.NewCond(&bm.mu)
+	bm.uploadCancels = map[*queuedPack]context.CancelFunc{}
+	bm.uploadContext, bm.cancelUploadContext = context.WithCancel(context.Background())
+
+	for i := 0; i < workers; i++ {
+		bm.backgroundTasks.Add(1)
+		go func() {
+			defer bm.backgroundTasks.Done()
+
+			for {
+				select {
+				case p := <-bm.uploadQueue:
+					bm.uploadQueuedPack(p)
+
+				case <-bm.closed:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// queuePackBlockLocked prepares the current pack and queues it for background upload. Blocks in the pack remain
+// readable from memory and are only added to the index being built once the pack has been uploaded.
+func (bm *Manager) queuePackBlockLocked(ctx context.Context) error {
+	bm.assertLocked()
+
+	bm.waitForUploadsLocked(cap(bm.uploadQueue) - 1)
+	if len(bm.currentPackItems) == 0 {
+		// the pack has been queued by another writer while we were waiting.
+		return nil
+	}
+
+	packFile, err := newPackFileName()
+	if err != nil {
+		return err
+	}
+
+	blockData, packFileIndex, err := bm.preparePackDataBlock(ctx, packFile)
+	if err != nil {
+		return fmt.Errorf("error preparing data block: %v", err)
+	}
+
+	p := &queuedPack{
+		packFile: packFile,
+		data:     blockData,
+		index:    packFileIndex,
+		items:    map[string]Info{},
+	}
+
+	for blockID := range packFileIndex {
+		p.items[blockID] = bm.currentPackItems[blockID]
+		bm.uploadingPackItems[blockID] = p
+	}
+
+	// never blocks, since there are fewer pending uploads than the capacity of the queue.
+	bm.pendingUploads++
+	bm.uploadQueue <- p
+	return nil
+}
+
+func (bm *Manager) uploadQueuedPack(p *queuedPack) {
+	ctx := bm.startUpload(p)
+
+	var err error
+	if ctx.Err() != nil {
+		err = errors.Wrap(ctx.Err(), "upload canceled")
+	} else if len(p.data) > 0 {
+		err = bm.writePackFileNotLocked(ctx, p.packFile, p.data)
+	}
+
+	bm.lock()
+	defer bm.unlock()
+
+	bm.uploadCancels[p]()
+	delete(bm.uploadCancels, p)
+
+	if err != nil {
+		log.Warningf("unable to upload pack %v in the background: %v", p.packFile, err)
+		bm.uploadErrors = append(bm.uploadErrors, errors.Wrapf(err, "can't save pack data block %v", p.packFile))
+
+		// the flush will fail anyway, so there's no point in finishing concurrent uploads.
+		for _, cancel := range bm.uploadCancels {
+			cancel()
+		}
+	} else {
+		formatLog.Debugf("wrote pack file in the background: %v (%v bytes)", p.packFile, len(p.data))
+	}
+
+	for blockID, item := range p.items {
+		if bm.uploadingPackItems[blockID] != p {
+			// the block has been deleted or written again since the pack was queued.
+			continue
+		}
+
+		delete(bm.uploadingPackItems, blockID)
+
+		if err != nil {
+			// keep the block pending, so that it's written again with the next pack.
+			bm.setPendingBlock(item)
+			bm.currentPackDataLength += len(item.Payload)
+			continue
+		}
+
+		bm.packIndexBuilder.Add(*p.index[blockID])
+	}
+
+	bm.pendingUploads--
+	bm.uploadsDone.Broadcast()
+}
+
+// startUpload returns the context of the upload of the provided pack, which is canceled when another upload fails.
+// Uploads started after a failure not reported by Flush() yet are canceled right away.
+func (bm *Manager) startUpload(p *queuedPack) context.Context {
+	bm.lock()
+	defer bm.unlock()
+
+	ctx, cancel := context.WithCancel(bm.uploadContext)
+	if len(bm.uploadErrors) > 0 {
+		cancel()
+	}
+
+	bm.uploadCancels[p] = cancel
+	return ctx
+}
+
+// waitForUploadsLocked waits until no more than maxPending queued packs remain to be uploaded.
+// The lock is released while waiting.
+func (bm *Manager) waitForUploadsLocked(maxPending int) {
+	bm.assertLocked()
+
+	for bm.uploadQueue != nil && bm.pendingUploads > maxPending {
+		bm.locked = false
+		bm.uploadsDone.Wait()
+		bm.locked = true
+	}
+}
+
+// takeUploadErrorsLocked returns an error summarizing background upload errors since the last call, if any.
+func (bm *Manager) takeUploadErrorsLocked() error {
+	bm.assertLocked()
+
+	errs := bm.uploadErrors
+	bm.uploadErrors = nil
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errors.Wrap(errs[0], "background upload failed")
+	default:
+		return errors.Wrapf(errs[0], "%v background uploads failed, first error", len(errs))
+	}
+}
@@ -32,10 +32,6 @@ type blockCache struct {
 	closed chan struct{}
 }
 
-type blockToucher interface {
-	TouchBlock(ctx context.Context, blockID string, threshold time.Duration) error
-}
-
 func adjustCacheKey(cacheKey string) string {
 	// block IDs with odd length have a single-byte prefix.
 	// move the prefix to the end of cache key to make sure the top level shard is spread 256 ways.
@@ -49,9 +45,14 @@ func adjustCacheKey(cacheKey string) string {
 func (c *blockCache) getContentBlock(ctx context.Context, cacheKey string, physicalBlockID string, offset, length int64) ([]byte, error) {
 	cacheKey = adjustCacheKey(cacheKey)
 
-	useCache := shouldUseBlockCache(ctx) && c.cacheStorage != nil
+	policy := storage.GetCachePolicy(ctx)
+	if !shouldUseBlockCache(ctx) {
+		policy = storage.CachePolicyBypass
+	}
+
+	useCache := policy != storage.CachePolicyBypass && c.cacheStorage != nil
 	if useCache {
-		if b := c.readAndVerifyCacheBlock(ctx, cacheKey); b != nil {
+		if b := c.readAndVerifyCacheBlock(ctx, cacheKey, policy == storage.CachePolicyPopulate); b != nil {
 			return b, nil
 		}
 	}
@@ -62,7 +63,7 @@ func (c *blockCache) getContentBlock(ctx context.Context, cacheKey string, physi
 		return nil, err
 	}
 
-	if err == nil && useCache {
+	if err == nil && useCache && policy == storage.CachePolicyPopulate {
 		if puterr := c.cacheStorage.PutBlock(ctx, cacheKey, appendHMAC(b, c.hmacSecret)); puterr != nil {
 			log.Warningf("unable to write cache item %v: %v", cacheKey, puterr)
 		}
@@ -71,13 +72,26 @@ func (c *blockCache) getContentBlock(ctx context.Context, cacheKey string, physi
 	return b, err
 }
 
-func (c *blockCache) readAndVerifyCacheBlock(ctx context.Context, cacheKey string) []byte {
+// deleteContentBlock removes the cached copy of a content block, if any.
+func (c *blockCache) deleteContentBlock(ctx context.Context, cacheKey string) {
+	if c.cacheStorage == nil {
+		return
+	}
+
+	if err := c.cacheStorage.DeleteBlock(ctx, adjustCacheKey(cacheKey)); err != nil && err != storage.ErrBlockNotFound {
+		log.Warningf("unable to delete cache item %v: %v", cacheKey, err)
+	}
+}
+
+// readAndVerifyCacheBlock returns the cached copy of a block, if it's present and valid, and optionally updates its
+// timestamp, which determines the order in which cached blocks are swept.
+func (c *blockCache) readAndVerifyCacheBlock(ctx context.Context, cacheKey string, touch bool) []byte {
 	b, err := c.cacheStorage.GetBlock(ctx, cacheKey, 0, -1)
 	if err == nil {
 		b, err = verifyAndStripHMAC(b, c.hmacSecret)
 		if err == nil {
-			if t, ok := c.cacheStorage.(blockToucher); ok {
-				t.TouchBlock(ctx, cacheKey, c.touchThreshold) //nolint:errcheck
+			if touch {
+				c.cacheStorage.TouchBlock(ctx, cacheKey, c.touchThreshold) //nolint:errcheck
 			}
 
 			// retrieved from cache and HMAC valid
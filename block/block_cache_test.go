@@ -160,6 +160,43 @@ func verifyBlockCache(t *testing.T, cache *blockCache) {
 	})
 }
 
+func TestBlockCachePolicy(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "kopia")
+	if err != nil {
+		t.Fatalf("error getting temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cache, err := newBlockCache(ctx, newUnderlyingStorageForBlockCacheTesting(t), CachingOptions{
+		MaxCacheSizeBytes: 10000,
+		CacheDirectory:    tmpDir,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cache.close()
+
+	for _, policy := range []storage.CachePolicy{storage.CachePolicyBypass, storage.CachePolicyReadOnly} {
+		if _, err := cache.getContentBlock(storage.WithCachePolicy(ctx, policy), "xf0f0f1", "block-1", 1, 5); err != nil {
+			t.Fatalf("error in getContentBlock: %v", err)
+		}
+	}
+
+	if _, err := cache.getContentBlock(UsingBlockCache(ctx, false), "xf0f0f2", "block-1", 1, 5); err != nil {
+		t.Fatalf("error in getContentBlock: %v", err)
+	}
+
+	verifyStorageBlockList(t, cache.cacheStorage)
+
+	if _, err := cache.getContentBlock(ctx, "xf0f0f1", "block-1", 1, 5); err != nil {
+		t.Fatalf("error in getContentBlock: %v", err)
+	}
+
+	verifyStorageBlockList(t, cache.cacheStorage, "f0f0f1x")
+}
+
 func TestCacheFailureToOpen(t *testing.T) {
 	someError := errors.New("some error")
 
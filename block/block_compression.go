@@ -0,0 +1,157 @@
+package block
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// SupportedCompression is a list of supported block compression algorithms including:
+//
+//	GZIP     - compression using gzip with the default level.
+//	ZSTD     - compression using zstd with the default level.
+var SupportedCompression []string
+
+// maxCompressionID is the largest compressor ID that fits in the bits of the index entry reserved for it.
+const maxCompressionID = 0xff >> compressionShift
+
+type blockCompressor struct {
+	id byte // recorded in index entries of compressed blocks, zero means no compression
+
+	compress   func(data []byte) ([]byte, error)
+	decompress func(data []byte) ([]byte, error)
+}
+
+var blockCompressors = map[string]*blockCompressor{
+	"GZIP": {id: 1, compress: gzipCompress, decompress: gzipDecompress},
+	"ZSTD": {id: 2, compress: zstdCompress, decompress: zstdDecompress},
+}
+
+var (
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func init() {
+	for k := range blockCompressors {
+		SupportedCompression = append(SupportedCompression, k)
+	}
+	sort.Strings(SupportedCompression)
+
+	var err error
+	if zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+		panic("unable to create zstd encoder: " + err.Error())
+	}
+
+	if zstdDecoder, err = zstd.NewReader(nil); err != nil {
+		panic("unable to create zstd decoder: " + err.Error())
+	}
+}
+
+func createCompressor(f FormattingOptions) (*blockCompressor, error) {
+	if f.Compression == "" {
+		return nil, nil
+	}
+
+	c := blockCompressors[f.Compression]
+	if c == nil {
+		return nil, fmt.Errorf("unknown compression algorithm: %v", f.Compression)
+	}
+
+	return c, nil
+}
+
+func compressorByID(id byte) *blockCompressor {
+	for _, c := range blockCompressors {
+		if c.id == id {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// maybeCompress returns the compressed data and the ID of the compressor, unless compression is disabled
+// or the compressed data is not smaller, in which case the original data is returned with zero ID.
+func (bm *Manager) maybeCompress(data []byte) ([]byte, byte, error) {
+	if bm.compressor == nil || len(data) == 0 {
+		return data, 0, nil
+	}
+
+	compressed, err := bm.compressor.compress(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(compressed) >= len(data) {
+		return data, 0, nil
+	}
+
+	return compressed, bm.compressor.id, nil
+}
+
+// originalLength returns the length recorded in the index entry of a block with the provided contents.
+func originalLength(compression byte, data []byte) uint32 {
+	if compression == 0 {
+		return 0
+	}
+
+	return uint32(len(data))
+}
+
+// decompressBlock decompresses the data of a block compressed with the provided compressor ID.
+// Data that can't be decompressed is reported as having invalid checksum, since it's corrupt.
+func decompressBlock(id byte, data []byte) ([]byte, error) {
+	if id == 0 {
+		return data, nil
+	}
+
+	c := compressorByID(id)
+	if c == nil {
+		return nil, fmt.Errorf("unknown compression %v", id)
+	}
+
+	decompressed, err := c.decompress(data)
+	if err != nil {
+		return nil, errors.Wrapf(errInvalidChecksum, "unable to decompress: %v", err)
+	}
+
+	return decompressed, nil
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+func zstdCompress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func zstdDecompress(data []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(data, nil)
+}
@@ -0,0 +1,137 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kopia/repo/internal/storagetesting"
+)
+
+func TestBlockCompression(t *testing.T) {
+	for _, compression := range SupportedCompression {
+		compression := compression
+		t.Run(compression, func(t *testing.T) {
+			verifyBlockCompression(t, compression)
+		})
+	}
+}
+
+func verifyBlockCompression(t *testing.T, compression string) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	timeFunc := fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+	st := storagetesting.NewMapStorage(data, keyTime, timeFunc)
+
+	f := FormattingOptions{
+		Version:     1,
+		Hash:        "HMAC-SHA256-128",
+		Encryption:  "AES-256-CTR",
+		HMACSecret:  hmacSecret,
+		MasterKey:   make([]byte, 32),
+		MaxPackSize: maxPackSize,
+	}
+
+	newManager := func(compression string) *Manager {
+		f.Compression = compression
+		bm, err := newManagerWithOptions(ctx, st, f, CachingOptions{}, timeFunc, nil)
+		if err != nil {
+			t.Fatalf("can't create block manager: %v", err)
+		}
+		return bm
+	}
+
+	dataSet := map[string][]byte{}
+	writeBlock := func(bm *Manager, b []byte) string {
+		blockID, err := bm.WriteBlock(ctx, b, "")
+		if err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+		dataSet[blockID] = b
+		return blockID
+	}
+
+	// blocks written before compression was enabled.
+	bm := newManager("")
+	uncompressedBlock := writeBlock(bm, []byte(strings.Repeat("uncompressed ", 100)))
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	bm = newManager(compression)
+	compressedBlock := writeBlock(bm, []byte(strings.Repeat("compressed ", 100)))
+	incompressibleBlock := writeBlock(bm, seededRandomData(1, 1000))
+	emptyBlock := writeBlock(bm, []byte{})
+
+	// pending blocks are readable before they're compressed.
+	verifyBlockManagerDataSet(ctx, t, bm, dataSet)
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	// reading does not depend on the compression of blocks being written.
+	for _, c := range []string{compression, ""} {
+		bm = newManager(c)
+		verifyBlockManagerDataSet(ctx, t, bm, dataSet)
+	}
+
+	cases := []struct {
+		blockID    string
+		compressed bool
+	}{
+		{uncompressedBlock, false},
+		{compressedBlock, true},
+		{incompressibleBlock, false},
+		{emptyBlock, false},
+	}
+
+	for _, tc := range cases {
+		bi, err := bm.BlockInfo(ctx, tc.blockID)
+		if err != nil {
+			t.Fatalf("unable to get block info: %v", err)
+		}
+
+		if got := bi.Compression != 0; got != tc.compressed {
+			t.Errorf("unexpected compression of block %v: %v, want compressed=%v", tc.blockID, bi.Compression, tc.compressed)
+		}
+
+		if got, want := bi.Length < uint32(len(dataSet[tc.blockID])), tc.compressed; got != want {
+			t.Errorf("unexpected stored length of block %v: %v (original %v)", tc.blockID, bi.Length, len(dataSet[tc.blockID]))
+		}
+	}
+}
+
+func TestDecompressCorruptBlock(t *testing.T) {
+	for _, compression := range SupportedCompression {
+		c := blockCompressors[compression]
+		compressed, err := c.compress(bytes.Repeat([]byte("foo"), 100))
+		if err != nil {
+			t.Fatalf("unable to compress: %v", err)
+		}
+
+		compressed[len(compressed)/2] ^= 0xff
+		if _, err := decompressBlock(c.id, compressed); err == nil {
+			t.Errorf("%v: unexpected success decompressing corrupt block", compression)
+		}
+	}
+}
+
+func TestUnknownBlockCompression(t *testing.T) {
+	st := storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)
+	f := FormattingOptions{
+		Version:     1,
+		Hash:        "HMAC-SHA256",
+		Encryption:  "NONE",
+		HMACSecret:  hmacSecret,
+		MaxPackSize: maxPackSize,
+		Compression: "NO-SUCH-COMPRESSION",
+	}
+
+	if _, err := newManagerWithOptions(context.Background(), st, f, CachingOptions{}, fakeTimeNowFrozen(fakeTime), nil); err == nil {
+		t.Errorf("unexpected success creating block manager with unknown compression")
+	}
+}
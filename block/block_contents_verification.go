@@ -0,0 +1,142 @@
+package block
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+// ContentsProblem describes why a block failed verification by VerifyContents().
+type ContentsProblem string
+
+// Problems reported by VerifyContents().
+const (
+	ContentsHashMismatch  ContentsProblem = "hash-mismatch"  // contents can't be decrypted or don't match the block ID
+	ContentsMissingPack   ContentsProblem = "missing-pack"   // pack referenced by the index entry does not exist
+	ContentsDanglingEntry ContentsProblem = "dangling-entry" // index entry points beyond the end of its pack
+	ContentsUnreadable    ContentsProblem = "unreadable"     // reading the pack failed
+)
+
+// ContentsFailure describes a block that failed verification by VerifyContents().
+type ContentsFailure struct {
+	Info    Info
+	Problem ContentsProblem
+	Err     error // underlying error, if any
+}
+
+// VerifyContentsOptions provides options for VerifyContents().
+type VerifyContentsOptions struct {
+	// SamplePercent, if between 0 and 100, causes only a randomly chosen percentage of blocks to be verified,
+	// which is useful for quick checks. Zero verifies all blocks.
+	SamplePercent float64
+
+	// OnFailure is invoked for each block that fails verification.
+	OnFailure func(f ContentsFailure)
+}
+
+// VerifyContentsResult summarizes verification by VerifyContents().
+type VerifyContentsResult struct {
+	Verified int // number of blocks verified, including the failed ones
+	Failed   int
+}
+
+// VerifyContents verifies that every committed, non-deleted block is readable from its pack and that its
+// contents match its ID. Unlike VerifyBlocks(), contents are always read from the storage, bypassing
+// the block cache, and failures are reported to opt.OnFailure classified by their cause.
+// Verification stops when the provided context is canceled, in which case the context error is returned.
+func (bm *Manager) VerifyContents(ctx context.Context, opt VerifyContentsOptions) (*VerifyContentsResult, error) {
+	var infos []Info
+
+	bm.lock()
+	err := bm.committedBlocks.listBlocks("", func(i Info) error {
+		if !i.Deleted {
+			infos = append(infos, i)
+		}
+		return nil
+	})
+	bm.unlock()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list committed blocks")
+	}
+
+	packLengths := map[string]int64{}
+	if err := bm.st.ListBlocks(ctx, PackBlockPrefix, func(m storage.BlockMetadata) error {
+		packLengths[m.BlockID] = m.Length
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "unable to list pack blocks")
+	}
+
+	result := &VerifyContentsResult{}
+	for _, bi := range infos {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		if opt.SamplePercent > 0 && opt.SamplePercent < 100 && rand.Float64()*100 >= opt.SamplePercent {
+			continue
+		}
+
+		result.Verified++
+
+		problem, err := bm.verifyBlockContents(ctx, bi, packLengths)
+		if problem == "" {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			// the read has been interrupted, which says nothing about the block.
+			result.Verified--
+			return result, ctx.Err()
+		}
+
+		log.Warningf("block %v failed verification: %v %v", bi.BlockID, problem, err)
+		result.Failed++
+		if opt.OnFailure != nil {
+			opt.OnFailure(ContentsFailure{Info: bi, Problem: problem, Err: err})
+		}
+	}
+
+	return result, nil
+}
+
+func (bm *Manager) verifyBlockContents(ctx context.Context, bi Info, packLengths map[string]int64) (ContentsProblem, error) {
+	iv, err := getPackedBlockIV(bi.BlockID)
+	if err != nil {
+		return ContentsHashMismatch, err
+	}
+
+	if bi.Payload != nil {
+		if err := verifyHashChecksum(bm.hasher, bi.Payload, iv); err != nil {
+			return ContentsHashMismatch, err
+		}
+		return "", nil
+	}
+
+	packLength, ok := packLengths[bi.PackFile]
+	if !ok {
+		return ContentsMissingPack, nil
+	}
+
+	length := int64(bm.storedLength(bi))
+	if int64(bi.PackOffset)+length > packLength {
+		return ContentsDanglingEntry, errors.Errorf("entry at offset %v length %v of pack %v of length %v", bi.PackOffset, length, bi.PackFile, packLength)
+	}
+
+	payload, err := bm.st.GetBlock(ctx, bi.PackFile, int64(bi.PackOffset), length)
+	if err == storage.ErrBlockNotFound {
+		return ContentsMissingPack, nil
+	}
+	if err != nil {
+		return ContentsUnreadable, err
+	}
+
+	if _, err := bm.decryptAndVerifyBlock(bi, payload, iv); err != nil {
+		return ContentsHashMismatch, err
+	}
+
+	return "", nil
+}
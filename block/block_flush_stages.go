@@ -0,0 +1,116 @@
+package block
+
+import (
+	"context"
+	"fmt"
+)
+
+// FlushStage identifies a stage of Flush(). Stages run in the order of their values and the index is only
+// committed after all packs have been uploaded (and verified, if enabled), so a failure in any stage never
+// leaves behind an index referencing packs that are not durable.
+type FlushStage int
+
+// Stages of Flush().
+const (
+	FlushStageUploadPacks FlushStage = iota // upload the current pack and wait for packs uploaded in the background
+	FlushStageVerifyPacks                   // read back uploaded packs and verify their blocks, if enabled
+	FlushStageCommitIndex                   // write the index of all uploaded packs
+)
+
+func (s FlushStage) String() string {
+	switch s {
+	case FlushStageUploadPacks:
+		return "upload-packs"
+	case FlushStageVerifyPacks:
+		return "verify-packs"
+	case FlushStageCommitIndex:
+		return "commit-index"
+	default:
+		return fmt.Sprintf("flush-stage-%d", int(s))
+	}
+}
+
+// FlushHook is invoked by Flush() before each stage and can abort the flush by returning an error.
+type FlushHook func(ctx context.Context, stage FlushStage) error
+
+// SetFlushHook installs the function invoked before each stage of Flush(), nil removes it.
+// The hook is invoked while holding the manager lock, so it must not call other methods of the manager.
+func (bm *Manager) SetFlushHook(f FlushHook) {
+	bm.lock()
+	defer bm.unlock()
+	bm.flushHook = f
+}
+
+// SetVerifyPacksBeforeCommit enables or disables reading back uploaded packs and verifying all their blocks
+// before their index is committed, which applies both to Flush() and to automatic index flushes.
+// Blocks of packs that fail verification are not committed and are reported as an error.
+func (bm *Manager) SetVerifyPacksBeforeCommit(enabled bool) {
+	bm.lock()
+	defer bm.unlock()
+	bm.verifyPacksBeforeCommit = enabled
+}
+
+func (bm *Manager) runFlushHookLocked(ctx context.Context, stage FlushStage) error {
+	bm.assertLocked()
+
+	if bm.flushHook == nil {
+		return nil
+	}
+
+	if err := bm.flushHook(ctx, stage); err != nil {
+		return fmt.Errorf("flush aborted before %v: %v", stage, err)
+	}
+
+	return nil
+}
+
+// verifyUploadedPacksLocked reads back all packs referenced by the index being built and verifies their blocks.
+// Entries of blocks in packs that fail verification are removed from the index being built, so they are never
+// committed, and an error is returned.
+func (bm *Manager) verifyUploadedPacksLocked(ctx context.Context) error {
+	bm.assertLocked()
+
+	if !bm.verifyPacksBeforeCommit {
+		return nil
+	}
+
+	byPack := map[string][]*Info{}
+	for _, bi := range bm.packIndexBuilder {
+		if bi.Deleted || bi.PackFile == "" {
+			continue
+		}
+
+		byPack[bi.PackFile] = append(byPack[bi.PackFile], bi)
+	}
+
+	var failedPacks, failedBlocks int
+	for packFile, infos := range byPack {
+		payload, err := bm.st.GetBlock(ctx, packFile, 0, -1)
+		for _, bi := range infos {
+			if err == nil {
+				err = bm.verifyPackedBlock(payload, *bi)
+			}
+
+			if err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			continue
+		}
+
+		log.Warningf("pack %v failed verification before commit: %v", packFile, err)
+		failedPacks++
+		failedBlocks += len(infos)
+		for _, bi := range infos {
+			delete(bm.packIndexBuilder, bi.BlockID)
+		}
+	}
+
+	if failedPacks > 0 {
+		return fmt.Errorf("%v packs with %v blocks failed verification and were not committed", failedPacks, failedBlocks)
+	}
+
+	return nil
+}
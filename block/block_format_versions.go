@@ -0,0 +1,143 @@
+package block
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+func createPreviousDecryptors(f FormattingOptions, writeVersion byte) (map[byte]Decryptor, error) {
+	result := map[byte]Decryptor{}
+
+	for _, p := range f.PreviousEncryption {
+		if p.FormatVersion > formatVersionMask {
+			return nil, fmt.Errorf("invalid previous encryption version %v", p.FormatVersion)
+		}
+
+		if p.FormatVersion == writeVersion {
+			return nil, fmt.Errorf("previous encryption version %v is the same as the version being written", p.FormatVersion)
+		}
+
+		if _, ok := result[p.FormatVersion]; ok {
+			return nil, fmt.Errorf("duplicate previous encryption version %v", p.FormatVersion)
+		}
+
+		pf := f
+		pf.Encryption = p.Encryption
+		pf.MasterKey = p.MasterKey
+
+		_, encryptor, err := CreateHashAndEncryptor(pf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous encryption version %v: %v", p.FormatVersion, err)
+		}
+
+		result[p.FormatVersion] = encryptor
+	}
+
+	return result, nil
+}
+
+// decryptorOf returns the decryptor of blocks written with the provided format version.
+func (bm *Manager) decryptorOf(formatVersion byte) Decryptor {
+	if d, ok := bm.previousDecryptors[formatVersion]; ok {
+		return d
+	}
+
+	return bm.decryptor
+}
+
+// overheadEncryptor is implemented by encryptors whose ciphertext is longer than the plaintext.
+type overheadEncryptor interface {
+	Overhead() int
+}
+
+// storedLength returns the length of the stored payload of the provided block, which is longer than the length
+// recorded in its index entry by the overhead of the encryption it was written with.
+func (bm *Manager) storedLength(bi Info) uint32 {
+	var e interface{} = bm.encryptor
+	if d, ok := bm.previousDecryptors[bi.FormatVersion]; ok {
+		e = d
+	}
+
+	if o, ok := e.(overheadEncryptor); ok {
+		return bi.Length + uint32(o.Overhead())
+	}
+
+	return bi.Length
+}
+
+// decryptAndVerifyBlock decrypts and decompresses the provided stored data of a block described by the provided index entry.
+func (bm *Manager) decryptAndVerifyBlock(bi Info, encrypted []byte, iv []byte) ([]byte, error) {
+	decrypted, err := bm.decryptAndVerifyWith(bm.decryptorOf(bi.FormatVersion), bi.Compression, encrypted, iv)
+	bm.recordDecryption(decrypted, err)
+	return decrypted, err
+}
+
+// decryptAndVerifyAnyVersion decrypts the provided data not described by an index entry, such as index blocks
+// or local indexes of packs, trying previous encryption when the current one fails.
+func (bm *Manager) decryptAndVerifyAnyVersion(encrypted []byte, iv []byte) ([]byte, error) {
+	decrypted, err := bm.decryptAndVerifyWith(bm.decryptor, 0, encrypted, iv)
+	for _, d := range bm.previousDecryptors {
+		if err == nil {
+			break
+		}
+
+		if b, perr := bm.decryptAndVerifyWith(d, 0, encrypted, iv); perr == nil {
+			decrypted, err = b, nil
+		}
+	}
+
+	bm.recordDecryption(decrypted, err)
+	return decrypted, err
+}
+
+func (bm *Manager) decryptAndVerifyWith(d Decryptor, compression byte, encrypted []byte, iv []byte) ([]byte, error) {
+	decrypted, err := d.Decrypt(encrypted, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err = decompressBlock(compression, decrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	// Since the encryption key is a function of data, we must be able to generate exactly the same key
+	// after decrypting the content. This serves as a checksum.
+	return decrypted, verifyHashChecksum(bm.hasher, decrypted, iv)
+}
+
+func (bm *Manager) recordDecryption(decrypted []byte, err error) {
+	atomic.AddInt64(&bm.stats.DecryptedBytes, int64(len(decrypted)))
+
+	switch {
+	case err == nil:
+		atomic.AddInt32(&bm.stats.ValidBlocks, 1)
+	case errors.Cause(err) == errInvalidChecksum:
+		atomic.AddInt32(&bm.stats.InvalidBlocks, 1)
+	}
+}
+
+// FormatVersionDistribution returns the number of blocks written with each format version, which includes
+// pending blocks under the version they are being written with. Blocks written with previous format versions
+// remain readable as long as their parameters are present in FormattingOptions.PreviousEncryption.
+func (bm *Manager) FormatVersionDistribution(ctx context.Context) (map[byte]int, error) {
+	infos, err := bm.FindBlocks(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[byte]int{}
+	for _, bi := range infos {
+		if bi.PackFile == "" {
+			result[bm.blockFormatVersion]++
+			continue
+		}
+
+		result[bi.FormatVersion]++
+	}
+
+	return result, nil
+}
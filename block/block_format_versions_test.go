@@ -0,0 +1,125 @@
+package block
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kopia/repo/internal/storagetesting"
+)
+
+func TestMixedEncryption(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	timeFunc := fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+	st := storagetesting.NewMapStorage(data, keyTime, timeFunc)
+
+	oldKey := make([]byte, 32)
+	newKey := make([]byte, 32)
+	for i := range newKey {
+		newKey[i] = 1
+	}
+
+	oldFormat := FormattingOptions{
+		Version:     1,
+		Hash:        "HMAC-SHA256-128",
+		Encryption:  "AES-256-CTR",
+		HMACSecret:  hmacSecret,
+		MasterKey:   oldKey,
+		MaxPackSize: maxPackSize,
+	}
+
+	newFormat := oldFormat
+	newFormat.Encryption = "SALSA20"
+	newFormat.MasterKey = newKey
+	newFormat.BlockFormatVersion = 3
+	newFormat.PreviousEncryption = []EncryptionParameters{
+		{FormatVersion: 1, Encryption: oldFormat.Encryption, MasterKey: oldKey},
+	}
+
+	dataSet := map[string][]byte{}
+
+	bm, err := newManagerWithOptions(ctx, st, oldFormat, CachingOptions{}, timeFunc, nil)
+	if err != nil {
+		t.Fatalf("can't create block manager: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		b := seededRandomData(i, 100)
+		blockID, err := bm.WriteBlock(ctx, b, "")
+		if err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+		dataSet[blockID] = b
+	}
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	// the new encryption alone can't read blocks written before the change.
+	withoutPrevious := newFormat
+	withoutPrevious.PreviousEncryption = nil
+	if _, err := newManagerWithOptions(ctx, st, withoutPrevious, CachingOptions{}, timeFunc, nil); err == nil {
+		t.Errorf("unexpected success opening repository without previous encryption")
+	}
+
+	bm, err = newManagerWithOptions(ctx, st, newFormat, CachingOptions{}, timeFunc, nil)
+	if err != nil {
+		t.Fatalf("can't create block manager: %v", err)
+	}
+
+	verifyBlockManagerDataSet(ctx, t, bm, dataSet)
+
+	for i := 5; i < 8; i++ {
+		b := seededRandomData(i, 100)
+		blockID, err := bm.WriteBlock(ctx, b, "")
+		if err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+		dataSet[blockID] = b
+	}
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	bm, err = newManagerWithOptions(ctx, st, newFormat, CachingOptions{}, timeFunc, nil)
+	if err != nil {
+		t.Fatalf("can't create block manager: %v", err)
+	}
+
+	verifyBlockManagerDataSet(ctx, t, bm, dataSet)
+
+	dist, err := bm.FormatVersionDistribution(ctx)
+	if err != nil {
+		t.Fatalf("error getting format version distribution: %v", err)
+	}
+
+	if want := map[byte]int{1: 5, 3: 3}; !reflect.DeepEqual(dist, want) {
+		t.Errorf("unexpected format version distribution: %v, want %v", dist, want)
+	}
+}
+
+func TestPreviousEncryptionValidation(t *testing.T) {
+	ctx := context.Background()
+	st := storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)
+
+	f := FormattingOptions{
+		Version:     1,
+		Hash:        "HMAC-SHA256-128",
+		Encryption:  "AES-256-CTR",
+		HMACSecret:  hmacSecret,
+		MasterKey:   make([]byte, 32),
+		MaxPackSize: maxPackSize,
+		PreviousEncryption: []EncryptionParameters{
+			{FormatVersion: 1, Encryption: "AES-256-CTR", MasterKey: make([]byte, 32)},
+		},
+	}
+
+	if _, err := newManagerWithOptions(ctx, st, f, CachingOptions{}, fakeTimeNowFrozen(fakeTime), nil); err == nil {
+		t.Errorf("expected error when previous encryption uses the version being written")
+	}
+}
@@ -8,20 +8,32 @@ import (
 	"fmt"
 	"hash"
 	"sort"
+	"sync"
 
+	"github.com/pkg/errors"
+	"github.com/zeebo/blake3"
 	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/salsa20"
 	"golang.org/x/crypto/sha3"
 )
 
 // HashFunc computes hash of block of data using a cryptographic hash function, possibly with HMAC and/or truncation.
+//
+// Block IDs are computed over the plaintext. Since the supported hash algorithms are keyed with the HMACSecret,
+// knowing the algorithm is not enough to derive the ID of known contents, except for BLAKE3-256 without a secret. Hashing the ciphertext instead is not
+// possible, because the ID is needed before encryption to derive the nonce and is used after decryption to verify the contents.
 type HashFunc func(data []byte) []byte
 
 // HashFuncFactory returns a hash function for given formatting options.
 type HashFuncFactory func(o FormattingOptions) (HashFunc, error)
 
 // Encryptor performs encryption and decryption of blocks of data.
+//
+// The block ID, which is a keyed hash of the block contents, is used as the nonce, so identical blocks always encrypt
+// to identical ciphertext. This is what allows deduplication of blocks written independently, the trade-off is that
+// anyone with access to the storage can tell whether two blocks have the same contents, but not what the contents are.
 type Encryptor interface {
 	// Encrypt returns encrypted bytes corresponding to the given plaintext. Must not clobber the input slice.
 	Encrypt(plainText []byte, blockID []byte) ([]byte, error)
@@ -30,9 +42,19 @@ type Encryptor interface {
 	Decrypt(cipherText []byte, blockID []byte) ([]byte, error)
 }
 
+// Decryptor performs decryption of blocks of data, possibly outside of the process, such as in an HSM.
+// It is only used when reading blocks, see FormattingOptions.Decryptor.
+type Decryptor interface {
+	// Decrypt returns unencrypted bytes corresponding to the given ciphertext. Must not clobber the input slice.
+	Decrypt(cipherText []byte, blockID []byte) ([]byte, error)
+}
+
 // EncryptorFactory creates new Encryptor for given FormattingOptions
 type EncryptorFactory func(o FormattingOptions) (Encryptor, error)
 
+// registryMutex protects hashFunctions and encryptors, which can be extended by callers using
+// RegisterHash() and RegisterEncryption().
+var registryMutex sync.RWMutex
 var hashFunctions = map[string]HashFuncFactory{}
 var encryptors = map[string]EncryptorFactory{}
 
@@ -96,6 +118,50 @@ func (s salsaEncryptor) encryptDecrypt(input []byte, blockID []byte) ([]byte, er
 	return result, nil
 }
 
+// aeadEncryptor implements authenticated encryption, which appends an authentication tag to the ciphertext.
+// The nonce is the suffix of the block ID, which is the same whether the full hash or only the suffix used
+// as the IV of packed and physical blocks is provided.
+type aeadEncryptor struct {
+	aead cipher.AEAD
+}
+
+func (e aeadEncryptor) nonce(blockID []byte) ([]byte, error) {
+	n := e.aead.NonceSize()
+	if len(blockID) < n {
+		return nil, fmt.Errorf("hash too short, expected >=%v bytes, got %v", n, len(blockID))
+	}
+
+	return blockID[len(blockID)-n:], nil
+}
+
+func (e aeadEncryptor) Overhead() int {
+	return e.aead.Overhead()
+}
+
+func (e aeadEncryptor) Encrypt(plainText []byte, blockID []byte) ([]byte, error) {
+	nonce, err := e.nonce(blockID)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.aead.Seal(nil, nonce, plainText, nil), nil
+}
+
+func (e aeadEncryptor) Decrypt(cipherText []byte, blockID []byte) ([]byte, error) {
+	nonce, err := e.nonce(blockID)
+	if err != nil {
+		return nil, err
+	}
+
+	plainText, err := e.aead.Open(nil, nonce, cipherText, nil)
+	if err != nil {
+		// tampered or corrupt contents are reported the same way as failed checksum verification.
+		return nil, errors.Wrapf(errInvalidChecksum, "authentication of block %x failed", blockID)
+	}
+
+	return plainText, nil
+}
+
 // truncatedHMACHashFuncFactory returns a HashFuncFactory that computes HMAC(hash, secret) of a given block of bytes
 // and truncates results to the given size.
 func truncatedHMACHashFuncFactory(hf func() hash.Hash, truncate int) HashFuncFactory {
@@ -124,6 +190,34 @@ func truncatedKeyedHashFuncFactory(hf func(key []byte) (hash.Hash, error), trunc
 	}
 }
 
+// blake3HashFuncFactory returns a HashFuncFactory that computes BLAKE3 of a given block of bytes, keyed with a key
+// derived from the HMACSecret if one is provided, and truncates results to the given size.
+func blake3HashFuncFactory(truncate int) HashFuncFactory {
+	return func(o FormattingOptions) (HashFunc, error) {
+		if len(o.HMACSecret) == 0 {
+			return func(b []byte) []byte {
+				h := blake3.New()
+				h.Write(b) // nolint:errcheck
+				return h.Sum(nil)[0:truncate]
+			}, nil
+		}
+
+		key := make([]byte, 32)
+		blake3.DeriveKey("kopia block hash", o.HMACSecret, key)
+
+		return func(b []byte) []byte {
+			h, _ := blake3.NewKeyed(key)
+			h.Write(b) // nolint:errcheck
+			return h.Sum(nil)[0:truncate]
+		}, nil
+	}
+}
+
+func newUnkeyedBlake2b256() hash.Hash {
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
 // newCTREncryptorFactory returns new EncryptorFactory that uses CTR with symmetric encryption (such as AES) and a given key size.
 func newCTREncryptorFactory(keySize int, createCipherWithKey func(key []byte) (cipher.Block, error)) EncryptorFactory {
 	return func(o FormattingOptions) (Encryptor, error) {
@@ -140,12 +234,20 @@ func newCTREncryptorFactory(keySize int, createCipherWithKey func(key []byte) (c
 	}
 }
 
-// RegisterHash registers a hash function with a given name.
+// RegisterHash registers a hash function with a given name, replacing any hash function previously
+// registered with that name. Hash functions must be registered before opening or creating repositories
+// that use them.
 func RegisterHash(name string, newHashFunc HashFuncFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
 	hashFunctions[name] = newHashFunc
 }
 
+// SupportedHashAlgorithms returns the sorted names of all registered hash functions.
 func SupportedHashAlgorithms() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
 	var result []string
 	for k := range hashFunctions {
 		result = append(result, k)
@@ -154,7 +256,11 @@ func SupportedHashAlgorithms() []string {
 	return result
 }
 
+// SupportedEncryptionAlgorithms returns the sorted names of all registered encryption algorithms.
 func SupportedEncryptionAlgorithms() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
 	var result []string
 	for k := range encryptors {
 		result = append(result, k)
@@ -163,11 +269,27 @@ func SupportedEncryptionAlgorithms() []string {
 	return result
 }
 
-// RegisterEncryption registers new encryption algorithm.
+// RegisterEncryption registers new encryption algorithm, replacing any algorithm previously registered
+// with that name. Encryption algorithms must be registered before opening or creating repositories
+// that use them.
 func RegisterEncryption(name string, newEncryptor EncryptorFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
 	encryptors[name] = newEncryptor
 }
 
+func hashFuncFactory(name string) HashFuncFactory {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	return hashFunctions[name]
+}
+
+func encryptorFactory(name string) EncryptorFactory {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	return encryptors[name]
+}
+
 // DefaultHash is the name of the default hash algorithm.
 const DefaultHash = "BLAKE2B-256-128"
 
@@ -180,11 +302,13 @@ func init() {
 	RegisterHash("HMAC-SHA224", truncatedHMACHashFuncFactory(sha256.New224, 28))
 	RegisterHash("HMAC-SHA3-224", truncatedHMACHashFuncFactory(sha3.New224, 28))
 	RegisterHash("HMAC-SHA3-256", truncatedHMACHashFuncFactory(sha3.New256, 32))
+	RegisterHash("HMAC-BLAKE2B-256", truncatedHMACHashFuncFactory(newUnkeyedBlake2b256, 32))
 
 	RegisterHash("BLAKE2S-128", truncatedKeyedHashFuncFactory(blake2s.New128, 16))
 	RegisterHash("BLAKE2S-256", truncatedKeyedHashFuncFactory(blake2s.New256, 32))
 	RegisterHash("BLAKE2B-256-128", truncatedKeyedHashFuncFactory(blake2b.New256, 16))
 	RegisterHash("BLAKE2B-256", truncatedKeyedHashFuncFactory(blake2b.New256, 32))
+	RegisterHash("BLAKE3-256", blake3HashFuncFactory(32))
 
 	RegisterEncryption("NONE", func(f FormattingOptions) (Encryptor, error) {
 		return nullEncryptor{}, nil
@@ -197,6 +321,19 @@ func init() {
 		copy(k[:], f.MasterKey[0:32])
 		return salsaEncryptor{8, &k}, nil
 	})
+	RegisterEncryption("CHACHA20-POLY1305", func(f FormattingOptions) (Encryptor, error) {
+		key, err := adjustKey(f.MasterKey, chacha20poly1305.KeySize)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get encryption key: %v", err)
+		}
+
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return aeadEncryptor{aead}, nil
+	})
 	RegisterEncryption("XSALSA20", func(f FormattingOptions) (Encryptor, error) {
 		var k [32]byte
 		copy(k[:], f.MasterKey[0:32])
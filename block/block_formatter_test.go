@@ -3,8 +3,11 @@ package block
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/hex"
 	"math/rand"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
 // combinations of hash and encryption that are not compatible.
@@ -60,3 +63,67 @@ func TestFormatters(t *testing.T) {
 		}
 	}
 }
+
+func TestBlake3Hash(t *testing.T) {
+	unkeyed, err := createHashFunc(FormattingOptions{Hash: "BLAKE3-256"})
+	if err != nil {
+		t.Fatalf("unable to create unkeyed hash: %v", err)
+	}
+
+	// BLAKE3 of empty input from the reference test vectors.
+	if got, want := hex.EncodeToString(unkeyed(nil)), "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"; got != want {
+		t.Errorf("unexpected unkeyed hash: %v, want %v", got, want)
+	}
+
+	keyed, err := createHashFunc(FormattingOptions{Hash: "BLAKE3-256", HMACSecret: []byte("key")})
+	if err != nil {
+		t.Fatalf("unable to create keyed hash: %v", err)
+	}
+
+	if bytes.Equal(keyed(nil), unkeyed(nil)) {
+		t.Errorf("keyed hash does not depend on the secret")
+	}
+}
+
+func TestChaCha20Poly1305(t *testing.T) {
+	h, e, err := CreateHashAndEncryptor(FormattingOptions{
+		Hash:       "HMAC-SHA256-128",
+		Encryption: "CHACHA20-POLY1305",
+		HMACSecret: []byte("key"),
+		MasterKey:  bytes.Repeat([]byte{1}, 32),
+	})
+	if err != nil {
+		t.Fatalf("unable to create encryptor: %v", err)
+	}
+
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	blockID := h(data)
+
+	cipherText, err := e.Encrypt(data, blockID)
+	if err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+
+	if got, want := hex.EncodeToString(cipherText), "d4edbf521c3abd93b56aa850a312181b09f29a595ed6a62721323f410a561291d7e0fb93a8891f0ce43c394f4b19809aa9b7f4003608dee7b96cbd"; got != want {
+		t.Errorf("unexpected ciphertext: %v, want %v", got, want)
+	}
+
+	// the same contents always encrypt the same way, which preserves deduplication.
+	cipherText2, err := e.Encrypt(data, blockID)
+	if err != nil || !bytes.Equal(cipherText, cipherText2) {
+		t.Errorf("encryption is not deterministic: %x %x %v", cipherText, cipherText2, err)
+	}
+
+	plainText, err := e.Decrypt(cipherText, blockID)
+	if err != nil || !bytes.Equal(plainText, data) {
+		t.Errorf("unexpected decrypted data: %q, %v", plainText, err)
+	}
+
+	for i := range cipherText {
+		tampered := append([]byte(nil), cipherText...)
+		tampered[i] ^= 1
+		if _, err := e.Decrypt(tampered, blockID); errors.Cause(err) != errInvalidChecksum {
+			t.Errorf("unexpected error decrypting ciphertext tampered at %v: %v", i, err)
+		}
+	}
+}
@@ -2,10 +2,41 @@ package block
 
 // FormattingOptions describes the rules for formatting blocks in repository.
 type FormattingOptions struct {
-	Version     int    `json:"version,omitempty"`     // version number, must be "1"
+	Version     int    `json:"version,omitempty"`     // version number, 1 (DefaultFormatVersion) or 2 (enables index sets, unreadable by clients supporting only 1)
 	Hash        string `json:"hash,omitempty"`        // identifier of the hash algorithm used
 	Encryption  string `json:"encryption,omitempty"`  // identifier of the encryption algorithm used
 	HMACSecret  []byte `json:"secret,omitempty"`      // HMAC secret used to generate encryption keys
 	MasterKey   []byte `json:"masterKey,omitempty"`   // master encryption key (SIV-mode encryption only)
 	MaxPackSize int    `json:"maxPackSize,omitempty"` // maximum size of a pack object
+
+	// Compression identifies the algorithm compressing blocks being written, if any. Blocks that don't become
+	// smaller are stored uncompressed and the algorithm of each block is recorded in its index entry,
+	// so that it can be changed at any time.
+	Compression string `json:"blockCompression,omitempty"`
+
+	// MaxInlinePayloadSize is the maximum length of blocks whose contents are stored in their index entries
+	// instead of pack files, which avoids writing and reading packs for tiny blocks. Zero disables inline payloads.
+	// Index blocks holding inline payloads can't be read by versions that predate them.
+	MaxInlinePayloadSize int `json:"maxInlinePayloadSize,omitempty"`
+
+	// BlockFormatVersion is the format version recorded in index entries of blocks being written, defaults to Version.
+	// Changing it together with the encryption above, while moving the old encryption to PreviousEncryption,
+	// allows blocks written before the change to remain readable.
+	BlockFormatVersion byte `json:"blockFormatVersion,omitempty"`
+
+	// PreviousEncryption describes the encryption of blocks written with earlier format versions.
+	// The hash can't change, since IDs of existing blocks are derived from it.
+	PreviousEncryption []EncryptionParameters `json:"previousEncryption,omitempty"`
+
+	// Decryptor, if set, performs decryption of all blocks read, instead of the in-process encryptor,
+	// which is then only used to encrypt blocks being written. The in-process encryptor is still created from
+	// the keys above, so the Decryptor does not keep them out of the process.
+	Decryptor Decryptor `json:"-"`
+}
+
+// EncryptionParameters describes the encryption of blocks whose index entries record the provided format version.
+type EncryptionParameters struct {
+	FormatVersion byte   `json:"formatVersion"`
+	Encryption    string `json:"encryption,omitempty"`
+	MasterKey     []byte `json:"masterKey,omitempty"`
 }
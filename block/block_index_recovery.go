@@ -7,33 +7,155 @@ import (
 	"fmt"
 	"hash/crc32"
 	"reflect"
+	"sync"
 )
 
+// RecoveryOptions provides options for recovering index entries from pack files.
+type RecoveryOptions struct {
+	Commit       bool // add recovered entries to the index
+	VerifyBlocks bool // decrypt and verify contents of each block, skipping blocks that fail verification
+	Parallelism  int  // number of parallel block verifications, defaults to 1
+}
+
 // RecoverIndexFromPackFile attempts to recover index block entries from a given pack file.
 // Pack file length may be provided (if known) to reduce the number of bytes that are read from the storage.
 func (bm *Manager) RecoverIndexFromPackFile(ctx context.Context, packFile string, packFileLength int64, commit bool) ([]Info, error) {
-	localIndexBytes, err := bm.readPackFileLocalIndex(ctx, packFile, packFileLength)
+	return bm.RecoverIndexFromPackFileWithOptions(ctx, packFile, packFileLength, RecoveryOptions{Commit: commit})
+}
+
+// RecoverIndexFromPackFileWithOptions attempts to recover index block entries from a given pack file
+// using the provided options. The returned entries are sorted by block ID regardless of parallelism.
+func (bm *Manager) RecoverIndexFromPackFileWithOptions(ctx context.Context, packFile string, packFileLength int64, opt RecoveryOptions) ([]Info, error) {
+	payload, localIndexBytes, err := bm.readPackFileLocalIndex(ctx, packFile, packFileLength)
 	if err != nil {
 		return nil, err
 	}
 
-	ndx, err := openPackIndex(bytes.NewReader(localIndexBytes))
+	recovered, err := parseLocalIndex(localIndexBytes)
 	if err != nil {
 		return nil, fmt.Errorf("unable to open index in file %v", packFile)
 	}
-	defer ndx.Close() //nolint:errcheck
 
-	var recovered []Info
+	if opt.VerifyBlocks {
+		recovered = bm.verifyRecoveredBlocks(payload, recovered, opt.Parallelism)
+	}
 
-	err = ndx.Iterate("", func(i Info) error {
-		recovered = append(recovered, i)
-		if commit {
+	if opt.Commit {
+		bm.lock()
+		for _, i := range recovered {
 			bm.packIndexBuilder.Add(i)
 		}
-		return nil
+		bm.unlock()
+	}
+
+	return recovered, nil
+}
+
+// ParsePackFile enumerates the blocks stored in the provided contents of a pack file using the local index
+// embedded in it, without consulting the repository indexes. The formatting options must match the repository
+// that wrote the pack, since the local index is encrypted. Contents of the blocks themselves are not verified.
+func ParsePackFile(data []byte, f FormattingOptions) ([]Info, error) {
+	hasher, encryptor, err := CreateHashAndEncryptor(f)
+	if err != nil {
+		return nil, err
+	}
+
+	decryptor := Decryptor(encryptor)
+	if f.Decryptor != nil {
+		decryptor = f.Decryptor
+	}
+
+	localIndexBytes, err := decodePackFileLocalIndex(data, func(encrypted []byte, iv []byte) ([]byte, error) {
+		decrypted, err := decryptor.Decrypt(encrypted, iv)
+		if err != nil {
+			return nil, err
+		}
+
+		return decrypted, verifyHashChecksum(hasher, decrypted, iv)
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLocalIndex(localIndexBytes)
+}
+
+func parseLocalIndex(localIndexBytes []byte) ([]Info, error) {
+	ndx, err := openPackIndex(bytes.NewReader(localIndexBytes))
+	if err != nil {
+		return nil, err
+	}
+	defer ndx.Close() //nolint:errcheck
+
+	var result []Info
 
-	return recovered, err
+	if err := ndx.Iterate("", func(i Info) error {
+		result = append(result, i)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// verifyRecoveredBlocks decrypts and verifies contents of the provided blocks within the pack payload
+// using a pool of workers and returns the blocks that are valid, preserving their order.
+func (bm *Manager) verifyRecoveredBlocks(payload []byte, infos []Info, parallelism int) []Info {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	valid := make([]bool, len(infos))
+	indexes := make(chan int, len(infos))
+	for i := range infos {
+		indexes <- i
+	}
+	close(indexes)
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				if err := bm.verifyPackedBlock(payload, infos[i]); err != nil {
+					log.Warningf("unable to verify block %q in %v: %v", infos[i].BlockID, infos[i].PackFile, err)
+					continue
+				}
+
+				valid[i] = true
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	var result []Info
+	for i, bi := range infos {
+		if valid[i] {
+			result = append(result, bi)
+		}
+	}
+
+	return result
+}
+
+func (bm *Manager) verifyPackedBlock(payload []byte, bi Info) error {
+	length := bm.storedLength(bi)
+	if uint64(bi.PackOffset)+uint64(length) > uint64(len(payload)) {
+		return fmt.Errorf("invalid offset %v and length %v", bi.PackOffset, length)
+	}
+
+	iv, err := getPackedBlockIV(bi.BlockID)
+	if err != nil {
+		return err
+	}
+
+	_, err = bm.decryptAndVerifyBlock(bi, payload[bi.PackOffset:bi.PackOffset+length], iv)
+	return err
 }
 
 type packBlockPostamble struct {
@@ -173,7 +295,7 @@ func (bm *Manager) appendPackFileIndexRecoveryData(blockData []byte, pending pac
 	postamble := packBlockPostamble{
 		localIndexIV:     localIndexIV,
 		localIndexOffset: uint32(localIndexOffset),
-		localIndexLength: uint32(len(localIndex)),
+		localIndexLength: uint32(len(encryptedLocalIndex)),
 	}
 
 	blockData = append(blockData, encryptedLocalIndex...)
@@ -196,28 +318,40 @@ func (bm *Manager) appendPackFileIndexRecoveryData(blockData []byte, pending pac
 	return blockData, nil
 }
 
-func (bm *Manager) readPackFileLocalIndex(ctx context.Context, packFile string, packFileLength int64) ([]byte, error) {
+// readPackFileLocalIndex returns the contents of the pack file and its decrypted local index.
+func (bm *Manager) readPackFileLocalIndex(ctx context.Context, packFile string, packFileLength int64) ([]byte, []byte, error) {
 	payload, err := bm.st.GetBlock(ctx, packFile, 0, -1)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	localIndexBytes, err := decodePackFileLocalIndex(payload, bm.decryptAndVerifyAnyVersion)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v in file %v", err, packFile)
 	}
 
+	return payload, localIndexBytes, nil
+}
+
+// decodePackFileLocalIndex locates the local index of the provided pack file contents using its postamble
+// and returns it decrypted using the provided function.
+func decodePackFileLocalIndex(payload []byte, decrypt func(encrypted []byte, iv []byte) ([]byte, error)) ([]byte, error) {
 	postamble := findPostamble(payload)
 	if postamble == nil {
-		return nil, fmt.Errorf("unable to find valid postamble in file %v", packFile)
+		return nil, fmt.Errorf("unable to find valid postamble")
 	}
 
-	if uint64(postamble.localIndexOffset+postamble.localIndexLength) > uint64(len(payload)) {
+	if uint64(postamble.localIndexOffset)+uint64(postamble.localIndexLength) > uint64(len(payload)) {
 		// invalid offset/length
-		return nil, fmt.Errorf("unable to find valid local index in file %v", packFile)
+		return nil, fmt.Errorf("unable to find valid local index")
 	}
 
 	encryptedLocalIndexBytes := payload[postamble.localIndexOffset : postamble.localIndexOffset+postamble.localIndexLength]
 	if encryptedLocalIndexBytes == nil {
-		return nil, fmt.Errorf("unable to find valid local index in file %v", packFile)
+		return nil, fmt.Errorf("unable to find valid local index")
 	}
 
-	localIndexBytes, err := bm.decryptAndVerify(encryptedLocalIndexBytes, postamble.localIndexIV)
+	localIndexBytes, err := decrypt(encryptedLocalIndexBytes, postamble.localIndexIV)
 	if err != nil {
 		return nil, fmt.Errorf("unable to decrypt local index: %v", err)
 	}
@@ -2,6 +2,8 @@ package block
 
 import (
 	"context"
+	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -88,3 +90,116 @@ func TestBlockIndexRecovery(t *testing.T) {
 	verifyBlock(ctx, t, bm, block2, seededRandomData(11, 100))
 	verifyBlock(ctx, t, bm, block3, seededRandomData(12, 100))
 }
+
+// writeLargePack writes the provided number of blocks into a single pack file and returns its metadata.
+func writeLargePack(ctx context.Context, t testing.TB, blockCount int) (map[string][]byte, *Manager, storage.BlockMetadata) {
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+	bm.checkInvariantsOnUnlock = false
+	bm.maxPackSize = blockCount * 1000
+
+	for i := 0; i < blockCount; i++ {
+		if _, err := bm.WriteBlock(ctx, seededRandomData(i, 500), ""); err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+	}
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	packs, err := storage.ListAllBlocks(ctx, bm.st, PackBlockPrefix)
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("unexpected packs: %v %v", packs, err)
+	}
+
+	return data, bm, packs[0]
+}
+
+func TestBlockIndexRecoveryWithParallelVerification(t *testing.T) {
+	ctx := context.Background()
+	data, bm, pack := writeLargePack(ctx, t, 1000)
+
+	serial, err := bm.RecoverIndexFromPackFileWithOptions(ctx, pack.BlockID, pack.Length, RecoveryOptions{VerifyBlocks: true})
+	if err != nil {
+		t.Fatalf("error recovering: %v", err)
+	}
+
+	if got, want := len(serial), 1000; got != want {
+		t.Errorf("invalid # of blocks recovered: %v, want %v", got, want)
+	}
+
+	parallel, err := bm.RecoverIndexFromPackFileWithOptions(ctx, pack.BlockID, pack.Length, RecoveryOptions{VerifyBlocks: true, Parallelism: 8})
+	if err != nil {
+		t.Fatalf("error recovering: %v", err)
+	}
+
+	if !reflect.DeepEqual(serial, parallel) {
+		t.Errorf("parallel recovery returned different results than serial")
+	}
+
+	// corrupt the contents of one block in the pack.
+	data[pack.BlockID][serial[500].PackOffset] ^= 1
+
+	parallel, err = bm.RecoverIndexFromPackFileWithOptions(ctx, pack.BlockID, pack.Length, RecoveryOptions{VerifyBlocks: true, Parallelism: 8})
+	if err != nil {
+		t.Fatalf("error recovering: %v", err)
+	}
+
+	want := append(append([]Info(nil), serial[0:500]...), serial[501:]...)
+	if !reflect.DeepEqual(parallel, want) {
+		t.Errorf("corrupted block was not skipped")
+	}
+}
+
+func BenchmarkRecoverIndexFromPackFile(b *testing.B) {
+	ctx := context.Background()
+	_, bm, pack := writeLargePack(ctx, b, 5000)
+
+	for _, parallelism := range []int{1, 8} {
+		opt := RecoveryOptions{VerifyBlocks: true, Parallelism: parallelism}
+		b.Run(fmt.Sprintf("parallelism-%v", parallelism), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := bm.RecoverIndexFromPackFileWithOptions(ctx, pack.BlockID, pack.Length, opt); err != nil {
+					b.Fatalf("error recovering: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePackFile(t *testing.T) {
+	ctx := context.Background()
+	data, bm, pack := writeLargePack(ctx, t, 10)
+
+	infos, err := ParsePackFile(data[pack.BlockID], bm.Format)
+	if err != nil {
+		t.Fatalf("unable to parse pack file: %v", err)
+	}
+
+	if got, want := len(infos), 10; got != want {
+		t.Fatalf("invalid # of blocks parsed: %v, want %v", got, want)
+	}
+
+	for _, i := range infos {
+		bi, err := bm.BlockInfo(ctx, i.BlockID)
+		if err != nil {
+			t.Fatalf("unable to get info of %v: %v", i.BlockID, err)
+		}
+
+		if !reflect.DeepEqual(i, bi) {
+			t.Errorf("unexpected parsed block %+v, want %+v", i, bi)
+		}
+	}
+
+	f := bm.Format
+	f.HMACSecret = []byte("wrong-secret")
+	if _, err := ParsePackFile(data[pack.BlockID], f); err == nil {
+		t.Errorf("unexpected success parsing pack file with wrong secret")
+	}
+
+	if _, err := ParsePackFile(data[pack.BlockID][0:100], bm.Format); err == nil {
+		t.Errorf("unexpected success parsing truncated pack file")
+	}
+}
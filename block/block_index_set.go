@@ -0,0 +1,295 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	// stagedIndexBlockPrefix is the prefix of index blocks that only become active once they are
+	// referenced by the current index set.
+	stagedIndexBlockPrefix = "s"
+
+	// indexSetBlockPrefix is the prefix of index set blocks, followed by the zero-padded generation number
+	// and a random suffix, which prevents concurrent writers of the same generation from overwriting each other.
+	indexSetBlockPrefix = "x"
+)
+
+// errIndexSetConflict is returned when a newer generation of the index set has been written concurrently.
+var errIndexSetConflict = errors.New("index set has been concurrently replaced")
+
+// indexSet describes a generation of the index set, which determines which staged index blocks are active
+// and which regular index blocks have been superseded by them.
+type indexSet struct {
+	Generation  int64    `json:"generation"`
+	IndexBlocks []string `json:"indexBlocks"`
+	Superseded  []string `json:"superseded,omitempty"`
+}
+
+func newIndexSetBlockID(generation int64) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := cryptorand.Read(suffix); err != nil {
+		return "", errors.Wrap(err, "unable to generate index set suffix")
+	}
+
+	return fmt.Sprintf("%v%016x-%x", indexSetBlockPrefix, generation, suffix), nil
+}
+
+func parseIndexSetGeneration(blockID string) (int64, error) {
+	s := strings.TrimPrefix(blockID, indexSetBlockPrefix)
+	if p := strings.IndexByte(s, '-'); p >= 0 {
+		s = s[0:p]
+	}
+
+	return strconv.ParseInt(s, 16, 64)
+}
+
+// readCurrentIndexSet returns the index set with the highest generation, or nil if there isn't one.
+// Index sets of the same generation written concurrently are merged, which is safe since each of them
+// only supersedes index blocks whose contents are present in its own staged index blocks.
+func readCurrentIndexSet(ctx context.Context, st storage.Storage) (*indexSet, []storage.BlockMetadata, error) {
+	sets, err := storage.ListAllBlocks(ctx, st, indexSetBlockPrefix)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to list index sets")
+	}
+
+	var latest []string
+	var latestGeneration int64 = -1
+	for _, s := range sets {
+		gen, err := parseIndexSetGeneration(s.BlockID)
+		if err != nil {
+			log.Warningf("ignoring malformed index set block %q", s.BlockID)
+			continue
+		}
+
+		switch {
+		case gen > latestGeneration:
+			latest = []string{s.BlockID}
+			latestGeneration = gen
+		case gen == latestGeneration:
+			latest = append(latest, s.BlockID)
+		}
+	}
+
+	if len(latest) == 0 {
+		return nil, sets, nil
+	}
+
+	result := &indexSet{Generation: latestGeneration}
+	for _, blockID := range latest {
+		data, err := st.GetBlock(ctx, blockID, 0, -1)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "unable to read index set %q", blockID)
+		}
+
+		is := &indexSet{}
+		if err := json.Unmarshal(data, is); err != nil {
+			return nil, nil, errors.Wrapf(err, "unable to parse index set %q", blockID)
+		}
+
+		if is.Generation != latestGeneration {
+			return nil, nil, errors.Errorf("index set %q has unexpected generation %v", blockID, is.Generation)
+		}
+
+		result.IndexBlocks = append(result.IndexBlocks, is.IndexBlocks...)
+		result.Superseded = append(result.Superseded, is.Superseded...)
+	}
+
+	result.IndexBlocks = uniqueSortedStrings(result.IndexBlocks)
+	result.Superseded = uniqueSortedStrings(result.Superseded)
+
+	return result, sets, nil
+}
+
+func uniqueSortedStrings(s []string) []string {
+	sort.Strings(s)
+
+	var result []string
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+// applyIndexSet filters the list of regular index blocks according to the provided index set and adds
+// staged index blocks that are part of it. Staged blocks not referenced by the set are left-overs
+// from interrupted swaps and are ignored.
+func applyIndexSet(ctx context.Context, st storage.Storage, is *indexSet, regular []IndexInfo) ([]IndexInfo, error) {
+	superseded := map[string]bool{}
+	for _, b := range is.Superseded {
+		superseded[b] = true
+	}
+
+	var results []IndexInfo
+	for _, ii := range regular {
+		if !superseded[ii.FileName] {
+			results = append(results, ii)
+		}
+	}
+
+	active := map[string]bool{}
+	for _, b := range is.IndexBlocks {
+		active[b] = true
+	}
+
+	staged, err := storage.ListAllBlocks(ctx, st, stagedIndexBlockPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list staged index blocks")
+	}
+
+	for _, it := range staged {
+		if !active[it.BlockID] {
+			continue
+		}
+
+		results = append(results, IndexInfo{
+			FileName:  it.BlockID,
+			Timestamp: it.Timestamp,
+			Length:    it.Length,
+		})
+	}
+
+	return results, nil
+}
+
+// ReplaceIndexBlocks atomically replaces the provided index blocks with a single index block containing the provided entries.
+// The new index block is staged first and becomes visible together with the removal of the replaced blocks
+// when the new index set is written, so readers observe either the old or the new set of indexes, never a mix.
+// Index blocks written concurrently that are not being replaced remain active.
+// If another replacement completes concurrently, the replaced blocks are left in place and an error is returned.
+// Requires format version 2 or higher.
+func (bm *Manager) ReplaceIndexBlocks(ctx context.Context, replaced []IndexInfo, entries []Info) error {
+	if bm.writeFormatVersion < indexSetMinVersion {
+		return errors.Errorf("index sets require format version %v or higher, got %v", indexSetMinVersion, bm.writeFormatVersion)
+	}
+
+	bld := make(packIndexBuilder)
+	for _, e := range entries {
+		bld.Add(e)
+	}
+
+	var buf bytes.Buffer
+	if err := bld.Build(&buf); err != nil {
+		return errors.Wrap(err, "unable to build an index")
+	}
+
+	_, err := bm.replaceIndexBlocks(ctx, replaced, buf.Bytes())
+	return err
+}
+
+func (bm *Manager) replaceIndexBlocks(ctx context.Context, replaced []IndexInfo, indexData []byte) (string, error) {
+	stagedBlockID, err := bm.encryptAndWriteBlockNotLocked(ctx, indexData, stagedIndexBlockPrefix)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to write staged index block")
+	}
+
+	current, oldSets, err := readCurrentIndexSet(ctx, bm.st)
+	if err != nil {
+		return "", err
+	}
+
+	if current == nil {
+		current = &indexSet{}
+	}
+
+	replacedNames := map[string]bool{}
+	for _, ii := range replaced {
+		replacedNames[ii.FileName] = true
+	}
+
+	regular, err := storage.ListAllBlocks(ctx, bm.st, newIndexBlockPrefix)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to list index blocks")
+	}
+
+	stillSuperseded := map[string]bool{}
+	for _, b := range current.Superseded {
+		stillSuperseded[b] = true
+	}
+
+	next := &indexSet{
+		Generation:  current.Generation + 1,
+		IndexBlocks: []string{stagedBlockID},
+	}
+
+	for _, b := range current.IndexBlocks {
+		if !replacedNames[b] && b != stagedBlockID {
+			next.IndexBlocks = append(next.IndexBlocks, b)
+		}
+	}
+
+	// only carry over superseded blocks that have not been deleted yet.
+	for _, it := range regular {
+		if replacedNames[it.BlockID] || stillSuperseded[it.BlockID] {
+			next.Superseded = append(next.Superseded, it.BlockID)
+		}
+	}
+
+	data, err := json.Marshal(next)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to serialize index set")
+	}
+
+	setBlockID, err := newIndexSetBlockID(next.Generation)
+	if err != nil {
+		return "", err
+	}
+
+	// this is the atomic flip - until the new index set is written, readers keep seeing the old one.
+	bm.listCache.deleteListCache(ctx)
+	if err := bm.st.PutBlock(ctx, setBlockID, data); err != nil {
+		return "", errors.Wrap(err, "unable to write index set")
+	}
+
+	// re-read the index set before deleting anything, if a newer generation has been written concurrently,
+	// our index set is not effective and the blocks it supersedes must remain in place.
+	latest, _, err := readCurrentIndexSet(ctx, bm.st)
+	if err != nil {
+		return "", err
+	}
+
+	if latest == nil || latest.Generation != next.Generation {
+		return "", errors.Wrapf(errIndexSetConflict, "index set generation %v", next.Generation)
+	}
+
+	formatLog.Debugf("activated index set generation %v with %v blocks", next.Generation, len(next.IndexBlocks))
+
+	// clean up blocks no longer needed by the new index set, failures here are harmless since superseded blocks are ignored.
+	for _, b := range next.Superseded {
+		if err := bm.st.DeleteBlock(ctx, b); err != nil {
+			log.Warningf("unable to delete superseded index block %q: %v", b, err)
+		}
+	}
+
+	for _, ii := range replaced {
+		if strings.HasPrefix(ii.FileName, stagedIndexBlockPrefix) && ii.FileName != stagedBlockID {
+			if err := bm.st.DeleteBlock(ctx, ii.FileName); err != nil {
+				log.Warningf("unable to delete replaced index block %q: %v", ii.FileName, err)
+			}
+		}
+	}
+
+	for _, s := range oldSets {
+		if gen, err := parseIndexSetGeneration(s.BlockID); err != nil || gen >= next.Generation {
+			continue
+		}
+
+		if err := bm.st.DeleteBlock(ctx, s.BlockID); err != nil {
+			log.Warningf("unable to delete old index set %q: %v", s.BlockID, err)
+		}
+	}
+
+	return stagedBlockID, nil
+}
@@ -0,0 +1,314 @@
+package block
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+type crashingStorage struct {
+	storage.Storage
+	failPutPrefix string
+	failDeletes   bool
+	afterPut      func(id string)
+}
+
+func (s *crashingStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	if s.failPutPrefix != "" && strings.HasPrefix(id, s.failPutPrefix) {
+		return errors.Errorf("simulated crash writing %v", id)
+	}
+
+	if err := s.Storage.PutBlock(ctx, id, data); err != nil {
+		return err
+	}
+
+	if s.afterPut != nil {
+		s.afterPut(id)
+	}
+
+	return nil
+}
+
+func (s *crashingStorage) DeleteBlock(ctx context.Context, id string) error {
+	if s.failDeletes {
+		return errors.Errorf("simulated crash deleting %v", id)
+	}
+
+	return s.Storage.DeleteBlock(ctx, id)
+}
+
+func TestIndexSetSwap(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	timeFunc := fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+	st := &crashingStorage{Storage: storagetesting.NewMapStorage(data, keyTime, timeFunc)}
+	bm := newTestBlockManagerWithVersion(st, timeFunc, CachingOptions{}, indexSetMinVersion)
+
+	var blocks []string
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+		assertNoError(t, bm.Flush(ctx))
+	}
+
+	originalIndexes := indexBlockNames(ctx, t, newIndexSetTestBlockManager(data, keyTime))
+	if got, want := len(originalIndexes), 3; got != want {
+		t.Fatalf("unexpected number of index blocks: %v, wanted %v", got, want)
+	}
+
+	// crash after the new index has been staged, but before the index set has been flipped.
+	st.failPutPrefix = indexSetBlockPrefix
+	assertNoError(t, bm.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true}))
+	if got, want := countBlocksWithPrefix(data, stagedIndexBlockPrefix), 1; got != want {
+		t.Fatalf("unexpected number of staged index blocks: %v, wanted %v", got, want)
+	}
+
+	// open sees the pre-swap index set.
+	bm2 := newIndexSetTestBlockManager(data, keyTime)
+	if got, want := indexBlockNames(ctx, t, bm2), originalIndexes; !stringSlicesEqual(got, want) {
+		t.Errorf("unexpected index blocks after interrupted swap: %v, wanted %v", got, want)
+	}
+	for i, b := range blocks {
+		verifyBlock(ctx, t, bm2, b, seededRandomData(i, 100))
+	}
+
+	// crash after the flip, but before the superseded index blocks have been cleaned up.
+	st.failPutPrefix = ""
+	st.failDeletes = true
+	assertNoError(t, bm.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true}))
+	if got, want := getIndexCount(data), 3; got != want {
+		t.Errorf("unexpected number of regular index blocks: %v, wanted %v", got, want)
+	}
+
+	// open sees only the post-swap index set.
+	bm3 := newIndexSetTestBlockManager(data, keyTime)
+	swapped := indexBlockNames(ctx, t, bm3)
+	if len(swapped) != 1 || !strings.HasPrefix(swapped[0], stagedIndexBlockPrefix) {
+		t.Errorf("unexpected index blocks after swap: %v", swapped)
+	}
+	for i, b := range blocks {
+		verifyBlock(ctx, t, bm3, b, seededRandomData(i, 100))
+	}
+
+	// new index blocks written after the swap are visible alongside the index set.
+	st.failDeletes = false
+	b4 := writeBlockAndVerify(ctx, t, bm3, seededRandomData(4, 100))
+	assertNoError(t, bm3.Flush(ctx))
+
+	bm4 := newIndexSetTestBlockManager(data, keyTime)
+	if got, want := len(indexBlockNames(ctx, t, bm4)), 2; got != want {
+		t.Errorf("unexpected number of index blocks: %v, wanted %v", got, want)
+	}
+	verifyBlock(ctx, t, bm4, b4, seededRandomData(4, 100))
+
+	// another full compaction cleans up superseded blocks and previous index sets.
+	assertNoError(t, bm4.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true}))
+	if got, want := getIndexCount(data), 0; got != want {
+		t.Errorf("unexpected number of regular index blocks: %v, wanted %v", got, want)
+	}
+	if got, want := countBlocksWithPrefix(data, indexSetBlockPrefix), 1; got != want {
+		t.Errorf("unexpected number of index sets: %v, wanted %v", got, want)
+	}
+
+	bm5 := newIndexSetTestBlockManager(data, keyTime)
+	if got, want := len(indexBlockNames(ctx, t, bm5)), 1; got != want {
+		t.Errorf("unexpected number of index blocks: %v, wanted %v", got, want)
+	}
+	for i, b := range blocks {
+		verifyBlock(ctx, t, bm5, b, seededRandomData(i, 100))
+	}
+	verifyBlock(ctx, t, bm5, b4, seededRandomData(4, 100))
+}
+
+func TestIndexSetConcurrentReplace(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	timeFunc := fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+	st := &crashingStorage{Storage: storagetesting.NewMapStorage(data, keyTime, timeFunc)}
+	bm := newTestBlockManagerWithVersion(st, timeFunc, CachingOptions{}, indexSetMinVersion)
+
+	var blocks []string
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+		assertNoError(t, bm.Flush(ctx))
+	}
+
+	// another compaction completes right after our index set has been written.
+	st.afterPut = func(id string) {
+		if !strings.HasPrefix(id, indexSetBlockPrefix) {
+			return
+		}
+
+		st.afterPut = nil
+		bm2 := newTestBlockManagerWithVersion(st, timeFunc, CachingOptions{}, indexSetMinVersion)
+		blocks = append(blocks, writeBlockAndVerify(ctx, t, bm2, seededRandomData(3, 100)))
+		assertNoError(t, bm2.Flush(ctx))
+		assertNoError(t, bm2.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true}))
+	}
+
+	indexes, err := bm.IndexBlocks(ctx)
+	assertNoError(t, err)
+	entries, err := bm.ListBlockInfos("", true)
+	assertNoError(t, err)
+
+	err = bm.ReplaceIndexBlocks(ctx, indexes, entries)
+	if errors.Cause(err) != errIndexSetConflict {
+		t.Fatalf("unexpected replace error: %v, wanted %v", err, errIndexSetConflict)
+	}
+
+	bm3 := newIndexSetTestBlockManager(data, keyTime)
+	for i, b := range blocks {
+		verifyBlock(ctx, t, bm3, b, seededRandomData(i, 100))
+	}
+}
+
+func TestIndexSetConflictRetry(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	timeFunc := fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+	st := &crashingStorage{Storage: storagetesting.NewMapStorage(data, keyTime, timeFunc)}
+	bm := newTestBlockManagerWithVersion(st, timeFunc, CachingOptions{}, indexSetMinVersion)
+
+	var blocks []string
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+		assertNoError(t, bm.Flush(ctx))
+	}
+
+	// another writer replaces the index set right after ours has been written and then commits another index.
+	st.afterPut = func(id string) {
+		if !strings.HasPrefix(id, indexSetBlockPrefix) {
+			return
+		}
+
+		st.afterPut = nil
+		bm2 := newTestBlockManagerWithVersion(st, timeFunc, CachingOptions{}, indexSetMinVersion)
+		blocks = append(blocks, writeBlockAndVerify(ctx, t, bm2, seededRandomData(3, 100)))
+		assertNoError(t, bm2.Flush(ctx))
+		assertNoError(t, bm2.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true}))
+		blocks = append(blocks, writeBlockAndVerify(ctx, t, bm2, seededRandomData(4, 100)))
+		assertNoError(t, bm2.Flush(ctx))
+	}
+
+	// the retry compacts the index set written by the other writer along with its new index block.
+	assertNoError(t, bm.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true, ConflictRetries: 1}))
+
+	bm3 := newIndexSetTestBlockManager(data, keyTime)
+	if got, want := len(indexBlockNames(ctx, t, bm3)), 1; got != want {
+		t.Errorf("unexpected number of index blocks after retried compaction: %v, wanted %v", got, want)
+	}
+
+	for i, b := range blocks {
+		verifyBlock(ctx, t, bm3, b, seededRandomData(i, 100))
+	}
+}
+
+func TestConcurrentFlushes(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	st := storagetesting.NewMapStorage(data, keyTime, nil)
+
+	// index blocks are content-addressed, so concurrent flushes never overwrite each other's indexes.
+	var wg sync.WaitGroup
+	blocks := make([][]string, 2)
+	for w := range blocks {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			bm := newTestBlockManagerWithVersion(st, nil, CachingOptions{}, indexSetMinVersion)
+			for i := 0; i < 10; i++ {
+				blocks[w] = append(blocks[w], writeBlockAndVerify(ctx, t, bm, seededRandomData(w*100+i, 100)))
+				assertNoError(t, bm.Flush(ctx))
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	bm := newIndexSetTestBlockManager(data, keyTime)
+	for w := range blocks {
+		for i, b := range blocks[w] {
+			verifyBlock(ctx, t, bm, b, seededRandomData(w*100+i, 100))
+		}
+	}
+}
+
+func TestIndexSetRequiresFormatVersion(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	for i := 0; i < 3; i++ {
+		writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100))
+		assertNoError(t, bm.Flush(ctx))
+	}
+
+	// older format versions compact without index sets, which older clients would not understand.
+	assertNoError(t, bm.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true}))
+	if got, want := countBlocksWithPrefix(data, indexSetBlockPrefix), 0; got != want {
+		t.Errorf("unexpected number of index sets: %v, wanted %v", got, want)
+	}
+	if got, want := getIndexCount(data), 1; got != want {
+		t.Errorf("unexpected number of regular index blocks: %v, wanted %v", got, want)
+	}
+
+	if err := bm.ReplaceIndexBlocks(ctx, nil, nil); err == nil {
+		t.Errorf("expected error replacing index blocks in format version 0")
+	}
+}
+
+func newIndexSetTestBlockManager(data map[string][]byte, keyTime map[string]time.Time) *Manager {
+	return newTestBlockManagerWithVersion(storagetesting.NewMapStorage(data, keyTime, nil), nil, CachingOptions{}, indexSetMinVersion)
+}
+
+func indexBlockNames(ctx context.Context, t *testing.T, bm *Manager) []string {
+	t.Helper()
+
+	infos, err := bm.IndexBlocks(ctx)
+	if err != nil {
+		t.Fatalf("unable to list index blocks: %v", err)
+	}
+
+	var result []string
+	for _, ii := range infos {
+		result = append(result, ii.FileName)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func countBlocksWithPrefix(d map[string][]byte, prefix string) int {
+	var cnt int
+	for k := range d {
+		if strings.HasPrefix(k, prefix) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,115 @@
+package block
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/kopia/repo/storage"
+)
+
+// MalformedIndexBlock describes an index block that failed verification.
+type MalformedIndexBlock struct {
+	IndexInfo
+	Err error
+}
+
+// VerifyIndexBlocks reads all committed index blocks and verifies their internal consistency.
+// It returns the list of malformed index blocks, which can be dropped and recovered from pack files
+// using RecoverIndexFromPackFile().
+func (bm *Manager) VerifyIndexBlocks(ctx context.Context) ([]MalformedIndexBlock, error) {
+	indexBlocks, err := bm.IndexBlocks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list index blocks: %v", err)
+	}
+
+	var malformed []MalformedIndexBlock
+
+	for _, ib := range indexBlocks {
+		payload, err := bm.st.GetBlock(ctx, ib.FileName, 0, -1)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read index block %v: %v", ib.FileName, err)
+		}
+
+		data, err := bm.decryptAndVerifyPhysicalBlock(ib.FileName, payload)
+		if err == nil {
+			err = verifyPackIndex(data)
+		}
+
+		if err != nil {
+			log.Warningf("malformed index block %v: %v", ib.FileName, err)
+			malformed = append(malformed, MalformedIndexBlock{ib, err})
+		}
+	}
+
+	return malformed, nil
+}
+
+// TruncatedPack describes a pack file that is shorter than required by the index entries referencing it.
+type TruncatedPack struct {
+	PackFile       string
+	Length         int64 // actual length of the pack file in the storage
+	RequiredLength int64 // minimum length of the pack file required by index entries
+	Blocks         []Info
+}
+
+// FindTruncatedPacks cross-references the lengths of pack files in the storage with the index entries referencing them
+// and returns the packs that are empty or too short to contain all their blocks. Packs missing from the storage
+// are not reported. When deleteBlocks is true, the affected blocks are deleted, so that they can be written again
+// and stored in new packs, the deletions become effective after the next Flush().
+func (bm *Manager) FindTruncatedPacks(ctx context.Context, deleteBlocks bool) ([]TruncatedPack, error) {
+	infos, err := bm.ListBlockInfos("", false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list index blocks: %v", err)
+	}
+
+	byPack := map[string]*TruncatedPack{}
+	for _, bi := range infos {
+		if bi.PackFile == "" || bi.Payload != nil {
+			continue
+		}
+
+		tp := byPack[bi.PackFile]
+		if tp == nil {
+			tp = &TruncatedPack{PackFile: bi.PackFile}
+			byPack[bi.PackFile] = tp
+		}
+
+		if end := int64(bi.PackOffset) + int64(bm.storedLength(bi)); end > tp.RequiredLength {
+			tp.RequiredLength = end
+		}
+		tp.Blocks = append(tp.Blocks, bi)
+	}
+
+	var truncated []TruncatedPack
+	err = bm.st.ListBlocks(ctx, PackBlockPrefix, func(m storage.BlockMetadata) error {
+		tp := byPack[m.BlockID]
+		if tp == nil || m.Length >= tp.RequiredLength {
+			return nil
+		}
+
+		log.Warningf("pack %v is truncated, got %v bytes, required %v bytes by %v blocks", m.BlockID, m.Length, tp.RequiredLength, len(tp.Blocks))
+		tp.Length = m.Length
+		truncated = append(truncated, *tp)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing storage blocks: %v", err)
+	}
+
+	sort.Slice(truncated, func(i, j int) bool {
+		return truncated[i].PackFile < truncated[j].PackFile
+	})
+
+	if deleteBlocks {
+		for _, tp := range truncated {
+			for _, bi := range tp.Blocks {
+				if err := bm.DeleteBlock(bi.BlockID); err != nil {
+					return nil, fmt.Errorf("unable to delete block %q in truncated pack %v: %v", bi.BlockID, tp.PackFile, err)
+				}
+			}
+		}
+	}
+
+	return truncated, nil
+}
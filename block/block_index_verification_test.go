@@ -0,0 +1,157 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func buildTestIndex(t *testing.T) []byte {
+	t.Helper()
+
+	b := packIndexBuilder{}
+	for i := 0; i < 10; i++ {
+		b.Add(Info{
+			BlockID:          hashValue([]byte(fmt.Sprintf("block-%v", i))),
+			PackFile:         fmt.Sprintf("%vpack-%v", PackBlockPrefix, i%3),
+			PackOffset:       uint32(i * 100),
+			Length:           100,
+			TimestampSeconds: fakeTime.Unix(),
+			FormatVersion:    1,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := b.Build(&buf); err != nil {
+		t.Fatalf("unable to build index: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestVerifyPackIndex(t *testing.T) {
+	valid := buildTestIndex(t)
+	if err := verifyPackIndex(valid); err != nil {
+		t.Fatalf("valid index failed verification: %v", err)
+	}
+
+	var empty bytes.Buffer
+	assertNoError(t, packIndexBuilder{}.Build(&empty))
+	if err := verifyPackIndex(empty.Bytes()); err != nil {
+		t.Errorf("empty index failed verification: %v", err)
+	}
+
+	corruptions := map[string]func(b []byte){
+		"entryCount+1": func(b []byte) { binary.BigEndian.PutUint32(b[4:8], binary.BigEndian.Uint32(b[4:8])+1) },
+		"entryCount-1": func(b []byte) { binary.BigEndian.PutUint32(b[4:8], binary.BigEndian.Uint32(b[4:8])-1) },
+		"keyLength":    func(b []byte) { b[1]++ },
+		"entryLength":  func(b []byte) { binary.BigEndian.PutUint16(b[2:4], 19) },
+		"version":      func(b []byte) { b[0] = 3 },
+		"packFileOffset": func(b []byte) {
+			stride := int(b[1]) + int(binary.BigEndian.Uint16(b[2:4]))
+			binary.BigEndian.PutUint32(b[8+int(b[1])+8:], uint32(len(b)+stride))
+		},
+	}
+
+	for desc, corrupt := range corruptions {
+		data := append([]byte(nil), valid...)
+		corrupt(data)
+		if err := verifyPackIndex(data); err == nil {
+			t.Errorf("corrupted index (%v) passed verification", desc)
+		}
+	}
+
+	if err := verifyPackIndex(valid[0 : len(valid)-1]); err == nil {
+		t.Errorf("truncated index passed verification")
+	}
+}
+
+func TestVerifyIndexBlocks(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	assertNoError(t, bm.Flush(ctx))
+	writeBlockAndVerify(ctx, t, bm, seededRandomData(2, 100))
+	assertNoError(t, bm.Flush(ctx))
+
+	malformed, err := bm.VerifyIndexBlocks(ctx)
+	if err != nil {
+		t.Fatalf("unable to verify index blocks: %v", err)
+	}
+	if len(malformed) != 0 {
+		t.Errorf("unexpected malformed index blocks: %v", malformed)
+	}
+
+	// write a correctly named and encrypted index block with corrupted entryCount.
+	corrupted := buildTestIndex(t)
+	binary.BigEndian.PutUint32(corrupted[4:8], binary.BigEndian.Uint32(corrupted[4:8])+1)
+	corruptedBlockID, err := bm.encryptAndWriteBlockNotLocked(ctx, corrupted, newIndexBlockPrefix)
+	if err != nil {
+		t.Fatalf("unable to write index block: %v", err)
+	}
+
+	malformed, err = bm.VerifyIndexBlocks(ctx)
+	if err != nil {
+		t.Fatalf("unable to verify index blocks: %v", err)
+	}
+
+	if len(malformed) != 1 || malformed[0].FileName != corruptedBlockID {
+		t.Errorf("unexpected malformed index blocks: %v, wanted %v", malformed, corruptedBlockID)
+	}
+}
+
+func TestFindTruncatedPacks(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	timeFunc := fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+	bm := newTestBlockManager(data, keyTime, timeFunc)
+
+	block1 := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	block2 := writeBlockAndVerify(ctx, t, bm, seededRandomData(2, 100))
+	assertNoError(t, bm.Flush(ctx))
+	block3 := writeBlockAndVerify(ctx, t, bm, seededRandomData(3, 100))
+	assertNoError(t, bm.Flush(ctx))
+
+	truncated, err := bm.FindTruncatedPacks(ctx, false)
+	if err != nil {
+		t.Fatalf("unable to find truncated packs: %v", err)
+	}
+	if len(truncated) != 0 {
+		t.Errorf("unexpected truncated packs: %v", truncated)
+	}
+
+	bi, err := bm.BlockInfo(ctx, block2)
+	if err != nil {
+		t.Fatalf("unable to get block info: %v", err)
+	}
+
+	// plant a zero-length version of the first pack, as left by a failed upload.
+	data[bi.PackFile] = nil
+
+	bm = newTestBlockManager(data, keyTime, timeFunc)
+	truncated, err = bm.FindTruncatedPacks(ctx, true)
+	if err != nil {
+		t.Fatalf("unable to find truncated packs: %v", err)
+	}
+
+	if len(truncated) != 1 || truncated[0].PackFile != bi.PackFile || truncated[0].Length != 0 || len(truncated[0].Blocks) != 2 {
+		t.Fatalf("unexpected truncated packs: %+v", truncated)
+	}
+
+	assertNoError(t, bm.Flush(ctx))
+
+	bm = newTestBlockManager(data, keyTime, timeFunc)
+	verifyBlockNotFound(ctx, t, bm, block1)
+	verifyBlockNotFound(ctx, t, bm, block2)
+	verifyBlock(ctx, t, bm, block3, seededRandomData(3, 100))
+
+	// the blocks can be written again.
+	writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+}
@@ -13,6 +13,7 @@ import (
 	"math/rand"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,6 +21,7 @@ import (
 
 	"github.com/kopia/repo/internal/repologging"
 	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -27,6 +29,16 @@ var (
 	formatLog = repologging.Logger("kopia/block/format")
 )
 
+// ErrFlushTimeout is returned by Flush() when it does not complete before the flush timeout or context deadline.
+// Blocks that have not been committed remain pending and will be written by a subsequent Flush().
+var ErrFlushTimeout = errors.New("flush timed out")
+
+// ErrTooManyIndexBlocks is returned when the number of index blocks exceeds CachingOptions.MaxIndexBlocks.
+var ErrTooManyIndexBlocks = errors.New("too many index blocks")
+
+// errInvalidChecksum is returned when the contents of a block don't match its ID.
+var errInvalidChecksum = errors.New("invalid checksum")
+
 // PackBlockPrefix is the prefix for all pack storage blocks.
 const PackBlockPrefix = "p"
 
@@ -38,10 +50,22 @@ const (
 	defaultMaxPreambleLength = 32
 	defaultPaddingUnit       = 4096
 
-	currentWriteVersion     = 1
+	currentWriteVersion     = 2
 	minSupportedReadVersion = 0
 	maxSupportedReadVersion = currentWriteVersion
 
+	// indexSetMinVersion is the minimum format version that supports index sets, clients that predate
+	// them refuse to open such repositories instead of misinterpreting staged and superseded index blocks.
+	indexSetMinVersion = 2
+
+	// DefaultFormatVersion is the format version of new repositories, which remain readable by clients that
+	// predate index sets. Later versions must be requested in FormattingOptions.Version or by upgrading.
+	DefaultFormatVersion = 1
+
+	// LatestFormatVersion is the latest format version supported by this package. Repositories using it can't
+	// be opened by clients that only support earlier versions.
+	LatestFormatVersion = currentWriteVersion
+
 	indexLoadAttempts = 10
 )
 
@@ -71,15 +95,53 @@ type Manager struct {
 	committedBlocks       *committedBlockIndex
 
 	disableIndexFlushCount int
-	flushPackIndexesAfter  time.Time // time when those indexes should be flushed
+	flushPackIndexesAfter  time.Time     // time when those indexes should be flushed
+	flushTimeout           time.Duration // maximum duration of Flush(), zero means no limit
+	writeInterceptor       WriteInterceptor
+
+	flushHook               FlushHook // invoked before each stage of Flush()
+	verifyPacksBeforeCommit bool      // read back and verify uploaded packs before committing their index
+
+	ignoreProvisional bool // treat provisional blocks as not found when reading
+
+	strictIndexes  bool // fail when any listed index block is missing instead of skipping it
+	maxIndexBlocks int  // maximum number of index blocks to load, zero means no limit
+
+	skippedIndexBlocksMutex sync.Mutex
+	skippedIndexBlocks      []MalformedIndexBlock // index blocks skipped during the most recent load
+
+	quarantinedMutex       sync.Mutex
+	quarantineOnCorruption bool            // quarantine packs in which reads detect corrupt blocks
+	quarantineLoaded       bool            // whether quarantine records have been loaded from storage
+	quarantined            map[string]bool // storage blocks known to be quarantined
+
+	uploadQueue        chan *queuedPack                   // packs waiting to be uploaded in the background, nil when uploading synchronously
+	uploadsDone        *sync.Cond                         // signaled whenever a queued pack has been uploaded
+	pendingUploads     int                                // number of queued packs not uploaded yet
+	uploadingPackItems map[string]*queuedPack             // blocks in queued packs, which remain pending until their pack is uploaded
+	uploadErrors       []error                            // errors of background uploads not reported by Flush() yet
+	uploadCancels      map[*queuedPack]context.CancelFunc // cancel uploads in progress after one of them fails
 
-	closed chan struct{}
+	uploadContext       context.Context    // context of background uploads, canceled by Close()
+	cancelUploadContext context.CancelFunc // nil when uploading synchronously
 
-	writeFormatVersion int32 // format version to write
+	closed          chan struct{}
+	backgroundTasks sync.WaitGroup // background compaction and uploads, which Close() waits for
 
-	maxPackSize int
-	hasher      HashFunc
-	encryptor   Encryptor
+	flushCompactionMutex sync.Mutex // held by Flush() and background compaction, which never run concurrently
+
+	writeFormatVersion int32              // format version to write
+	blockFormatVersion byte               // format version recorded in index entries of blocks being written
+	previousDecryptors map[byte]Decryptor // decryptors of blocks written with earlier format versions
+	compressor         *blockCompressor   // compressor of blocks being written, nil if compression is disabled
+
+	maxPackSize          int
+	maxInlinePayloadSize int // maximum length of payloads stored inline in the index instead of packs
+	parallelIndexFetches int
+	caching              CachingOptions
+	hasher               HashFunc
+	encryptor            Encryptor
+	decryptor            Decryptor
 
 	minPreambleLength int
 	maxPreambleLength int
@@ -107,6 +169,7 @@ func (bm *Manager) DeleteBlock(blockID string) error {
 				// added and never committed, just forget about it.
 				delete(bm.packIndexBuilder, blockID)
 				delete(bm.currentPackItems, blockID)
+				delete(bm.uploadingPackItems, blockID)
 				return nil
 			}
 
@@ -141,15 +204,17 @@ func (bm *Manager) DeleteBlock(blockID string) error {
 func (bm *Manager) setPendingBlock(i Info) {
 	bm.packIndexBuilder.Add(i)
 	bm.currentPackItems[i.BlockID] = i
+	delete(bm.uploadingPackItems, i.BlockID)
 }
 
-func (bm *Manager) addToPackLocked(ctx context.Context, blockID string, data []byte, isDeleted bool) error {
+func (bm *Manager) addToPackLocked(ctx context.Context, blockID string, data []byte, isDeleted, isProvisional bool) error {
 	bm.assertLocked()
 
 	data = cloneBytes(data)
 	bm.currentPackDataLength += len(data)
 	bm.setPendingBlock(Info{
 		Deleted:          isDeleted,
+		Provisional:      isProvisional,
 		BlockID:          blockID,
 		Payload:          data,
 		Length:           uint32(len(data)),
@@ -171,7 +236,8 @@ func (bm *Manager) finishPackAndMaybeFlushIndexesLocked(ctx context.Context) err
 		return err
 	}
 
-	if bm.timeNow().After(bm.flushPackIndexesAfter) {
+	// index entries of blocks in queued packs can't be written until their packs have been uploaded.
+	if bm.timeNow().After(bm.flushPackIndexesAfter) && len(bm.uploadingPackItems) == 0 {
 		if err := bm.flushPackIndexesLocked(ctx); err != nil {
 			return err
 		}
@@ -232,11 +298,15 @@ func (bm *Manager) verifyPackIndexBuilderLocked() {
 			// ignore blocks also in currentPackItems
 			continue
 		}
+		if _, ok := bm.uploadingPackItems[cpi.BlockID]; ok {
+			// ignore blocks in packs that are being uploaded in the background
+			continue
+		}
 		if cpi.Deleted {
 			bm.assertInvariant(cpi.PackFile == "", "block can't be both deleted and have a pack block: %v", cpi.BlockID)
 		} else {
-			bm.assertInvariant(cpi.PackFile != "", "block that's not deleted must have a pack block: %+v", cpi)
-			bm.assertInvariant(cpi.FormatVersion == byte(bm.writeFormatVersion), "block that's not deleted must have a valid format version: %+v", cpi)
+			bm.assertInvariant(cpi.PackFile != "" || cpi.Payload != nil, "block that's not deleted must have a pack block or inline payload: %+v", cpi)
+			bm.assertInvariant(cpi.FormatVersion == bm.blockFormatVersion, "block that's not deleted must have a valid format version: %+v", cpi)
 		}
 		bm.assertInvariant(cpi.TimestampSeconds != 0, "block has no timestamp: %v", cpi.BlockID)
 	}
@@ -267,6 +337,17 @@ func (bm *Manager) flushPackIndexesLocked(ctx context.Context) error {
 		return nil
 	}
 
+	if err := bm.verifyUploadedPacksLocked(ctx); err != nil {
+		return err
+	}
+
+	return bm.commitPackIndexesLocked(ctx)
+}
+
+// commitPackIndexesLocked writes the index of all blocks in uploaded packs, which must be durable by now.
+func (bm *Manager) commitPackIndexesLocked(ctx context.Context) error {
+	bm.assertLocked()
+
 	if len(bm.packIndexBuilder) > 0 {
 		var buf bytes.Buffer
 
@@ -302,7 +383,12 @@ func (bm *Manager) finishPackLocked(ctx context.Context) error {
 		return nil
 	}
 
-	if err := bm.writePackBlockLocked(ctx); err != nil {
+	writePack := bm.writePackBlockLocked
+	if bm.uploadQueue != nil {
+		writePack = bm.queuePackBlockLocked
+	}
+
+	if err := writePack(ctx); err != nil {
 		return fmt.Errorf("error writing pack block: %v", err)
 	}
 
@@ -313,14 +399,12 @@ func (bm *Manager) finishPackLocked(ctx context.Context) error {
 func (bm *Manager) writePackBlockLocked(ctx context.Context) error {
 	bm.assertLocked()
 
-	blockID := make([]byte, 16)
-	if _, err := cryptorand.Read(blockID); err != nil {
-		return fmt.Errorf("unable to read crypto bytes: %v", err)
+	packFile, err := newPackFileName()
+	if err != nil {
+		return err
 	}
 
-	packFile := fmt.Sprintf("%v%x", PackBlockPrefix, blockID)
-
-	blockData, packFileIndex, err := bm.preparePackDataBlock(packFile)
+	blockData, packFileIndex, err := bm.preparePackDataBlock(ctx, packFile)
 	if err != nil {
 		return fmt.Errorf("error preparing data block: %v", err)
 	}
@@ -339,7 +423,29 @@ func (bm *Manager) writePackBlockLocked(ctx context.Context) error {
 	return nil
 }
 
-func (bm *Manager) preparePackDataBlock(packFile string) ([]byte, packIndexBuilder, error) {
+func init() {
+	isHex := func(s string) bool { return isStorageBlockName(s, "") }
+
+	storage.RegisterBlockNameFormat(PackBlockPrefix, storage.BlockKindPack, isHex)
+	storage.RegisterBlockNameFormat(newIndexBlockPrefix, storage.BlockKindIndex, isHex)
+	storage.RegisterBlockNameFormat(stagedIndexBlockPrefix, storage.BlockKindIndex, isHex)
+	storage.RegisterBlockNameFormat(indexSetBlockPrefix, storage.BlockKindIndex, func(s string) bool {
+		p := strings.IndexByte(s, '-')
+		return p >= 0 && isHex(s[0:p]) && isHex(s[p+1:])
+	})
+	storage.RegisterBlockNameFormat(quarantineRecordPrefix, storage.BlockKindQuarantine, isPackBlockName)
+}
+
+func newPackFileName() (string, error) {
+	blockID := make([]byte, 16)
+	if _, err := cryptorand.Read(blockID); err != nil {
+		return "", fmt.Errorf("unable to read crypto bytes: %v", err)
+	}
+
+	return fmt.Sprintf("%v%x", PackBlockPrefix, blockID), nil
+}
+
+func (bm *Manager) preparePackDataBlock(ctx context.Context, packFile string) ([]byte, packIndexBuilder, error) {
 	formatLog.Debugf("preparing block data with %v items", len(bm.currentPackItems))
 
 	blockData, err := appendRandomBytes(append([]byte(nil), bm.repositoryFormatBytes...), rand.Intn(bm.maxPreambleLength-bm.minPreambleLength+1)+bm.minPreambleLength)
@@ -348,34 +454,68 @@ func (bm *Manager) preparePackDataBlock(packFile string) ([]byte, packIndexBuild
 	}
 
 	packFileIndex := packIndexBuilder{}
+	packedIndex := packIndexBuilder{}
 	for blockID, info := range bm.currentPackItems {
 		if info.Payload == nil {
 			continue
 		}
 
+		if bm.shouldStoreInline(info.Payload) {
+			formatLog.Debugf("inlining %v length=%v deleted=%v", blockID, len(info.Payload), info.Deleted)
+			packFileIndex.Add(Info{
+				BlockID:          blockID,
+				Deleted:          info.Deleted,
+				Provisional:      info.Provisional,
+				FormatVersion:    bm.blockFormatVersion,
+				Payload:          info.Payload,
+				Length:           uint32(len(info.Payload)),
+				TimestampSeconds: info.TimestampSeconds,
+			})
+			continue
+		}
+
+		payload, compression, err := bm.maybeCompress(info.Payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to compress %q: %v", blockID, err)
+		}
+
 		var encrypted []byte
-		encrypted, err = bm.maybeEncryptBlockDataForPacking(info.Payload, info.BlockID)
+		t0 := time.Now()
+		encrypted, err = bm.maybeEncryptBlockDataForPacking(payload, info.BlockID)
+		recordTiming(timingsFromContext(ctx).encryption(), t0)
 		if err != nil {
 			return nil, nil, fmt.Errorf("unable to encrypt %q: %v", blockID, err)
 		}
 
 		formatLog.Debugf("adding %v length=%v deleted=%v", blockID, len(info.Payload), info.Deleted)
 
-		packFileIndex.Add(Info{
+		packedIndex.Add(Info{
 			BlockID:          blockID,
 			Deleted:          info.Deleted,
-			FormatVersion:    byte(bm.writeFormatVersion),
+			Provisional:      info.Provisional,
+			FormatVersion:    bm.blockFormatVersion,
+			Compression:      compression,
+			OriginalLength:   originalLength(compression, info.Payload),
 			PackFile:         packFile,
 			PackOffset:       uint32(len(blockData)),
-			Length:           uint32(len(info.Payload)),
+			Length:           uint32(len(payload)),
 			TimestampSeconds: info.TimestampSeconds,
 		})
 
 		blockData = append(blockData, encrypted...)
 	}
 
-	if len(packFileIndex) == 0 {
-		return nil, nil, nil
+	if len(packedIndex) == 0 {
+		// all blocks are stored inline in the index, so there's no pack to write.
+		if len(packFileIndex) == 0 {
+			return nil, nil, nil
+		}
+
+		return nil, packFileIndex, nil
+	}
+
+	for _, info := range packedIndex {
+		packFileIndex.Add(*info)
 	}
 
 	if bm.paddingUnit > 0 {
@@ -388,12 +528,17 @@ func (bm *Manager) preparePackDataBlock(packFile string) ([]byte, packIndexBuild
 	}
 
 	origBlockLength := len(blockData)
-	blockData, err = bm.appendPackFileIndexRecoveryData(blockData, packFileIndex)
+	blockData, err = bm.appendPackFileIndexRecoveryData(blockData, packedIndex)
 
 	formatLog.Debugf("finished block %v bytes (%v bytes index)", len(blockData), len(blockData)-origBlockLength)
 	return blockData, packFileIndex, err
 }
 
+// shouldStoreInline determines whether the provided payload is stored in the index instead of the pack.
+func (bm *Manager) shouldStoreInline(payload []byte) bool {
+	return bm.maxInlinePayloadSize > 0 && len(payload) <= bm.maxInlinePayloadSize
+}
+
 func (bm *Manager) maybeEncryptBlockDataForPacking(data []byte, blockID string) ([]byte, error) {
 	if bm.writeFormatVersion == 0 {
 		// in v0 the entire block is encrypted together later on
@@ -420,9 +565,32 @@ func (bm *Manager) IndexBlocks(ctx context.Context) ([]IndexInfo, error) {
 	return bm.listCache.listIndexBlocks(ctx)
 }
 
+// CommittedIndexBlocks returns the sorted list of committed index blocks holding the entries of the provided blocks,
+// which are sufficient to read them. Returns storage.ErrBlockNotFound if any of the blocks is not committed.
+func (bm *Manager) CommittedIndexBlocks(blockIDs []string) ([]string, error) {
+	found := map[string]bool{}
+	for _, blockID := range blockIDs {
+		indexBlockID, err := bm.committedBlocks.indexBlockContaining(blockID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to find index block of %q", blockID)
+		}
+
+		found[indexBlockID] = true
+	}
+
+	var result []string
+	for indexBlockID := range found {
+		result = append(result, indexBlockID)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
 func (bm *Manager) loadPackIndexesUnlocked(ctx context.Context) ([]IndexInfo, bool, error) {
 	nextSleepTime := 100 * time.Millisecond
 
+	var missing map[string]bool
 	for i := 0; i < indexLoadAttempts; i++ {
 		if err := ctx.Err(); err != nil {
 			return nil, false, err
@@ -440,48 +608,108 @@ func (bm *Manager) loadPackIndexesUnlocked(ctx context.Context) ([]IndexInfo, bo
 			return nil, false, err
 		}
 
-		err = bm.tryLoadPackIndexBlocksUnlocked(ctx, blocks)
-		if err == nil {
-			var blockIDs []string
-			for _, b := range blocks {
-				blockIDs = append(blockIDs, b.FileName)
-			}
-			var updated bool
-			updated, err = bm.committedBlocks.use(blockIDs)
-			if err != nil {
-				return nil, false, err
-			}
-			return blocks, updated, nil
+		if bm.maxIndexBlocks > 0 && len(blocks) > bm.maxIndexBlocks {
+			return nil, false, errors.Wrapf(ErrTooManyIndexBlocks, "found %v index blocks, which exceeds the limit of %v, compact indexes without the limit to reduce their number", len(blocks), bm.maxIndexBlocks)
+		}
+
+		notFound, err := bm.tryLoadPackIndexBlocksUnlocked(ctx, blocks)
+		if err != nil {
+			return nil, false, err
 		}
-		if err != storage.ErrBlockNotFound {
+
+		loaded, skipped, retry, err := bm.handleMissingIndexBlocks(blocks, notFound, missing)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if retry {
+			missing = notFound
+			continue
+		}
+
+		bm.skippedIndexBlocksMutex.Lock()
+		bm.skippedIndexBlocks = skipped
+		bm.skippedIndexBlocksMutex.Unlock()
+
+		var blockIDs []string
+		for _, b := range loaded {
+			blockIDs = append(blockIDs, b.FileName)
+		}
+		updated, err := bm.committedBlocks.use(blockIDs)
+		if err != nil {
 			return nil, false, err
 		}
+		return loaded, updated, nil
 	}
 
 	return nil, false, fmt.Errorf("unable to load pack indexes despite %v retries", indexLoadAttempts)
 }
 
-func (bm *Manager) tryLoadPackIndexBlocksUnlocked(ctx context.Context, blocks []IndexInfo) error {
+// handleMissingIndexBlocks determines which index blocks have been loaded and whether to retry loading.
+// A missing index block is retried with a fresh list, since it may have just been compacted. If it is still listed
+// after the retry, it is considered lost, which is fatal in strict mode and otherwise causes the block to be skipped.
+func (bm *Manager) handleMissingIndexBlocks(blocks []IndexInfo, notFound, previouslyMissing map[string]bool) (loaded []IndexInfo, skipped []MalformedIndexBlock, retry bool, err error) {
+	for _, b := range blocks {
+		if !notFound[b.FileName] {
+			loaded = append(loaded, b)
+			continue
+		}
+
+		if !previouslyMissing[b.FileName] {
+			retry = true
+			continue
+		}
+
+		if bm.strictIndexes {
+			return nil, nil, false, errors.Wrapf(storage.ErrBlockNotFound, "index block %v is missing", b.FileName)
+		}
+
+		log.Warningf("skipping missing index block %v", b.FileName)
+		skipped = append(skipped, MalformedIndexBlock{IndexInfo: b, Err: storage.ErrBlockNotFound})
+	}
+
+	return loaded, skipped, retry, nil
+}
+
+// SkippedIndexBlocks returns index blocks that were listed but missing and were skipped during the most recent load of indexes.
+func (bm *Manager) SkippedIndexBlocks() []MalformedIndexBlock {
+	bm.skippedIndexBlocksMutex.Lock()
+	defer bm.skippedIndexBlocksMutex.Unlock()
+
+	return append([]MalformedIndexBlock(nil), bm.skippedIndexBlocks...)
+}
+
+// tryLoadPackIndexBlocksUnlocked loads index blocks that are not in the cache yet and returns the set of index blocks
+// that were not found. Any other error is fatal.
+func (bm *Manager) tryLoadPackIndexBlocksUnlocked(ctx context.Context, blocks []IndexInfo) (map[string]bool, error) {
 	ch, unprocessedIndexesSize, err := bm.unprocessedIndexBlocksUnlocked(blocks)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(ch) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	log.Infof("downloading %v new index blocks (%v bytes)...", len(ch), unprocessedIndexesSize)
 	var wg sync.WaitGroup
+	var mu sync.Mutex
 
-	errors := make(chan error, parallelFetches)
+	notFound := map[string]bool{}
+	errors := make(chan error, bm.parallelIndexFetches)
 
-	for i := 0; i < parallelFetches; i++ {
+	for i := 0; i < bm.parallelIndexFetches; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
 			for indexBlockID := range ch {
 				data, err := bm.getPhysicalBlockInternal(ctx, indexBlockID)
+				if err == storage.ErrBlockNotFound {
+					mu.Lock()
+					notFound[indexBlockID] = true
+					mu.Unlock()
+					continue
+				}
 				if err != nil {
 					errors <- err
 					return
@@ -500,11 +728,11 @@ func (bm *Manager) tryLoadPackIndexBlocksUnlocked(ctx context.Context, blocks []
 
 	// Propagate async errors, if any.
 	for err := range errors {
-		return err
+		return nil, err
 	}
 	log.Infof("Index blocks downloaded.")
 
-	return nil
+	return notFound, nil
 }
 
 // unprocessedIndexBlocksUnlocked returns a closed channel filled with block IDs that are not in committedBlocks cache.
@@ -527,81 +755,235 @@ func (bm *Manager) unprocessedIndexBlocksUnlocked(blocks []IndexInfo) (<-chan st
 	return ch, totalSize, nil
 }
 
-// Close closes the block manager.
+// Close closes the block manager. Packs queued for background upload that have not been uploaded yet are discarded
+// and uploads in progress are canceled, so Flush() should be called first. Close stops background compaction and
+// uploads and waits for a running compaction and the upload workers to finish.
 func (bm *Manager) Close() {
-	bm.blockCache.close()
 	close(bm.closed)
+	if bm.cancelUploadContext != nil {
+		bm.cancelUploadContext()
+	}
+	bm.backgroundTasks.Wait()
+	bm.blockCache.close()
 }
 
-// ListBlocks returns IDs of blocks matching given prefix.
+// ListBlocks returns IDs of non-deleted blocks matching given prefix, sorted by block ID.
 func (bm *Manager) ListBlocks(prefix string) ([]string, error) {
-	bm.lock()
-	defer bm.unlock()
+	infos, err := bm.ListBlockInfos(prefix, false)
+	if err != nil {
+		return nil, err
+	}
 
 	var result []string
-
-	appendToResult := func(i Info) error {
-		if i.Deleted || !strings.HasPrefix(i.BlockID, prefix) {
-			return nil
-		}
-		if bi, ok := bm.packIndexBuilder[i.BlockID]; ok && bi.Deleted {
-			return nil
+	for _, i := range infos {
+		if i.Provisional && bm.ignoreProvisional {
+			continue
 		}
 		result = append(result, i.BlockID)
-		return nil
 	}
 
-	for _, bi := range bm.packIndexBuilder {
-		_ = appendToResult(*bi)
-	}
-
-	_ = bm.committedBlocks.listBlocks(prefix, appendToResult)
 	return result, nil
 }
 
-// ListBlockInfos returns the metadata about blocks with a given prefix and kind.
+// ListBlockInfos returns the metadata about blocks with a given prefix, sorted by block ID, with a single entry
+// for each block. Pending entries take precedence over committed ones and committed entries are merged so that
+// the newest one wins. Deleted blocks are only included
+// when includeDeleted is set, which is useful for garbage collection.
 func (bm *Manager) ListBlockInfos(prefix string, includeDeleted bool) ([]Info, error) {
 	bm.lock()
 	defer bm.unlock()
 
 	var result []Info
 
-	appendToResult := func(i Info) error {
+	appendToResult := func(i Info) {
 		if (i.Deleted && !includeDeleted) || !strings.HasPrefix(i.BlockID, prefix) {
-			return nil
-		}
-		if bi, ok := bm.packIndexBuilder[i.BlockID]; ok && bi.Deleted {
-			return nil
+			return
 		}
 		result = append(result, i)
+	}
+
+	for _, bi := range bm.packIndexBuilder {
+		appendToResult(*bi)
+	}
+
+	if err := bm.committedBlocks.listBlocks(prefix, func(i Info) error {
+		if _, ok := bm.packIndexBuilder[i.BlockID]; !ok {
+			appendToResult(i)
+		}
 		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "unable to list committed blocks")
 	}
 
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].BlockID < result[j].BlockID
+	})
+
+	return result, nil
+}
+
+// FindBlocks returns information about all non-deleted blocks whose IDs start with the provided prefix,
+// sorted by block ID. Pending blocks take precedence over committed ones. Committed indexes are searched
+// starting at the prefix rather than listed in full, and the context is checked for each committed block.
+func (bm *Manager) FindBlocks(ctx context.Context, idPrefix string) ([]Info, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	bm.lock()
+	defer bm.unlock()
+
+	var pending []Info
 	for _, bi := range bm.packIndexBuilder {
-		_ = appendToResult(*bi)
+		if strings.HasPrefix(bi.BlockID, idPrefix) {
+			pending = append(pending, *bi)
+		}
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].BlockID < pending[j].BlockID
+	})
+
+	var result []Info
+
+	// committed blocks are iterated in order of block IDs, so pending ones are merged into the result before them.
+	appendPendingBefore := func(blockID string) {
+		for len(pending) > 0 && (blockID == "" || pending[0].BlockID < blockID) {
+			if !pending[0].Deleted {
+				result = append(result, pending[0])
+			}
+			pending = pending[1:]
+		}
 	}
 
-	_ = bm.committedBlocks.listBlocks(prefix, appendToResult)
+	if err := bm.committedBlocks.listBlocks(idPrefix, func(i Info) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
+		if _, ok := bm.packIndexBuilder[i.BlockID]; ok {
+			return nil
+		}
+
+		appendPendingBefore(i.BlockID)
+		if !i.Deleted {
+			result = append(result, i)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "unable to find committed blocks")
+	}
+
+	appendPendingBefore("")
 	return result, nil
 }
 
 // Flush completes writing any pending packs and writes pack indexes to the underlyign storage.
+//
+// Flush runs in stages (see FlushStage): it first uploads all packs, then optionally reads them back and
+// verifies them (see SetVerifyPacksBeforeCommit) and only then commits their index. A failure at any stage
+// leaves the index uncommitted, so no index ever references a pack that has not been uploaded.
+//
+// If the flush does not complete before the flush timeout or the deadline of the provided context,
+// Flush returns ErrFlushTimeout. Packs whose index has not been written are left uncommitted and
+// their blocks remain pending, so the repository stays consistent and a subsequent Flush() can retry.
+//
+// When packs are uploaded in the background, Flush waits for all queued packs to be uploaded and returns
+// any errors encountered by the uploads since the previous Flush(). Blocks from packs that failed to upload
+// remain pending and are written again by the next Flush().
 func (bm *Manager) Flush(ctx context.Context) error {
+	bm.flushCompactionMutex.Lock()
+	defer bm.flushCompactionMutex.Unlock()
+
 	bm.lock()
 	defer bm.unlock()
 
+	if bm.flushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bm.flushTimeout)
+		defer cancel()
+	}
+
+	if err := bm.runFlushHookLocked(ctx, FlushStageUploadPacks); err != nil {
+		return err
+	}
+
 	if err := bm.finishPackLocked(ctx); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Wrapf(ErrFlushTimeout, "unable to write pack with %v pending blocks, nothing committed", len(bm.currentPackItems))
+		}
+
 		return fmt.Errorf("error writing pending block: %v", err)
 	}
 
-	if err := bm.flushPackIndexesLocked(ctx); err != nil {
+	bm.waitForUploadsLocked(0)
+	if err := bm.takeUploadErrorsLocked(); err != nil {
+		return err
+	}
+
+	if bm.disableIndexFlushCount > 0 {
+		log.Debugf("not flushing index because flushes are currently disabled")
+		return nil
+	}
+
+	if err := bm.runFlushHookLocked(ctx, FlushStageVerifyPacks); err != nil {
+		return err
+	}
+
+	if err := bm.verifyUploadedPacksLocked(ctx); err != nil {
+		return fmt.Errorf("error verifying packs: %v", err)
+	}
+
+	if err := bm.runFlushHookLocked(ctx, FlushStageCommitIndex); err != nil {
+		return err
+	}
+
+	uncommitted := len(bm.packIndexBuilder)
+	if err := bm.commitPackIndexesLocked(ctx); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Wrapf(ErrFlushTimeout, "packs written but index for %v blocks not committed", uncommitted)
+		}
+
 		return fmt.Errorf("error flushing indexes: %v", err)
 	}
 
 	return nil
 }
 
+// MaxPackSize returns the maximum size of pack blocks written by the manager.
+func (bm *Manager) MaxPackSize() int {
+	return bm.maxPackSize
+}
+
+// ParallelIndexFetches returns the number of index blocks fetched in parallel.
+func (bm *Manager) ParallelIndexFetches() int {
+	return bm.parallelIndexFetches
+}
+
+// CachingOptions returns the caching options the manager was opened with, excluding secrets.
+func (bm *Manager) CachingOptions() CachingOptions {
+	return bm.caching
+}
+
+// SetFlushTimeout sets the maximum duration of a single Flush(). Zero duration means no limit.
+func (bm *Manager) SetFlushTimeout(d time.Duration) {
+	bm.lock()
+	defer bm.unlock()
+	bm.flushTimeout = d
+}
+
+// WriteInterceptor is invoked by WriteBlock() before a new block is added to a pack and can veto the write
+// by returning an error. It's not invoked for blocks that already exist.
+type WriteInterceptor func(ctx context.Context, blockID string, data []byte) error
+
+// SetWriteInterceptor installs the function invoked before new blocks are written, nil removes it.
+// The interceptor is invoked without holding the manager lock, so it may call other methods of the manager.
+func (bm *Manager) SetWriteInterceptor(f WriteInterceptor) {
+	bm.lock()
+	defer bm.unlock()
+	bm.writeInterceptor = f
+}
+
 // RewriteBlock causes reads and re-writes a given block using the most recent format.
 func (bm *Manager) RewriteBlock(ctx context.Context, blockID string) error {
 	bi, err := bm.getBlockInfo(blockID)
@@ -616,31 +998,61 @@ func (bm *Manager) RewriteBlock(ctx context.Context, blockID string) error {
 
 	bm.lock()
 	defer bm.unlock()
-	return bm.addToPackLocked(ctx, blockID, data, bi.Deleted)
+	return bm.addToPackLocked(ctx, blockID, data, bi.Deleted, bi.Provisional)
 }
 
 // WriteBlock saves a given block of data to a pack group with a provided name and returns a blockID
 // that's based on the contents of data written.
 func (bm *Manager) WriteBlock(ctx context.Context, data []byte, prefix string) (string, error) {
+	return bm.writeBlock(ctx, data, prefix, false)
+}
+
+func (bm *Manager) writeBlock(ctx context.Context, data []byte, prefix string, provisional bool) (string, error) {
 	if err := validatePrefix(prefix); err != nil {
 		return "", err
 	}
+	t0 := time.Now()
 	blockID := prefix + hex.EncodeToString(bm.hashData(data))
+	recordTiming(timingsFromContext(ctx).hashing(), t0)
 
 	// block already tracked
 	if bi, err := bm.getBlockInfo(blockID); err == nil {
 		if !bi.Deleted {
+			if bi.Provisional && !provisional {
+				// writing the block again confirms it.
+				return blockID, bm.ConfirmBlock(ctx, blockID)
+			}
+
 			return blockID, nil
 		}
 	}
 
 	log.Debugf("WriteBlock(%q) - new", blockID)
+	bm.lock()
+	interceptor := bm.writeInterceptor
+	bm.unlock()
+
+	if interceptor != nil {
+		if err := interceptor(ctx, blockID, data); err != nil {
+			return "", errors.Wrapf(err, "write of block %q rejected", blockID)
+		}
+	}
+
 	bm.lock()
 	defer bm.unlock()
-	err := bm.addToPackLocked(ctx, blockID, data, false)
+	err := bm.addToPackLocked(ctx, blockID, data, false, provisional)
 	return blockID, err
 }
 
+// BlockIDForData returns the block ID that WriteBlock() would assign to the provided data, without writing it.
+func (bm *Manager) BlockIDForData(data []byte, prefix string) (string, error) {
+	if err := validatePrefix(prefix); err != nil {
+		return "", err
+	}
+
+	return prefix + hex.EncodeToString(bm.hashData(data)), nil
+}
+
 func validatePrefix(prefix string) error {
 	switch len(prefix) {
 	case 0:
@@ -658,6 +1070,7 @@ func (bm *Manager) writePackFileNotLocked(ctx context.Context, packFile string,
 	atomic.AddInt32(&bm.stats.WrittenBlocks, 1)
 	atomic.AddInt64(&bm.stats.WrittenBytes, int64(len(data)))
 	bm.listCache.deleteListCache(ctx)
+	defer recordTiming(timingsFromContext(ctx).storage(), time.Now())
 	return bm.st.PutBlock(ctx, packFile, data)
 }
 
@@ -666,8 +1079,11 @@ func (bm *Manager) encryptAndWriteBlockNotLocked(ctx context.Context, data []byt
 	physicalBlockID := prefix + hex.EncodeToString(hash)
 
 	// Encrypt the block in-place.
+	timings := timingsFromContext(ctx)
+	t0 := time.Now()
 	atomic.AddInt64(&bm.stats.EncryptedBytes, int64(len(data)))
 	data2, err := bm.encryptor.Encrypt(data, hash)
+	recordTiming(timings.encryption(), t0)
 	if err != nil {
 		return "", err
 	}
@@ -675,7 +1091,10 @@ func (bm *Manager) encryptAndWriteBlockNotLocked(ctx context.Context, data []byt
 	atomic.AddInt32(&bm.stats.WrittenBlocks, 1)
 	atomic.AddInt64(&bm.stats.WrittenBytes, int64(len(data)))
 	bm.listCache.deleteListCache(ctx)
-	if err := bm.st.PutBlock(ctx, physicalBlockID, data2); err != nil {
+	t0 = time.Now()
+	err = bm.st.PutBlock(ctx, physicalBlockID, data2)
+	recordTiming(timings.storage(), t0)
+	if err != nil {
 		return "", err
 	}
 
@@ -701,11 +1120,20 @@ func (bm *Manager) GetBlock(ctx context.Context, blockID string) ([]byte, error)
 		return nil, err
 	}
 
-	if bi.Deleted {
+	if bi.Deleted || bm.isHiddenProvisional(bi) {
 		return nil, storage.ErrBlockNotFound
 	}
 
-	return bm.getBlockContentsUnlocked(ctx, bi)
+	b, err := bm.getBlockContentsUnlocked(ctx, bi)
+	if err == storage.ErrBlockNotFound && bi.PackFile != "" {
+		// the pack may have been repacked and deleted after we looked up the block, retry using current index.
+		if bi2, err2 := bm.getBlockInfo(blockID); err2 == nil && !bi2.Deleted && bi2.PackFile != bi.PackFile {
+			log.Debugf("pack %v of block %q not found, retrying with %v", bi.PackFile, blockID, bi2.PackFile)
+			return bm.getBlockContentsUnlocked(ctx, bi2)
+		}
+	}
+
+	return b, err
 }
 
 func (bm *Manager) getBlockInfo(blockID string) (Info, error) {
@@ -734,6 +1162,11 @@ func (bm *Manager) BlockInfo(ctx context.Context, blockID string) (Info, error)
 		return Info{}, err
 	}
 
+	if bm.isHiddenProvisional(bi) {
+		log.Debugf("BlockInfo(%q) - provisional", blockID)
+		return Info{}, storage.ErrBlockNotFound
+	}
+
 	if bi.Deleted {
 		log.Debugf("BlockInfo(%q) - deleted", blockID)
 	} else {
@@ -743,8 +1176,52 @@ func (bm *Manager) BlockInfo(ctx context.Context, blockID string) (Info, error)
 	return bi, err
 }
 
+// BlockExists determines whether the provided block exists and has not been deleted, using only the pending
+// and committed indexes, so the payload of the block is never read from the storage.
+func (bm *Manager) BlockExists(ctx context.Context, blockID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	bi, err := bm.getBlockInfo(blockID)
+	if err == storage.ErrBlockNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return !bi.Deleted && !bm.isHiddenProvisional(bi), nil
+}
+
 // FindUnreferencedStorageFiles returns the list of unreferenced storage blocks.
 func (bm *Manager) FindUnreferencedStorageFiles(ctx context.Context) ([]storage.BlockMetadata, error) {
+	return bm.FindOrphanedPacks(ctx)
+}
+
+// ReferencedPackFiles returns the sorted list of distinct pack files referenced by the index entries,
+// including entries for deleted blocks and entries that have not been committed yet.
+func (bm *Manager) ReferencedPackFiles(ctx context.Context) ([]string, error) {
+	infos, err := bm.ListBlockInfos("", true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list index blocks: %v", err)
+	}
+
+	var result []string
+	for packFile := range findPackBlocksInUse(infos) {
+		if packFile != "" {
+			result = append(result, packFile)
+		}
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// FindOrphanedPacks returns the list of pack storage blocks that are not referenced by any index entry.
+// This is the complement of ReferencedPackFiles() with respect to all pack blocks in the storage.
+func (bm *Manager) FindOrphanedPacks(ctx context.Context) ([]storage.BlockMetadata, error) {
 	infos, err := bm.ListBlockInfos("", true)
 	if err != nil {
 		return nil, fmt.Errorf("unable to list index blocks: %v", err)
@@ -754,6 +1231,11 @@ func (bm *Manager) FindUnreferencedStorageFiles(ctx context.Context) ([]storage.
 
 	var unused []storage.BlockMetadata
 	err = bm.st.ListBlocks(ctx, PackBlockPrefix, func(bi storage.BlockMetadata) error {
+		if !isStorageBlockName(bi.BlockID, PackBlockPrefix) {
+			log.Debugf("ignoring foreign block %q", bi.BlockID)
+			return nil
+		}
+
 		u := usedPackBlocks[bi.BlockID]
 		if u > 0 {
 			log.Debugf("pack %v, in use by %v blocks", bi.BlockID, u)
@@ -770,6 +1252,67 @@ func (bm *Manager) FindUnreferencedStorageFiles(ctx context.Context) ([]storage.
 	return unused, nil
 }
 
+// UnreferencedPack describes a pack storage block that is not referenced by any index entry.
+type UnreferencedPack struct {
+	storage.BlockMetadata
+	Age time.Duration // time elapsed since the pack was written
+}
+
+// FindUnreferencedPacks returns pack storage blocks that are not referenced by any index entry, along with
+// their ages. Packs being written by a flush in progress, here or on another host, are not referenced yet
+// either, so unreferenced packs should only be deleted using DeleteUnreferencedPacks() with a safety margin.
+func (bm *Manager) FindUnreferencedPacks(ctx context.Context) ([]UnreferencedPack, error) {
+	orphaned, err := bm.FindOrphanedPacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := bm.timeNow()
+
+	var result []UnreferencedPack
+	for _, m := range orphaned {
+		result = append(result, UnreferencedPack{BlockMetadata: m, Age: now.Sub(m.Timestamp)})
+	}
+
+	return result, nil
+}
+
+// DeleteUnreferencedPacks deletes pack storage blocks that are not referenced by any index entry and are
+// at least minAge old, which should exceed the time it takes to flush to avoid deleting packs whose index
+// has not been written yet. The indexes are refreshed first, so that packs referenced by indexes written
+// by other hosts are not deleted. Returns the IDs of the deleted packs.
+func (bm *Manager) DeleteUnreferencedPacks(ctx context.Context, minAge time.Duration) ([]string, error) {
+	if minAge < 0 {
+		return nil, fmt.Errorf("invalid minimum age: %v", minAge)
+	}
+
+	if _, err := bm.Refresh(ctx); err != nil {
+		return nil, errors.Wrap(err, "unable to refresh indexes")
+	}
+
+	unreferenced, err := bm.FindUnreferencedPacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, p := range unreferenced {
+		if p.Age < minAge {
+			log.Debugf("not deleting unreferenced pack %v, which is only %v old", p.BlockID, p.Age)
+			continue
+		}
+
+		log.Debugf("deleting unreferenced pack %v", p.BlockID)
+		if err := bm.st.DeleteBlock(ctx, p.BlockID); err != nil {
+			return deleted, fmt.Errorf("unable to delete pack %v: %v", p.BlockID, err)
+		}
+
+		deleted = append(deleted, p.BlockID)
+	}
+
+	return deleted, nil
+}
+
 func findPackBlocksInUse(infos []Info) map[string]int {
 	packUsage := map[string]int{}
 
@@ -785,7 +1328,11 @@ func (bm *Manager) getBlockContentsUnlocked(ctx context.Context, bi Info) ([]byt
 		return cloneBytes(bi.Payload), nil
 	}
 
-	payload, err := bm.blockCache.getContentBlock(ctx, bi.BlockID, bi.PackFile, int64(bi.PackOffset), int64(bi.Length))
+	if bm.isQuarantined(ctx, bi.PackFile) {
+		return nil, errors.Wrapf(ErrBlockQuarantined, "pack %v of block %q", bi.PackFile, bi.BlockID)
+	}
+
+	payload, err := bm.blockCache.getContentBlock(ctx, bi.BlockID, bi.PackFile, int64(bi.PackOffset), int64(bm.storedLength(bi)))
 	if err != nil {
 		return nil, err
 	}
@@ -798,7 +1345,10 @@ func (bm *Manager) getBlockContentsUnlocked(ctx context.Context, bi Info) ([]byt
 		return nil, err
 	}
 
-	decrypted, err := bm.decryptAndVerify(payload, iv)
+	decrypted, err := bm.decryptAndVerifyBlock(bi, payload, iv)
+	if errors.Cause(err) == errInvalidChecksum && bm.shouldQuarantineOnCorruption() {
+		return bm.confirmCorruptionAndQuarantine(ctx, bi, iv)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("invalid checksum at %v offset %v length %v: %v", bi.PackFile, bi.PackOffset, len(payload), err)
 	}
@@ -806,25 +1356,16 @@ func (bm *Manager) getBlockContentsUnlocked(ctx context.Context, bi Info) ([]byt
 	return decrypted, nil
 }
 
-func (bm *Manager) decryptAndVerify(encrypted []byte, iv []byte) ([]byte, error) {
-	decrypted, err := bm.encryptor.Decrypt(encrypted, iv)
-	if err != nil {
-		return nil, err
-	}
-
-	atomic.AddInt64(&bm.stats.DecryptedBytes, int64(len(decrypted)))
-
-	// Since the encryption key is a function of data, we must be able to generate exactly the same key
-	// after decrypting the content. This serves as a checksum.
-	return decrypted, bm.verifyChecksum(decrypted, iv)
-}
-
 func (bm *Manager) getPhysicalBlockInternal(ctx context.Context, blockID string) ([]byte, error) {
 	payload, err := bm.blockCache.getContentBlock(ctx, blockID, blockID, 0, -1)
 	if err != nil {
 		return nil, err
 	}
 
+	return bm.decryptAndVerifyPhysicalBlock(blockID, payload)
+}
+
+func (bm *Manager) decryptAndVerifyPhysicalBlock(blockID string, payload []byte) ([]byte, error) {
 	iv, err := getPhysicalBlockIV(blockID)
 	if err != nil {
 		return nil, err
@@ -833,19 +1374,7 @@ func (bm *Manager) getPhysicalBlockInternal(ctx context.Context, blockID string)
 	atomic.AddInt32(&bm.stats.ReadBlocks, 1)
 	atomic.AddInt64(&bm.stats.ReadBytes, int64(len(payload)))
 
-	payload, err = bm.encryptor.Decrypt(payload, iv)
-	atomic.AddInt64(&bm.stats.DecryptedBytes, int64(len(payload)))
-	if err != nil {
-		return nil, err
-	}
-
-	// Since the encryption key is a function of data, we must be able to generate exactly the same key
-	// after decrypting the content. This serves as a checksum.
-	if err := bm.verifyChecksum(payload, iv); err != nil {
-		return nil, err
-	}
-
-	return payload, nil
+	return bm.decryptAndVerifyAnyVersion(payload, iv)
 }
 
 func getPackedBlockIV(blockID string) ([]byte, error) {
@@ -859,15 +1388,13 @@ func getPhysicalBlockIV(s string) ([]byte, error) {
 	return hex.DecodeString(s[len(s)-(aes.BlockSize*2):])
 }
 
-func (bm *Manager) verifyChecksum(data []byte, blockID []byte) error {
-	expected := bm.hasher(data)
+func verifyHashChecksum(hasher HashFunc, data []byte, blockID []byte) error {
+	expected := hasher(data)
 	expected = expected[len(expected)-aes.BlockSize:]
 	if !bytes.HasSuffix(blockID, expected) {
-		atomic.AddInt32(&bm.stats.InvalidBlocks, 1)
-		return fmt.Errorf("invalid checksum for blob %x, expected %x", blockID, expected)
+		return errors.Wrapf(errInvalidChecksum, "blob %x, expected %x", blockID, expected)
 	}
 
-	atomic.AddInt32(&bm.stats.ValidBlocks, 1)
 	return nil
 }
 
@@ -903,6 +1430,16 @@ func (bm *Manager) Refresh(ctx context.Context) (bool, error) {
 	return updated, err
 }
 
+// PurgeIndexCache removes all locally cached index blocks that are not currently in use.
+// Purged index blocks will be re-fetched from the storage when they are needed again.
+func (bm *Manager) PurgeIndexCache(ctx context.Context) error {
+	bm.lock()
+	defer bm.unlock()
+
+	log.Debugf("PurgeIndexCache()")
+	return bm.committedBlocks.purgeUnused()
+}
+
 type cachedList struct {
 	Timestamp time.Time   `json:"timestamp"`
 	Blocks    []IndexInfo `json:"blocks"`
@@ -910,7 +1447,7 @@ type cachedList struct {
 
 // listIndexBlocksFromStorage returns the list of index blocks in the given storage.
 // The list of blocks is not guaranteed to be sorted.
-func listIndexBlocksFromStorage(ctx context.Context, st storage.Storage) ([]IndexInfo, error) {
+func listIndexBlocksFromStorage(ctx context.Context, st storage.Storage, indexSets bool) ([]IndexInfo, error) {
 	snapshot, err := storage.ListAllBlocksConsistent(ctx, st, newIndexBlockPrefix, math.MaxInt32)
 	if err != nil {
 		return nil, err
@@ -918,6 +1455,11 @@ func listIndexBlocksFromStorage(ctx context.Context, st storage.Storage) ([]Inde
 
 	var results []IndexInfo
 	for _, it := range snapshot {
+		if !isStorageBlockName(it.BlockID, newIndexBlockPrefix) {
+			log.Debugf("ignoring foreign block %q", it.BlockID)
+			continue
+		}
+
 		ii := IndexInfo{
 			FileName:  it.BlockID,
 			Timestamp: it.Timestamp,
@@ -926,7 +1468,37 @@ func listIndexBlocksFromStorage(ctx context.Context, st storage.Storage) ([]Inde
 		results = append(results, ii)
 	}
 
-	return results, err
+	if !indexSets {
+		return results, nil
+	}
+
+	is, _, err := readCurrentIndexSet(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+
+	if is == nil {
+		return results, nil
+	}
+
+	return applyIndexSet(ctx, st, is, results)
+}
+
+// isStorageBlockName determines whether the provided storage block ID consists of the prefix followed by
+// a hexadecimal string, which is how the block manager names storage blocks. Storage shared with other applications
+// may contain foreign blocks with the same prefixes, which must be ignored.
+func isStorageBlockName(blockID, prefix string) bool {
+	if !strings.HasPrefix(blockID, prefix) || len(blockID) == len(prefix) {
+		return false
+	}
+
+	for _, c := range blockID[len(prefix):] {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
 }
 
 // NewManager creates new block manager with given packing options and a formatter.
@@ -934,7 +1506,58 @@ func NewManager(ctx context.Context, st storage.Storage, f FormattingOptions, ca
 	return newManagerWithOptions(ctx, st, f, caching, time.Now, repositoryFormatBytes)
 }
 
+// NewManagerWithIndex creates new block manager that uses the provided index entries instead of loading the index
+// from the storage, which saves listing and downloading index blocks in short-lived processes that already know it,
+// such as ones started by a parent process that has the repository open. Refresh() loads the index from the storage.
+func NewManagerWithIndex(ctx context.Context, st storage.Storage, f FormattingOptions, caching CachingOptions, repositoryFormatBytes []byte, index []Info) (*Manager, error) {
+	m, err := createManager(ctx, st, f, caching, time.Now, repositoryFormatBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.useIndexEntries(index); err != nil {
+		return nil, errors.Wrap(err, "unable to use provided index")
+	}
+
+	m.maybeStartBackgroundUploads()
+	return m, nil
+}
+
+// useIndexEntries replaces the committed index with one consisting of the provided entries.
+func (bm *Manager) useIndexEntries(index []Info) error {
+	if len(index) == 0 {
+		return nil
+	}
+
+	bld := make(packIndexBuilder)
+	for _, i := range index {
+		bld.Add(i)
+	}
+
+	var buf bytes.Buffer
+	if err := bld.Build(&buf); err != nil {
+		return fmt.Errorf("unable to build index: %v", err)
+	}
+
+	data := buf.Bytes()
+	return bm.committedBlocks.addBlock(newIndexBlockPrefix+hex.EncodeToString(bm.hashData(data)), data, true)
+}
+
 func newManagerWithOptions(ctx context.Context, st storage.Storage, f FormattingOptions, caching CachingOptions, timeNow func() time.Time, repositoryFormatBytes []byte) (*Manager, error) {
+	m, err := createManager(ctx, st, f, caching, timeNow, repositoryFormatBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.CompactIndexes(ctx, autoCompactionOptions); err != nil {
+		return nil, errors.Wrap(err, "error initializing block manager")
+	}
+
+	m.maybeStartBackgroundUploads()
+	return m, nil
+}
+
+func createManager(ctx context.Context, st storage.Storage, f FormattingOptions, caching CachingOptions, timeNow func() time.Time, repositoryFormatBytes []byte) (*Manager, error) {
 	if f.Version < minSupportedReadVersion || f.Version > currentWriteVersion {
 		return nil, fmt.Errorf("can't handle repositories created using version %v (min supported %v, max supported %v)", f.Version, minSupportedReadVersion, maxSupportedReadVersion)
 	}
@@ -944,6 +1567,25 @@ func newManagerWithOptions(ctx context.Context, st storage.Storage, f Formatting
 		return nil, err
 	}
 
+	blockFormatVersion := f.BlockFormatVersion
+	if blockFormatVersion == 0 {
+		blockFormatVersion = byte(f.Version)
+	}
+
+	if blockFormatVersion > formatVersionMask {
+		return nil, fmt.Errorf("invalid block format version %v, must be at most %v", blockFormatVersion, formatVersionMask)
+	}
+
+	previousDecryptors, err := createPreviousDecryptors(f, blockFormatVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	compressor, err := createCompressor(f)
+	if err != nil {
+		return nil, err
+	}
+
 	blockCache, err := newBlockCache(ctx, st, caching)
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize block cache: %v", err)
@@ -953,6 +1595,7 @@ func newManagerWithOptions(ctx context.Context, st storage.Storage, f Formatting
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize list cache: %v", err)
 	}
+	listCache.indexSets = f.Version >= indexSetMinVersion
 
 	blockIndex, err := newCommittedBlockIndex(caching)
 	if err != nil {
@@ -964,10 +1607,15 @@ func newManagerWithOptions(ctx context.Context, st storage.Storage, f Formatting
 		timeNow:               timeNow,
 		flushPackIndexesAfter: timeNow().Add(flushPackIndexTimeout),
 		maxPackSize:           f.MaxPackSize,
+		maxInlinePayloadSize:  f.MaxInlinePayloadSize,
+		parallelIndexFetches:  parallelFetches,
+		caching:               caching,
 		encryptor:             encryptor,
+		decryptor:             encryptor,
 		hasher:                hasher,
 		currentPackItems:      make(map[string]Info),
 		packIndexBuilder:      make(packIndexBuilder),
+		uploadingPackItems:    make(map[string]*queuedPack),
 		committedBlocks:       blockIndex,
 		minPreambleLength:     defaultMinPreambleLength,
 		maxPreambleLength:     defaultMaxPreambleLength,
@@ -978,19 +1626,32 @@ func newManagerWithOptions(ctx context.Context, st storage.Storage, f Formatting
 		repositoryFormatBytes: repositoryFormatBytes,
 
 		writeFormatVersion:      int32(f.Version),
+		blockFormatVersion:      blockFormatVersion,
+		previousDecryptors:      previousDecryptors,
+		compressor:              compressor,
 		closed:                  make(chan struct{}),
 		checkInvariantsOnUnlock: os.Getenv("KOPIA_VERIFY_INVARIANTS") != "",
 	}
 
-	m.startPackIndexLocked()
+	if f.Decryptor != nil {
+		m.decryptor = f.Decryptor
+	}
 
-	if err := m.CompactIndexes(ctx, autoCompactionOptions); err != nil {
-		return nil, fmt.Errorf("error initializing block manager: %v", err)
+	m.strictIndexes = caching.StrictIndexes
+	m.maxIndexBlocks = caching.MaxIndexBlocks
+
+	if caching.ParallelIndexFetches > 0 {
+		m.parallelIndexFetches = caching.ParallelIndexFetches
 	}
+	m.caching.HMACSecret = nil
+
+	m.startPackIndexLocked()
 
 	return m, nil
 }
 
+// CreateHashAndEncryptor creates the hash function and encryptor registered with RegisterHash() and RegisterEncryption()
+// under the names in the provided options and returns an error if either of them is unknown or invalid.
 func CreateHashAndEncryptor(f FormattingOptions) (HashFunc, Encryptor, error) {
 	h, err := createHashFunc(f)
 	if err != nil {
@@ -1012,9 +1673,9 @@ func CreateHashAndEncryptor(f FormattingOptions) (HashFunc, Encryptor, error) {
 }
 
 func createHashFunc(f FormattingOptions) (HashFunc, error) {
-	h := hashFunctions[f.Hash]
+	h := hashFuncFactory(f.Hash)
 	if h == nil {
-		return nil, fmt.Errorf("unknown hash function %v", f.Hash)
+		return nil, fmt.Errorf("unknown hash function %q, supported: %v", f.Hash, strings.Join(SupportedHashAlgorithms(), ", "))
 	}
 
 	hashFunc, err := h(f)
@@ -1030,9 +1691,9 @@ func createHashFunc(f FormattingOptions) (HashFunc, error) {
 }
 
 func createEncryptor(f FormattingOptions) (Encryptor, error) {
-	e := encryptors[f.Encryption]
+	e := encryptorFactory(f.Encryption)
 	if e == nil {
-		return nil, fmt.Errorf("unknown encryption algorithm: %v", f.Encryption)
+		return nil, fmt.Errorf("unknown encryption algorithm %q, supported: %v", f.Encryption, strings.Join(SupportedEncryptionAlgorithms(), ", "))
 	}
 
 	return e(f)
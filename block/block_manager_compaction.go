@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/kopia/repo/storage"
 	"github.com/pkg/errors"
 )
 
@@ -20,6 +21,14 @@ type CompactOptions struct {
 	MaxSmallBlocks       int
 	AllBlocks            bool
 	SkipDeletedOlderThan time.Duration
+
+	// VerifyPacks confirms that each compacted entry exists at the claimed offset and length in the local index
+	// of its pack before the compacted index is written, dropping dangling entries of missing packs.
+	VerifyPacks bool
+
+	// ConflictRetries is the number of times a full compaction is retried after another writer replaced
+	// the index set concurrently, each time after reloading the committed indexes.
+	ConflictRetries int
 }
 
 // CompactIndexes performs compaction of index blocks ensuring that # of small blocks is between minSmallBlockCount and maxSmallBlockCount
@@ -29,18 +38,29 @@ func (bm *Manager) CompactIndexes(ctx context.Context, opt CompactOptions) error
 		return fmt.Errorf("invalid block counts")
 	}
 
-	indexBlocks, _, err := bm.loadPackIndexesUnlocked(ctx)
-	if err != nil {
-		return errors.Wrap(err, "error loading indexes")
-	}
+	for attempt := 0; ; attempt++ {
+		// the lock prevents replacing indexes committed by a concurrent Flush() with a stale list.
+		bm.mu.Lock()
+		indexBlocks, _, err := bm.loadPackIndexesUnlocked(ctx)
+		bm.mu.Unlock()
+		if err != nil {
+			return errors.Wrap(err, "error loading indexes")
+		}
 
-	blocksToCompact := bm.getBlocksToCompact(indexBlocks, opt)
+		blocksToCompact := bm.getBlocksToCompact(indexBlocks, opt)
 
-	if err := bm.compactAndDeleteIndexBlocks(ctx, blocksToCompact, opt); err != nil {
-		log.Warningf("error performing quick compaction: %v", err)
-	}
+		err = bm.compactAndDeleteIndexBlocks(ctx, blocksToCompact, opt)
+		if errors.Cause(err) == errIndexSetConflict && attempt < opt.ConflictRetries {
+			log.Debugf("retrying compaction after conflict: %v", err)
+			continue
+		}
 
-	return nil
+		if err != nil {
+			log.Warningf("error performing quick compaction: %v", err)
+		}
+
+		return nil
+	}
 }
 
 func (bm *Manager) getBlocksToCompact(indexBlocks []IndexInfo, opt CompactOptions) []IndexInfo {
@@ -98,11 +118,26 @@ func (bm *Manager) compactAndDeleteIndexBlocks(ctx context.Context, indexBlocks
 		}
 	}
 
+	if opt.VerifyPacks {
+		bm.dropDanglingIndexEntries(ctx, bld)
+	}
+
 	var buf bytes.Buffer
 	if err := bld.Build(&buf); err != nil {
 		return errors.Wrap(err, "unable to build an index")
 	}
 
+	if opt.AllBlocks && bm.writeFormatVersion >= indexSetMinVersion {
+		// full compaction replaces the entire index set at once.
+		compactedIndexBlock, err := bm.replaceIndexBlocks(ctx, indexBlocks, buf.Bytes())
+		if err != nil {
+			return errors.Wrap(err, "unable to replace index set")
+		}
+
+		formatLog.Debugf("replaced index set with %v in %v", compactedIndexBlock, time.Since(t0))
+		return nil
+	}
+
 	compactedIndexBlock, err := bm.writePackIndexesNew(ctx, buf.Bytes())
 	if err != nil {
 		return errors.Wrap(err, "unable to write compacted indexes")
@@ -132,7 +167,7 @@ func (bm *Manager) addIndexBlocksToBuilder(ctx context.Context, bld packIndexBui
 
 	index, err := openPackIndex(bytes.NewReader(data))
 	if err != nil {
-		return fmt.Errorf("unable to open index block %q: %v", indexBlock, err)
+		return fmt.Errorf("unable to open index block %q: %v", indexBlock.FileName, err)
 	}
 
 	_ = index.Iterate("", func(i Info) error {
@@ -146,3 +181,46 @@ func (bm *Manager) addIndexBlocksToBuilder(ctx context.Context, bld packIndexBui
 
 	return nil
 }
+
+// dropDanglingIndexEntries removes entries that don't exist in the local indexes of their packs from the provided builder.
+// Entries of packs that can't be verified for other reasons are kept.
+func (bm *Manager) dropDanglingIndexEntries(ctx context.Context, bld packIndexBuilder) {
+	byPack := map[string][]*Info{}
+	for _, i := range bld {
+		if !i.Deleted && i.PackFile != "" {
+			byPack[i.PackFile] = append(byPack[i.PackFile], i)
+		}
+	}
+
+	for packFile, infos := range byPack {
+		_, localIndexBytes, err := bm.readPackFileLocalIndex(ctx, packFile, 0)
+		if errors.Cause(err) == storage.ErrBlockNotFound {
+			for _, i := range infos {
+				log.Warningf("dropping index entry of block %q in missing pack %v", i.BlockID, packFile)
+				delete(bld, i.BlockID)
+			}
+			continue
+		}
+
+		if err != nil {
+			log.Warningf("unable to verify index entries in %v, keeping them: %v", packFile, err)
+			continue
+		}
+
+		ndx, err := openPackIndex(bytes.NewReader(localIndexBytes))
+		if err != nil {
+			log.Warningf("unable to open local index of %v, keeping its entries: %v", packFile, err)
+			continue
+		}
+
+		for _, i := range infos {
+			pi, err := ndx.GetInfo(i.BlockID)
+			if err != nil || pi == nil || pi.PackOffset != i.PackOffset || pi.Length != i.Length {
+				log.Warningf("dropping index entry of block %q not found at offset %v length %v in %v", i.BlockID, i.PackOffset, i.Length, packFile)
+				delete(bld, i.BlockID)
+			}
+		}
+
+		ndx.Close() //nolint:errcheck
+	}
+}
@@ -6,18 +6,23 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
-	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/kopia/repo/internal/storagetesting"
 	"github.com/kopia/repo/storage"
 	logging "github.com/op/go-logging"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -384,6 +389,63 @@ func TestBlockManagerConcurrency(t *testing.T) {
 	}
 }
 
+func TestBackgroundCompaction(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	st := storagetesting.NewMapStorage(data, keyTime, nil)
+	bm := newTestBlockManagerWithCaching(st, nil, CachingOptions{})
+
+	indexCount := func() int {
+		blocks, err := storage.ListAllBlocks(ctx, st, newIndexBlockPrefix)
+		if err != nil {
+			t.Fatalf("unable to list index blocks: %v", err)
+		}
+		return len(blocks)
+	}
+
+	var blockIDs []string
+	for i := 0; i < 10; i++ {
+		blockIDs = append(blockIDs, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+		assertNoError(t, bm.Flush(ctx))
+	}
+
+	if got, want := indexCount(), 10; got != want {
+		t.Fatalf("unexpected index count before compaction: %v, wanted %v", got, want)
+	}
+
+	if err := bm.StartBackgroundCompaction(ctx, 0, CompactOptions{}); err == nil {
+		t.Errorf("unexpected success starting compaction with zero interval")
+	}
+
+	assertNoError(t, bm.StartBackgroundCompaction(ctx, 5*time.Millisecond, CompactOptions{
+		MinSmallBlocks: 2,
+		MaxSmallBlocks: 2,
+	}))
+
+	// blocks written and flushed while compacting are not lost.
+	for i := 10; i < 20; i++ {
+		blockIDs = append(blockIDs, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+		assertNoError(t, bm.Flush(ctx))
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for indexCount() > 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got, want := indexCount(), 1; got != want {
+		t.Errorf("unexpected index count after background compaction: %v, wanted %v", got, want)
+	}
+
+	bm.Close()
+
+	bm2 := newTestBlockManager(data, keyTime, nil)
+	for i, blockID := range blockIDs {
+		verifyBlock(ctx, t, bm2, blockID, seededRandomData(i, 100))
+	}
+}
+
 func TestDeleteBlock(t *testing.T) {
 	ctx := context.Background()
 	data := map[string][]byte{}
@@ -408,6 +470,45 @@ func TestDeleteBlock(t *testing.T) {
 	verifyBlockNotFound(ctx, t, bm, block2)
 }
 
+func TestDeleteBlockKeepsPackAndResurrects(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+
+	// all managers share the clock, so that each entry is newer than the previous ones.
+	timeFunc := fakeTimeNowWithAutoAdvance(fakeTime, time.Second)
+	bm := newTestBlockManager(data, keyTime, timeFunc)
+
+	block1 := writeBlockAndVerify(ctx, t, bm, seededRandomData(10, 100))
+	assertNoError(t, bm.Flush(ctx))
+
+	bi, err := bm.BlockInfo(ctx, block1)
+	if err != nil {
+		t.Fatalf("unable to get block info: %v", err)
+	}
+
+	assertNoError(t, bm.DeleteBlock(block1))
+	assertNoError(t, bm.Flush(ctx))
+	verifyBlockNotFound(ctx, t, bm, block1)
+
+	// deletion only writes a newer index entry, the pack is kept until it's garbage-collected.
+	if _, ok := data[bi.PackFile]; !ok {
+		t.Errorf("pack %v of deleted block was removed", bi.PackFile)
+	}
+
+	bm = newTestBlockManager(data, keyTime, timeFunc)
+	verifyBlockNotFound(ctx, t, bm, block1)
+
+	// writing the same contents again adds a newer entry, which undeletes the block.
+	if got := writeBlockAndVerify(ctx, t, bm, seededRandomData(10, 100)); got != block1 {
+		t.Errorf("unexpected block ID of resurrected block: %v, wanted %v", got, block1)
+	}
+	assertNoError(t, bm.Flush(ctx))
+
+	bm = newTestBlockManager(data, keyTime, timeFunc)
+	verifyBlock(ctx, t, bm, block1, seededRandomData(10, 100))
+}
+
 func TestRewriteNonDeleted(t *testing.T) {
 	const stepBehaviors = 3
 
@@ -631,173 +732,1219 @@ func TestFindUnreferencedStorageFiles2(t *testing.T) {
 	verifyUnreferencedStorageFilesCount(ctx, t, bm, 0)
 }
 
-func dumpBlocks(t *testing.T, bm *Manager, caption string) {
-	t.Helper()
-	infos, err := bm.ListBlockInfos("", true)
+func TestReferencedPackFiles(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	for i := 0; i < 20; i++ {
+		writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 500))
+	}
+	assertNoError(t, bm.Flush(ctx))
+
+	var want []string
+	for k := range data {
+		if strings.HasPrefix(k, PackBlockPrefix) {
+			want = append(want, k)
+		}
+	}
+	sort.Strings(want)
+
+	if len(want) < 2 {
+		t.Fatalf("expected multiple pack files, got %v", want)
+	}
+
+	got, err := bm.ReferencedPackFiles(ctx)
 	if err != nil {
-		t.Errorf("error listing blocks: %v", err)
-		return
+		t.Fatalf("unable to get referenced pack files: %v", err)
 	}
 
-	log.Infof("**** dumping %v blocks %v", len(infos), caption)
-	for i, bi := range infos {
-		log.Debugf(" bi[%v]=%#v", i, bi)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected referenced pack files: %v, wanted %v", got, want)
 	}
-	log.Infof("finished dumping %v blocks", len(infos))
-}
 
-func verifyUnreferencedStorageFilesCount(ctx context.Context, t *testing.T, bm *Manager, want int) {
-	t.Helper()
-	unref, err := bm.FindUnreferencedStorageFiles(ctx)
+	orphanedPack := PackBlockPrefix + hashValue([]byte("orphan"))
+	data[orphanedPack] = []byte{1, 2, 3}
+
+	orphaned, err := bm.FindOrphanedPacks(ctx)
 	if err != nil {
-		t.Errorf("error in FindUnreferencedStorageFiles: %v", err)
+		t.Fatalf("unable to find orphaned packs: %v", err)
 	}
 
-	log.Infof("got %v expecting %v", unref, want)
-	if got := len(unref); got != want {
-		t.Errorf("invalid number of unreferenced blocks: %v, wanted %v", got, want)
+	if len(orphaned) != 1 || orphaned[0].BlockID != orphanedPack {
+		t.Errorf("unexpected orphaned packs: %v, wanted %v", orphaned, orphanedPack)
 	}
 }
 
-func TestBlockWriteAliasing(t *testing.T) {
+func TestUnreferencedPacks(t *testing.T) {
 	ctx := context.Background()
 	data := map[string][]byte{}
 	keyTime := map[string]time.Time{}
-	bm := newTestBlockManager(data, keyTime, fakeTimeNowFrozen(fakeTime))
 
-	blockData := []byte{100, 0, 0}
-	id1 := writeBlockAndVerify(ctx, t, bm, blockData)
-	blockData[0] = 101
-	id2 := writeBlockAndVerify(ctx, t, bm, blockData)
-	bm.Flush(ctx)
-	blockData[0] = 102
-	id3 := writeBlockAndVerify(ctx, t, bm, blockData)
-	blockData[0] = 103
-	id4 := writeBlockAndVerify(ctx, t, bm, blockData)
-	verifyBlock(ctx, t, bm, id1, []byte{100, 0, 0})
-	verifyBlock(ctx, t, bm, id2, []byte{101, 0, 0})
-	verifyBlock(ctx, t, bm, id3, []byte{102, 0, 0})
-	verifyBlock(ctx, t, bm, id4, []byte{103, 0, 0})
+	now := fakeTime
+	bm := newTestBlockManager(data, keyTime, func() time.Time { return now })
+
+	blockID := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	assertNoError(t, bm.Flush(ctx))
+
+	oldPack := PackBlockPrefix + hashValue([]byte("old"))
+	data[oldPack] = []byte{1, 2, 3}
+	keyTime[oldPack] = now
+
+	now = now.Add(2 * time.Hour)
+
+	youngPack := PackBlockPrefix + hashValue([]byte("young"))
+	data[youngPack] = []byte{4, 5, 6}
+	keyTime[youngPack] = now.Add(-time.Minute)
+
+	unreferenced, err := bm.FindUnreferencedPacks(ctx)
+	if err != nil {
+		t.Fatalf("unable to find unreferenced packs: %v", err)
+	}
+
+	ages := map[string]time.Duration{}
+	for _, p := range unreferenced {
+		ages[p.BlockID] = p.Age
+	}
+
+	if want := map[string]time.Duration{oldPack: 2 * time.Hour, youngPack: time.Minute}; !reflect.DeepEqual(ages, want) {
+		t.Errorf("unexpected unreferenced packs: %v, wanted %v", ages, want)
+	}
+
+	if _, err := bm.DeleteUnreferencedPacks(ctx, -time.Hour); err == nil {
+		t.Errorf("unexpected success deleting with invalid minimum age")
+	}
+
+	deleted, err := bm.DeleteUnreferencedPacks(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("unable to delete unreferenced packs: %v", err)
+	}
+
+	if !reflect.DeepEqual(deleted, []string{oldPack}) {
+		t.Errorf("unexpected deleted packs: %v, wanted %v", deleted, oldPack)
+	}
+
+	if _, ok := data[oldPack]; ok {
+		t.Errorf("old pack was not deleted")
+	}
+
+	if _, ok := data[youngPack]; !ok {
+		t.Errorf("young pack was deleted")
+	}
+
+	// the referenced pack is kept.
+	verifyBlock(ctx, t, newTestBlockManager(data, keyTime, nil), blockID, seededRandomData(1, 100))
 }
 
-func TestBlockReadAliasing(t *testing.T) {
+func TestReadDuringRepack(t *testing.T) {
 	ctx := context.Background()
 	data := map[string][]byte{}
 	keyTime := map[string]time.Time{}
-	bm := newTestBlockManager(data, keyTime, fakeTimeNowFrozen(fakeTime))
 
-	blockData := []byte{100, 0, 0}
-	id1 := writeBlockAndVerify(ctx, t, bm, blockData)
-	blockData2, err := bm.GetBlock(ctx, id1)
+	now := fakeTime
+	timeFunc := func() time.Time { return now }
+
+	bm := newTestBlockManager(data, keyTime, timeFunc)
+	b1 := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	b2 := writeBlockAndVerify(ctx, t, bm, seededRandomData(2, 100))
+	assertNoError(t, bm.Flush(ctx))
+
+	bi, err := bm.BlockInfo(ctx, b1)
 	if err != nil {
-		t.Fatalf("can't get block data: %v", err)
+		t.Fatalf("unable to get block info: %v", err)
 	}
+	oldPack := bi.PackFile
 
-	blockData2[0]++
-	verifyBlock(ctx, t, bm, id1, blockData)
-	bm.Flush(ctx)
-	verifyBlock(ctx, t, bm, id1, blockData)
+	// another reader that has loaded the index before the repack.
+	staleReader := newTestBlockManager(data, keyTime, timeFunc)
+
+	now = now.Add(time.Minute)
+	assertNoError(t, bm.RepackBlocks(ctx, []string{oldPack}))
+
+	bi, err = bm.BlockInfo(ctx, b1)
+	if err != nil {
+		t.Fatalf("unable to get block info: %v", err)
+	}
+	if bi.PackFile == oldPack {
+		t.Errorf("block was not moved to a new pack")
+	}
+
+	// the old pack is kept, so the reader with the stale index can still read all blocks.
+	if _, ok := data[oldPack]; !ok {
+		t.Fatalf("old pack was deleted during repacking")
+	}
+	verifyBlock(ctx, t, staleReader, b1, seededRandomData(1, 100))
+	verifyBlock(ctx, t, staleReader, b2, seededRandomData(2, 100))
+
+	// old pack is not deleted until the grace period elapses.
+	now = now.Add(30 * time.Minute)
+	deleted, err := bm.DeleteRepackedPacks(ctx, time.Hour)
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("unexpected result of deleting repacked packs before grace period: %v %v", deleted, err)
+	}
+
+	now = now.Add(time.Hour)
+	deleted, err = bm.DeleteRepackedPacks(ctx, time.Hour)
+	if err != nil || len(deleted) != 1 || deleted[0] != oldPack {
+		t.Errorf("unexpected result of deleting repacked packs: %v %v, wanted %v", deleted, err, oldPack)
+	}
+	if _, ok := data[oldPack]; ok {
+		t.Errorf("old pack was not deleted after grace period")
+	}
+	if _, ok := data[repackedPackPrefix+oldPack]; ok {
+		t.Errorf("repack marker was not deleted")
+	}
+
+	bm = newTestBlockManager(data, keyTime, timeFunc)
+	verifyBlock(ctx, t, bm, b1, seededRandomData(1, 100))
+	verifyBlock(ctx, t, bm, b2, seededRandomData(2, 100))
 }
 
-func TestVersionCompatibility(t *testing.T) {
-	for writeVer := minSupportedReadVersion; writeVer <= currentWriteVersion; writeVer++ {
-		t.Run(fmt.Sprintf("version-%v", writeVer), func(t *testing.T) {
-			verifyVersionCompat(t, writeVer)
-		})
+// slowPutStorage is a storage that blocks PutBlock() calls for blocks with a given prefix until the context is done.
+type slowPutStorage struct {
+	storage.Storage
+	slowPrefix string
+}
+
+func (s *slowPutStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	if s.slowPrefix != "" && strings.HasPrefix(id, s.slowPrefix) {
+		<-ctx.Done()
+		return ctx.Err()
 	}
+
+	return s.Storage.PutBlock(ctx, id, data)
 }
 
-func verifyVersionCompat(t *testing.T, writeVersion int) {
+func TestRewritePacks(t *testing.T) {
 	ctx := context.Background()
-
-	// create block manager that writes 'writeVersion' and reads all versions >= minSupportedReadVersion
 	data := map[string][]byte{}
 	keyTime := map[string]time.Time{}
-	mgr := newTestBlockManager(data, keyTime, nil)
-	mgr.writeFormatVersion = int32(writeVersion)
 
-	dataSet := map[string][]byte{}
+	now := fakeTime
+	timeFunc := func() time.Time { return now }
 
-	for i := 0; i < 3000000; i = (i + 1) * 2 {
-		data := make([]byte, i)
-		rand.Read(data)
+	packCount := func() int {
+		cnt := 0
+		for k := range data {
+			if strings.HasPrefix(k, PackBlockPrefix) {
+				cnt++
+			}
+		}
+		return cnt
+	}
 
-		cid, err := mgr.WriteBlock(ctx, data, "")
-		if err != nil {
-			t.Fatalf("unable to write %v bytes: %v", len(data), err)
+	bm := newTestBlockManager(data, keyTime, timeFunc)
+
+	// three packs of 4 blocks each, the first two of which have most of their blocks deleted.
+	var blockIDs []string
+	for p := 0; p < 3; p++ {
+		for i := 0; i < 4; i++ {
+			blockIDs = append(blockIDs, writeBlockAndVerify(ctx, t, bm, seededRandomData(p*4+i, 400)))
 		}
-		dataSet[cid] = data
+		assertNoError(t, bm.Flush(ctx))
 	}
-	verifyBlockManagerDataSet(ctx, t, mgr, dataSet)
 
-	// delete random 3 items (map iteration order is random)
-	cnt := 0
-	for blockID := range dataSet {
-		t.Logf("deleting %v", blockID)
-		assertNoError(t, mgr.DeleteBlock(blockID))
-		delete(dataSet, blockID)
-		cnt++
-		if cnt >= 3 {
-			break
+	now = now.Add(time.Minute)
+	deleted := map[int]bool{}
+	for i := 0; i < 8; i++ {
+		if i%4 != 0 {
+			deleted[i] = true
+			assertNoError(t, bm.DeleteBlock(blockIDs[i]))
 		}
 	}
-	if err := mgr.Flush(ctx); err != nil {
-		t.Fatalf("failed to flush: %v", err)
+	assertNoError(t, bm.Flush(ctx))
+
+	if got, want := packCount(), 3; got != want {
+		t.Fatalf("unexpected pack count: %v, wanted %v", got, want)
 	}
 
-	// create new manager that reads and writes using new version.
-	mgr = newTestBlockManager(data, keyTime, nil)
+	now = now.Add(time.Minute)
+	repacked, err := bm.RewritePacks(ctx, 0.15)
+	if err != nil || len(repacked) != 2 {
+		t.Fatalf("unexpected result of rewriting packs: %v %v", repacked, err)
+	}
 
-	// make sure we can read everything
-	verifyBlockManagerDataSet(ctx, t, mgr, dataSet)
+	// repacked packs are not rewritten again.
+	if again, err := bm.RewritePacks(ctx, 0.15); err != nil || len(again) != 0 {
+		t.Errorf("unexpected result of rewriting packs again: %v %v", again, err)
+	}
 
-	if err := mgr.CompactIndexes(ctx, CompactOptions{
-		MinSmallBlocks: 1,
-		MaxSmallBlocks: 1,
-	}); err != nil {
-		t.Fatalf("unable to compact indexes: %v", err)
+	deletedPacks, err := bm.DeleteRepackedPacks(ctx, 0)
+	if err != nil || len(deletedPacks) != 2 {
+		t.Errorf("unexpected result of deleting repacked packs: %v %v", deletedPacks, err)
 	}
-	if err := mgr.Flush(ctx); err != nil {
-		t.Fatalf("failed to flush: %v", err)
+
+	// the remaining live blocks of both sparse packs were rewritten into a single new pack.
+	if got, want := packCount(), 2; got != want {
+		t.Errorf("unexpected pack count after rewrite: %v, wanted %v", got, want)
 	}
-	verifyBlockManagerDataSet(ctx, t, mgr, dataSet)
 
-	// now open one more manager
-	mgr = newTestBlockManager(data, keyTime, nil)
-	verifyBlockManagerDataSet(ctx, t, mgr, dataSet)
+	bm = newTestBlockManager(data, keyTime, timeFunc)
+	for i, blockID := range blockIDs {
+		if deleted[i] {
+			verifyBlockNotFound(ctx, t, bm, blockID)
+		} else {
+			verifyBlock(ctx, t, bm, blockID, seededRandomData(i, 400))
+		}
+	}
 }
 
-func verifyBlockManagerDataSet(ctx context.Context, t *testing.T, mgr *Manager, dataSet map[string][]byte) {
-	for blockID, originalPayload := range dataSet {
-		v, err := mgr.GetBlock(ctx, blockID)
-		if err != nil {
-			t.Errorf("unable to read block %q: %v", blockID, err)
-			continue
-		}
+func TestWriteInterceptor(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
 
-		if !reflect.DeepEqual(v, originalPayload) {
-			t.Errorf("payload for %q does not match original: %v", v, originalPayload)
+	errTooLarge := errors.New("block too large")
+	bm.SetWriteInterceptor(func(ctx context.Context, blockID string, data []byte) error {
+		if len(data) > 100 {
+			return errTooLarge
 		}
+
+		return nil
+	})
+
+	small := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+
+	blockID, err := bm.WriteBlock(ctx, seededRandomData(2, 101), "")
+	if errors.Cause(err) != errTooLarge || blockID != "" {
+		t.Fatalf("unexpected result of rejected write: %q %v", blockID, err)
 	}
+
+	rejectedID, _ := bm.BlockIDForData(seededRandomData(2, 101), "")
+	verifyBlockNotFound(ctx, t, bm, rejectedID)
+	assertNoError(t, bm.Flush(ctx))
+
+	bm = newTestBlockManager(data, keyTime, nil)
+	verifyBlock(ctx, t, bm, small, seededRandomData(1, 100))
+	verifyBlockNotFound(ctx, t, bm, rejectedID)
+
+	// without the interceptor the block can be written.
+	writeBlockAndVerify(ctx, t, bm, seededRandomData(2, 101))
 }
 
-func newTestBlockManager(data map[string][]byte, keyTime map[string]time.Time, timeFunc func() time.Time) *Manager {
-	//st = logging.NewWrapper(st)
-	if timeFunc == nil {
-		timeFunc = fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+func TestFlushTimeout(t *testing.T) {
+	cases := []struct {
+		slowPrefix      string
+		wantPacks       int
+		wantErrContains string
+	}{
+		{PackBlockPrefix, 0, "nothing committed"},
+		{newIndexBlockPrefix, 1, "not committed"},
 	}
-	st := storagetesting.NewMapStorage(data, keyTime, timeFunc)
-	bm, err := newManagerWithOptions(context.Background(), st, FormattingOptions{
-		Hash:        "HMAC-SHA256",
-		Encryption:  "NONE",
-		HMACSecret:  hmacSecret,
-		MaxPackSize: maxPackSize,
-	}, CachingOptions{}, timeFunc, nil)
-	if err != nil {
-		panic("can't create block manager: " + err.Error())
+
+	for _, tc := range cases {
+		t.Run(tc.slowPrefix, func(t *testing.T) {
+			ctx := context.Background()
+			data := map[string][]byte{}
+			keyTime := map[string]time.Time{}
+			timeFunc := fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+			st := &slowPutStorage{Storage: storagetesting.NewMapStorage(data, keyTime, timeFunc)}
+
+			bm := newTestBlockManagerWithCaching(st, timeFunc, CachingOptions{})
+			bm.SetFlushTimeout(50 * time.Millisecond)
+
+			b1 := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+			b2 := writeBlockAndVerify(ctx, t, bm, seededRandomData(2, 100))
+
+			st.slowPrefix = tc.slowPrefix
+			err := bm.Flush(ctx)
+			if errors.Cause(err) != ErrFlushTimeout || !strings.Contains(err.Error(), tc.wantErrContains) {
+				t.Fatalf("unexpected flush error: %v, wanted %v", err, ErrFlushTimeout)
+			}
+
+			if got, want := len(data), tc.wantPacks; got != want {
+				t.Errorf("unexpected number of storage blocks after timeout: %v, wanted %v", got, want)
+			}
+
+			// nothing got committed, another block manager can't see the blocks.
+			bm2 := newTestBlockManager(data, keyTime, nil)
+			verifyBlockNotFound(ctx, t, bm2, b1)
+			verifyBlockNotFound(ctx, t, bm2, b2)
+
+			// blocks are still readable and will be flushed once the storage recovers.
+			verifyBlock(ctx, t, bm, b1, seededRandomData(1, 100))
+			st.slowPrefix = ""
+			assertNoError(t, bm.Flush(ctx))
+
+			bm2 = newTestBlockManager(data, keyTime, nil)
+			verifyBlock(ctx, t, bm2, b1, seededRandomData(1, 100))
+			verifyBlock(ctx, t, bm2, b2, seededRandomData(2, 100))
+		})
 	}
-	bm.checkInvariantsOnUnlock = true
-	return bm
+}
+
+func TestFlushStageOrder(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+	bm.SetVerifyPacksBeforeCommit(true)
+
+	var stages []FlushStage
+	bm.SetFlushHook(func(ctx context.Context, stage FlushStage) error {
+		stages = append(stages, stage)
+		return nil
+	})
+
+	writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	assertNoError(t, bm.Flush(ctx))
+
+	want := []FlushStage{FlushStageUploadPacks, FlushStageVerifyPacks, FlushStageCommitIndex}
+	if !reflect.DeepEqual(stages, want) {
+		t.Errorf("unexpected flush stages: %v, wanted %v", stages, want)
+	}
+}
+
+func TestFlushFailureBeforeIndexCommit(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	errInjected := errors.New("injected failure")
+	bm.SetFlushHook(func(ctx context.Context, stage FlushStage) error {
+		if stage == FlushStageCommitIndex {
+			return errInjected
+		}
+
+		return nil
+	})
+
+	b1 := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	if err := bm.Flush(ctx); err == nil || !strings.Contains(err.Error(), errInjected.Error()) {
+		t.Fatalf("unexpected flush error: %v, wanted %v", err, errInjected)
+	}
+
+	// the pack has been uploaded, but no index has been written.
+	for blockID := range data {
+		if !strings.HasPrefix(blockID, PackBlockPrefix) {
+			t.Errorf("unexpected storage block after failed flush: %v", blockID)
+		}
+	}
+
+	if len(data) != 1 {
+		t.Errorf("unexpected number of storage blocks after failed flush: %v, wanted 1", len(data))
+	}
+
+	verifyBlockNotFound(ctx, t, newTestBlockManager(data, keyTime, nil), b1)
+
+	// the block is still pending and gets committed by the next flush.
+	verifyBlock(ctx, t, bm, b1, seededRandomData(1, 100))
+	bm.SetFlushHook(nil)
+	assertNoError(t, bm.Flush(ctx))
+	verifyBlock(ctx, t, newTestBlockManager(data, keyTime, nil), b1, seededRandomData(1, 100))
+}
+
+func TestVerifyPacksBeforeCommit(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+	bm.SetVerifyPacksBeforeCommit(true)
+
+	// corrupt packs after they've been uploaded, but before their index is committed.
+	bm.SetFlushHook(func(ctx context.Context, stage FlushStage) error {
+		if stage == FlushStageVerifyPacks {
+			for blockID, b := range data {
+				if strings.HasPrefix(blockID, PackBlockPrefix) {
+					for i := range b {
+						b[i] ^= 0xff
+					}
+				}
+			}
+		}
+
+		return nil
+	})
+
+	b1 := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	if err := bm.Flush(ctx); err == nil || !strings.Contains(err.Error(), "failed verification") {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+
+	for blockID := range data {
+		if strings.HasPrefix(blockID, newIndexBlockPrefix) {
+			t.Errorf("unexpected index block after failed verification: %v", blockID)
+		}
+	}
+
+	verifyBlockNotFound(ctx, t, newTestBlockManager(data, keyTime, nil), b1)
+}
+
+func dumpBlocks(t *testing.T, bm *Manager, caption string) {
+	t.Helper()
+	infos, err := bm.ListBlockInfos("", true)
+	if err != nil {
+		t.Errorf("error listing blocks: %v", err)
+		return
+	}
+
+	log.Infof("**** dumping %v blocks %v", len(infos), caption)
+	for i, bi := range infos {
+		log.Debugf(" bi[%v]=%#v", i, bi)
+	}
+	log.Infof("finished dumping %v blocks", len(infos))
+}
+
+func verifyUnreferencedStorageFilesCount(ctx context.Context, t *testing.T, bm *Manager, want int) {
+	t.Helper()
+	unref, err := bm.FindUnreferencedStorageFiles(ctx)
+	if err != nil {
+		t.Errorf("error in FindUnreferencedStorageFiles: %v", err)
+	}
+
+	log.Infof("got %v expecting %v", unref, want)
+	if got := len(unref); got != want {
+		t.Errorf("invalid number of unreferenced blocks: %v, wanted %v", got, want)
+	}
+}
+
+func TestPurgeIndexCache(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+
+	cacheDir, err := ioutil.TempDir("", "kopia-cache")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(cacheDir) //nolint:errcheck
+
+	caching := CachingOptions{CacheDirectory: cacheDir}
+	bm := newTestBlockManagerWithCaching(storagetesting.NewMapStorage(data, keyTime, nil), nil, caching)
+
+	// produce several small index blocks, all of which end up in the cache.
+	var blockIDs []string
+	for i := 0; i < 3; i++ {
+		blockIDs = append(blockIDs, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+		assertNoError(t, bm.Flush(ctx))
+	}
+
+	assertNoError(t, bm.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1}))
+	if _, err := bm.Refresh(ctx); err != nil {
+		t.Fatalf("refresh error: %v", err)
+	}
+
+	if got, want := len(cachedIndexFiles(t, cacheDir)), 4; got != want {
+		t.Errorf("unexpected number of cached index files before purge: %v, wanted %v", got, want)
+	}
+
+	assertNoError(t, bm.PurgeIndexCache(ctx))
+
+	indexBlocks, err := bm.IndexBlocks(ctx)
+	if err != nil {
+		t.Fatalf("unable to list index blocks: %v", err)
+	}
+
+	var want []string
+	for _, ib := range indexBlocks {
+		want = append(want, ib.FileName)
+	}
+	sort.Strings(want)
+
+	if got := cachedIndexFiles(t, cacheDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected cached index files after purge: %v, wanted %v", got, want)
+	}
+
+	for i, blockID := range blockIDs {
+		verifyBlock(ctx, t, bm, blockID, seededRandomData(i, 100))
+	}
+
+	// remove everything from the cache, new manager must re-fetch indexes from storage.
+	assertNoError(t, os.RemoveAll(filepath.Join(cacheDir, "indexes")))
+	bm = newTestBlockManagerWithCaching(storagetesting.NewMapStorage(data, keyTime, nil), nil, caching)
+	for i, blockID := range blockIDs {
+		verifyBlock(ctx, t, bm, blockID, seededRandomData(i, 100))
+	}
+}
+
+func cachedIndexFiles(t *testing.T, cacheDir string) []string {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(filepath.Join(cacheDir, "indexes"))
+	if err != nil {
+		t.Fatalf("unable to list cache directory: %v", err)
+	}
+
+	var result []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), simpleIndexSuffix) {
+			result = append(result, strings.TrimSuffix(e.Name(), simpleIndexSuffix))
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func TestFindBlocks(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	var blockIDs []string
+	for i := 0; i < 100; i++ {
+		blockIDs = append(blockIDs, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 20)))
+		if i == 50 {
+			assertNoError(t, bm.Flush(ctx))
+		}
+	}
+
+	// delete one matching block, it should not be returned
+	deleted := blockIDs[3]
+	assertNoError(t, bm.DeleteBlock(deleted))
+
+	for _, prefix := range []string{"", deleted[0:1], blockIDs[7][0:2], blockIDs[60][0:2], "nosuchprefix"} {
+		var want []string
+		for _, b := range blockIDs {
+			if strings.HasPrefix(b, prefix) && b != deleted {
+				want = append(want, b)
+			}
+		}
+		sort.Strings(want)
+
+		infos, err := bm.FindBlocks(ctx, prefix)
+		if err != nil {
+			t.Fatalf("FindBlocks(%q) failed: %v", prefix, err)
+		}
+
+		var got []string
+		for _, bi := range infos {
+			got = append(got, bi.BlockID)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected result of FindBlocks(%q): %v, wanted %v", prefix, got, want)
+		}
+	}
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := bm.FindBlocks(canceledCtx, ""); errors.Cause(err) != context.Canceled {
+		t.Errorf("unexpected error of FindBlocks() with canceled context: %v", err)
+	}
+}
+
+type countingDecryptor struct {
+	Encryptor
+	calls int32
+}
+
+func (d *countingDecryptor) Decrypt(cipherText []byte, blockID []byte) ([]byte, error) {
+	atomic.AddInt32(&d.calls, 1)
+	return d.Encryptor.Decrypt(cipherText, blockID)
+}
+
+func TestListBlockInfos(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	var plain, prefixed []string
+	for i := 0; i < 3; i++ {
+		plain = append(plain, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+
+		blockID, err := bm.WriteBlock(ctx, seededRandomData(10+i, 100), "k")
+		if err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+		prefixed = append(prefixed, blockID)
+	}
+	assertNoError(t, bm.Flush(ctx))
+
+	// pending entries of committed blocks replace the committed entries in the listing.
+	assertNoError(t, bm.DeleteBlock(plain[0]))
+	assertNoError(t, bm.RewriteBlock(ctx, plain[1]))
+
+	verifyListing := func(desc string) {
+		t.Helper()
+
+		cases := []struct {
+			prefix         string
+			includeDeleted bool
+			want           []string
+		}{
+			{"", false, append([]string{plain[1], plain[2]}, prefixed...)},
+			{"", true, append(append([]string(nil), plain...), prefixed...)},
+			{"k", false, prefixed},
+			{"k", true, prefixed},
+			{"nosuchprefix", true, nil},
+		}
+
+		for _, tc := range cases {
+			want := append([]string(nil), tc.want...)
+			sort.Strings(want)
+
+			infos, err := bm.ListBlockInfos(tc.prefix, tc.includeDeleted)
+			if err != nil {
+				t.Fatalf("ListBlockInfos(%q, %v) failed: %v", tc.prefix, tc.includeDeleted, err)
+			}
+
+			var got []string
+			for _, bi := range infos {
+				got = append(got, bi.BlockID)
+				if bi.Deleted != (bi.BlockID == plain[0]) {
+					t.Errorf("%v: unexpected deleted flag of %v: %v", desc, bi.BlockID, bi.Deleted)
+				}
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: unexpected result of ListBlockInfos(%q, %v): %v, wanted %v", desc, tc.prefix, tc.includeDeleted, got, want)
+			}
+		}
+	}
+
+	verifyListing("pending")
+	assertNoError(t, bm.Flush(ctx))
+	verifyListing("committed")
+
+	bm = newTestBlockManager(data, keyTime, fakeTimeNowWithAutoAdvance(fakeTime.Add(time.Hour), time.Second))
+	verifyListing("reopened")
+}
+
+func TestBlockExists(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	st := &storagetesting.FaultyStorage{Base: storagetesting.NewMapStorage(data, keyTime, nil)}
+	bm := newTestBlockManagerWithCaching(st, nil, CachingOptions{})
+
+	flushed := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	deleted := writeBlockAndVerify(ctx, t, bm, seededRandomData(2, 100))
+	assertNoError(t, bm.Flush(ctx))
+	assertNoError(t, bm.DeleteBlock(deleted))
+
+	pending := writeBlockAndVerify(ctx, t, bm, seededRandomData(3, 100))
+	neverWritten, err := bm.BlockIDForData(seededRandomData(4, 100), "")
+	if err != nil {
+		t.Fatalf("unable to compute block ID: %v", err)
+	}
+
+	// checking existence never reads from the storage.
+	st.Faults = map[string][]*storagetesting.Fault{
+		"GetBlock": {{Repeat: 100, Err: errors.New("unexpected read")}},
+	}
+
+	for blockID, want := range map[string]bool{
+		pending:      true,
+		flushed:      true,
+		deleted:      false,
+		neverWritten: false,
+	} {
+		if got, err := bm.BlockExists(ctx, blockID); err != nil || got != want {
+			t.Errorf("unexpected result of BlockExists(%q): %v %v, wanted %v", blockID, got, err, want)
+		}
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := bm.BlockExists(canceled, flushed); err != context.Canceled {
+		t.Errorf("unexpected error with canceled context: %v", err)
+	}
+}
+
+func TestCustomDecryptor(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	st := storagetesting.NewMapStorage(data, keyTime, nil)
+
+	f := FormattingOptions{
+		Version:     1,
+		Hash:        "HMAC-SHA256-128",
+		Encryption:  "AES-256-CTR",
+		HMACSecret:  hmacSecret,
+		MasterKey:   make([]byte, 32),
+		MaxPackSize: maxPackSize,
+	}
+
+	bm, err := newManagerWithOptions(ctx, st, f, CachingOptions{}, fakeTimeNowFrozen(fakeTime), nil)
+	if err != nil {
+		t.Fatalf("can't create block manager: %v", err)
+	}
+
+	var blockIDs []string
+	for i := 0; i < 10; i++ {
+		blockID, err := bm.WriteBlock(ctx, seededRandomData(i, 100), "")
+		if err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+		blockIDs = append(blockIDs, blockID)
+	}
+	assertNoError(t, bm.Flush(ctx))
+
+	// the fake decryptor holds its own copy of the key, like an HSM would.
+	_, e, err := CreateHashAndEncryptor(f)
+	if err != nil {
+		t.Fatalf("unable to create encryptor: %v", err)
+	}
+
+	d := &countingDecryptor{Encryptor: e}
+	f.Decryptor = d
+	bm2, err := newManagerWithOptions(ctx, st, f, CachingOptions{}, fakeTimeNowFrozen(fakeTime), nil)
+	if err != nil {
+		t.Fatalf("can't create block manager: %v", err)
+	}
+
+	for i, b := range blockIDs {
+		verifyBlock(ctx, t, bm2, b, seededRandomData(i, 100))
+	}
+
+	// one decryption of the index block and one per block read.
+	if got, want := atomic.LoadInt32(&d.calls), int32(len(blockIDs)+1); got != want {
+		t.Errorf("unexpected number of decryptor calls: %v, wanted %v", got, want)
+	}
+}
+
+func TestBlockWriteAliasing(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, fakeTimeNowFrozen(fakeTime))
+
+	blockData := []byte{100, 0, 0}
+	id1 := writeBlockAndVerify(ctx, t, bm, blockData)
+	blockData[0] = 101
+	id2 := writeBlockAndVerify(ctx, t, bm, blockData)
+	bm.Flush(ctx)
+	blockData[0] = 102
+	id3 := writeBlockAndVerify(ctx, t, bm, blockData)
+	blockData[0] = 103
+	id4 := writeBlockAndVerify(ctx, t, bm, blockData)
+	verifyBlock(ctx, t, bm, id1, []byte{100, 0, 0})
+	verifyBlock(ctx, t, bm, id2, []byte{101, 0, 0})
+	verifyBlock(ctx, t, bm, id3, []byte{102, 0, 0})
+	verifyBlock(ctx, t, bm, id4, []byte{103, 0, 0})
+}
+
+func TestBlockReadAliasing(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, fakeTimeNowFrozen(fakeTime))
+
+	blockData := []byte{100, 0, 0}
+	id1 := writeBlockAndVerify(ctx, t, bm, blockData)
+	blockData2, err := bm.GetBlock(ctx, id1)
+	if err != nil {
+		t.Fatalf("can't get block data: %v", err)
+	}
+
+	blockData2[0]++
+	verifyBlock(ctx, t, bm, id1, blockData)
+	bm.Flush(ctx)
+	verifyBlock(ctx, t, bm, id1, blockData)
+}
+
+func TestVersionCompatibility(t *testing.T) {
+	for writeVer := minSupportedReadVersion; writeVer <= currentWriteVersion; writeVer++ {
+		t.Run(fmt.Sprintf("version-%v", writeVer), func(t *testing.T) {
+			verifyVersionCompat(t, writeVer)
+		})
+	}
+}
+
+func verifyVersionCompat(t *testing.T, writeVersion int) {
+	ctx := context.Background()
+
+	// create block manager that writes 'writeVersion' and reads all versions >= minSupportedReadVersion
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	mgr := newTestBlockManager(data, keyTime, nil)
+	mgr.writeFormatVersion = int32(writeVersion)
+
+	dataSet := map[string][]byte{}
+
+	for i := 0; i < 3000000; i = (i + 1) * 2 {
+		data := make([]byte, i)
+		rand.Read(data)
+
+		cid, err := mgr.WriteBlock(ctx, data, "")
+		if err != nil {
+			t.Fatalf("unable to write %v bytes: %v", len(data), err)
+		}
+		dataSet[cid] = data
+	}
+	verifyBlockManagerDataSet(ctx, t, mgr, dataSet)
+
+	// delete random 3 items (map iteration order is random)
+	cnt := 0
+	for blockID := range dataSet {
+		t.Logf("deleting %v", blockID)
+		assertNoError(t, mgr.DeleteBlock(blockID))
+		delete(dataSet, blockID)
+		cnt++
+		if cnt >= 3 {
+			break
+		}
+	}
+	if err := mgr.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	// create new manager that reads and writes using new version.
+	mgr = newTestBlockManager(data, keyTime, nil)
+
+	// make sure we can read everything
+	verifyBlockManagerDataSet(ctx, t, mgr, dataSet)
+
+	if err := mgr.CompactIndexes(ctx, CompactOptions{
+		MinSmallBlocks: 1,
+		MaxSmallBlocks: 1,
+	}); err != nil {
+		t.Fatalf("unable to compact indexes: %v", err)
+	}
+	if err := mgr.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	verifyBlockManagerDataSet(ctx, t, mgr, dataSet)
+
+	// now open one more manager
+	mgr = newTestBlockManager(data, keyTime, nil)
+	verifyBlockManagerDataSet(ctx, t, mgr, dataSet)
+}
+
+func TestAuthenticatedEncryptionDetectsTampering(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	st := storagetesting.NewMapStorage(data, nil, nil)
+
+	f := FormattingOptions{
+		Version:     1,
+		Hash:        "HMAC-SHA256-128",
+		Encryption:  "CHACHA20-POLY1305",
+		HMACSecret:  hmacSecret,
+		MasterKey:   make([]byte, 32),
+		MaxPackSize: maxPackSize,
+	}
+
+	bm, err := newManagerWithOptions(ctx, st, f, CachingOptions{}, fakeTimeNowFrozen(fakeTime), nil)
+	if err != nil {
+		t.Fatalf("can't create block manager: %v", err)
+	}
+
+	blockID, err := bm.WriteBlock(ctx, seededRandomData(1, 100), "")
+	if err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	verifyBlock(ctx, t, bm, blockID, seededRandomData(1, 100))
+
+	bi, err := bm.BlockInfo(ctx, blockID)
+	if err != nil {
+		t.Fatalf("unable to get block info: %v", err)
+	}
+
+	data[bi.PackFile][bi.PackOffset+bi.Length-1] ^= 1
+
+	bm, err = newManagerWithOptions(ctx, st, f, CachingOptions{}, fakeTimeNowFrozen(fakeTime), nil)
+	if err != nil {
+		t.Fatalf("can't create block manager: %v", err)
+	}
+
+	if _, err := bm.GetBlock(ctx, blockID); err == nil || !strings.Contains(err.Error(), "authentication of block") {
+		t.Errorf("unexpected error reading tampered block: %v", err)
+	}
+}
+
+func TestInlinePayloads(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	timeFunc := fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+	st := storagetesting.NewMapStorage(data, keyTime, timeFunc)
+
+	f := FormattingOptions{
+		Hash:                 "HMAC-SHA256",
+		Encryption:           "NONE",
+		HMACSecret:           hmacSecret,
+		MaxPackSize:          maxPackSize,
+		MaxInlinePayloadSize: 16,
+	}
+
+	newManager := func() *Manager {
+		bm, err := newManagerWithOptions(ctx, st, f, CachingOptions{}, timeFunc, nil)
+		if err != nil {
+			t.Fatalf("can't create block manager: %v", err)
+		}
+		bm.checkInvariantsOnUnlock = true
+		return bm
+	}
+
+	countPacks := func() int {
+		var count int
+		for k := range data {
+			if strings.HasPrefix(k, PackBlockPrefix) {
+				count++
+			}
+		}
+		return count
+	}
+
+	bm := newManager()
+	small := map[string][]byte{}
+	for _, b := range [][]byte{{}, []byte("a"), seededRandomData(1, 16)} {
+		small[writeBlockAndVerify(ctx, t, bm, b)] = b
+	}
+	assertNoError(t, bm.Flush(ctx))
+
+	if n := countPacks(); n != 0 {
+		t.Errorf("unexpected pack files written for small blocks: %v", n)
+	}
+
+	bm = newManager()
+	verifyBlockManagerDataSet(ctx, t, bm, small)
+	for blockID := range small {
+		if bi, err := bm.BlockInfo(ctx, blockID); err != nil || bi.PackFile != "" || bi.Payload == nil {
+			t.Errorf("unexpected info of inline block %v: %+v %v", blockID, bi, err)
+		}
+	}
+
+	// blocks above the threshold are packed.
+	large := seededRandomData(2, 17)
+	largeID := writeBlockAndVerify(ctx, t, bm, large)
+	smallID := writeBlockAndVerify(ctx, t, bm, seededRandomData(3, 5))
+	assertNoError(t, bm.DeleteBlock(seededBlockID(t, bm, 1, 16)))
+	assertNoError(t, bm.Flush(ctx))
+
+	if n := countPacks(); n != 1 {
+		t.Errorf("unexpected number of pack files: %v, wanted 1", n)
+	}
+
+	assertNoError(t, bm.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true}))
+
+	bm = newManager()
+	verifyBlock(ctx, t, bm, largeID, large)
+	verifyBlock(ctx, t, bm, smallID, seededRandomData(3, 5))
+	verifyBlockNotFound(ctx, t, bm, seededBlockID(t, bm, 1, 16))
+
+	if bi, err := bm.BlockInfo(ctx, largeID); err != nil || bi.PackFile == "" {
+		t.Errorf("unexpected info of packed block: %+v %v", bi, err)
+	}
+}
+
+func seededBlockID(t *testing.T, bm *Manager, seed, length int) string {
+	t.Helper()
+
+	blockID, err := bm.BlockIDForData(seededRandomData(seed, length), "")
+	if err != nil {
+		t.Fatalf("unable to compute block ID: %v", err)
+	}
+
+	return blockID
+}
+
+func verifyBlockManagerDataSet(ctx context.Context, t *testing.T, mgr *Manager, dataSet map[string][]byte) {
+	for blockID, originalPayload := range dataSet {
+		v, err := mgr.GetBlock(ctx, blockID)
+		if err != nil {
+			t.Errorf("unable to read block %q: %v", blockID, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(v, originalPayload) {
+			t.Errorf("payload for %q does not match original: %v", v, originalPayload)
+		}
+	}
+}
+
+func newTestBlockManager(data map[string][]byte, keyTime map[string]time.Time, timeFunc func() time.Time) *Manager {
+	if timeFunc == nil {
+		timeFunc = fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+	}
+	return newTestBlockManagerWithCaching(storagetesting.NewMapStorage(data, keyTime, timeFunc), timeFunc, CachingOptions{})
+}
+
+func newTestBlockManagerWithCaching(st storage.Storage, timeFunc func() time.Time, caching CachingOptions) *Manager {
+	return newTestBlockManagerWithVersion(st, timeFunc, caching, 0)
+}
+
+func newTestBlockManagerWithVersion(st storage.Storage, timeFunc func() time.Time, caching CachingOptions, version int) *Manager {
+	//st = logging.NewWrapper(st)
+	if timeFunc == nil {
+		timeFunc = fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second)
+	}
+	bm, err := newManagerWithOptions(context.Background(), st, FormattingOptions{
+		Version:     version,
+		Hash:        "HMAC-SHA256",
+		Encryption:  "NONE",
+		HMACSecret:  hmacSecret,
+		MaxPackSize: maxPackSize,
+	}, caching, timeFunc, nil)
+	if err != nil {
+		panic("can't create block manager: " + err.Error())
+	}
+	bm.checkInvariantsOnUnlock = true
+	return bm
+}
+
+func TestCompactionVerifyPacks(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	var blocks []string
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+		assertNoError(t, bm.Flush(ctx))
+	}
+
+	bi, err := bm.BlockInfo(ctx, blocks[1])
+	assertNoError(t, err)
+	delete(data, bi.PackFile)
+
+	// regular compaction keeps the dangling entry.
+	assertNoError(t, bm.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true}))
+	bm = newTestBlockManager(data, keyTime, nil)
+	if _, err := bm.BlockInfo(ctx, blocks[1]); err != nil {
+		t.Errorf("unexpected error getting info of block in missing pack: %v", err)
+	}
+
+	// write another index, so that there's something to compact.
+	blocks = append(blocks, writeBlockAndVerify(ctx, t, bm, seededRandomData(3, 100)))
+	assertNoError(t, bm.Flush(ctx))
+
+	assertNoError(t, bm.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true, VerifyPacks: true}))
+	if got, want := getIndexCount(data), 1; got != want {
+		t.Errorf("unexpected number of index blocks: %v, wanted %v", got, want)
+	}
+
+	bm = newTestBlockManager(data, keyTime, nil)
+	if _, err := bm.BlockInfo(ctx, blocks[1]); err != storage.ErrBlockNotFound {
+		t.Errorf("unexpected error getting info of dropped block: %v, wanted %v", err, storage.ErrBlockNotFound)
+	}
+
+	for i, b := range blocks {
+		if i != 1 {
+			verifyBlock(ctx, t, bm, b, seededRandomData(i, 100))
+		}
+	}
+}
+
+func TestForeignStorageBlocksIgnored(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	var blocks []string
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+		assertNoError(t, bm.Flush(ctx))
+	}
+
+	// objects of other applications sharing the bucket.
+	foreign := []string{"notes.txt", "n", "nABCD", "pictures/cat.jpg", "p0123-backup", "qrforeign", "readme"}
+	for _, id := range foreign {
+		data[id] = []byte("foreign object")
+		keyTime[id] = fakeTime
+	}
+
+	bm = newTestBlockManager(data, keyTime, nil)
+	for i, b := range blocks {
+		verifyBlock(ctx, t, bm, b, seededRandomData(i, 100))
+	}
+
+	assertNoError(t, bm.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true}))
+	indexBlocks, err := bm.IndexBlocks(ctx)
+	assertNoError(t, err)
+	if got, want := len(indexBlocks), 1; got != want {
+		t.Errorf("unexpected number of index blocks: %v, wanted %v", got, want)
+	}
+
+	orphaned, err := bm.FindOrphanedPacks(ctx)
+	assertNoError(t, err)
+	if len(orphaned) != 0 {
+		t.Errorf("unexpected orphaned packs: %v", orphaned)
+	}
+
+	if _, err := bm.Quarantined(ctx); err != nil {
+		t.Errorf("unable to list quarantined blocks: %v", err)
+	}
+
+	if _, err := bm.DeleteRepackedPacks(ctx, 0); err != nil {
+		t.Errorf("unable to delete repacked packs: %v", err)
+	}
+
+	bm = newTestBlockManager(data, keyTime, nil)
+	for i, b := range blocks {
+		verifyBlock(ctx, t, bm, b, seededRandomData(i, 100))
+	}
+
+	for _, id := range foreign {
+		if string(data[id]) != "foreign object" {
+			t.Errorf("foreign object %q was modified", id)
+		}
+	}
+}
+
+// indexAccessCountingStorage counts accesses to index blocks.
+type indexAccessCountingStorage struct {
+	storage.Storage
+	accesses int
+}
+
+func (s *indexAccessCountingStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	if strings.HasPrefix(id, newIndexBlockPrefix) {
+		s.accesses++
+	}
+
+	return s.Storage.GetBlock(ctx, id, offset, length)
+}
+
+func (s *indexAccessCountingStorage) ListBlocks(ctx context.Context, prefix string, cb func(storage.BlockMetadata) error) error {
+	if strings.HasPrefix(newIndexBlockPrefix, prefix) {
+		s.accesses++
+	}
+
+	return s.Storage.ListBlocks(ctx, prefix, cb)
+}
+
+func TestManagerWithIndex(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	var blocks []string
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+		assertNoError(t, bm.Flush(ctx))
+	}
+
+	index, err := bm.ListBlockInfos("", true)
+	assertNoError(t, err)
+
+	st := &indexAccessCountingStorage{Storage: storagetesting.NewMapStorage(data, keyTime, nil)}
+	bm2, err := NewManagerWithIndex(ctx, st, FormattingOptions{
+		Hash:        "HMAC-SHA256",
+		Encryption:  "NONE",
+		HMACSecret:  hmacSecret,
+		MaxPackSize: maxPackSize,
+	}, CachingOptions{}, nil, index)
+	assertNoError(t, err)
+
+	for i, b := range blocks {
+		verifyBlock(ctx, t, bm2, b, seededRandomData(i, 100))
+	}
+
+	if st.accesses != 0 {
+		t.Errorf("unexpected accesses to index blocks: %v", st.accesses)
+	}
+
+	// new blocks can be written and committed.
+	b := writeBlockAndVerify(ctx, t, bm2, seededRandomData(3, 100))
+	assertNoError(t, bm2.Flush(ctx))
+	verifyBlock(ctx, t, newTestBlockManager(data, keyTime, nil), b, seededRandomData(3, 100))
 }
 
 func getIndexCount(d map[string][]byte) int {
@@ -0,0 +1,91 @@
+package block
+
+import (
+	"context"
+
+	"github.com/kopia/repo/storage"
+)
+
+// WriteProvisionalBlock writes the provided block like WriteBlock(), but marks its index entry provisional,
+// which allows the entry to be committed before the durability of its pack has been confirmed.
+// Provisional blocks remain provisional until ConfirmBlock() is called or they are written again using WriteBlock().
+func (bm *Manager) WriteProvisionalBlock(ctx context.Context, data []byte, prefix string) (string, error) {
+	return bm.writeBlock(ctx, data, prefix, true)
+}
+
+// ConfirmBlock clears the provisional flag of the provided block. Entries that have already been committed
+// are superseded by a newer confirmed entry, which is committed by the next Flush().
+func (bm *Manager) ConfirmBlock(ctx context.Context, blockID string) error {
+	bm.lock()
+	defer bm.unlock()
+
+	if bi, ok := bm.currentPackItems[blockID]; ok {
+		if bi.Deleted {
+			return storage.ErrBlockNotFound
+		}
+
+		bi.Provisional = false
+		bm.setPendingBlock(bi)
+		return nil
+	}
+
+	if p, ok := bm.uploadingPackItems[blockID]; ok {
+		// the entry is added to the index being built once the upload of the pack completes.
+		item := p.items[blockID]
+		item.Provisional = false
+		p.items[blockID] = item
+		p.index[blockID].Provisional = false
+	}
+
+	if bi, ok := bm.packIndexBuilder[blockID]; ok {
+		if bi.Deleted {
+			return storage.ErrBlockNotFound
+		}
+
+		// the entry has not been committed yet, so it can be updated in place.
+		bi.Provisional = false
+		return nil
+	}
+
+	bi, err := bm.committedBlocks.getBlock(blockID)
+	if err != nil {
+		return err
+	}
+
+	if bi.Deleted {
+		return storage.ErrBlockNotFound
+	}
+
+	if !bi.Provisional {
+		return nil
+	}
+
+	// the confirmed entry must be newer than the provisional one to take precedence over it.
+	bi.Provisional = false
+	if now := bm.timeNow().Unix(); now > bi.TimestampSeconds {
+		bi.TimestampSeconds = now
+	} else {
+		bi.TimestampSeconds++
+	}
+
+	bm.packIndexBuilder.Add(bi)
+	return nil
+}
+
+// SetIgnoreProvisionalBlocks determines whether provisional blocks are treated as not found by GetBlock(),
+// BlockInfo() and ListBlocks(), which allows readers to only see blocks whose packs are known to be durable.
+func (bm *Manager) SetIgnoreProvisionalBlocks(ignore bool) {
+	bm.lock()
+	defer bm.unlock()
+	bm.ignoreProvisional = ignore
+}
+
+func (bm *Manager) isHiddenProvisional(bi Info) bool {
+	if !bi.Provisional {
+		return false
+	}
+
+	bm.lock()
+	defer bm.unlock()
+	return bm.ignoreProvisional
+}
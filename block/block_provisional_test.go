@@ -0,0 +1,106 @@
+package block
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProvisionalBlocks(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	b1Data := seededRandomData(1, 100)
+	b1, err := bm.WriteProvisionalBlock(ctx, b1Data, "")
+	if err != nil {
+		t.Fatalf("unable to write provisional block: %v", err)
+	}
+
+	// confirmed before the flush
+	b2Data := seededRandomData(2, 100)
+	b2, err := bm.WriteProvisionalBlock(ctx, b2Data, "")
+	assertNoError(t, err)
+	assertNoError(t, bm.ConfirmBlock(ctx, b2))
+
+	// confirmed by writing it again
+	b3Data := seededRandomData(3, 100)
+	b3, err := bm.WriteProvisionalBlock(ctx, b3Data, "")
+	assertNoError(t, err)
+	assertNoError(t, bm.Flush(ctx))
+
+	bm = newTestBlockManager(data, keyTime, nil)
+	verifyBlock(ctx, t, bm, b1, b1Data)
+	verifyBlockProvisional(ctx, t, bm, b1, true)
+	verifyBlockProvisional(ctx, t, bm, b2, false)
+	verifyBlockProvisional(ctx, t, bm, b3, true)
+
+	bm.SetIgnoreProvisionalBlocks(true)
+	verifyBlockNotFound(ctx, t, bm, b1)
+	verifyBlockNotFound(ctx, t, bm, b3)
+	verifyBlock(ctx, t, bm, b2, b2Data)
+
+	if blocks, err := bm.ListBlocks(""); err != nil || len(blocks) != 1 || blocks[0] != b2 {
+		t.Errorf("unexpected blocks listed when ignoring provisional blocks: %v %v, wanted %v", blocks, err, b2)
+	}
+
+	assertNoError(t, bm.ConfirmBlock(ctx, b1))
+	if _, err := bm.WriteBlock(ctx, b3Data, ""); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	verifyBlock(ctx, t, bm, b1, b1Data)
+	verifyBlock(ctx, t, bm, b3, b3Data)
+	assertNoError(t, bm.Flush(ctx))
+
+	bm = newTestBlockManager(data, keyTime, nil)
+	bm.SetIgnoreProvisionalBlocks(true)
+	verifyBlock(ctx, t, bm, b1, b1Data)
+	verifyBlock(ctx, t, bm, b2, b2Data)
+	verifyBlock(ctx, t, bm, b3, b3Data)
+	verifyBlockProvisional(ctx, t, bm, b1, false)
+	verifyBlockProvisional(ctx, t, bm, b3, false)
+
+	// confirmed entries survive compaction.
+	assertNoError(t, bm.CompactIndexes(ctx, CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1, AllBlocks: true}))
+	bm = newTestBlockManager(data, keyTime, nil)
+	bm.SetIgnoreProvisionalBlocks(true)
+	verifyBlock(ctx, t, bm, b1, b1Data)
+	verifyBlock(ctx, t, bm, b3, b3Data)
+}
+
+func TestProvisionalIndexEntry(t *testing.T) {
+	ndx, err := indexWithItems(
+		Info{BlockID: "ab", PackFile: "p1", TimestampSeconds: 12345, Provisional: true},
+		Info{BlockID: "cd", PackFile: "p1", TimestampSeconds: 12345},
+	)
+	if err != nil {
+		t.Fatalf("unable to build index: %v", err)
+	}
+	defer ndx.Close() //nolint:errcheck
+
+	for blockID, want := range map[string]bool{"ab": true, "cd": false} {
+		i, err := ndx.GetInfo(blockID)
+		if err != nil || i == nil {
+			t.Fatalf("unable to get info of %v: %v %v", blockID, i, err)
+		}
+
+		if i.Provisional != want || i.TimestampSeconds != 12345 {
+			t.Errorf("unexpected entry of %v: %+v, wanted provisional=%v", blockID, i, want)
+		}
+	}
+}
+
+func verifyBlockProvisional(ctx context.Context, t *testing.T, bm *Manager, blockID string, want bool) {
+	t.Helper()
+
+	bi, err := bm.BlockInfo(ctx, blockID)
+	if err != nil {
+		t.Fatalf("unable to get block info of %v: %v", blockID, err)
+	}
+
+	if bi.Provisional != want {
+		t.Errorf("unexpected provisional flag of %v: %v, wanted %v", blockID, bi.Provisional, want)
+	}
+}
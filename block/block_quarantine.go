@@ -0,0 +1,196 @@
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+// quarantineRecordPrefix is the prefix of the records describing quarantined storage blocks.
+const quarantineRecordPrefix = "qr"
+
+// ErrBlockQuarantined is returned when reading a block stored in a storage block that has been quarantined.
+var ErrBlockQuarantined = errors.New("block is quarantined")
+
+// QuarantinedBlock describes a storage block that has been quarantined.
+type QuarantinedBlock struct {
+	StorageBlockID string    `json:"storageBlockID"`
+	Length         int64     `json:"length"`
+	Reason         string    `json:"reason"`
+	Time           time.Time `json:"time"`
+}
+
+// SetQuarantineOnCorruption enables or disables automatic quarantine of pack blocks in which GetBlock() detects
+// a corrupt block. Corruption is only assumed after the block has been re-read directly from the storage,
+// bypassing the cache, and still fails checksum verification; decryption errors never cause a quarantine.
+// When enabled, reads of blocks stored in quarantined packs fail with ErrBlockQuarantined. Quarantine applies
+// to entire packs, so a single corrupt block makes all other blocks of its pack unreadable too.
+func (bm *Manager) SetQuarantineOnCorruption(enabled bool) {
+	bm.quarantinedMutex.Lock()
+	defer bm.quarantinedMutex.Unlock()
+	bm.quarantineOnCorruption = enabled
+}
+
+func (bm *Manager) shouldQuarantineOnCorruption() bool {
+	bm.quarantinedMutex.Lock()
+	defer bm.quarantinedMutex.Unlock()
+	return bm.quarantineOnCorruption
+}
+
+// QuarantineStorageBlock records the provided pack as quarantined along with the reason, so that automated retries
+// stop reading its blocks. The pack itself is left in place, so that it can be inspected by an operator.
+func (bm *Manager) QuarantineStorageBlock(ctx context.Context, storageBlockID string, reason string) error {
+	if !isPackBlockName(storageBlockID) {
+		return fmt.Errorf("%q is not a pack", storageBlockID)
+	}
+
+	length, err := bm.st.GetBlockSize(ctx, storageBlockID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get length of %v", storageBlockID)
+	}
+
+	qb := QuarantinedBlock{
+		StorageBlockID: storageBlockID,
+		Length:         length,
+		Reason:         reason,
+		Time:           bm.timeNow(),
+	}
+
+	rec, err := json.Marshal(qb)
+	if err != nil {
+		return errors.Wrap(err, "unable to serialize quarantine record")
+	}
+
+	if err := bm.st.PutBlock(ctx, quarantineRecordPrefix+storageBlockID, rec); err != nil {
+		return errors.Wrapf(err, "unable to write quarantine record of %v", storageBlockID)
+	}
+
+	bm.markQuarantined(storageBlockID)
+
+	log.Warningf("quarantined %v (%v bytes): %v", storageBlockID, length, reason)
+	return nil
+}
+
+// isPackBlockName determines whether the provided storage block ID is a name of a pack, the only storage blocks
+// that can be quarantined.
+func isPackBlockName(storageBlockID string) bool {
+	return isStorageBlockName(storageBlockID, PackBlockPrefix)
+}
+
+// confirmCorruptionAndQuarantine re-reads the provided block directly from the storage after it failed verification
+// and quarantines its pack if it is still corrupt. A copy that only failed verification because of a bad cache entry
+// is replaced and returned.
+func (bm *Manager) confirmCorruptionAndQuarantine(ctx context.Context, bi Info, iv []byte) ([]byte, error) {
+	payload, err := bm.st.GetBlock(ctx, bi.PackFile, int64(bi.PackOffset), int64(bm.storedLength(bi)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to re-read %v", bi.PackFile)
+	}
+
+	decrypted, err := bm.decryptAndVerifyBlock(bi, payload, iv)
+	if err == nil {
+		log.Warningf("cached copy of block %q was corrupt, using the copy from %v", bi.BlockID, bi.PackFile)
+		bm.blockCache.deleteContentBlock(ctx, bi.BlockID)
+		return decrypted, nil
+	}
+
+	corrupt := errors.Cause(err) == errInvalidChecksum
+	err = fmt.Errorf("invalid checksum at %v offset %v length %v: %v", bi.PackFile, bi.PackOffset, len(payload), err)
+	if !corrupt {
+		return nil, err
+	}
+
+	if qerr := bm.QuarantineStorageBlock(ctx, bi.PackFile, err.Error()); qerr != nil {
+		log.Warningf("unable to quarantine %v: %v", bi.PackFile, qerr)
+		return nil, err
+	}
+
+	return nil, errors.Wrapf(ErrBlockQuarantined, "%v", err)
+}
+
+// Quarantined returns the list of quarantined storage blocks sorted by storage block ID.
+func (bm *Manager) Quarantined(ctx context.Context) ([]QuarantinedBlock, error) {
+	records, err := storage.ListAllBlocks(ctx, bm.st, quarantineRecordPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list quarantine records")
+	}
+
+	var result []QuarantinedBlock
+	for _, r := range records {
+		if !isPackBlockName(strings.TrimPrefix(r.BlockID, quarantineRecordPrefix)) {
+			log.Debugf("ignoring foreign block %q", r.BlockID)
+			continue
+		}
+
+		qb, err := bm.readQuarantineRecord(ctx, strings.TrimPrefix(r.BlockID, quarantineRecordPrefix))
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, *qb)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StorageBlockID < result[j].StorageBlockID
+	})
+
+	return result, nil
+}
+
+func (bm *Manager) readQuarantineRecord(ctx context.Context, storageBlockID string) (*QuarantinedBlock, error) {
+	rec, err := bm.st.GetBlock(ctx, quarantineRecordPrefix+storageBlockID, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	qb := &QuarantinedBlock{}
+	if err := json.Unmarshal(rec, qb); err != nil {
+		return nil, errors.Wrapf(err, "invalid quarantine record of %v", storageBlockID)
+	}
+
+	return qb, nil
+}
+
+func (bm *Manager) markQuarantined(storageBlockID string) {
+	bm.quarantinedMutex.Lock()
+	defer bm.quarantinedMutex.Unlock()
+
+	if bm.quarantined == nil {
+		bm.quarantined = map[string]bool{}
+	}
+	bm.quarantined[storageBlockID] = true
+}
+
+// isQuarantined determines whether the provided storage block has been quarantined. When quarantine is enabled,
+// records written by other managers are loaded from the storage the first time.
+func (bm *Manager) isQuarantined(ctx context.Context, storageBlockID string) bool {
+	bm.quarantinedMutex.Lock()
+	defer bm.quarantinedMutex.Unlock()
+
+	if bm.quarantineOnCorruption && !bm.quarantineLoaded {
+		records, err := storage.ListAllBlocks(ctx, bm.st, quarantineRecordPrefix)
+		if err != nil {
+			log.Warningf("unable to list quarantine records: %v", err)
+			return bm.quarantined[storageBlockID]
+		}
+
+		if bm.quarantined == nil {
+			bm.quarantined = map[string]bool{}
+		}
+
+		for _, r := range records {
+			if id := strings.TrimPrefix(r.BlockID, quarantineRecordPrefix); isPackBlockName(id) {
+				bm.quarantined[id] = true
+			}
+		}
+
+		bm.quarantineLoaded = true
+	}
+
+	return bm.quarantined[storageBlockID]
+}
@@ -0,0 +1,161 @@
+package block
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+// corruptingReadStorage flips a bit in the first corruptReads reads of pack blocks.
+type corruptingReadStorage struct {
+	storage.Storage
+	corruptReads int
+}
+
+func (s *corruptingReadStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	b, err := s.Storage.GetBlock(ctx, id, offset, length)
+	if err == nil && s.corruptReads > 0 && strings.HasPrefix(id, PackBlockPrefix) {
+		s.corruptReads--
+		b = cloneBytes(b)
+		b[0] ^= 1
+	}
+
+	return b, err
+}
+
+// failingDecryptor fails all decryption attempts.
+type failingDecryptor struct{}
+
+func (failingDecryptor) Decrypt(cipherText []byte, blockID []byte) ([]byte, error) {
+	return nil, errors.New("decryption service unavailable")
+}
+
+func TestQuarantineCorruptBlock(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	b1 := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	b2 := writeBlockAndVerify(ctx, t, bm, seededRandomData(2, 100))
+	assertNoError(t, bm.Flush(ctx))
+
+	bi, err := bm.BlockInfo(ctx, b1)
+	if err != nil {
+		t.Fatalf("unable to get block info: %v", err)
+	}
+
+	if bi2, err := bm.BlockInfo(ctx, b2); err != nil || bi2.PackFile != bi.PackFile {
+		t.Fatalf("unexpected info of block sharing the pack: %+v %v", bi2, err)
+	}
+
+	// corrupt the block in storage.
+	original := cloneBytes(data[bi.PackFile])
+	data[bi.PackFile][bi.PackOffset] ^= 1
+
+	bm = newTestBlockManager(data, keyTime, nil)
+	bm.SetQuarantineOnCorruption(true)
+
+	if _, err := bm.GetBlock(ctx, b1); errors.Cause(err) != ErrBlockQuarantined {
+		t.Fatalf("unexpected error reading corrupt block: %v, wanted %v", err, ErrBlockQuarantined)
+	}
+
+	// the entire pack is quarantined, including intact blocks.
+	if _, err := bm.GetBlock(ctx, b2); errors.Cause(err) != ErrBlockQuarantined {
+		t.Errorf("unexpected error reading intact block of the quarantined pack: %v, wanted %v", err, ErrBlockQuarantined)
+	}
+
+	// the corrupt pack is left in place for inspection.
+	if _, ok := data[bi.PackFile]; !ok {
+		t.Errorf("corrupt pack %v was removed", bi.PackFile)
+	}
+
+	q, err := bm.Quarantined(ctx)
+	if err != nil {
+		t.Fatalf("unable to list quarantined blocks: %v", err)
+	}
+
+	if len(q) != 1 || q[0].StorageBlockID != bi.PackFile || q[0].Length != int64(len(original)) || !strings.Contains(q[0].Reason, "invalid checksum") {
+		t.Errorf("unexpected quarantined blocks: %+v", q)
+	}
+
+	// subsequent reads, including from other managers, fail without hitting the corrupt data.
+	data[bi.PackFile] = original
+	if _, err := bm.GetBlock(ctx, b1); errors.Cause(err) != ErrBlockQuarantined {
+		t.Errorf("unexpected error on retry: %v, wanted %v", err, ErrBlockQuarantined)
+	}
+
+	bm2 := newTestBlockManager(data, keyTime, nil)
+	bm2.SetQuarantineOnCorruption(true)
+	if _, err := bm2.GetBlock(ctx, b1); errors.Cause(err) != ErrBlockQuarantined {
+		t.Errorf("unexpected error from another manager: %v, wanted %v", err, ErrBlockQuarantined)
+	}
+
+	if err := bm.QuarantineStorageBlock(ctx, indexSetBlockPrefix+hashValue([]byte("index")), "test"); err == nil {
+		t.Errorf("unexpected success quarantining a storage block that is not a pack")
+	}
+}
+
+func TestQuarantineRequiresConfirmedCorruption(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	b1 := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	assertNoError(t, bm.Flush(ctx))
+
+	// a single bad read is retried directly from the storage.
+	st := &corruptingReadStorage{Storage: storagetesting.NewMapStorage(data, keyTime, nil), corruptReads: 1}
+	bm = newTestBlockManagerWithCaching(st, nil, CachingOptions{})
+	bm.SetQuarantineOnCorruption(true)
+	verifyBlock(ctx, t, bm, b1, seededRandomData(1, 100))
+
+	// decryption failures are not corruption.
+	bm = newTestBlockManager(data, keyTime, nil)
+	bm.SetQuarantineOnCorruption(true)
+	bm.decryptor = failingDecryptor{}
+	if _, err := bm.GetBlock(ctx, b1); err == nil || errors.Cause(err) == ErrBlockQuarantined {
+		t.Errorf("unexpected error reading with failing decryptor: %v", err)
+	}
+
+	q, err := bm.Quarantined(ctx)
+	if err != nil {
+		t.Fatalf("unable to list quarantined blocks: %v", err)
+	}
+
+	if len(q) != 0 {
+		t.Errorf("unexpected quarantined blocks: %+v", q)
+	}
+}
+
+func TestQuarantineDisabledByDefault(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	b1 := writeBlockAndVerify(ctx, t, bm, seededRandomData(1, 100))
+	assertNoError(t, bm.Flush(ctx))
+
+	bi, err := bm.BlockInfo(ctx, b1)
+	if err != nil {
+		t.Fatalf("unable to get block info: %v", err)
+	}
+
+	data[bi.PackFile][bi.PackOffset] ^= 1
+
+	bm = newTestBlockManager(data, keyTime, nil)
+	if _, err := bm.GetBlock(ctx, b1); err == nil || errors.Cause(err) == ErrBlockQuarantined {
+		t.Errorf("unexpected error reading corrupt block: %v", err)
+	}
+
+	if got, want := countBlocksWithPrefix(data, quarantineRecordPrefix), 0; got != want {
+		t.Errorf("unexpected number of quarantine records: %v, wanted %v", got, want)
+	}
+}
@@ -0,0 +1,186 @@
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+// repackedPackPrefix is the prefix of storage blocks marking pack files that have been repacked and are awaiting deletion.
+const repackedPackPrefix = "r"
+
+type repackedPackMarker struct {
+	PackFile   string    `json:"packFile"`
+	RepackTime time.Time `json:"repackTime"`
+}
+
+// RepackBlocks rewrites all blocks stored in the provided pack files into new packs and commits the index
+// referencing the new packs. The old pack files are not deleted, since other processes may still be reading
+// them using indexes loaded before the repack. Instead they are marked for deletion by a subsequent call to
+// DeleteRepackedPacks() once all readers have had a chance to refresh their indexes.
+func (bm *Manager) RepackBlocks(ctx context.Context, packFiles []string) error {
+	repack := map[string]bool{}
+	for _, pf := range packFiles {
+		repack[pf] = true
+	}
+
+	infos, err := bm.ListBlockInfos("", false)
+	if err != nil {
+		return fmt.Errorf("unable to list blocks: %v", err)
+	}
+
+	for _, bi := range infos {
+		if !repack[bi.PackFile] {
+			continue
+		}
+
+		if err := bm.RewriteBlock(ctx, bi.BlockID); err != nil {
+			return fmt.Errorf("unable to rewrite block %q: %v", bi.BlockID, err)
+		}
+	}
+
+	if err := bm.Flush(ctx); err != nil {
+		return fmt.Errorf("unable to flush rewritten blocks: %v", err)
+	}
+
+	for _, packFile := range packFiles {
+		m, err := json.Marshal(&repackedPackMarker{PackFile: packFile, RepackTime: bm.timeNow()})
+		if err != nil {
+			return errors.Wrap(err, "unable to serialize repack marker")
+		}
+
+		if err := bm.st.PutBlock(ctx, repackedPackPrefix+packFile, m); err != nil {
+			return fmt.Errorf("unable to mark %v as repacked: %v", packFile, err)
+		}
+	}
+
+	return nil
+}
+
+// RewritePacks repacks all pack files referenced by the index in which live blocks take up less than minLiveRatio
+// of the stored pack length (including padding and the local index), which reclaims the space of deleted blocks. Block IDs and contents are not changed, so objects keep
+// resolving. The repacked packs are deleted by a subsequent call to DeleteRepackedPacks().
+// Returns the list of repacked pack files.
+func (bm *Manager) RewritePacks(ctx context.Context, minLiveRatio float64) ([]string, error) {
+	infos, err := bm.ListBlockInfos("", true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list blocks: %v", err)
+	}
+
+	referenced := map[string]bool{}
+	liveBytes := map[string]int64{}
+	for _, bi := range infos {
+		if bi.PackFile == "" {
+			continue
+		}
+
+		referenced[bi.PackFile] = true
+		if !bi.Deleted {
+			liveBytes[bi.PackFile] += int64(bi.Length)
+		}
+	}
+
+	markers, err := storage.ListAllBlocks(ctx, bm.st, repackedPackPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list repacked packs")
+	}
+
+	alreadyRepacked := map[string]bool{}
+	for _, mb := range markers {
+		alreadyRepacked[strings.TrimPrefix(mb.BlockID, repackedPackPrefix)] = true
+	}
+
+	var packFiles []string
+	if err := bm.st.ListBlocks(ctx, PackBlockPrefix, func(bi storage.BlockMetadata) error {
+		if !referenced[bi.BlockID] || alreadyRepacked[bi.BlockID] || bi.Length <= 0 {
+			return nil
+		}
+
+		if ratio := float64(liveBytes[bi.BlockID]) / float64(bi.Length); ratio < minLiveRatio {
+			log.Debugf("repacking %v with %v of %v bytes live (%.2f)", bi.BlockID, liveBytes[bi.BlockID], bi.Length, ratio)
+			packFiles = append(packFiles, bi.BlockID)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "unable to list packs")
+	}
+
+	if len(packFiles) == 0 {
+		return nil, nil
+	}
+
+	if err := bm.RepackBlocks(ctx, packFiles); err != nil {
+		return nil, err
+	}
+
+	return packFiles, nil
+}
+
+// DeleteRepackedPacks deletes pack files that have been repacked more than gracePeriod ago and are no longer
+// referenced by the current index. The grace period must be longer than the interval at which readers refresh
+// their indexes, otherwise readers that still use old indexes will fail to find blocks.
+// Returns the list of deleted pack files.
+func (bm *Manager) DeleteRepackedPacks(ctx context.Context, gracePeriod time.Duration) ([]string, error) {
+	if _, err := bm.Refresh(ctx); err != nil {
+		return nil, errors.Wrap(err, "unable to refresh indexes")
+	}
+
+	infos, err := bm.ListBlockInfos("", false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list blocks: %v", err)
+	}
+
+	inUse := findPackBlocksInUse(infos)
+
+	markers, err := storage.ListAllBlocks(ctx, bm.st, repackedPackPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list repacked packs")
+	}
+
+	var deleted []string
+	for _, mb := range markers {
+		if !isStorageBlockName(strings.TrimPrefix(mb.BlockID, repackedPackPrefix), PackBlockPrefix) {
+			log.Debugf("ignoring foreign block %q", mb.BlockID)
+			continue
+		}
+
+		data, err := bm.st.GetBlock(ctx, mb.BlockID, 0, -1)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read repack marker %v", mb.BlockID)
+		}
+
+		var m repackedPackMarker
+		if err := json.Unmarshal(data, &m); err != nil || m.PackFile != strings.TrimPrefix(mb.BlockID, repackedPackPrefix) {
+			log.Warningf("ignoring malformed repack marker %v", mb.BlockID)
+			continue
+		}
+
+		if bm.timeNow().Sub(m.RepackTime) < gracePeriod {
+			continue
+		}
+
+		if inUse[m.PackFile] > 0 {
+			log.Warningf("repacked pack %v is still referenced by %v blocks, not deleting", m.PackFile, inUse[m.PackFile])
+			continue
+		}
+
+		log.Debugf("deleting repacked pack %v", m.PackFile)
+		if err := bm.st.DeleteBlock(ctx, m.PackFile); err != nil {
+			return deleted, fmt.Errorf("unable to delete pack %v: %v", m.PackFile, err)
+		}
+
+		if err := bm.st.DeleteBlock(ctx, mb.BlockID); err != nil {
+			return deleted, fmt.Errorf("unable to delete repack marker %v: %v", mb.BlockID, err)
+		}
+
+		deleted = append(deleted, m.PackFile)
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,107 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCommitTokenExpired is returned by RollbackTo() when index blocks captured by the commit token no longer exist,
+// typically because they have been compacted since.
+var ErrCommitTokenExpired = errors.New("index blocks of commit token no longer exist")
+
+// CommitToken captures the set of committed index blocks at a point in time, which RollbackTo() can restore.
+type CommitToken struct {
+	IndexBlocks []string `json:"indexBlocks"`
+}
+
+// CommitToken returns a token capturing the blocks committed so far. Pending blocks are not included
+// unless they are flushed first.
+func (bm *Manager) CommitToken(ctx context.Context) (CommitToken, error) {
+	blocks, err := bm.IndexBlocks(ctx)
+	if err != nil {
+		return CommitToken{}, errors.Wrap(err, "unable to list index blocks")
+	}
+
+	var result CommitToken
+	for _, b := range blocks {
+		result.IndexBlocks = append(result.IndexBlocks, b.FileName)
+	}
+	sort.Strings(result.IndexBlocks)
+
+	return result, nil
+}
+
+// RollbackTo restores the committed state captured by the provided token by deactivating all index blocks committed
+// afterwards, which hides blocks written since and restores blocks deleted since. Pending blocks are not affected.
+// Packs of the hidden blocks are no longer referenced and are reported by FindUnreferencedStorageFiles(), which
+// allows them to be garbage-collected.
+//
+// With format version 2 or higher, the newer index blocks are replaced atomically using an index set, otherwise
+// they are deleted one by one. Returns ErrCommitTokenExpired if index blocks captured by the token have been
+// compacted since, in which case nothing is changed.
+func (bm *Manager) RollbackTo(ctx context.Context, token CommitToken) error {
+	bm.listCache.deleteListCache(ctx)
+
+	current, err := bm.IndexBlocks(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to list index blocks")
+	}
+
+	inToken := map[string]bool{}
+	for _, b := range token.IndexBlocks {
+		inToken[b] = true
+	}
+
+	var newer []IndexInfo
+	var found int
+	for _, ii := range current {
+		if inToken[ii.FileName] {
+			found++
+		} else {
+			newer = append(newer, ii)
+		}
+	}
+
+	if found != len(inToken) {
+		return errors.Wrapf(ErrCommitTokenExpired, "%v of %v index blocks are missing", len(inToken)-found, len(inToken))
+	}
+
+	if len(newer) > 0 {
+		if err := bm.deactivateIndexBlocks(ctx, newer); err != nil {
+			return err
+		}
+	}
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	_, _, err = bm.loadPackIndexesUnlocked(ctx)
+	return err
+}
+
+func (bm *Manager) deactivateIndexBlocks(ctx context.Context, blocks []IndexInfo) error {
+	log.Infof("rolling back %v index blocks", len(blocks))
+
+	if bm.writeFormatVersion >= indexSetMinVersion {
+		var buf bytes.Buffer
+		if err := make(packIndexBuilder).Build(&buf); err != nil {
+			return errors.Wrap(err, "unable to build an empty index")
+		}
+
+		_, err := bm.replaceIndexBlocks(ctx, blocks, buf.Bytes())
+		return err
+	}
+
+	defer bm.listCache.deleteListCache(ctx)
+
+	for _, ii := range blocks {
+		if err := bm.st.DeleteBlock(ctx, ii.FileName); err != nil {
+			return errors.Wrapf(err, "unable to delete index block %q", ii.FileName)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultVerifyCheckpointInterval = 1000
+
+// VerifyOptions provides options for verifying contents of blocks.
+type VerifyOptions struct {
+	// CheckpointFile, if set, is a local file where the progress of the verification is persisted,
+	// so that the verification resumes where it left off when it is interrupted and restarted.
+	// The file is not removed when the verification completes.
+	CheckpointFile string
+
+	// CheckpointInterval is the number of blocks verified between checkpoints, defaults to 1000.
+	CheckpointInterval int
+
+	// BlocksPerSecond limits the rate of verification, unlimited if zero.
+	BlocksPerSecond float64
+
+	// MaxBlocks limits the number of blocks verified by a single call, unlimited if zero.
+	MaxBlocks int
+}
+
+// BlockVerificationFailure describes a block that failed verification.
+type BlockVerificationFailure struct {
+	BlockID string `json:"blockID"`
+	Error   string `json:"error"`
+}
+
+// VerifyResult describes the progress of a verification, which is also persisted as the checkpoint.
+type VerifyResult struct {
+	LastBlockID string                     `json:"lastBlockID,omitempty"` // blocks up to and including this one have been verified
+	Verified    int                        `json:"verified"`
+	Failures    []BlockVerificationFailure `json:"failures,omitempty"`
+	Complete    bool                       `json:"complete"`
+}
+
+// VerifyBlocks reads and verifies contents of all committed blocks in the order of their IDs.
+// Blocks that fail verification are reported in the result and don't stop the verification.
+// When a checkpoint file is provided, the results accumulate across calls until the verification is complete,
+// after which the next call starts over.
+func (bm *Manager) VerifyBlocks(ctx context.Context, opt VerifyOptions) (*VerifyResult, error) {
+	result, err := readVerifyCheckpoint(opt.CheckpointFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Complete {
+		result = &VerifyResult{}
+	}
+
+	infos, err := bm.FindBlocks(ctx, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list blocks")
+	}
+
+	checkpointInterval := opt.CheckpointInterval
+	if checkpointInterval <= 0 {
+		checkpointInterval = defaultVerifyCheckpointInterval
+	}
+
+	var throttle <-chan time.Time
+	if opt.BlocksPerSecond > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / opt.BlocksPerSecond))
+		defer t.Stop()
+		throttle = t.C
+	}
+
+	verifiedNow := 0
+	result.Complete = true
+
+	for _, bi := range infos {
+		if bi.BlockID <= result.LastBlockID {
+			continue
+		}
+
+		if opt.MaxBlocks > 0 && verifiedNow >= opt.MaxBlocks {
+			result.Complete = false
+			break
+		}
+
+		if throttle != nil {
+			select {
+			case <-throttle:
+			case <-ctx.Done():
+			}
+		}
+
+		if ctx.Err() != nil {
+			result.Complete = false
+			break
+		}
+
+		if _, err := bm.GetBlock(ctx, bi.BlockID); err != nil {
+			log.Warningf("block %v failed verification: %v", bi.BlockID, err)
+			result.Failures = append(result.Failures, BlockVerificationFailure{BlockID: bi.BlockID, Error: err.Error()})
+		}
+
+		result.LastBlockID = bi.BlockID
+		result.Verified++
+		verifiedNow++
+
+		if verifiedNow%checkpointInterval == 0 {
+			if err := writeVerifyCheckpoint(opt.CheckpointFile, result); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := writeVerifyCheckpoint(opt.CheckpointFile, result); err != nil {
+		return nil, err
+	}
+
+	return result, ctx.Err()
+}
+
+func readVerifyCheckpoint(fname string) (*VerifyResult, error) {
+	result := &VerifyResult{}
+	if fname == "" {
+		return result, nil
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read verification checkpoint")
+	}
+
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, errors.Wrap(err, "invalid verification checkpoint")
+	}
+
+	return result, nil
+}
+
+func writeVerifyCheckpoint(fname string, result *VerifyResult) error {
+	if fname == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errors.Wrap(err, "unable to serialize verification checkpoint")
+	}
+
+	if err := ioutil.WriteFile(fname+".tmp", data, 0600); err != nil {
+		return errors.Wrap(err, "unable to write verification checkpoint")
+	}
+
+	return errors.Wrap(os.Rename(fname+".tmp", fname), "unable to write verification checkpoint")
+}
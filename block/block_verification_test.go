@@ -0,0 +1,83 @@
+package block
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyBlocksResumed(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	var blockIDs []string
+	for i := 0; i < 20; i++ {
+		blockIDs = append(blockIDs, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+	}
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	// corrupt one of the blocks in its pack.
+	bi, err := bm.BlockInfo(ctx, blockIDs[7])
+	if err != nil {
+		t.Fatalf("unable to get block info: %v", err)
+	}
+	data[bi.PackFile][bi.PackOffset] ^= 1
+
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	opt := VerifyOptions{
+		CheckpointFile:     filepath.Join(dir, "checkpoint"),
+		CheckpointInterval: 3,
+		MaxBlocks:          10,
+	}
+
+	bm = newTestBlockManager(data, keyTime, nil)
+	first, err := bm.VerifyBlocks(ctx, opt)
+	if err != nil {
+		t.Fatalf("verification error: %v", err)
+	}
+
+	if first.Verified != 10 || first.Complete {
+		t.Fatalf("unexpected result of the first half: %+v", first)
+	}
+
+	// resume with a new manager, as if the process had been restarted.
+	bm = newTestBlockManager(data, keyTime, nil)
+	opt.BlocksPerSecond = 1000
+	second, err := bm.VerifyBlocks(ctx, opt)
+	if err != nil {
+		t.Fatalf("verification error: %v", err)
+	}
+
+	if second.Verified != len(blockIDs) || !second.Complete {
+		t.Fatalf("unexpected result of the second half: %+v", second)
+	}
+
+	if len(second.Failures) != 1 || second.Failures[0].BlockID != blockIDs[7] {
+		t.Errorf("unexpected failures: %+v", second.Failures)
+	}
+
+	// once complete, the next verification starts over.
+	opt.BlocksPerSecond = 0
+	opt.MaxBlocks = 0
+	third, err := bm.VerifyBlocks(ctx, opt)
+	if err != nil {
+		t.Fatalf("verification error: %v", err)
+	}
+
+	if third.Verified != len(blockIDs) || !third.Complete || len(third.Failures) != 1 {
+		t.Errorf("unexpected result of the repeated verification: %+v", third)
+	}
+}
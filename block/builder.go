@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"sort"
 )
 
@@ -35,6 +36,7 @@ func (b packIndexBuilder) sortedBlocks() []*Info {
 
 type indexLayout struct {
 	packFileOffsets map[string]uint32
+	payloadOffsets  map[string]uint32 // offsets of inline payloads by block ID
 	entryCount      int
 	keyLength       int
 	entryLength     int
@@ -46,6 +48,7 @@ func (b packIndexBuilder) Build(output io.Writer) error {
 	allBlocks := b.sortedBlocks()
 	layout := &indexLayout{
 		packFileOffsets: map[string]uint32{},
+		payloadOffsets:  map[string]uint32{},
 		keyLength:       -1,
 		entryLength:     20,
 		entryCount:      len(allBlocks),
@@ -53,12 +56,30 @@ func (b packIndexBuilder) Build(output io.Writer) error {
 
 	w := bufio.NewWriter(output)
 
+	// validate keys before anything is written, so that invalid indexes are never partially written.
+	if err := validateKeyLengths(allBlocks, layout); err != nil {
+		return err
+	}
+
+	for _, it := range allBlocks {
+		if it.OriginalLength > 0 {
+			// readers ignore bytes of entries beyond the ones they know about, so indexes with original lengths
+			// remain readable by readers that predate them.
+			layout.entryLength = originalLengthEntryLength
+			break
+		}
+	}
+
 	// prepare extra data to be appended at the end of an index.
 	extraData := prepareExtraData(allBlocks, layout)
 
 	// write header
 	header := make([]byte, 8)
 	header[0] = 1 // version
+	if len(layout.payloadOffsets) > 0 {
+		// readers that predate inline payloads reject the index instead of misinterpreting its entries.
+		header[0] = inlinePayloadIndexVersion
+	}
 	header[1] = byte(layout.keyLength)
 	binary.BigEndian.PutUint16(header[2:4], uint16(layout.entryLength))
 	binary.BigEndian.PutUint32(header[4:8], uint32(layout.entryCount))
@@ -81,27 +102,52 @@ func (b packIndexBuilder) Build(output io.Writer) error {
 	return w.Flush()
 }
 
+// validateKeyLengths declares the key length of the index, which is the length of the key of the first block,
+// and ensures that keys of all blocks have that length, since the index can only store keys of a single length.
+func validateKeyLengths(allBlocks []*Info, layout *indexLayout) error {
+	if len(allBlocks) == 0 {
+		return nil
+	}
+
+	first := allBlocks[0].BlockID
+	layout.keyLength = len(contentIDToBytes(first))
+	if layout.keyLength <= 1 || layout.keyLength > math.MaxUint8 {
+		return fmt.Errorf("invalid key length of block %q: %v bytes", first, layout.keyLength)
+	}
+
+	for _, it := range allBlocks[1:] {
+		if l := len(contentIDToBytes(it.BlockID)); l != layout.keyLength {
+			return fmt.Errorf("inconsistent key length of block %q: %v bytes, expected %v bytes like %q", it.BlockID, l, layout.keyLength, first)
+		}
+	}
+
+	return nil
+}
+
 func prepareExtraData(allBlocks []*Info, layout *indexLayout) []byte {
 	var extraData []byte
 
-	for i, it := range allBlocks {
-		if i == 0 {
-			layout.keyLength = len(contentIDToBytes(it.BlockID))
-		}
+	for _, it := range allBlocks {
 		if it.PackFile != "" {
 			if _, ok := layout.packFileOffsets[it.PackFile]; !ok {
 				layout.packFileOffsets[it.PackFile] = uint32(len(extraData))
 				extraData = append(extraData, []byte(it.PackFile)...)
 			}
 		}
-		if len(it.Payload) > 0 {
-			panic("storing payloads in indexes is not supported")
+		if isInline(it) {
+			layout.payloadOffsets[it.BlockID] = uint32(len(extraData))
+			extraData = append(extraData, it.Payload...)
 		}
 	}
 	layout.extraDataOffset = uint32(8 + layout.entryCount*(layout.keyLength+layout.entryLength))
 	return extraData
 }
 
+// isInline determines whether the payload of the provided entry is stored in the index.
+func isInline(it *Info) bool {
+	return it.PackFile == "" && it.Payload != nil
+}
+
 func writeEntry(w io.Writer, it *Info, layout *indexLayout, entry []byte) error {
 	k := contentIDToBytes(it.BlockID)
 	if len(k) != layout.keyLength {
@@ -129,19 +175,34 @@ func formatEntry(entry []byte, it *Info, layout *indexLayout) error {
 	entryPackedLength := entry[16:20]
 	timestampAndFlags := uint64(it.TimestampSeconds) << 16
 
-	if len(it.PackFile) == 0 {
+	if isInline(it) {
+		// the pack file offset and length locate the payload, the length of the pack block ID is zero.
+		binary.BigEndian.PutUint32(entryPackFileOffset, layout.extraDataOffset+layout.payloadOffsets[it.BlockID])
+		binary.BigEndian.PutUint32(entryPackedLength, uint32(len(it.Payload)))
+	} else if len(it.PackFile) == 0 {
 		return fmt.Errorf("empty pack block ID for %v", it.BlockID)
+	} else {
+		binary.BigEndian.PutUint32(entryPackFileOffset, layout.extraDataOffset+layout.packFileOffsets[it.PackFile])
+		binary.BigEndian.PutUint32(entryPackedLength, it.Length)
 	}
 
-	binary.BigEndian.PutUint32(entryPackFileOffset, layout.extraDataOffset+layout.packFileOffsets[it.PackFile])
 	if it.Deleted {
 		binary.BigEndian.PutUint32(entryPackedOffset, it.PackOffset|0x80000000)
 	} else {
 		binary.BigEndian.PutUint32(entryPackedOffset, it.PackOffset)
 	}
-	binary.BigEndian.PutUint32(entryPackedLength, it.Length)
-	timestampAndFlags |= uint64(it.FormatVersion) << 8
+	if it.FormatVersion > formatVersionMask || it.Compression > maxCompressionID {
+		return fmt.Errorf("invalid format version %v or compression %v for %v", it.FormatVersion, it.Compression, it.BlockID)
+	}
+	timestampAndFlags |= uint64(it.FormatVersion|it.Compression<<compressionShift) << 8
 	timestampAndFlags |= uint64(len(it.PackFile))
+	if it.Provisional {
+		timestampAndFlags |= provisionalFlag
+	}
 	binary.BigEndian.PutUint64(entryTimestampAndFlags, timestampAndFlags)
+
+	if len(entry) >= originalLengthEntryLength {
+		binary.BigEndian.PutUint32(entry[20:24], it.OriginalLength)
+	}
 	return nil
 }
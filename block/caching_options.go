@@ -6,5 +6,11 @@ type CachingOptions struct {
 	MaxCacheSizeBytes       int64  `json:"maxCacheSize,omitempty"`
 	MaxListCacheDurationSec int    `json:"maxListCacheDuration,omitempty"`
 	IgnoreListCache         bool   `json:"-"`
+	ParallelIndexFetches    int    `json:"-"` // number of index blocks fetched in parallel, zero selects the default
+	StrictIndexes           bool   `json:"-"` // fail loading indexes if any listed index block is missing instead of skipping it
+	MaxIndexBlocks          int    `json:"-"` // fail loading indexes if there are more index blocks than this, zero means no limit
+	BackgroundFlushQueue    int    `json:"-"` // number of finished packs queued for upload in the background, zero uploads them synchronously
+	ParallelPackUploads     int    `json:"-"` // number of queued packs uploaded concurrently, more than one implies uploading in the background
+	IndexBloomFilters       bool   `json:"-"` // skip committed index blocks that can't contain looked up blocks using bloom filters
 	HMACSecret              []byte `json:"-"`
 }
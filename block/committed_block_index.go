@@ -21,6 +21,7 @@ type committedBlockIndexCache interface {
 	addBlockToCache(indexBlockID string, data []byte) error
 	openIndex(indexBlockID string) (packIndex, error)
 	expireUnused(used []string) error
+	purgeUnused(used []string) error
 }
 
 func (b *committedBlockIndex) getBlock(blockID string) (Info, error) {
@@ -37,6 +38,41 @@ func (b *committedBlockIndex) getBlock(blockID string) (Info, error) {
 	return Info{}, err
 }
 
+// indexBlockContaining returns the name of the index block holding the entry of the provided block
+// that's in effect, using the same precedence as the merged index.
+func (b *committedBlockIndex) indexBlockContaining(blockID string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *Info
+	var bestIndexBlock string
+	for indexBlockID, ndx := range b.inUse {
+		i, err := ndx.GetInfo(blockID)
+		if err != nil {
+			return "", err
+		}
+		if i == nil {
+			continue
+		}
+
+		if best == nil || isBetterIndexEntry(i, best) || (!isBetterIndexEntry(best, i) && indexBlockID < bestIndexBlock) {
+			best = i
+			bestIndexBlock = indexBlockID
+		}
+	}
+
+	if best == nil || best.Deleted {
+		return "", storage.ErrBlockNotFound
+	}
+
+	return bestIndexBlock, nil
+}
+
+// isBetterIndexEntry determines whether the entry i takes precedence over the entry best of the same block.
+func isBetterIndexEntry(i, best *Info) bool {
+	return i.TimestampSeconds > best.TimestampSeconds || (i.TimestampSeconds == best.TimestampSeconds && best.Deleted && !i.Deleted)
+}
+
 func (b *committedBlockIndex) addBlock(indexBlockID string, data []byte, use bool) error {
 	if err := b.cache.addBlockToCache(indexBlockID, data); err != nil {
 		return err
@@ -119,15 +155,29 @@ func (b *committedBlockIndex) use(packFiles []string) (bool, error) {
 	return true, nil
 }
 
+// purgeUnused removes all cached index blocks that are not currently in use, regardless of their age.
+func (b *committedBlockIndex) purgeUnused() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var used []string
+	for k := range b.inUse {
+		used = append(used, k)
+	}
+
+	return b.cache.purgeUnused(used)
+}
+
 func newCommittedBlockIndex(caching CachingOptions) (*committedBlockIndex, error) {
 	var cache committedBlockIndexCache
 
 	if caching.CacheDirectory != "" {
 		dirname := filepath.Join(caching.CacheDirectory, "indexes")
-		cache = &diskCommittedBlockIndexCache{dirname}
+		cache = &diskCommittedBlockIndexCache{dirname, caching.IndexBloomFilters}
 	} else {
 		cache = &memoryCommittedBlockIndexCache{
-			blocks: map[string]packIndex{},
+			blocks:       map[string]packIndex{},
+			bloomFilters: caching.IndexBloomFilters,
 		}
 	}
 
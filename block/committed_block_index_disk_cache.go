@@ -1,6 +1,7 @@
 package block
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -13,17 +14,23 @@ import (
 
 const (
 	simpleIndexSuffix                    = ".sndx"
+	bloomFilterSuffix                    = ".bloom"
 	unusedCommittedBlockIndexCleanupTime = 1 * time.Hour // delete unused committed index blocks after 1 hour
 )
 
 type diskCommittedBlockIndexCache struct {
-	dirname string
+	dirname      string
+	bloomFilters bool // store bloom filters of cached indexes next to them and use them when opening the indexes
 }
 
 func (c *diskCommittedBlockIndexCache) indexBlockPath(indexBlockID string) string {
 	return filepath.Join(c.dirname, indexBlockID+simpleIndexSuffix)
 }
 
+func (c *diskCommittedBlockIndexCache) bloomFilterPath(indexBlockID string) string {
+	return filepath.Join(c.dirname, indexBlockID+bloomFilterSuffix)
+}
+
 func (c *diskCommittedBlockIndexCache) openIndex(indexBlockID string) (packIndex, error) {
 	fullpath := c.indexBlockPath(indexBlockID)
 
@@ -32,7 +39,47 @@ func (c *diskCommittedBlockIndexCache) openIndex(indexBlockID string) (packIndex
 		return nil, err
 	}
 
-	return openPackIndex(f)
+	ndx, err := openPackIndex(f)
+	if err != nil || !c.bloomFilters {
+		return ndx, err
+	}
+
+	return &bloomFilteredIndex{ndx, c.loadBloomFilter(indexBlockID, ndx)}, nil
+}
+
+// loadBloomFilter returns the cached bloom filter of the provided index, building and caching it first
+// if the index was cached without one.
+func (c *diskCommittedBlockIndexCache) loadBloomFilter(indexBlockID string, ndx packIndex) *bloomFilter {
+	if data, err := ioutil.ReadFile(c.bloomFilterPath(indexBlockID)); err == nil {
+		if f, err := parseBloomFilter(data); err == nil {
+			return f
+		}
+
+		log.Warningf("ignoring invalid bloom filter of %v", indexBlockID)
+	}
+
+	f, err := buildBloomFilter(ndx)
+	if err != nil {
+		// a filter reporting all blocks as present falls back to lookups in the index.
+		log.Warningf("unable to build bloom filter of %v: %v", indexBlockID, err)
+		return &bloomFilter{hashFunctions: 1, bits: []byte{0xff}}
+	}
+
+	if err := c.writeBloomFilter(indexBlockID, f); err != nil {
+		log.Warningf("unable to cache bloom filter of %v: %v", indexBlockID, err)
+	}
+
+	return f
+}
+
+func (c *diskCommittedBlockIndexCache) writeBloomFilter(indexBlockID string, f *bloomFilter) error {
+	tmpFile, err := writeTempFileAtomic(c.dirname, f.serialize())
+	if err != nil {
+		return err
+	}
+
+	// all writers produce identical filters, so whichever rename happens last wins.
+	return os.Rename(tmpFile, c.bloomFilterPath(indexBlockID))
 }
 
 func (c *diskCommittedBlockIndexCache) hasIndexBlockID(indexBlockID string) (bool, error) {
@@ -74,6 +121,22 @@ func (c *diskCommittedBlockIndexCache) addBlockToCache(indexBlockID string, data
 		}
 	}
 
+	if c.bloomFilters {
+		ndx, err := openPackIndex(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("unable to open index block %q: %v", indexBlockID, err)
+		}
+
+		f, err := buildBloomFilter(ndx)
+		if err != nil {
+			return fmt.Errorf("unable to build bloom filter of %q: %v", indexBlockID, err)
+		}
+
+		if err := c.writeBloomFilter(indexBlockID, f); err != nil {
+			log.Warningf("unable to cache bloom filter of %v: %v", indexBlockID, err)
+		}
+	}
+
 	return nil
 }
 
@@ -100,10 +163,11 @@ func writeTempFileAtomic(dirname string, data []byte) (string, error) {
 	return tf.Name(), nil
 }
 
-func (c *diskCommittedBlockIndexCache) expireUnused(used []string) error {
+// unusedEntries returns cached index files that are not in the provided list of used index blocks.
+func (c *diskCommittedBlockIndexCache) unusedEntries(used []string) (map[string]os.FileInfo, error) {
 	entries, err := ioutil.ReadDir(c.dirname)
 	if err != nil {
-		return fmt.Errorf("can't list cache: %v", err)
+		return nil, fmt.Errorf("can't list cache: %v", err)
 	}
 
 	remaining := map[string]os.FileInfo{}
@@ -119,12 +183,24 @@ func (c *diskCommittedBlockIndexCache) expireUnused(used []string) error {
 		delete(remaining, u)
 	}
 
-	for _, rem := range remaining {
+	return remaining, nil
+}
+
+func (c *diskCommittedBlockIndexCache) expireUnused(used []string) error {
+	remaining, err := c.unusedEntries(used)
+	if err != nil {
+		return err
+	}
+
+	for n, rem := range remaining {
 		if time.Since(rem.ModTime()) > unusedCommittedBlockIndexCleanupTime {
 			log.Debugf("removing unused %v %v", rem.Name(), rem.ModTime())
 			if err := os.Remove(filepath.Join(c.dirname, rem.Name())); err != nil {
 				log.Warningf("unable to remove unused index file: %v", err)
 			}
+			if err := os.Remove(c.bloomFilterPath(n)); err != nil && !os.IsNotExist(err) {
+				log.Warningf("unable to remove unused bloom filter: %v", err)
+			}
 		} else {
 			log.Debugf("keeping unused %v because it's too new %v", rem.Name(), rem.ModTime())
 		}
@@ -132,3 +208,27 @@ func (c *diskCommittedBlockIndexCache) expireUnused(used []string) error {
 
 	return nil
 }
+
+func (c *diskCommittedBlockIndexCache) purgeUnused(used []string) error {
+	if _, err := os.Stat(c.dirname); os.IsNotExist(err) {
+		// nothing cached yet
+		return nil
+	}
+
+	remaining, err := c.unusedEntries(used)
+	if err != nil {
+		return err
+	}
+
+	for n, rem := range remaining {
+		log.Debugf("purging unused %v", rem.Name())
+		if err := os.Remove(filepath.Join(c.dirname, rem.Name())); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove unused index file: %v", err)
+		}
+		if err := os.Remove(c.bloomFilterPath(n)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove unused bloom filter: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -7,8 +7,9 @@ import (
 )
 
 type memoryCommittedBlockIndexCache struct {
-	mu     sync.Mutex
-	blocks map[string]packIndex
+	mu           sync.Mutex
+	blocks       map[string]packIndex
+	bloomFilters bool // wrap cached indexes with bloom filters of their blocks
 }
 
 func (m *memoryCommittedBlockIndexCache) hasIndexBlockID(indexBlockID string) (bool, error) {
@@ -27,6 +28,15 @@ func (m *memoryCommittedBlockIndexCache) addBlockToCache(indexBlockID string, da
 		return err
 	}
 
+	if m.bloomFilters {
+		f, err := buildBloomFilter(ndx)
+		if err != nil {
+			return fmt.Errorf("unable to build bloom filter of %q: %v", indexBlockID, err)
+		}
+
+		ndx = &bloomFilteredIndex{ndx, f}
+	}
+
 	m.blocks[indexBlockID] = ndx
 	return nil
 }
@@ -46,3 +56,21 @@ func (m *memoryCommittedBlockIndexCache) openIndex(indexBlockID string) (packInd
 func (m *memoryCommittedBlockIndexCache) expireUnused(used []string) error {
 	return nil
 }
+
+func (m *memoryCommittedBlockIndexCache) purgeUnused(used []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inUse := map[string]bool{}
+	for _, u := range used {
+		inUse[u] = true
+	}
+
+	for k := range m.blocks {
+		if !inUse[k] {
+			delete(m.blocks, k)
+		}
+	}
+
+	return nil
+}
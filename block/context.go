@@ -1,13 +1,19 @@
 package block
 
-import "context"
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
 
 type contextKey string
 
 var useBlockCacheContextKey contextKey = "use-block-cache"
 var useListCacheContextKey contextKey = "use-list-cache"
+var timingsContextKey contextKey = "timings"
 
 // UsingBlockCache returns a derived context that causes block manager to use cache.
+// Disabling the cache is equivalent to storage.CachePolicyBypass, see storage.WithCachePolicy.
 func UsingBlockCache(ctx context.Context, enabled bool) context.Context {
 	return context.WithValue(ctx, useBlockCacheContextKey, enabled)
 }
@@ -32,3 +38,21 @@ func shouldUseListCache(ctx context.Context) bool {
 
 	return true
 }
+
+// WithTimings returns a derived context that causes block manager to record time spent hashing,
+// encrypting and writing blocks to storage in the provided Timings.
+func WithTimings(ctx context.Context, t *Timings) context.Context {
+	return context.WithValue(ctx, timingsContextKey, t)
+}
+
+func timingsFromContext(ctx context.Context) *Timings {
+	t, _ := ctx.Value(timingsContextKey).(*Timings)
+	return t
+}
+
+// recordTiming adds the time elapsed since start to the provided duration, if it's not nil.
+func recordTiming(d *time.Duration, start time.Time) {
+	if d != nil {
+		atomic.AddInt64((*int64)(d), int64(time.Since(start)))
+	}
+}
@@ -22,10 +22,18 @@ type Format struct {
 	ExtraData []byte // extra data
 }
 
+const (
+	compressionShift  = 6                       // position of the compression bits in the format version byte
+	formatVersionMask = 1<<compressionShift - 1 // bits of the format version byte holding the format version
+
+	provisionalFlag = 1 << 63 // most significant bit of the timestamp, which is never set in valid timestamps
+)
+
 type entry struct {
 	// big endian:
-	// 48 most significant bits - 48-bit timestamp in seconds since 1970/01/01 UTC
-	// 8 bits - format version (currently == 1)
+	// 1 most significant bit - set when the entry is provisional
+	// 47 bits - timestamp in seconds since 1970/01/01 UTC
+	// 8 bits - compression (2 most significant bits, zero when uncompressed) and format version (6 bits)
 	// 8 least significant bits - length of pack block ID
 	timestampAndFlags uint64 //
 	packFileOffset    uint32 // 4 bytes, big endian, offset within index file where pack block ID begins
@@ -49,12 +57,20 @@ func (e *entry) IsDeleted() bool {
 	return e.packedOffset&0x80000000 != 0
 }
 
+func (e *entry) IsProvisional() bool {
+	return e.timestampAndFlags&provisionalFlag != 0
+}
+
 func (e *entry) TimestampSeconds() int64 {
-	return int64(e.timestampAndFlags >> 16)
+	return int64(e.timestampAndFlags&^provisionalFlag) >> 16
 }
 
 func (e *entry) PackedFormatVersion() byte {
-	return byte(e.timestampAndFlags >> 8)
+	return byte(e.timestampAndFlags>>8) & formatVersionMask
+}
+
+func (e *entry) PackedCompression() byte {
+	return byte(e.timestampAndFlags>>8) >> compressionShift
 }
 
 func (e *entry) PackFileLength() byte {
@@ -24,7 +24,15 @@ type index struct {
 	readerAt io.ReaderAt
 }
 
+// originalLengthEntryLength is the length of index entries that record the original length of compressed blocks
+// after the 20 bytes of other fields.
+const originalLengthEntryLength = 24
+
+// inlinePayloadIndexVersion is the version of indexes in which entries without a pack block ID hold inline payloads.
+const inlinePayloadIndexVersion = 2
+
 type headerInfo struct {
+	version    byte
 	keySize    int
 	valueSize  int
 	entryCount int
@@ -37,11 +45,12 @@ func readHeader(readerAt io.ReaderAt) (headerInfo, error) {
 		return headerInfo{}, errors.Wrap(err, "invalid header")
 	}
 
-	if header[0] != 1 {
+	if header[0] != 1 && header[0] != inlinePayloadIndexVersion {
 		return headerInfo{}, fmt.Errorf("invalid header format: %v", header[0])
 	}
 
 	hi := headerInfo{
+		version:    header[0],
 		keySize:    int(header[1]),
 		valueSize:  int(binary.BigEndian.Uint16(header[2:4])),
 		entryCount: int(binary.BigEndian.Uint32(header[4:8])),
@@ -108,6 +117,11 @@ func (b *index) findEntryPosition(blockID string) (int, error) {
 }
 
 func (b *index) findEntry(blockID string) ([]byte, error) {
+	// the key size of empty indexes is unknown.
+	if b.hdr.entryCount == 0 {
+		return nil, nil
+	}
+
 	key := contentIDToBytes(blockID)
 	if len(key) != b.hdr.keySize {
 		return nil, fmt.Errorf("invalid block ID: %q", blockID)
@@ -162,23 +176,54 @@ func (b *index) entryToInfo(blockID string, entryData []byte) (Info, error) {
 		return Info{}, err
 	}
 
+	if e.PackFileLength() == 0 && b.hdr.version >= inlinePayloadIndexVersion {
+		return b.inlineEntryToInfo(blockID, &e)
+	}
+
 	packFile := make([]byte, e.PackFileLength())
 	n, err := b.readerAt.ReadAt(packFile, int64(e.PackFileOffset()))
 	if err != nil || n != int(e.PackFileLength()) {
 		return Info{}, errors.Wrap(err, "can't read pack block ID")
 	}
 
+	var originalLength uint32
+	if len(entryData) >= originalLengthEntryLength {
+		originalLength = binary.BigEndian.Uint32(entryData[20:24])
+	}
+
 	return Info{
 		BlockID:          blockID,
 		Deleted:          e.IsDeleted(),
+		Provisional:      e.IsProvisional(),
 		TimestampSeconds: e.TimestampSeconds(),
 		FormatVersion:    e.PackedFormatVersion(),
+		Compression:      e.PackedCompression(),
+		OriginalLength:   originalLength,
 		PackOffset:       e.PackedOffset(),
 		Length:           e.PackedLength(),
 		PackFile:         string(packFile),
 	}, nil
 }
 
+func (b *index) inlineEntryToInfo(blockID string, e *entry) (Info, error) {
+	// reads of all requested bytes may still report io.EOF, which is not an error.
+	payload := make([]byte, e.PackedLength())
+	n, err := b.readerAt.ReadAt(payload, int64(e.PackFileOffset()))
+	if n != len(payload) {
+		return Info{}, fmt.Errorf("can't read inline payload: %v", err)
+	}
+
+	return Info{
+		BlockID:          blockID,
+		Deleted:          e.IsDeleted(),
+		Provisional:      e.IsProvisional(),
+		TimestampSeconds: e.TimestampSeconds(),
+		FormatVersion:    e.PackedFormatVersion(),
+		Length:           e.PackedLength(),
+		Payload:          payload,
+	}, nil
+}
+
 // Close closes the index and the underlying reader.
 func (b *index) Close() error {
 	if closer, ok := b.readerAt.(io.Closer); ok {
@@ -196,3 +241,84 @@ func openPackIndex(readerAt io.ReaderAt) (packIndex, error) {
 	}
 	return &index{hdr: h, readerAt: readerAt}, nil
 }
+
+// verifyPackIndex verifies that the provided index data is internally consistent with the layout
+// produced by packIndexBuilder.Build().
+func verifyPackIndex(data []byte) error {
+	h, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "invalid header")
+	}
+
+	if h.valueSize < 20 {
+		return fmt.Errorf("invalid entry length: %v", h.valueSize)
+	}
+
+	stride := h.keySize + h.valueSize
+	extraDataOffset := 8 + int64(h.entryCount)*int64(stride)
+	if extraDataOffset > int64(len(data)) {
+		return fmt.Errorf("%v entries of %v bytes exceed index length %v", h.entryCount, stride, len(data))
+	}
+
+	if h.entryCount == 0 {
+		if extraDataOffset != int64(len(data)) {
+			return fmt.Errorf("unexpected extra data in empty index")
+		}
+		return nil
+	}
+
+	minPackFileOffset := int64(len(data))
+	maxPackFileEnd := extraDataOffset
+
+	var previousKey []byte
+	for i := 0; i < h.entryCount; i++ {
+		entryData := data[8+i*stride : 8+(i+1)*stride]
+		key := entryData[0:h.keySize]
+		if previousKey != nil && bytes.Compare(previousKey, key) >= 0 {
+			return fmt.Errorf("entry %v is not sorted", i)
+		}
+		previousKey = key
+
+		var e entry
+		if err := e.parse(entryData[h.keySize:]); err != nil {
+			return fmt.Errorf("invalid entry %v: %v", i, err)
+		}
+
+		// entries without a pack block ID reference their inline payload instead.
+		inline := e.PackFileLength() == 0 && h.version >= inlinePayloadIndexVersion
+		if e.PackFileLength() == 0 && !inline {
+			return fmt.Errorf("entry %v has empty pack block ID", i)
+		}
+
+		start := int64(e.PackFileOffset())
+		end := start + int64(e.PackFileLength())
+		if inline {
+			end = start + int64(e.PackedLength())
+		}
+
+		if start < extraDataOffset || end > int64(len(data)) {
+			return fmt.Errorf("entry %v references extra data at [%v,%v) outside of extra data [%v,%v)", i, start, end, extraDataOffset, len(data))
+		}
+
+		if start == end {
+			continue
+		}
+
+		if start < minPackFileOffset {
+			minPackFileOffset = start
+		}
+		if end > maxPackFileEnd {
+			maxPackFileEnd = end
+		}
+	}
+
+	if minPackFileOffset != extraDataOffset {
+		return fmt.Errorf("extra data starts at %v, expected %v", minPackFileOffset, extraDataOffset)
+	}
+
+	if maxPackFileEnd != int64(len(data)) {
+		return fmt.Errorf("unexpected %v bytes after extra data", int64(len(data))-maxPackFileEnd)
+	}
+
+	return nil
+}
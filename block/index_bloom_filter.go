@@ -0,0 +1,119 @@
+package block
+
+import (
+	"fmt"
+)
+
+const (
+	bloomFilterVersion       = 1
+	bloomFilterBitsPerEntry  = 10
+	bloomFilterHashFunctions = 7 // minimizes the false positive rate (under 1%) for 10 bits per entry
+	bloomFilterMinBits       = 64
+)
+
+// bloomFilter is a probabilistic set of block IDs. It never reports blocks that have been added as missing,
+// but reports a small fraction of other blocks as present.
+type bloomFilter struct {
+	hashFunctions uint32
+	bits          []byte
+}
+
+func newBloomFilter(entryCount int) *bloomFilter {
+	bitCount := entryCount * bloomFilterBitsPerEntry
+	if bitCount < bloomFilterMinBits {
+		bitCount = bloomFilterMinBits
+	}
+
+	return &bloomFilter{
+		hashFunctions: bloomFilterHashFunctions,
+		bits:          make([]byte, (bitCount+7)/8),
+	}
+}
+
+// bloomFilterHashes returns two independent hashes of the provided block ID (64-bit FNV-1a split in halves),
+// which are combined to derive the positions of all hash functions.
+func bloomFilterHashes(blockID string) (uint32, uint32) {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(blockID); i++ {
+		h ^= uint64(blockID[i])
+		h *= 1099511628211
+	}
+
+	// the second hash must be odd, so that positions don't repeat when the number of bits is even.
+	return uint32(h), uint32(h>>32) | 1
+}
+
+func (f *bloomFilter) add(blockID string) {
+	h1, h2 := bloomFilterHashes(blockID)
+	bitCount := uint32(len(f.bits) * 8)
+
+	for i := uint32(0); i < f.hashFunctions; i++ {
+		bit := (h1 + i*h2) % bitCount
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain returns false if the provided block has definitely not been added to the filter.
+func (f *bloomFilter) mayContain(blockID string) bool {
+	h1, h2 := bloomFilterHashes(blockID)
+	bitCount := uint32(len(f.bits) * 8)
+
+	for i := uint32(0); i < f.hashFunctions; i++ {
+		bit := (h1 + i*h2) % bitCount
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serialize returns the representation of the filter stored in the index cache, which consists of the version,
+// the number of hash functions and the bits of the filter.
+func (f *bloomFilter) serialize() []byte {
+	return append([]byte{bloomFilterVersion, byte(f.hashFunctions)}, f.bits...)
+}
+
+func parseBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < 2+bloomFilterMinBits/8 || data[0] != bloomFilterVersion || data[1] == 0 {
+		return nil, fmt.Errorf("invalid bloom filter")
+	}
+
+	return &bloomFilter{
+		hashFunctions: uint32(data[1]),
+		bits:          append([]byte(nil), data[2:]...),
+	}, nil
+}
+
+// buildBloomFilter returns a filter containing all blocks in the provided index.
+func buildBloomFilter(ndx packIndex) (*bloomFilter, error) {
+	var blockIDs []string
+	if err := ndx.Iterate("", func(i Info) error {
+		blockIDs = append(blockIDs, i.BlockID)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	f := newBloomFilter(len(blockIDs))
+	for _, blockID := range blockIDs {
+		f.add(blockID)
+	}
+
+	return f, nil
+}
+
+// bloomFilteredIndex is a packIndex that skips lookups of blocks its filter reports as missing.
+// False positives fall back to the lookup in the underlying index.
+type bloomFilteredIndex struct {
+	packIndex
+	filter *bloomFilter
+}
+
+func (b *bloomFilteredIndex) GetInfo(blockID string) (*Info, error) {
+	if !b.filter.mayContain(blockID) {
+		return nil, nil
+	}
+
+	return b.packIndex.GetInfo(blockID)
+}
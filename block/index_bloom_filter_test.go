@@ -0,0 +1,179 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kopia/repo/internal/storagetesting"
+)
+
+func bloomFilterTestBlockID(prefix string, i int) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%v-%v", prefix, i))))
+}
+
+func TestBloomFilter(t *testing.T) {
+	const entryCount = 10000
+
+	f := newBloomFilter(entryCount)
+	for i := 0; i < entryCount; i++ {
+		f.add(bloomFilterTestBlockID("present", i))
+	}
+
+	f2, err := parseBloomFilter(f.serialize())
+	if err != nil {
+		t.Fatalf("unable to parse bloom filter: %v", err)
+	}
+
+	for _, f := range []*bloomFilter{f, f2} {
+		for i := 0; i < entryCount; i++ {
+			if blockID := bloomFilterTestBlockID("present", i); !f.mayContain(blockID) {
+				t.Fatalf("bloom filter does not contain %v", blockID)
+			}
+		}
+
+		falsePositives := 0
+		for i := 0; i < entryCount; i++ {
+			if f.mayContain(bloomFilterTestBlockID("missing", i)) {
+				falsePositives++
+			}
+		}
+
+		if falsePositives > entryCount/50 {
+			t.Errorf("too many false positives: %v of %v", falsePositives, entryCount)
+		}
+	}
+
+	for _, data := range [][]byte{nil, {bloomFilterVersion}, {2, 7, 0, 0, 0, 0, 0, 0, 0, 0}, {bloomFilterVersion, 0, 0, 0, 0, 0, 0, 0, 0, 0}} {
+		if _, err := parseBloomFilter(data); err == nil {
+			t.Errorf("unexpected success parsing invalid bloom filter %x", data)
+		}
+	}
+}
+
+func TestIndexBloomFilters(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir, err := ioutil.TempDir("", "bloom")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(cacheDir) //nolint:errcheck
+
+	for _, caching := range []CachingOptions{
+		{IndexBloomFilters: true},
+		{IndexBloomFilters: true, CacheDirectory: cacheDir},
+	} {
+		data := map[string][]byte{}
+		st := storagetesting.NewMapStorage(data, nil, nil)
+		bm := newTestBlockManagerWithCaching(st, nil, caching)
+
+		var blockIDs []string
+		for i := 0; i < 5; i++ {
+			blockIDs = append(blockIDs, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+			assertNoError(t, bm.Flush(ctx))
+		}
+
+		bm2 := newTestBlockManagerWithCaching(st, nil, caching)
+		for i, blockID := range blockIDs {
+			verifyBlock(ctx, t, bm2, blockID, seededRandomData(i, 100))
+		}
+
+		for i := 0; i < 100; i++ {
+			verifyBlockNotFound(ctx, t, bm2, bloomFilterTestBlockID("missing", i))
+		}
+
+		if caching.CacheDirectory == "" {
+			continue
+		}
+
+		for _, indexBlockID := range cachedIndexFiles(t, cacheDir) {
+			if _, err := os.Stat(filepath.Join(cacheDir, "indexes", indexBlockID+bloomFilterSuffix)); err != nil {
+				t.Errorf("missing bloom filter of %v: %v", indexBlockID, err)
+			}
+		}
+	}
+}
+
+// probeCountingIndex counts lookups in the underlying index.
+type probeCountingIndex struct {
+	packIndex
+	probes *int
+}
+
+func (c probeCountingIndex) GetInfo(blockID string) (*Info, error) {
+	*c.probes++
+	return c.packIndex.GetInfo(blockID)
+}
+
+func BenchmarkMissingBlockLookup(b *testing.B) {
+	const (
+		indexCount         = 50
+		blocksPerIndex     = 1000
+		missingBlockLookup = 1000
+	)
+
+	var indexData [][]byte
+	for n := 0; n < indexCount; n++ {
+		bld := packIndexBuilder{}
+		for i := 0; i < blocksPerIndex; i++ {
+			bld.Add(Info{
+				BlockID:          bloomFilterTestBlockID(fmt.Sprintf("index-%v", n), i),
+				PackFile:         fmt.Sprintf("p%v", n),
+				PackOffset:       uint32(i * 100),
+				Length:           100,
+				TimestampSeconds: int64(n),
+			})
+		}
+
+		var buf bytes.Buffer
+		if err := bld.Build(&buf); err != nil {
+			b.Fatalf("unable to build index: %v", err)
+		}
+		indexData = append(indexData, buf.Bytes())
+	}
+
+	var missing []string
+	for i := 0; i < missingBlockLookup; i++ {
+		missing = append(missing, bloomFilterTestBlockID("missing", i))
+	}
+
+	for _, bloomFilters := range []bool{false, true} {
+		b.Run(fmt.Sprintf("bloomFilters=%v", bloomFilters), func(b *testing.B) {
+			probes := 0
+
+			var merged mergedIndex
+			for _, data := range indexData {
+				ndx, err := openPackIndex(bytes.NewReader(data))
+				if err != nil {
+					b.Fatalf("unable to open index: %v", err)
+				}
+
+				var counted packIndex = probeCountingIndex{ndx, &probes}
+				if bloomFilters {
+					f, err := buildBloomFilter(ndx)
+					if err != nil {
+						b.Fatalf("unable to build bloom filter: %v", err)
+					}
+					counted = &bloomFilteredIndex{counted, f}
+				}
+
+				merged = append(merged, counted)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if info, err := merged.GetInfo(missing[i%missingBlockLookup]); info != nil || err != nil {
+					b.Fatalf("unexpected result: %v %v", info, err)
+				}
+			}
+
+			b.ReportMetric(float64(probes)/float64(b.N), "probes/op")
+		})
+	}
+}
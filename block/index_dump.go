@@ -0,0 +1,95 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dumpedIndexEntry is the representation of an index entry emitted by DumpIndexJSON().
+type dumpedIndexEntry struct {
+	BlockID       string    `json:"blockID"`
+	PackFile      string    `json:"packFile"`
+	PackOffset    uint32    `json:"packOffset"`
+	Length        uint32    `json:"length"`
+	Deleted       bool      `json:"deleted"`
+	Provisional   bool      `json:"provisional,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+	FormatVersion byte      `json:"formatVersion"`
+	Compression   byte      `json:"compression,omitempty"`
+}
+
+// DumpIndex parses a pack index in the format produced by the block manager and writes its entries to the provided
+// writer as tab-separated values, one entry per line, preceded by a header line.
+func DumpIndex(r io.Reader, w io.Writer) error {
+	entries, err := readIndexEntriesForDump(r)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(tw, "BLOCK ID\tPACK FILE\tOFFSET\tLENGTH\tDELETED\tTIMESTAMP\tFORMAT VERSION") //nolint:errcheck
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", e.BlockID, e.PackFile, e.PackOffset, e.Length, e.Deleted, e.Timestamp.Format(time.RFC3339), e.FormatVersion) //nolint:errcheck
+	}
+
+	return tw.Flush()
+}
+
+// DumpIndexJSON parses a pack index in the format produced by the block manager and writes its entries
+// to the provided writer as a JSON array.
+func DumpIndexJSON(r io.Reader, w io.Writer) error {
+	entries, err := readIndexEntriesForDump(r)
+	if err != nil {
+		return err
+	}
+
+	if entries == nil {
+		entries = []dumpedIndexEntry{}
+	}
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(entries)
+}
+
+func readIndexEntriesForDump(r io.Reader) ([]dumpedIndexEntry, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read index")
+	}
+
+	if err := verifyPackIndex(data); err != nil {
+		return nil, errors.Wrap(err, "invalid index")
+	}
+
+	ndx, err := openPackIndex(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer ndx.Close() //nolint:errcheck
+
+	var entries []dumpedIndexEntry
+	err = ndx.Iterate("", func(i Info) error {
+		entries = append(entries, dumpedIndexEntry{
+			BlockID:       i.BlockID,
+			PackFile:      i.PackFile,
+			PackOffset:    i.PackOffset,
+			Length:        i.Length,
+			Deleted:       i.Deleted,
+			Provisional:   i.Provisional,
+			Timestamp:     i.Timestamp().UTC(),
+			FormatVersion: i.FormatVersion,
+			Compression:   i.Compression,
+		})
+		return nil
+	})
+
+	return entries, err
+}
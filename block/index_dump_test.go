@@ -0,0 +1,56 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDumpIndex(t *testing.T) {
+	b := packIndexBuilder{}
+	b.Add(Info{BlockID: "abcdef", PackFile: "p123", PackOffset: 10, Length: 20, TimestampSeconds: 1000, FormatVersion: 1})
+	b.Add(Info{BlockID: "x123456", PackFile: "p456", PackOffset: 30, Length: 40, TimestampSeconds: 2000, FormatVersion: 1, Deleted: true})
+
+	var index bytes.Buffer
+	if err := b.Build(&index); err != nil {
+		t.Fatalf("unable to build index: %v", err)
+	}
+
+	var tsv bytes.Buffer
+	if err := DumpIndex(bytes.NewReader(index.Bytes()), &tsv); err != nil {
+		t.Fatalf("unable to dump index: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(tsv.String()), "\n")
+	if got, want := len(lines), 3; got != want {
+		t.Fatalf("unexpected number of lines: %v, wanted %v:\n%v", got, want, tsv.String())
+	}
+
+	for i, want := range [][]string{
+		{"abcdef", "p123", "10", "20", "false", "1970-01-01T00:16:40Z", "1"},
+		{"x123456", "p456", "30", "40", "true", "1970-01-01T00:33:20Z", "1"},
+	} {
+		if got := strings.Fields(lines[i+1]); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("unexpected entry #%v: %v, wanted %v", i, got, want)
+		}
+	}
+
+	var js bytes.Buffer
+	if err := DumpIndexJSON(bytes.NewReader(index.Bytes()), &js); err != nil {
+		t.Fatalf("unable to dump index: %v", err)
+	}
+
+	var entries []dumpedIndexEntry
+	if err := json.Unmarshal(js.Bytes(), &entries); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	if len(entries) != 2 || entries[0].BlockID != "abcdef" || entries[1].BlockID != "x123456" || !entries[1].Deleted || entries[1].PackOffset != 30 {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+
+	if err := DumpIndex(strings.NewReader("not an index"), &tsv); err == nil {
+		t.Errorf("expected error dumping invalid index")
+	}
+}
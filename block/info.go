@@ -7,13 +7,33 @@ import (
 // Info is an information about a single block managed by Manager.
 type Info struct {
 	BlockID          string `json:"blockID"`
-	Length           uint32 `json:"length"`
+	Length           uint32 `json:"length"` // length of the payload before encryption, which is compressed if Compression is set
 	TimestampSeconds int64  `json:"time"`
 	PackFile         string `json:"packFile,omitempty"`
 	PackOffset       uint32 `json:"packOffset,omitempty"`
 	Deleted          bool   `json:"deleted"`
-	Payload          []byte `json:"payload"` // set for payloads stored inline
+	Provisional      bool   `json:"provisional,omitempty"` // committed before the pack is confirmed durable, see ConfirmBlock()
+	Payload          []byte `json:"payload"`               // set for payloads stored inline
 	FormatVersion    byte   `json:"formatVersion"`
+	Compression      byte   `json:"compression,omitempty"` // identifies the compression algorithm, zero when uncompressed
+
+	// OriginalLength is the length of the contents of a compressed block before compression, zero when
+	// the block is not compressed or its index entry was written before the length was recorded.
+	OriginalLength uint32 `json:"originalLength,omitempty"`
+}
+
+// ContentLength returns the length of the contents of the block, as returned by GetBlock(), and whether
+// it is known without reading the block, which is not the case for compressed blocks whose index entries don't
+// record the original length.
+func (i Info) ContentLength() (int64, bool) {
+	switch {
+	case i.Compression == 0:
+		return int64(i.Length), true
+	case i.OriginalLength > 0:
+		return int64(i.OriginalLength), true
+	default:
+		return 0, false
+	}
 }
 
 // Timestamp returns the time when a block was created or deleted.
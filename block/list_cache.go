@@ -17,6 +17,7 @@ type listCache struct {
 	cacheFile         string
 	listCacheDuration time.Duration
 	hmacSecret        []byte
+	indexSets         bool // whether the repository format supports index sets
 }
 
 func (c *listCache) listIndexBlocks(ctx context.Context) ([]IndexInfo, error) {
@@ -33,7 +34,7 @@ func (c *listCache) listIndexBlocks(ctx context.Context) ([]IndexInfo, error) {
 		}
 	}
 
-	blocks, err := listIndexBlocksFromStorage(ctx, c.st)
+	blocks, err := listIndexBlocksFromStorage(ctx, c.st, c.indexSets)
 	if err == nil {
 		c.saveListToCache(ctx, &cachedList{
 			Blocks:    blocks,
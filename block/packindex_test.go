@@ -49,7 +49,10 @@ func TestPackIndex(t *testing.T) {
 		return uint32(rnd.Int31())
 	}
 	deterministicFormatVersion := func(id int) byte {
-		return byte(id % 100)
+		return byte(id % (formatVersionMask + 1))
+	}
+	deterministicCompression := func(id int) byte {
+		return byte(id % (maxCompressionID + 1))
 	}
 
 	randomUnixTime := func() int64 {
@@ -68,6 +71,7 @@ func TestPackIndex(t *testing.T) {
 			PackOffset:       deterministicPackedOffset(i),
 			Length:           deterministicPackedLength(i),
 			FormatVersion:    deterministicFormatVersion(i),
+			Compression:      deterministicCompression(i),
 		})
 	}
 	// non-deleted block
@@ -79,6 +83,7 @@ func TestPackIndex(t *testing.T) {
 			PackOffset:       deterministicPackedOffset(i),
 			Length:           deterministicPackedLength(i),
 			FormatVersion:    deterministicFormatVersion(i),
+			Compression:      deterministicCompression(i),
 		})
 	}
 
@@ -177,6 +182,95 @@ func TestPackIndex(t *testing.T) {
 	}
 }
 
+func TestPackIndexKeyLengths(t *testing.T) {
+	full := strings.Repeat("ab", 32)
+	short := strings.Repeat("cd", 16)
+
+	// prefixed and unprefixed keys of the same hash length have keys of the same length.
+	b := packIndexBuilder{}
+	for _, blockID := range []string{full, "x" + full, strings.Repeat("12", 32)} {
+		b.Add(Info{BlockID: blockID, PackFile: "p1", TimestampSeconds: 1})
+	}
+
+	var buf bytes.Buffer
+	assertNoError(t, b.Build(&buf))
+	if got, want := int(buf.Bytes()[1]), 33; got != want {
+		t.Errorf("unexpected key length: %v, wanted %v", got, want)
+	}
+
+	ndx, err := openPackIndex(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("can't open index: %v", err)
+	}
+	defer ndx.Close() //nolint:errcheck
+
+	if i, err := ndx.GetInfo("x" + full); err != nil || i == nil {
+		t.Errorf("unable to get info: %v %v", i, err)
+	}
+
+	b.Add(Info{BlockID: "m" + short, PackFile: "p1", TimestampSeconds: 1})
+
+	var buf2 bytes.Buffer
+	err = b.Build(&buf2)
+	if err == nil || !strings.Contains(err.Error(), "m"+short) {
+		t.Errorf("unexpected error building index with mixed key lengths: %v", err)
+	}
+
+	if buf2.Len() != 0 {
+		t.Errorf("unexpected output of failed build: %v bytes", buf2.Len())
+	}
+}
+
+func TestPackIndexInlinePayloads(t *testing.T) {
+	infos := []Info{
+		{BlockID: "ab", PackFile: "p1", PackOffset: 10, Length: 100, TimestampSeconds: 1},
+		{BlockID: "cd", Payload: []byte("inline"), Length: 6, TimestampSeconds: 2, FormatVersion: 1},
+		{BlockID: "ef", Payload: []byte{}, TimestampSeconds: 3},
+		{BlockID: "fe", Payload: []byte("x"), Length: 1, TimestampSeconds: 4, Deleted: true},
+	}
+
+	var plain bytes.Buffer
+	assertNoError(t, packIndexBuilder{"ab": &infos[0]}.Build(&plain))
+	if plain.Bytes()[0] != 1 {
+		t.Errorf("unexpected version of index without inline payloads: %v", plain.Bytes()[0])
+	}
+
+	b := packIndexBuilder{}
+	for _, i := range infos {
+		b.Add(i)
+	}
+
+	var buf bytes.Buffer
+	assertNoError(t, b.Build(&buf))
+	data := buf.Bytes()
+
+	// readers that predate inline payloads only accept version 1.
+	if data[0] != inlinePayloadIndexVersion {
+		t.Errorf("unexpected version of index with inline payloads: %v", data[0])
+	}
+
+	if err := verifyPackIndex(data); err != nil {
+		t.Errorf("index with inline payloads failed verification: %v", err)
+	}
+
+	ndx, err := openPackIndex(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("can't open index: %v", err)
+	}
+	defer ndx.Close() //nolint:errcheck
+
+	for _, want := range infos {
+		got, err := ndx.GetInfo(want.BlockID)
+		if err != nil || got == nil {
+			t.Fatalf("unable to get info of %v: %v %v", want.BlockID, got, err)
+		}
+
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("unexpected info of %v: %+v, wanted %+v", want.BlockID, *got, want)
+		}
+	}
+}
+
 func fuzzTestIndexOpen(t *testing.T, originalData []byte) {
 	// use consistent random
 	rnd := rand.New(rand.NewSource(12345))
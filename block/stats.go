@@ -1,5 +1,7 @@
 package block
 
+import "time"
+
 // Stats exposes statistics about block operation.
 type Stats struct {
 	// Keep int64 fields first to ensure they get aligned to at least 64-bit boundaries
@@ -23,3 +25,34 @@ type Stats struct {
 func (s *Stats) Reset() {
 	*s = Stats{}
 }
+
+// Timings records time spent in individual phases of writing blocks.
+// Encryption and storage of packed blocks happens when a pack is written, so it is recorded in the Timings
+// of the write that completes the pack or of Flush(), not of the writes that added the blocks.
+// Durations may be updated concurrently and should only be read after writes have completed.
+type Timings struct {
+	Hashing    time.Duration `json:"hashing"`
+	Encryption time.Duration `json:"encryption"`
+	Storage    time.Duration `json:"storage"`
+}
+
+func (t *Timings) hashing() *time.Duration {
+	if t == nil {
+		return nil
+	}
+	return &t.Hashing
+}
+
+func (t *Timings) encryption() *time.Duration {
+	if t == nil {
+		return nil
+	}
+	return &t.Encryption
+}
+
+func (t *Timings) storage() *time.Duration {
+	if t == nil {
+		return nil
+	}
+	return &t.Storage
+}
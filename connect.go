@@ -21,7 +21,7 @@ type ConnectOptions struct {
 
 // Connect connects to the repository in the specified storage and persists the configuration and credentials in the file provided.
 func Connect(ctx context.Context, configFile string, st storage.Storage, password string, opt ConnectOptions) error {
-	formatBytes, err := st.GetBlock(ctx, FormatBlockID, 0, -1)
+	formatBytes, err := readFormatBlockBytes(ctx, st)
 	if err != nil {
 		return errors.Wrap(err, "unable to read format block")
 	}
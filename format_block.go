@@ -8,6 +8,7 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -36,6 +37,9 @@ var (
 	purposeAuthData = []byte("CHECKSUM")
 
 	errFormatBlockNotFound = errors.New("format block not found")
+
+	// ErrFormatFingerprintMismatch is returned when the format block does not match the fingerprint pinned in Options.
+	ErrFormatFingerprintMismatch = errors.New("format block fingerprint mismatch")
 )
 
 type formatBlock struct {
@@ -57,6 +61,12 @@ type encryptedRepositoryConfig struct {
 	Format repositoryObjectFormat `json:"format"`
 }
 
+// formatBlockFingerprint returns the fingerprint of raw format block bytes as stored in the repository.
+func formatBlockFingerprint(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
 func parseFormatBlock(b []byte) (*formatBlock, error) {
 	f := &formatBlock{}
 
@@ -144,7 +154,8 @@ func verifyFormatBlockChecksum(b []byte) ([]byte, bool) {
 	return data, true
 }
 
-func writeFormatBlock(ctx context.Context, st storage.Storage, f *formatBlock) error {
+// writeFormatBlock writes the format block and its redundant copies with provided IDs.
+func writeFormatBlock(ctx context.Context, st storage.Storage, f *formatBlock, copyIDs []string) error {
 	var buf bytes.Buffer
 	e := json.NewEncoder(&buf)
 	e.SetIndent("", "  ")
@@ -152,13 +163,121 @@ func writeFormatBlock(ctx context.Context, st storage.Storage, f *formatBlock) e
 		return errors.Wrap(err, "unable to marshal format block")
 	}
 
-	if err := st.PutBlock(ctx, FormatBlockID, buf.Bytes()); err != nil {
-		return errors.Wrap(err, "unable to write format block")
+	for _, id := range append([]string{FormatBlockID}, copyIDs...) {
+		if err := st.PutBlock(ctx, id, buf.Bytes()); err != nil {
+			return errors.Wrapf(err, "unable to write format block %v", id)
+		}
 	}
 
 	return nil
 }
 
+func init() {
+	// the format block and its redundant copies.
+	storage.RegisterBlockNameFormat(FormatBlockID, storage.BlockKindFormat, func(s string) bool {
+		if s == "" {
+			return true
+		}
+
+		if len(s) < 2 || s[0] != '.' {
+			return false
+		}
+
+		for _, c := range s[1:] {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// formatBlockCopyID returns the identifier of n-th redundant copy of the format block.
+func formatBlockCopyID(n int) string {
+	return fmt.Sprintf("%v.%v", FormatBlockID, n)
+}
+
+// listFormatBlockCopies returns the identifiers of redundant copies of the format block present in the storage.
+func listFormatBlockCopies(ctx context.Context, st storage.Storage) ([]string, error) {
+	var ids []string
+
+	if err := st.ListBlocks(ctx, FormatBlockID+".", func(bm storage.BlockMetadata) error {
+		ids = append(ids, bm.BlockID)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "unable to list format block copies")
+	}
+
+	return ids, nil
+}
+
+// readFormatBlockBytes reads the format block, falling back to its redundant copies if it's not available.
+// The primary format block is preferred, when it's missing the contents shared by most copies are used.
+// Copies that diverge from the chosen contents are reported, but don't prevent reading.
+func readFormatBlockBytes(ctx context.Context, st storage.Storage) ([]byte, error) {
+	copyIDs, err := listFormatBlockCopies(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	var contents [][]byte
+
+	for _, id := range append([]string{FormatBlockID}, copyIDs...) {
+		b, err := st.GetBlock(ctx, id, 0, -1)
+		if err == storage.ErrBlockNotFound {
+			log.Debugf("format block %v not found", id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+		contents = append(contents, b)
+	}
+
+	if len(contents) == 0 {
+		return nil, storage.ErrBlockNotFound
+	}
+
+	result := contents[0]
+	if ids[0] != FormatBlockID {
+		result = mostCommonContents(contents)
+	}
+
+	for i, b := range contents {
+		if !bytes.Equal(result, b) {
+			log.Warningf("format block %v is inconsistent with other copies, ignoring", ids[i])
+		}
+	}
+
+	return result, nil
+}
+
+// mostCommonContents returns the contents that occur most often, preferring earlier ones in case of a tie.
+func mostCommonContents(contents [][]byte) []byte {
+	var result []byte
+	var resultCount int
+
+	for _, b := range contents {
+		var cnt int
+		for _, other := range contents {
+			if bytes.Equal(b, other) {
+				cnt++
+			}
+		}
+
+		if cnt > resultCount {
+			result = b
+			resultCount = cnt
+		}
+	}
+
+	return result
+}
+
 func (f *formatBlock) decryptFormatBytes(masterKey []byte) (*repositoryObjectFormat, error) {
 	switch f.EncryptionAlgorithm {
 	case "NONE": // do nothing
@@ -25,6 +25,8 @@ type NewRepositoryOptions struct {
 	BlockFormat  block.FormattingOptions
 	DisableHMAC  bool
 	ObjectFormat object.Format // object format
+
+	FormatBlockCopies int // number of redundant copies of the format block to write in addition to the primary one
 }
 
 // Initialize creates initial repository data structures in the specified storage with given credentials.
@@ -33,8 +35,19 @@ func Initialize(ctx context.Context, st storage.Storage, opt *NewRepositoryOptio
 		opt = &NewRepositoryOptions{}
 	}
 
+	objectFormat := repositoryObjectFormatFromOptions(opt)
+
+	// algorithms are resolved by name through the block format registry, fail before anything is written.
+	if _, _, err := block.CreateHashAndEncryptor(objectFormat.FormattingOptions); err != nil {
+		return errors.Wrap(err, "invalid block format")
+	}
+
+	if err := objectFormat.Format.ValidateBlockSizes(); err != nil {
+		return errors.Wrap(err, "invalid object format")
+	}
+
 	// get the block - expect ErrBlockNotFound
-	_, err := st.GetBlock(ctx, FormatBlockID, 0, -1)
+	_, err := readFormatBlockBytes(ctx, st)
 	if err == nil {
 		return fmt.Errorf("repository already initialized")
 	}
@@ -48,11 +61,16 @@ func Initialize(ctx context.Context, st storage.Storage, opt *NewRepositoryOptio
 		return errors.Wrap(err, "unable to derive master key")
 	}
 
-	if err := encryptFormatBytes(format, repositoryObjectFormatFromOptions(opt), masterKey, format.UniqueID); err != nil {
+	if err := encryptFormatBytes(format, objectFormat, masterKey, format.UniqueID); err != nil {
 		return errors.Wrap(err, "unable to encrypt format bytes")
 	}
 
-	if err := writeFormatBlock(ctx, st, format); err != nil {
+	var copyIDs []string
+	for i := 1; i <= opt.FormatBlockCopies; i++ {
+		copyIDs = append(copyIDs, formatBlockCopyID(i))
+	}
+
+	if err := writeFormatBlock(ctx, st, format, copyIDs); err != nil {
 		return errors.Wrap(err, "unable to write format block")
 	}
 
@@ -77,20 +95,33 @@ func formatBlockFromOptions(opt *NewRepositoryOptions) *formatBlock {
 }
 
 func repositoryObjectFormatFromOptions(opt *NewRepositoryOptions) *repositoryObjectFormat {
+	// block sizes that aren't provided default to the proportions of 10/16/20 MiB.
+	maxBlockSize := applyDefaultInt(opt.ObjectFormat.MaxBlockSize, 20<<20) // 20MiB
+	avgBlockSize := applyDefaultInt(opt.ObjectFormat.AvgBlockSize, maxBlockSize*4/5)
+
 	f := &repositoryObjectFormat{
 		FormattingOptions: block.FormattingOptions{
-			Version:     1,
+			Version:     applyDefaultInt(opt.BlockFormat.Version, block.DefaultFormatVersion),
 			Hash:        applyDefaultString(opt.BlockFormat.Hash, block.DefaultHash),
 			Encryption:  applyDefaultString(opt.BlockFormat.Encryption, block.DefaultEncryption),
 			HMACSecret:  applyDefaultRandomBytes(opt.BlockFormat.HMACSecret, 32),
 			MasterKey:   applyDefaultRandomBytes(opt.BlockFormat.MasterKey, 32),
 			MaxPackSize: applyDefaultInt(opt.BlockFormat.MaxPackSize, applyDefaultInt(opt.ObjectFormat.MaxBlockSize, 20<<20)), // 20 MB
+			Compression: opt.BlockFormat.Compression,
+
+			MaxInlinePayloadSize: opt.BlockFormat.MaxInlinePayloadSize,
 		},
 		Format: object.Format{
 			Splitter:     applyDefaultString(opt.ObjectFormat.Splitter, object.DefaultSplitter),
-			MaxBlockSize: applyDefaultInt(opt.ObjectFormat.MaxBlockSize, 20<<20), // 20MiB
-			MinBlockSize: applyDefaultInt(opt.ObjectFormat.MinBlockSize, 10<<20), // 10MiB
-			AvgBlockSize: applyDefaultInt(opt.ObjectFormat.AvgBlockSize, 16<<20), // 16MiB
+			MaxBlockSize: maxBlockSize,
+			MinBlockSize: applyDefaultInt(opt.ObjectFormat.MinBlockSize, avgBlockSize*5/8),
+			AvgBlockSize: avgBlockSize,
+
+			SplitterWindowSize: opt.ObjectFormat.SplitterWindowSize,
+
+			Compression:        opt.ObjectFormat.Compression,
+			CompressionLevel:   opt.ObjectFormat.CompressionLevel,
+			MinCompressionSize: opt.ObjectFormat.MinCompressionSize,
 		},
 	}
 
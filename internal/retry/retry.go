@@ -3,6 +3,7 @@ package retry
 
 import (
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/kopia/repo/internal/repologging"
@@ -10,11 +11,14 @@ import (
 
 var log = repologging.Logger("repo/retry")
 
-var (
-	maxAttempts             = 10
-	retryInitialSleepAmount = 1 * time.Second
-	retryMaxSleepAmount     = 32 * time.Second
-)
+// defaultPolicy is used by WithExponentialBackoff() and provides the values of the fields of other policies left empty.
+var defaultPolicy = Policy{
+	MaxAttempts:  10,
+	InitialSleep: 1 * time.Second,
+	MaxSleep:     32 * time.Second,
+	Multiplier:   2,
+	RandomFloat:  rand.Float64,
+}
 
 // AttemptFunc performs an attempt and returns a value (optional, may be nil) and an error.
 type AttemptFunc func() (interface{}, error)
@@ -22,23 +26,84 @@ type AttemptFunc func() (interface{}, error)
 // IsRetriableFunc is a function that determines whether an error is retriable.
 type IsRetriableFunc func(err error) bool
 
+// Policy determines the number of attempts and delays between them, zero values select the defaults
+// (10 attempts, sleeping for up to 1s before the first retry, doubling with each retry up to 32s).
+//
+// Each delay is a random duration between zero and the current limit (InitialSleep, multiplied with each retry
+// up to MaxSleep), which spreads retries of concurrent operations failing at the same time.
+type Policy struct {
+	MaxAttempts  int
+	InitialSleep time.Duration
+	MaxSleep     time.Duration
+
+	// Multiplier is the factor by which the delay grows with each retry, values below 1 select the default.
+	Multiplier float64
+
+	// RandomFloat returns random numbers in [0,1) determining the delays, defaults to rand.Float64().
+	RandomFloat func() float64
+
+	// OnRetry, if set, is invoked with the number of the failed attempt (starting at 1) and its error before
+	// sleeping for nextSleep and retrying. It is not invoked when the last attempt fails.
+	OnRetry func(attempt int, err error, nextSleep time.Duration)
+}
+
+// withDefaults returns the policy with empty fields replaced by the defaults.
+func (p Policy) withDefaults() Policy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultPolicy.MaxAttempts
+	}
+	if p.InitialSleep <= 0 {
+		p.InitialSleep = defaultPolicy.InitialSleep
+	}
+	if p.MaxSleep <= 0 {
+		p.MaxSleep = defaultPolicy.MaxSleep
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaultPolicy.Multiplier
+	}
+	if p.RandomFloat == nil {
+		p.RandomFloat = defaultPolicy.RandomFloat
+	}
+
+	return p
+}
+
 // WithExponentialBackoff runs the provided attempt until it succeeds, retrying on all errors that are
 // deemed retriable by the provided function. The delay between retries grows exponentially up to
 // a certain limit.
 func WithExponentialBackoff(desc string, attempt AttemptFunc, isRetriableError IsRetriableFunc) (interface{}, error) {
-	sleepAmount := retryInitialSleepAmount
-	for i := 0; i < maxAttempts; i++ {
+	return WithPolicy(defaultPolicy, desc, attempt, isRetriableError)
+}
+
+// WithPolicy is like WithExponentialBackoff() but uses the number of attempts and delays of the provided policy.
+func WithPolicy(policy Policy, desc string, attempt AttemptFunc, isRetriableError IsRetriableFunc) (interface{}, error) {
+	policy = policy.withDefaults()
+	maxSleepAmount := policy.InitialSleep
+
+	for i := 0; i < policy.MaxAttempts; i++ {
 		v, err := attempt()
 		if !isRetriableError(err) {
 			return v, err
 		}
+		if i == policy.MaxAttempts-1 {
+			break
+		}
+		sleepAmount := policy.jitter(maxSleepAmount)
 		log.Debugf("got error %v when %v (#%v), sleeping for %v before retrying", err, desc, i, sleepAmount)
+		if policy.OnRetry != nil {
+			policy.OnRetry(i+1, err, sleepAmount)
+		}
 		time.Sleep(sleepAmount)
-		sleepAmount *= 2
-		if sleepAmount > retryMaxSleepAmount {
-			sleepAmount = retryMaxSleepAmount
+		maxSleepAmount = time.Duration(float64(maxSleepAmount) * policy.Multiplier)
+		if maxSleepAmount > policy.MaxSleep {
+			maxSleepAmount = policy.MaxSleep
 		}
 	}
 
-	return nil, fmt.Errorf("unable to complete %v despite %v retries", desc, maxAttempts)
+	return nil, fmt.Errorf("unable to complete %v despite %v retries", desc, policy.MaxAttempts)
+}
+
+// jitter returns a random duration between zero and the provided limit.
+func (p Policy) jitter(max time.Duration) time.Duration {
+	return time.Duration(p.RandomFloat() * float64(max))
 }
@@ -3,6 +3,7 @@ package retry
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"testing"
 	"time"
@@ -17,9 +18,11 @@ func isRetriable(e error) bool {
 }
 
 func TestRetry(t *testing.T) {
-	retryInitialSleepAmount = 10 * time.Millisecond
-	retryMaxSleepAmount = 20 * time.Millisecond
-	maxAttempts = 3
+	policy := Policy{
+		InitialSleep: 10 * time.Millisecond,
+		MaxSleep:     20 * time.Millisecond,
+		MaxAttempts:  3,
+	}
 
 	cnt := 0
 
@@ -46,7 +49,7 @@ func TestRetry(t *testing.T) {
 			tc := tc
 			t.Parallel()
 
-			got, err := WithExponentialBackoff(tc.desc, tc.f, isRetriable)
+			got, err := WithPolicy(policy, tc.desc, tc.f, isRetriable)
 			if !reflect.DeepEqual(err, tc.wantError) {
 				t.Errorf("invalid error %q, wanted %q", err, tc.wantError)
 			}
@@ -57,3 +60,135 @@ func TestRetry(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryMultiplier(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		multiplier float64
+		minElapsed time.Duration
+		maxElapsed time.Duration
+	}{
+		// sleeps for 10ms, 10ms and 10ms without jitter between 4 attempts
+		{multiplier: 1, minElapsed: 30 * time.Millisecond, maxElapsed: 200 * time.Millisecond},
+		// sleeps for 10ms, 40ms and 160ms
+		{multiplier: 4, minElapsed: 210 * time.Millisecond, maxElapsed: 10 * time.Second},
+	}
+
+	for _, tc := range cases {
+		policy := Policy{
+			InitialSleep: 10 * time.Millisecond,
+			MaxSleep:     time.Second,
+			MaxAttempts:  4,
+			Multiplier:   tc.multiplier,
+			RandomFloat:  func() float64 { return 1 },
+		}
+
+		attempts := 0
+		t0 := time.Now()
+		_, err := WithPolicy(policy, "multiplier", func() (interface{}, error) {
+			attempts++
+			return nil, errRetriable
+		}, isRetriable)
+		elapsed := time.Since(t0)
+
+		if err == nil || attempts != 4 {
+			t.Errorf("unexpected result with multiplier %v: %v after %v attempts", tc.multiplier, err, attempts)
+		}
+
+		if elapsed < tc.minElapsed || elapsed > tc.maxElapsed {
+			t.Errorf("unexpected duration of retries with multiplier %v: %v, wanted between %v and %v", tc.multiplier, elapsed, tc.minElapsed, tc.maxElapsed)
+		}
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+	policy := Policy{
+		InitialSleep: 10 * time.Millisecond,
+		MaxSleep:     40 * time.Millisecond,
+		Multiplier:   2,
+		RandomFloat:  rnd.Float64,
+	}.withDefaults()
+
+	for _, max := range []time.Duration{0, time.Nanosecond, 10 * time.Millisecond, 40 * time.Millisecond, time.Hour} {
+		for i := 0; i < 1000; i++ {
+			if d := policy.jitter(max); d < 0 || d > max {
+				t.Fatalf("invalid jittered sleep %v, wanted between 0 and %v", d, max)
+			}
+		}
+	}
+
+	// with the randomness source returning zero, retries don't sleep at all despite long delays.
+	policy = Policy{
+		InitialSleep: time.Hour,
+		MaxSleep:     time.Hour,
+		MaxAttempts:  5,
+		RandomFloat:  func() float64 { return 0 },
+	}
+
+	attempts := 0
+	t0 := time.Now()
+	_, err := WithPolicy(policy, "jitter", func() (interface{}, error) {
+		attempts++
+		return nil, errRetriable
+	}, isRetriable)
+
+	if want := fmt.Errorf("unable to complete jitter despite 5 retries"); !reflect.DeepEqual(err, want) || attempts != 5 {
+		t.Errorf("unexpected result: %v after %v attempts, wanted %v", err, attempts, want)
+	}
+
+	if elapsed := time.Since(t0); elapsed > 10*time.Second {
+		t.Errorf("retries took too long: %v", elapsed)
+	}
+}
+
+func TestRetryOnRetry(t *testing.T) {
+	t.Parallel()
+
+	type retryInfo struct {
+		attempt   int
+		err       error
+		nextSleep time.Duration
+	}
+
+	var retries []retryInfo
+	policy := Policy{
+		InitialSleep: 10 * time.Millisecond,
+		MaxAttempts:  4,
+		RandomFloat:  func() float64 { return 0.5 },
+		OnRetry: func(attempt int, err error, nextSleep time.Duration) {
+			retries = append(retries, retryInfo{attempt, err, nextSleep})
+		},
+	}
+
+	errs := []error{
+		fmt.Errorf("error 1"),
+		fmt.Errorf("error 2"),
+		fmt.Errorf("error 3"),
+		fmt.Errorf("error 4"),
+	}
+
+	attempts := 0
+	_, err := WithPolicy(policy, "on-retry", func() (interface{}, error) {
+		attempts++
+		return nil, errs[attempts-1]
+	}, func(error) bool { return true })
+
+	if err == nil || attempts != 4 {
+		t.Fatalf("unexpected result: %v after %v attempts", err, attempts)
+	}
+
+	// the failure of the last attempt is not retried.
+	want := []retryInfo{
+		{1, errs[0], 5 * time.Millisecond},
+		{2, errs[1], 10 * time.Millisecond},
+		{3, errs[2], 20 * time.Millisecond},
+	}
+
+	if !reflect.DeepEqual(retries, want) {
+		t.Errorf("unexpected retries: %v, wanted %v", retries, want)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/kopia/repo/storage"
 )
@@ -83,6 +84,108 @@ func AssertGetBlockNotFound(ctx context.Context, t *testing.T, s storage.Storage
 	}
 }
 
+// AssertGetBlocks asserts that GetBlocks() returns the expected results, which must have either the expected data
+// or the expected error.
+func AssertGetBlocks(ctx context.Context, t *testing.T, s storage.Storage, reqs []storage.BlockRange, expected []storage.BlockResult) {
+	t.Helper()
+
+	results, err := s.GetBlocks(ctx, reqs)
+	if err != nil {
+		t.Errorf("GetBlocks() returned error %v", err)
+		return
+	}
+
+	if len(results) != len(expected) {
+		t.Errorf("GetBlocks() returned %v results, expected %v", len(results), len(expected))
+		return
+	}
+
+	for i, r := range results {
+		want := expected[i]
+		if r.BlockID != want.BlockID || r.Err != want.Err || !bytes.Equal(r.Data, want.Data) {
+			t.Errorf("GetBlocks() result %v was %v, %x, %v but expected %v, %x, %v", i, r.BlockID, r.Data, r.Err, want.BlockID, want.Data, want.Err)
+		}
+	}
+}
+
+// AssertGetBlockSize asserts that GetBlockSize() of the specified storage block returns the expected length.
+func AssertGetBlockSize(ctx context.Context, t *testing.T, s storage.Storage, block string, expected int64) {
+	t.Helper()
+
+	l, err := s.GetBlockSize(ctx, block)
+	if err != nil || l != expected {
+		t.Errorf("GetBlockSize(%v) returned %v, %v but expected %v", block, l, err, expected)
+	}
+}
+
+// AssertGetBlockSizeNotFound asserts that GetBlockSize() for specified storage block returns ErrBlockNotFound.
+func AssertGetBlockSizeNotFound(ctx context.Context, t *testing.T, s storage.Storage, block string) {
+	t.Helper()
+
+	l, err := s.GetBlockSize(ctx, block)
+	if err != storage.ErrBlockNotFound {
+		t.Errorf("GetBlockSize(%v) returned %v, %v but expected ErrBlockNotFound", block, l, err)
+	}
+}
+
+// AssertTouchBlock asserts that TouchBlock() of the specified storage block advances its timestamp reported by
+// ListBlocks(), unless the timestamp is newer than the threshold.
+func AssertTouchBlock(ctx context.Context, t *testing.T, s storage.Storage, block string) {
+	t.Helper()
+
+	ts0 := blockTimestamp(ctx, t, s, block)
+	if err := s.TouchBlock(ctx, block, time.Hour); err != nil {
+		t.Errorf("TouchBlock(%v) returned %v", block, err)
+	}
+
+	if ts := blockTimestamp(ctx, t, s, block); !ts.Equal(ts0) {
+		t.Errorf("TouchBlock(%v) updated recent timestamp %v to %v", block, ts0, ts)
+	}
+
+	if err := s.TouchBlock(ctx, block, 0); err != nil {
+		t.Errorf("TouchBlock(%v) returned %v", block, err)
+	}
+
+	if ts := blockTimestamp(ctx, t, s, block); !ts.After(ts0) {
+		t.Errorf("TouchBlock(%v) did not advance timestamp %v, got %v", block, ts0, ts)
+	}
+}
+
+// AssertTouchBlockMonotonic asserts that TouchBlock() of the specified storage block succeeds
+// and does not move its timestamp back, which holds also for storage that can't update timestamps.
+func AssertTouchBlockMonotonic(ctx context.Context, t *testing.T, s storage.Storage, block string) {
+	t.Helper()
+
+	ts0 := blockTimestamp(ctx, t, s, block)
+	if err := s.TouchBlock(ctx, block, 0); err != nil {
+		t.Errorf("TouchBlock(%v) returned %v", block, err)
+	}
+
+	if ts := blockTimestamp(ctx, t, s, block); ts.Before(ts0) {
+		t.Errorf("TouchBlock(%v) moved timestamp %v back to %v", block, ts0, ts)
+	}
+}
+
+func blockTimestamp(ctx context.Context, t *testing.T, s storage.Storage, block string) time.Time {
+	t.Helper()
+
+	var ts time.Time
+	if err := s.ListBlocks(ctx, block, func(bm storage.BlockMetadata) error {
+		if bm.BlockID == block {
+			ts = bm.Timestamp
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if ts.IsZero() {
+		t.Fatalf("block %v not listed", block)
+	}
+
+	return ts
+}
+
 // AssertListResults asserts that the list results with given prefix return the specified list of names in order.
 func AssertListResults(ctx context.Context, t *testing.T, s storage.Storage, prefix string, want ...string) {
 	t.Helper()
@@ -103,6 +206,50 @@ func AssertListResults(ctx context.Context, t *testing.T, s storage.Storage, pre
 	}
 }
 
+// AssertListStops asserts that returning ErrStopIteration from the callback after the specified number of items
+// stops the listing with given prefix without an error.
+func AssertListStops(ctx context.Context, t *testing.T, s storage.Storage, prefix string, stopAfter int) {
+	t.Helper()
+
+	cnt := 0
+	if err := s.ListBlocks(ctx, prefix, func(e storage.BlockMetadata) error {
+		cnt++
+		if cnt == stopAfter {
+			return storage.ErrStopIteration
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("ListBlocks(%v) returned error when stopped: %v", prefix, err)
+	}
+
+	if cnt != stopAfter {
+		t.Errorf("ListBlocks(%v) returned %v items after being stopped at %v", prefix, cnt, stopAfter)
+	}
+}
+
+// AssertListCanceled asserts that the listing with given prefix stops and returns the error of the context
+// when the context is canceled during the listing.
+func AssertListCanceled(ctx context.Context, t *testing.T, s storage.Storage, prefix string) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cnt := 0
+	err := s.ListBlocks(ctx, prefix, func(e storage.BlockMetadata) error {
+		cnt++
+		cancel()
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("ListBlocks(%v) returned %v when canceled, expected %v", prefix, err, context.Canceled)
+	}
+
+	if cnt != 1 {
+		t.Errorf("ListBlocks(%v) returned %v items after being canceled", prefix, cnt)
+	}
+}
+
 func sorted(s []string) []string {
 	x := append([]string(nil), s...)
 	sort.Strings(x)
@@ -36,6 +36,30 @@ func (s *FaultyStorage) GetBlock(ctx context.Context, id string, offset, length
 	return s.Base.GetBlock(ctx, id, offset, length)
 }
 
+// GetBlocks implements storage.Storage
+func (s *FaultyStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	if err := s.getNextFault("GetBlocks", len(reqs)); err != nil {
+		return nil, err
+	}
+	return s.Base.GetBlocks(ctx, reqs)
+}
+
+// GetBlockSize implements storage.Storage
+func (s *FaultyStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	if err := s.getNextFault("GetBlockSize", id); err != nil {
+		return 0, err
+	}
+	return s.Base.GetBlockSize(ctx, id)
+}
+
+// TouchBlock implements storage.Storage
+func (s *FaultyStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	if err := s.getNextFault("TouchBlock", id, threshold); err != nil {
+		return err
+	}
+	return s.Base.TouchBlock(ctx, id, threshold)
+}
+
 // PutBlock implements storage.Storage
 func (s *FaultyStorage) PutBlock(ctx context.Context, id string, data []byte) error {
 	if err := s.getNextFault("PutBlock", id, len(data)); err != nil {
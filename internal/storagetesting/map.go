@@ -43,6 +43,22 @@ func (s *mapStorage) GetBlock(ctx context.Context, id string, offset, length int
 	return nil, storage.ErrBlockNotFound
 }
 
+func (s *mapStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	return storage.GetBlocksInParallel(ctx, s, reqs, 1)
+}
+
+func (s *mapStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	data, ok := s.data[id]
+	if !ok {
+		return 0, storage.ErrBlockNotFound
+	}
+
+	return int64(len(data)), nil
+}
+
 func (s *mapStorage) PutBlock(ctx context.Context, id string, data []byte) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -79,6 +95,10 @@ func (s *mapStorage) ListBlocks(ctx context.Context, prefix string, callback fun
 	sort.Strings(keys)
 
 	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		s.mutex.RLock()
 		v, ok := s.data[k]
 		ts := s.keyTime[k]
@@ -91,6 +111,9 @@ func (s *mapStorage) ListBlocks(ctx context.Context, prefix string, callback fun
 			Length:    int64(len(v)),
 			Timestamp: ts,
 		}); err != nil {
+			if err == storage.ErrStopIteration {
+				return nil
+			}
 			return err
 		}
 	}
@@ -105,11 +128,13 @@ func (s *mapStorage) TouchBlock(ctx context.Context, blockID string, threshold t
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if v, ok := s.keyTime[blockID]; ok {
-		n := s.timeNow()
-		if n.Sub(v) >= threshold {
-			s.keyTime[blockID] = n
-		}
+	if _, ok := s.data[blockID]; !ok {
+		return storage.ErrBlockNotFound
+	}
+
+	n := s.timeNow()
+	if n.Sub(s.keyTime[blockID]) >= threshold {
+		s.keyTime[blockID] = n
 	}
 
 	return nil
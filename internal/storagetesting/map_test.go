@@ -12,4 +12,9 @@ func TestMapStorage(t *testing.T) {
 		t.Errorf("unexpected result: %v", r)
 	}
 	VerifyStorage(context.Background(), t, r)
+
+	if err := r.PutBlock(context.Background(), "touched", []byte{1}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	AssertTouchBlock(context.Background(), t, r, "touched")
 }
@@ -25,6 +25,7 @@ func VerifyStorage(ctx context.Context, t *testing.T, r storage.Storage) {
 	// First verify that blocks don't exist.
 	for _, b := range blocks {
 		AssertGetBlockNotFound(ctx, t, r, b.blk)
+		AssertGetBlockSizeNotFound(ctx, t, r, b.blk)
 	}
 
 	ctx2 := storage.WithUploadProgressCallback(ctx, func(desc string, completed, total int64) {
@@ -38,10 +39,27 @@ func VerifyStorage(ctx context.Context, t *testing.T, r storage.Storage) {
 		}
 
 		AssertGetBlock(ctx, t, r, b.blk, b.contents)
+		AssertGetBlockSize(ctx, t, r, b.blk, int64(len(b.contents)))
 	}
 
+	AssertGetBlocks(ctx, t, r, []storage.BlockRange{
+		{BlockID: blocks[2].blk, Offset: 0, Length: -1},
+		{BlockID: "abmissing", Offset: 0, Length: -1},
+		{BlockID: blocks[3].blk, Offset: 100, Length: 50},
+		{BlockID: "zzmissing", Offset: 10, Length: 5},
+		{BlockID: blocks[1].blk, Offset: 0, Length: -1},
+	}, []storage.BlockResult{
+		{BlockID: blocks[2].blk, Data: blocks[2].contents},
+		{BlockID: "abmissing", Err: storage.ErrBlockNotFound},
+		{BlockID: blocks[3].blk, Data: blocks[3].contents[100:150]},
+		{BlockID: "zzmissing", Err: storage.ErrBlockNotFound},
+		{BlockID: blocks[1].blk, Data: blocks[1].contents},
+	})
+
 	AssertListResults(ctx, t, r, "", blocks[0].blk, blocks[1].blk, blocks[2].blk, blocks[3].blk, blocks[4].blk)
 	AssertListResults(ctx, t, r, "ab", blocks[0].blk, blocks[2].blk, blocks[3].blk)
+	AssertListStops(ctx, t, r, "", 2)
+	AssertListCanceled(ctx, t, r, "")
 
 	// Overwrite blocks.
 	for _, b := range blocks {
@@ -52,12 +70,15 @@ func VerifyStorage(ctx context.Context, t *testing.T, r storage.Storage) {
 		AssertGetBlock(ctx, t, r, b.blk, b.contents)
 	}
 
+	AssertTouchBlockMonotonic(ctx, t, r, blocks[1].blk)
+
 	if err := r.DeleteBlock(ctx, blocks[0].blk); err != nil {
 		t.Errorf("unable to delete block: %v", err)
 	}
 	if err := r.DeleteBlock(ctx, blocks[0].blk); err != nil {
 		t.Errorf("invalid error when deleting deleted block: %v", err)
 	}
+	AssertGetBlockSizeNotFound(ctx, t, r, blocks[0].blk)
 	AssertListResults(ctx, t, r, "ab", blocks[2].blk, blocks[3].blk)
 	AssertListResults(ctx, t, r, "", blocks[1].blk, blocks[2].blk, blocks[3].blk, blocks[4].blk)
 }
@@ -0,0 +1,123 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ErrIncompatibleBlockHashing is returned by Merge() when a source repository assigns different IDs to the same
+// contents than the destination, in which case its object IDs can't be preserved.
+var ErrIncompatibleBlockHashing = errors.New("repositories use incompatible block hashing")
+
+// MergeStats describes the blocks processed by Merge().
+type MergeStats struct {
+	Blocks int   `json:"blocks"` // blocks read from all sources
+	Bytes  int64 `json:"bytes"`
+
+	CopiedBlocks int   `json:"copiedBlocks"` // blocks written to the destination
+	CopiedBytes  int64 `json:"copiedBytes"`
+
+	DuplicateBlocks int   `json:"duplicateBlocks"` // blocks already present in the destination or another source
+	DuplicateBytes  int64 `json:"duplicateBytes"`
+}
+
+// Merge copies all blocks of the source repositories to the destination, which makes objects and manifests of
+// all sources available in the destination under the same IDs. Blocks are content-addressed, so blocks already
+// present in the destination are not copied again, and copied blocks are packed, compressed and encrypted according
+// to the format of the destination.
+//
+// Object IDs can only be preserved when the sources compute the same block IDs as the destination, which requires
+// the same hash algorithm and HMAC secret, otherwise ErrIncompatibleBlockHashing is returned before anything is copied.
+func Merge(ctx context.Context, dst *Repository, srcs []*Repository) (MergeStats, error) {
+	var stats MergeStats
+
+	for _, src := range srcs {
+		if err := checkCompatibleBlockHashing(dst, src); err != nil {
+			return stats, err
+		}
+	}
+
+	for _, src := range srcs {
+		if err := mergeBlocks(ctx, dst, src, &stats); err != nil {
+			return stats, err
+		}
+	}
+
+	if err := dst.Blocks.Flush(ctx); err != nil {
+		return stats, errors.Wrap(err, "error flushing destination")
+	}
+
+	if err := dst.Manifests.Refresh(ctx); err != nil {
+		return stats, errors.Wrap(err, "error reloading manifests")
+	}
+
+	return stats, nil
+}
+
+func checkCompatibleBlockHashing(dst, src *Repository) error {
+	probe := []byte("kopia merge probe")
+
+	dstID, err := dst.Blocks.BlockIDForData(probe, "")
+	if err != nil {
+		return err
+	}
+
+	srcID, err := src.Blocks.BlockIDForData(probe, "")
+	if err != nil {
+		return err
+	}
+
+	if dstID != srcID {
+		return ErrIncompatibleBlockHashing
+	}
+
+	return nil
+}
+
+func mergeBlocks(ctx context.Context, dst, src *Repository, stats *MergeStats) error {
+	blockIDs, err := src.Blocks.ListBlocks("")
+	if err != nil {
+		return errors.Wrap(err, "unable to list source blocks")
+	}
+
+	for _, blockID := range blockIDs {
+		data, err := src.Blocks.GetBlock(ctx, blockID)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read source block %q", blockID)
+		}
+
+		stats.Blocks++
+		stats.Bytes += int64(len(data))
+
+		if bi, err := dst.Blocks.BlockInfo(ctx, blockID); err == nil && !bi.Deleted {
+			stats.DuplicateBlocks++
+			stats.DuplicateBytes += int64(len(data))
+			continue
+		}
+
+		newID, err := dst.Blocks.WriteBlock(ctx, data, blockIDPrefix(blockID))
+		if err != nil {
+			return errors.Wrapf(err, "unable to write block %q", blockID)
+		}
+
+		if newID != blockID {
+			return errors.Wrapf(ErrIncompatibleBlockHashing, "block %q was written as %q", blockID, newID)
+		}
+
+		stats.CopiedBlocks++
+		stats.CopiedBytes += int64(len(data))
+	}
+
+	return nil
+}
+
+// blockIDPrefix returns the prefix the provided block was written with, which is a single letter preceding
+// the hexadecimal hash.
+func blockIDPrefix(blockID string) string {
+	if len(blockID) > 0 && blockID[0] >= 'g' && blockID[0] <= 'z' {
+		return blockID[0:1]
+	}
+
+	return ""
+}
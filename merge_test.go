@@ -0,0 +1,113 @@
+package repo_test
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/kopia/repo"
+	"github.com/kopia/repo/block"
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/object"
+	"github.com/pkg/errors"
+)
+
+func openRepositoryWithSecret(ctx context.Context, t *testing.T, hmacSecret []byte, password string) *repo.Repository {
+	t.Helper()
+
+	st := storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{
+		BlockFormat:  block.FormattingOptions{HMACSecret: hmacSecret},
+		ObjectFormat: object.Format{Splitter: "FIXED", MaxBlockSize: 400},
+	}, password); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, password, &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	return r
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("merge-test-secret")
+
+	src1 := openRepositoryWithSecret(ctx, t, secret, "password1")
+	src2 := openRepositoryWithSecret(ctx, t, secret, "password2")
+	dst := openRepositoryWithSecret(ctx, t, secret, "password3")
+
+	randomData := func(seed int64, length int) []byte {
+		b := make([]byte, length)
+		rand.New(rand.NewSource(seed)).Read(b) //nolint:errcheck
+		return b
+	}
+
+	shared := randomData(1, 2000)
+	unique1 := randomData(2, 1500)
+	unique2 := randomData(3, 700)
+
+	objects := map[object.ID][]byte{}
+	for _, c := range []struct {
+		r    *repo.Repository
+		data []byte
+	}{
+		{src1, shared},
+		{src1, unique1},
+		{src2, shared},
+		{src2, unique2},
+	} {
+		objects[writeObject(ctx, t, c.r, c.data, "merge")] = c.data
+	}
+
+	if len(objects) != 3 {
+		t.Fatalf("unexpected number of distinct objects: %v", len(objects))
+	}
+
+	if _, err := src2.Manifests.Put(ctx, map[string]string{"type": "merge-test"}, map[string]string{"host": "src2"}); err != nil {
+		t.Fatalf("unable to put manifest: %v", err)
+	}
+
+	for _, r := range []*repo.Repository{src1, src2} {
+		if err := r.Flush(ctx); err != nil {
+			t.Fatalf("unable to flush: %v", err)
+		}
+	}
+
+	stats, err := repo.Merge(ctx, dst, []*repo.Repository{src1, src2})
+	if err != nil {
+		t.Fatalf("unable to merge: %v", err)
+	}
+
+	if stats.DuplicateBlocks == 0 || stats.CopiedBlocks+stats.DuplicateBlocks != stats.Blocks {
+		t.Errorf("unexpected merge stats: %+v", stats)
+	}
+
+	// blocks of the shared object are only copied once.
+	if stats.DuplicateBytes < int64(len(shared)) {
+		t.Errorf("unexpected number of duplicate bytes: %v, wanted at least %v", stats.DuplicateBytes, len(shared))
+	}
+
+	for oid, data := range objects {
+		verify(ctx, t, dst, oid, data, "merged")
+	}
+
+	manifests, err := dst.Manifests.Find(ctx, map[string]string{"type": "merge-test"})
+	if err != nil || len(manifests) != 1 {
+		t.Errorf("unexpected manifests in merged repository: %v %v", manifests, err)
+	}
+
+	// merging again copies nothing.
+	stats, err = repo.Merge(ctx, dst, []*repo.Repository{src1, src2})
+	if err != nil || stats.CopiedBlocks != 0 {
+		t.Errorf("unexpected result of merging again: %+v %v", stats, err)
+	}
+
+	other := openRepositoryWithSecret(ctx, t, []byte("other-secret"), "password1")
+	if _, err := repo.Merge(ctx, other, []*repo.Repository{src1}); errors.Cause(err) != repo.ErrIncompatibleBlockHashing {
+		t.Errorf("unexpected error merging repositories with different secrets: %v, wanted %v", err, repo.ErrIncompatibleBlockHashing)
+	}
+}
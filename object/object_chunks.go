@@ -0,0 +1,74 @@
+package object
+
+import (
+	"context"
+	"io"
+)
+
+// Chunk describes a contiguous range of an object stored as a single storage block.
+type Chunk struct {
+	Start  int64 `json:"start"`
+	Length int64 `json:"length"`
+	Object ID    `json:"object"`
+}
+
+// Chunks returns the boundaries of the chunks of the provided object along with their object IDs, which are
+// derived from the chunk contents, in order. Comparing them with LocalChunks() of a local copy of the object
+// identifies the chunks that need to be transferred to synchronize the two.
+func (om *Manager) Chunks(ctx context.Context, oid ID) ([]Chunk, error) {
+	if indexObjectID, ok := oid.IndexObjectID(); ok {
+		rd, err := om.Open(ctx, indexObjectID)
+		if err != nil {
+			return nil, err
+		}
+		defer rd.Close() //nolint:errcheck
+
+		seekTable, err := om.flattenListChunk(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		var result []Chunk
+		for _, e := range seekTable {
+			result = append(result, Chunk{Start: e.Start, Length: e.Length, Object: e.Object})
+		}
+
+		return result, nil
+	}
+
+	rd, err := om.Open(ctx, oid)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close() //nolint:errcheck
+
+	return []Chunk{{Start: 0, Length: rd.Length(), Object: oid}}, nil
+}
+
+// LocalChunks splits the provided data into chunks the same way a writer with the provided options would and
+// returns them along with the object IDs they would be stored as, without writing anything to the repository.
+func (om *Manager) LocalChunks(ctx context.Context, r io.Reader, opt WriterOptions) ([]Chunk, error) {
+	w := om.NewWriter(ctx, WriterOptions{
+		Prefix:           opt.Prefix,
+		Compression:      opt.Compression,
+		CompressionLevel: opt.CompressionLevel,
+	}).(*objectWriter)
+	w.hashOnly = true
+
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+
+	if w.buffer.Len() > 0 || len(w.blockIndex) == 0 {
+		if err := w.flushBuffer(); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []Chunk
+	for _, e := range w.blockIndex {
+		result = append(result, Chunk{Start: e.Start, Length: e.Length, Object: e.Object})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,163 @@
+package object
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotCompressed is returned by OpenCompressed() when the object does not have compressed storage blocks.
+var ErrNotCompressed = errors.New("object is not compressed")
+
+// OpenCompressed returns a reader of the stored compressed representation of an object along with its HTTP Content-Encoding
+// (e.g. "gzip"), which allows serving the object to compatible clients without decompressing and recompressing it.
+// Compressed blocks are streamed as stored, blocks that were stored uncompressed are wrapped in the compressed format
+// on the fly without compressing them.
+// Returns ErrNotCompressed if none of the blocks of the object are compressed, in which case the caller should use Open().
+func (om *Manager) OpenCompressed(ctx context.Context, objectID ID) (io.ReadCloser, string, error) {
+	entries, err := om.leafObjects(ctx, objectID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var c *compressor
+	for _, e := range entries {
+		compressedObjectID, ok := e.Compressed()
+		if !ok {
+			continue
+		}
+
+		_, payload, err := om.getCompressedBlock(ctx, compressedObjectID)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if c, _, _, err = parseCompressedBlockHeader(payload); err != nil {
+			return nil, "", errors.Wrapf(err, "invalid compressed object %v", e)
+		}
+		break
+	}
+
+	if c == nil {
+		return nil, "", ErrNotCompressed
+	}
+
+	return &compressedStreamReader{ctx: ctx, repo: om, compressor: c, entries: entries}, c.contentEncoding, nil
+}
+
+// leafObjects returns the list of direct and compressed objects that make up the provided object, in order.
+func (om *Manager) leafObjects(ctx context.Context, objectID ID) ([]ID, error) {
+	if indexObjectID, ok := objectID.IndexObjectID(); ok {
+		rd, err := om.Open(ctx, indexObjectID)
+		if err != nil {
+			return nil, err
+		}
+		defer rd.Close() //nolint:errcheck
+
+		seekTable, err := om.flattenListChunk(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		var result []ID
+		for _, m := range seekTable {
+			leaves, err := om.leafObjects(ctx, m.Object)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, leaves...)
+		}
+
+		return result, nil
+	}
+
+	if _, ok := objectID.Compressed(); ok {
+		return []ID{objectID}, nil
+	}
+
+	if _, ok := objectID.BlockID(); ok {
+		return []ID{objectID}, nil
+	}
+
+	if _, _, _, ok := objectID.Slice(); ok {
+		return nil, ErrNotCompressed
+	}
+
+	if _, ok := objectID.Delta(); ok {
+		return nil, ErrNotCompressed
+	}
+
+	return nil, fmt.Errorf("unsupported object ID: %v", objectID)
+}
+
+func (om *Manager) getCompressedBlock(ctx context.Context, compressedObjectID ID) (string, []byte, error) {
+	blockID, ok := compressedObjectID.BlockID()
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported compressed object ID: %v", compressedObjectID)
+	}
+
+	payload, err := om.getBlock(ctx, blockID)
+	return blockID, payload, err
+}
+
+// compressedStreamReader reads the compressed representation of a sequence of objects one block at a time.
+type compressedStreamReader struct {
+	ctx        context.Context
+	repo       *Manager
+	compressor *compressor
+	entries    []ID
+	current    *bytes.Reader
+}
+
+func (r *compressedStreamReader) Read(b []byte) (int, error) {
+	for r.current == nil || r.current.Len() == 0 {
+		if len(r.entries) == 0 {
+			return 0, io.EOF
+		}
+
+		data, err := r.nextChunk(r.entries[0])
+		if err != nil {
+			return 0, err
+		}
+
+		r.entries = r.entries[1:]
+		r.current = bytes.NewReader(data)
+	}
+
+	return r.current.Read(b)
+}
+
+func (r *compressedStreamReader) nextChunk(oid ID) ([]byte, error) {
+	if compressedObjectID, ok := oid.Compressed(); ok {
+		_, payload, err := r.repo.getCompressedBlock(r.ctx, compressedObjectID)
+		if err != nil {
+			return nil, err
+		}
+
+		c, _, compressed, err := parseCompressedBlockHeader(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid compressed object %v", oid)
+		}
+
+		if c != r.compressor {
+			return nil, fmt.Errorf("object %v uses a different compression than the rest of the stream", oid)
+		}
+
+		return compressed, nil
+	}
+
+	blockID, _ := oid.BlockID()
+	data, err := r.repo.getBlock(r.ctx, blockID)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.compressor.compress(data, r.compressor.storeLevel)
+}
+
+func (r *compressedStreamReader) Close() error {
+	return nil
+}
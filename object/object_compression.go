@@ -0,0 +1,180 @@
+package object
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ErrDecompressionLimitExceeded is returned when reading compressed data that decompresses beyond the limits
+// configured in ManagerOptions.
+var ErrDecompressionLimitExceeded = errors.New("decompression limit exceeded")
+
+// SupportedCompression is a list of supported compression algorithms including:
+//
+//    GZIP     - compression using gzip with levels between 1 (fastest) and 9 (best compression), defaults to 6.
+var SupportedCompression []string
+
+// NoCompression is the compression name which disables compression, overriding the default compression policy.
+const NoCompression = "NONE"
+
+type compressor struct {
+	id           byte // identifies the compressor in the header of each compressed block
+	minLevel     int
+	maxLevel     int
+	defaultLevel int
+	storeLevel   int // level that encodes data in the compressed format without compressing it
+
+	contentEncoding string // HTTP Content-Encoding of the compressed stream
+
+	compress   func(data []byte, level int) ([]byte, error)
+	decompress func(data []byte, maxLength int64) ([]byte, error) // fails if data decompresses beyond maxLength
+}
+
+var compressors = map[string]*compressor{
+	"GZIP": {
+		id:           1,
+		minLevel:     gzip.BestSpeed,
+		maxLevel:     gzip.BestCompression,
+		defaultLevel: 6,
+		storeLevel:   gzip.NoCompression,
+
+		contentEncoding: "gzip",
+
+		compress:   gzipCompress,
+		decompress: gzipDecompress,
+	},
+}
+
+func init() {
+	for k := range compressors {
+		SupportedCompression = append(SupportedCompression, k)
+	}
+	sort.Strings(SupportedCompression)
+}
+
+// getCompressor returns the compressor with a given name and the effective compression level.
+func getCompressor(name string, level int) (*compressor, int, error) {
+	c := compressors[name]
+	if c == nil {
+		return nil, 0, fmt.Errorf("unsupported compression %q", name)
+	}
+
+	if level == 0 {
+		level = c.defaultLevel
+	}
+
+	if level < c.minLevel || level > c.maxLevel {
+		return nil, 0, fmt.Errorf("invalid %v compression level %v, must be between %v and %v", name, level, c.minLevel, c.maxLevel)
+	}
+
+	return c, level, nil
+}
+
+// compressBlock compresses the data and prepends a header consisting of the compressor ID
+// and the uncompressed length, so that the block can be decompressed without knowing the compression options.
+func compressBlock(c *compressor, level int, data []byte) ([]byte, error) {
+	compressed, err := c.compress(data, level)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 1+binary.MaxVarintLen64)
+	header[0] = c.id
+	n := binary.PutUvarint(header[1:], uint64(len(data)))
+
+	return append(header[0:1+n], compressed...), nil
+}
+
+// parseCompressedBlockHeader returns the compressor, uncompressed length and the compressed payload of a block.
+func parseCompressedBlockHeader(b []byte) (*compressor, int64, []byte, error) {
+	if len(b) < 2 {
+		return nil, 0, nil, fmt.Errorf("compressed block too short")
+	}
+
+	var c *compressor
+	for _, cc := range compressors {
+		if cc.id == b[0] {
+			c = cc
+		}
+	}
+	if c == nil {
+		return nil, 0, nil, fmt.Errorf("unsupported compressor ID %v", b[0])
+	}
+
+	length, n := binary.Uvarint(b[1:])
+	if n <= 0 {
+		return nil, 0, nil, fmt.Errorf("invalid uncompressed length")
+	}
+
+	return c, int64(length), b[1+n:], nil
+}
+
+// decompressBlock decompresses the provided block, failing with ErrDecompressionLimitExceeded if it decompresses
+// beyond maxLength, when positive.
+func decompressBlock(b []byte, maxLength int64) ([]byte, error) {
+	c, length, payload, err := parseCompressedBlockHeader(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxLength > 0 && length > maxLength {
+		return nil, errors.Wrapf(ErrDecompressionLimitExceeded, "block decompresses to %v bytes, limit is %v", length, maxLength)
+	}
+
+	// the length in the header can't be trusted, so decompression stops right after it has been exceeded.
+	data, err := c.decompress(payload, length)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decompress block")
+	}
+
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("unexpected decompressed length: %v, expected %v", len(data), length)
+	}
+
+	return data, nil
+}
+
+func gzipCompress(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(data []byte, maxLength int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close() //nolint:errcheck
+
+	result, err := ioutil.ReadAll(io.LimitReader(r, maxLength+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(result)) > maxLength {
+		return nil, errors.Wrapf(ErrDecompressionLimitExceeded, "data decompresses beyond %v bytes", maxLength)
+	}
+
+	return result, nil
+}
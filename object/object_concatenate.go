@@ -0,0 +1,104 @@
+package object
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Concatenate returns an object whose contents are the concatenation of the contents of the provided objects.
+// The new object is an indirect object referencing the existing blocks of the parts, so only its index is written
+// and the data of the parts is not read or rewritten. Empty parts are skipped and when a single part is provided
+// or remains, its ID is returned as is.
+func (om *Manager) Concatenate(ctx context.Context, parts []ID) (ID, error) {
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+
+	var entries []indirectObjectEntry
+	var nonEmpty []ID
+	var start int64
+
+	for _, part := range parts {
+		partEntries, err := om.concatenationEntries(ctx, part)
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to concatenate %v", part)
+		}
+
+		if len(partEntries) > 0 {
+			nonEmpty = append(nonEmpty, part)
+		}
+
+		for _, e := range partEntries {
+			e.Start = start
+			start += e.Length
+			entries = append(entries, e)
+		}
+	}
+
+	switch len(nonEmpty) {
+	case 0:
+		w := om.NewWriter(ctx, WriterOptions{Description: "CONCATENATE"})
+		defer w.Close() //nolint:errcheck
+		return w.Result()
+	case 1:
+		return nonEmpty[0], nil
+	}
+
+	w := om.NewWriter(ctx, WriterOptions{Description: "LIST(CONCATENATE)"})
+	defer w.Close() //nolint:errcheck
+
+	ind := indirectObject{
+		StreamID: "kopia:indirect",
+		Entries:  entries,
+	}
+
+	if err := json.NewEncoder(w).Encode(ind); err != nil {
+		return "", errors.Wrap(err, "unable to write indirect block index")
+	}
+
+	oid, err := w.Result()
+	if err != nil {
+		return "", err
+	}
+
+	return IndirectObjectID(oid), nil
+}
+
+// concatenationEntries returns the non-empty entries of the seek table referencing the contents of the provided
+// object, which are the entries of indirect objects or a single entry referencing any other object.
+func (om *Manager) concatenationEntries(ctx context.Context, oid ID) ([]indirectObjectEntry, error) {
+	if indexObjectID, ok := oid.IndexObjectID(); ok {
+		rd, err := om.Open(ctx, indexObjectID)
+		if err != nil {
+			return nil, err
+		}
+		defer rd.Close() //nolint:errcheck
+
+		seekTable, err := om.flattenListChunk(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		var result []indirectObjectEntry
+		for _, e := range seekTable {
+			if e.Length > 0 {
+				result = append(result, e)
+			}
+		}
+
+		return result, nil
+	}
+
+	l, err := om.Length(ctx, oid)
+	if err != nil {
+		return nil, err
+	}
+
+	if l == 0 {
+		return nil, nil
+	}
+
+	return []indirectObjectEntry{{Length: l, Object: oid}}, nil
+}
@@ -0,0 +1,632 @@
+package object
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/silvasur/buzhash"
+)
+
+/*
+
+{"stream":"kopia:delta","base":"Df0f0...","length":1048580,"ops":[
+{"l":1048576},
+{"d":"ZXh0cmE="}
+]}
+*/
+
+type deltaObject struct {
+	StreamID string    `json:"stream"`
+	Base     ID        `json:"base"`
+	Inserts  ID        `json:"inserts,omitempty"`
+	Length   int64     `json:"length"`
+	Ops      []deltaOp `json:"ops"`
+}
+
+// deltaOp either copies Length bytes starting at Offset of the base object, or of the inserts object when Inserted
+// is set, or, when Data is not nil, inserts the provided bytes.
+type deltaOp struct {
+	Offset   int64  `json:"o,omitempty"`
+	Length   int64  `json:"l,omitempty"`
+	Inserted bool   `json:"i,omitempty"`
+	Data     []byte `json:"d,omitempty"`
+}
+
+func (op deltaOp) length() int64 {
+	if op.Data != nil {
+		return int64(len(op.Data))
+	}
+
+	return op.Length
+}
+
+const (
+	// deltaMatchLength is the length of blocks of the base object that are looked up in the new object.
+	deltaMatchLength = 4096
+
+	// maxDeltaLiteralRun is the maximum number of unmatched bytes buffered before they are stored.
+	maxDeltaLiteralRun = 65536
+
+	// maxInlineDeltaData is the maximum number of unmatched bytes stored in the delta descriptor itself,
+	// the remaining ones are stored in a separate inserts object.
+	maxInlineDeltaData = 65536
+)
+
+// deltaBaseBlock is a block of the base object of deltaMatchLength bytes.
+type deltaBaseBlock struct {
+	offset int64
+	hash   [sha256.Size]byte
+}
+
+// deltaWriter stores the object as a delta against the base object as it is being written. The base object
+// is indexed by the rolling hashes of its blocks of deltaMatchLength bytes, and each block found in the data
+// is extended forward and backward byte by byte. Unmatched bytes are stored in the descriptor or in a separate
+// inserts object. When no bytes match, the inserts object holds all the data and is itself the result.
+type deltaWriter struct {
+	ctx  context.Context
+	repo *Manager
+	opt  WriterOptions
+	err  error
+
+	base       Reader
+	baseBlocks map[uint32][]deltaBaseBlock // blocks of the base object by their rolling hash
+	baseBuffer []byte
+
+	hash       *buzhash.BuzHash
+	hashValid  bool   // whether hash covers the first deltaMatchLength bytes of pending
+	pending    []byte // bytes not matched yet
+	literal    []byte // unmatched bytes preceding pending, not stored yet
+	extendAt   int64  // offset of the base object the last copy is extended from, negative when it can't be
+	length     int64
+	ops        []deltaOp
+	copied     bool
+	inlineData int
+
+	inserts       Writer
+	insertsLength int64
+}
+
+func newDeltaWriter(ctx context.Context, om *Manager, opt WriterOptions) *deltaWriter {
+	w := &deltaWriter{
+		ctx:      ctx,
+		repo:     om,
+		opt:      opt,
+		hash:     buzhash.NewBuzHash(deltaMatchLength),
+		extendAt: -1,
+	}
+
+	if opt.CheckpointInterval > 0 || opt.ResumeFrom != nil {
+		w.err = errors.New("delta objects can't be written with checkpoints")
+	}
+
+	return w
+}
+
+func (w *deltaWriter) Close() error {
+	if w.inserts != nil {
+		w.inserts.Close() //nolint:errcheck
+	}
+
+	if w.base != nil {
+		return w.base.Close()
+	}
+
+	return nil
+}
+
+func (w *deltaWriter) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.base == nil {
+		if w.err = w.indexBase(); w.err != nil {
+			return 0, w.err
+		}
+	}
+
+	// only accept data up to the limit.
+	tooLarge := w.opt.MaxObjectSize > 0 && w.length+int64(len(data)) > w.opt.MaxObjectSize
+	if tooLarge {
+		data = data[0 : w.opt.MaxObjectSize-w.length]
+	}
+
+	if w.opt.Digest != nil {
+		w.opt.Digest.Write(data) //nolint:errcheck
+	}
+
+	w.length += int64(len(data))
+	w.pending = append(w.pending, data...)
+	if w.err = w.match(false); w.err != nil {
+		return 0, w.err
+	}
+
+	if tooLarge {
+		w.err = errors.Wrapf(ErrObjectTooLarge, "%v exceeds %v bytes", w.opt.Description, w.opt.MaxObjectSize)
+		return len(data), w.err
+	}
+
+	return len(data), nil
+}
+
+func (w *deltaWriter) Result() (ID, error) {
+	if w.err != nil {
+		return "", w.err
+	}
+
+	if w.base == nil {
+		if err := w.indexBase(); err != nil {
+			return "", err
+		}
+	}
+
+	if err := w.match(true); err != nil {
+		return "", err
+	}
+
+	if !w.copied {
+		// nothing is shared with the base object, the inserts object holds all the data.
+		return w.insertsWriter().Result()
+	}
+
+	d := deltaObject{
+		StreamID: "kopia:delta",
+		Base:     w.opt.DeltaBase,
+		Length:   w.length,
+		Ops:      w.ops,
+	}
+
+	if w.inserts != nil {
+		insertsID, err := w.inserts.Result()
+		if err != nil {
+			return "", err
+		}
+
+		d.Inserts = insertsID
+	}
+
+	dw := w.repo.NewWriter(w.ctx, w.nestedOptions("DELTA("+w.opt.Description+")"))
+	defer dw.Close() //nolint:errcheck
+
+	if err := json.NewEncoder(dw).Encode(d); err != nil {
+		return "", errors.Wrap(err, "unable to write delta descriptor")
+	}
+
+	oid, err := dw.Result()
+	if err != nil {
+		return "", err
+	}
+
+	return DeltaObjectID(oid), nil
+}
+
+// indexBase opens the base object and computes the hashes of its blocks.
+func (w *deltaWriter) indexBase() error {
+	rd, err := w.repo.Open(w.ctx, w.opt.DeltaBase)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open delta base %v", w.opt.DeltaBase)
+	}
+
+	w.base = rd
+	w.baseBlocks = map[uint32][]deltaBaseBlock{}
+	w.baseBuffer = make([]byte, maxDeltaLiteralRun)
+
+	block := make([]byte, deltaMatchLength)
+	for offset := int64(0); ; offset += deltaMatchLength {
+		if _, err := io.ReadFull(rd, block); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// the last partial block can still be matched by extending the preceding one.
+				return nil
+			}
+
+			return errors.Wrapf(err, "unable to read delta base %v", w.opt.DeltaBase)
+		}
+
+		w.hash.Reset()
+		w.hash.Write(block) //nolint:errcheck
+		h := w.hash.Sum32()
+		w.baseBlocks[h] = append(w.baseBlocks[h], deltaBaseBlock{offset, sha256.Sum256(block)})
+	}
+}
+
+// match consumes pending bytes that can be matched with the base object or are known not to match.
+// When final is set, all the remaining bytes are consumed.
+func (w *deltaWriter) match(final bool) error {
+	for {
+		if err := w.extendCopy(); err != nil {
+			return err
+		}
+
+		if len(w.pending) < deltaMatchLength {
+			break
+		}
+
+		window := w.pending[0:deltaMatchLength]
+		if !w.hashValid {
+			w.hash.Reset()
+			w.hash.Write(window) //nolint:errcheck
+			w.hashValid = true
+		}
+
+		if offset, ok := w.findBaseBlock(window); ok {
+			if err := w.copyBaseBlock(offset); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(w.pending) == deltaMatchLength {
+			// the window can't slide until more data is written.
+			break
+		}
+
+		w.hash.HashByte(w.pending[deltaMatchLength])
+		w.literal = append(w.literal, w.pending[0])
+		w.pending = w.pending[1:]
+
+		if len(w.literal) >= maxDeltaLiteralRun {
+			if err := w.flushLiteral(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !final {
+		return nil
+	}
+
+	w.literal = append(w.literal, w.pending...)
+	w.pending = nil
+	return w.flushLiteral()
+}
+
+func (w *deltaWriter) findBaseBlock(window []byte) (int64, bool) {
+	candidates := w.baseBlocks[w.hash.Sum32()]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	h := sha256.Sum256(window)
+	for _, c := range candidates {
+		if c.hash == h {
+			return c.offset, true
+		}
+	}
+
+	return 0, false
+}
+
+// copyBaseBlock copies the block of the base object at the provided offset, which matches the first
+// deltaMatchLength pending bytes, along with the unmatched bytes just before it that match the base object too.
+func (w *deltaWriter) copyBaseBlock(offset int64) error {
+	length := int64(deltaMatchLength)
+
+	if back := int64(len(w.literal)); back > 0 && offset > 0 {
+		if back > offset {
+			back = offset
+		}
+
+		preceding, err := w.readBase(offset-back, w.baseBuffer[0:back])
+		if err != nil {
+			return err
+		}
+
+		var common int64
+		for common < int64(len(preceding)) && preceding[len(preceding)-1-int(common)] == w.literal[len(w.literal)-1-int(common)] {
+			common++
+		}
+
+		w.literal = w.literal[0 : int64(len(w.literal))-common]
+		offset -= common
+		length += common
+	}
+
+	if err := w.flushLiteral(); err != nil {
+		return err
+	}
+
+	w.addCopy(offset, length)
+	w.pending = w.pending[deltaMatchLength:]
+	w.hashValid = false
+	w.extendAt = offset + length
+	return nil
+}
+
+// extendCopy extends the last copy with the pending bytes that match the base object following it.
+func (w *deltaWriter) extendCopy() error {
+	for w.extendAt >= 0 && len(w.pending) > 0 {
+		n := len(w.pending)
+		if n > len(w.baseBuffer) {
+			n = len(w.baseBuffer)
+		}
+
+		following, err := w.readBase(w.extendAt, w.baseBuffer[0:n])
+		if err != nil {
+			return err
+		}
+
+		common := 0
+		for common < len(following) && following[common] == w.pending[common] {
+			common++
+		}
+
+		if common > 0 {
+			w.addCopy(w.extendAt, int64(common))
+			w.pending = w.pending[common:]
+			w.hashValid = false
+			w.extendAt += int64(common)
+		}
+
+		if common < n {
+			w.extendAt = -1
+		}
+	}
+
+	return nil
+}
+
+// readBase reads the bytes of the base object at the provided offset, fewer than requested at its end.
+func (w *deltaWriter) readBase(offset int64, buffer []byte) ([]byte, error) {
+	if _, err := w.base.Seek(offset, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "unable to seek delta base %v", w.opt.DeltaBase)
+	}
+
+	n, err := io.ReadFull(w.base, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrapf(err, "unable to read delta base %v", w.opt.DeltaBase)
+	}
+
+	return buffer[0:n], nil
+}
+
+func (w *deltaWriter) addCopy(offset, length int64) {
+	w.copied = true
+	if n := len(w.ops); n > 0 {
+		if last := &w.ops[n-1]; last.Data == nil && !last.Inserted && last.Offset+last.Length == offset {
+			last.Length += length
+			return
+		}
+	}
+
+	w.ops = append(w.ops, deltaOp{Offset: offset, Length: length})
+}
+
+// flushLiteral stores the unmatched bytes in the descriptor when they follow copied bytes and the descriptor
+// has room for them, otherwise in the inserts object.
+func (w *deltaWriter) flushLiteral() error {
+	if len(w.literal) == 0 {
+		return nil
+	}
+
+	defer func() { w.literal = nil }()
+
+	if w.copied && w.inlineData+len(w.literal) <= maxInlineDeltaData {
+		w.ops = append(w.ops, deltaOp{Data: append([]byte(nil), w.literal...)})
+		w.inlineData += len(w.literal)
+		return nil
+	}
+
+	if _, err := w.insertsWriter().Write(w.literal); err != nil {
+		return errors.Wrap(err, "unable to write delta inserts")
+	}
+
+	offset, length := w.insertsLength, int64(len(w.literal))
+	w.insertsLength += length
+
+	if n := len(w.ops); n > 0 {
+		if last := &w.ops[n-1]; last.Inserted && last.Offset+last.Length == offset {
+			last.Length += length
+			return nil
+		}
+	}
+
+	w.ops = append(w.ops, deltaOp{Offset: offset, Length: length, Inserted: true})
+	return nil
+}
+
+func (w *deltaWriter) insertsWriter() Writer {
+	if w.inserts == nil {
+		w.inserts = w.repo.NewWriter(w.ctx, w.nestedOptions(w.opt.Description))
+	}
+
+	return w.inserts
+}
+
+// nestedOptions returns options of writers of the underlying objects, which don't apply the limits of the
+// delta writer again. Timings accumulate the writes of all underlying objects.
+func (w *deltaWriter) nestedOptions(description string) WriterOptions {
+	return WriterOptions{
+		Description:      description,
+		Prefix:           w.opt.Prefix,
+		Timings:          w.opt.Timings,
+		Compression:      w.opt.Compression,
+		CompressionLevel: w.opt.CompressionLevel,
+		AsyncUploads:     w.opt.AsyncUploads,
+	}
+}
+
+func (om *Manager) readDeltaObject(ctx context.Context, descriptorID ID) (*deltaObject, error) {
+	rd, err := om.Open(ctx, descriptorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close() //nolint:errcheck
+
+	var d deltaObject
+	if err := json.NewDecoder(rd).Decode(&d); err != nil {
+		return nil, errors.Wrap(err, "invalid delta object")
+	}
+
+	if d.StreamID != "kopia:delta" {
+		return nil, fmt.Errorf("invalid delta object stream: %q", d.StreamID)
+	}
+
+	return &d, nil
+}
+
+// checkRanges ensures that the operations of the delta object reference only bytes of the base and inserts objects
+// of the provided lengths and add up to the length of the object.
+func (d *deltaObject) checkRanges(baseLength, insertsLength int64) error {
+	var total int64
+	for _, op := range d.Ops {
+		if op.Data == nil {
+			source, sourceLength := "base", baseLength
+			if op.Inserted {
+				source, sourceLength = "inserts", insertsLength
+			}
+
+			if op.Offset < 0 || op.Length < 0 || op.Offset+op.Length > sourceLength {
+				return fmt.Errorf("delta copies %v bytes at %v out of range of the %v object of length %v", op.Length, op.Offset, source, sourceLength)
+			}
+		}
+
+		total += op.length()
+	}
+
+	if total != d.Length {
+		return fmt.Errorf("delta reconstructs %v bytes, expected %v", total, d.Length)
+	}
+
+	return nil
+}
+
+func (om *Manager) newDeltaReader(ctx context.Context, descriptorID ID) (Reader, error) {
+	d, err := om.readDeltaObject(ctx, descriptorID)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := om.Open(ctx, d.Base)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &deltaReader{base: base, ops: d.Ops, length: d.Length}
+	var insertsLength int64
+	if d.Inserts != "" {
+		if r.inserts, err = om.Open(ctx, d.Inserts); err != nil {
+			base.Close() //nolint:errcheck
+			return nil, err
+		}
+
+		insertsLength = r.inserts.Length()
+	}
+
+	if err := d.checkRanges(base.Length(), insertsLength); err != nil {
+		r.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	var start int64
+	for _, op := range d.Ops {
+		r.starts = append(r.starts, start)
+		start += op.length()
+	}
+
+	return r, nil
+}
+
+// deltaReader reconstructs a delta object from the operations of its descriptor and the base and inserts objects.
+type deltaReader struct {
+	base     Reader
+	inserts  Reader // nil when the delta has no inserts object
+	ops      []deltaOp
+	starts   []int64 // offsets of the bytes produced by each operation
+	length   int64
+	position int64
+}
+
+func (r *deltaReader) Read(buffer []byte) (int, error) {
+	if r.position >= r.length {
+		return 0, io.EOF
+	}
+
+	var total int
+	for len(buffer) > 0 && r.position < r.length {
+		n, err := r.readFromOp(buffer)
+		total += n
+		buffer = buffer[n:]
+		if err != nil {
+			return total, err
+		}
+
+		if n == 0 {
+			return total, io.ErrUnexpectedEOF
+		}
+	}
+
+	return total, nil
+}
+
+// readFromOp reads bytes produced by the operation at the current position.
+func (r *deltaReader) readFromOp(buffer []byte) (int, error) {
+	i := sort.Search(len(r.starts), func(i int) bool {
+		return r.starts[i]+r.ops[i].length() > r.position
+	})
+	op := r.ops[i]
+	inOp := r.position - r.starts[i]
+
+	if remaining := op.length() - inOp; int64(len(buffer)) > remaining {
+		buffer = buffer[0:remaining]
+	}
+
+	if op.Data != nil {
+		n := copy(buffer, op.Data[inOp:])
+		r.position += int64(n)
+		return n, nil
+	}
+
+	source := r.base
+	if op.Inserted {
+		source = r.inserts
+	}
+
+	if _, err := source.Seek(op.Offset+inOp, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := source.Read(buffer)
+	r.position += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (r *deltaReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.position
+	case io.SeekEnd:
+		offset += r.length
+	}
+
+	if offset < 0 {
+		return -1, fmt.Errorf("invalid seek %v %v", offset, whence)
+	}
+
+	if offset > r.length {
+		offset = r.length
+	}
+
+	r.position = offset
+	return r.position, nil
+}
+
+func (r *deltaReader) Close() error {
+	if r.inserts != nil {
+		r.inserts.Close() //nolint:errcheck
+	}
+
+	return r.base.Close()
+}
+
+func (r *deltaReader) Length() int64 {
+	return r.length
+}
@@ -0,0 +1,110 @@
+package object
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// IntegrityProof identifies the contents of an object without revealing them: the blocks making up the object
+// and the byte ranges of the object they hold, in order.
+//
+// Block IDs are hashes of block contents keyed with the secret of the repository, so proofs can only be computed,
+// and therefore verified, by someone having the repository password. Two proofs computed by the same repository
+// are equal only if the objects have the same contents, which allows detecting that an object no longer matches
+// a proof recorded earlier. A proof can be shared without revealing the contents, but a third party can only
+// compare it with other proofs, not check it against the object.
+type IntegrityProof struct {
+	BlockIDs []string `json:"blocks"` // IDs of all blocks making up the object, including index blocks, in order
+	Digest   string   `json:"digest"` // digest of the ordered list of blocks and byte ranges
+}
+
+// IntegrityProof returns the integrity proof of the provided object. Computing the proof only checks that each
+// block of the object is present in the index of the repository (see block.Manager.BlockInfo); the contents of
+// data blocks are neither read nor verified, which only reading the object does.
+func (om *Manager) IntegrityProof(ctx context.Context, objectID ID) (*IntegrityProof, error) {
+	var lines []string
+	p := &IntegrityProof{}
+
+	if err := om.collectIntegrityProof(ctx, objectID, p, &lines); err != nil {
+		return nil, err
+	}
+
+	h := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	p.Digest = hex.EncodeToString(h[:])
+	return p, nil
+}
+
+func (om *Manager) collectIntegrityProof(ctx context.Context, objectID ID, p *IntegrityProof, lines *[]string) error {
+	if indexObjectID, ok := objectID.IndexObjectID(); ok {
+		if err := om.collectIntegrityProof(ctx, indexObjectID, p, lines); err != nil {
+			return err
+		}
+
+		rd, err := om.Open(ctx, indexObjectID)
+		if err != nil {
+			return err
+		}
+		defer rd.Close() //nolint:errcheck
+
+		seekTable, err := om.flattenListChunk(rd)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range seekTable {
+			*lines = append(*lines, fmt.Sprintf("range %v %v", m.Start, m.Length))
+			if err := om.collectIntegrityProof(ctx, m.Object, p, lines); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if compressedObjectID, ok := objectID.Compressed(); ok {
+		return om.collectIntegrityProof(ctx, compressedObjectID, p, lines)
+	}
+
+	if base, offset, length, ok := objectID.Slice(); ok {
+		*lines = append(*lines, fmt.Sprintf("slice %v %v", offset, length))
+		return om.collectIntegrityProof(ctx, base, p, lines)
+	}
+
+	if descriptorID, ok := objectID.Delta(); ok {
+		d, err := om.readDeltaObject(ctx, descriptorID)
+		if err != nil {
+			return err
+		}
+
+		*lines = append(*lines, "delta")
+		if err := om.collectIntegrityProof(ctx, descriptorID, p, lines); err != nil {
+			return err
+		}
+
+		if err := om.collectIntegrityProof(ctx, d.Base, p, lines); err != nil {
+			return err
+		}
+
+		if d.Inserts == "" {
+			return nil
+		}
+
+		*lines = append(*lines, "inserts")
+		return om.collectIntegrityProof(ctx, d.Inserts, p, lines)
+	}
+
+	if blockID, ok := objectID.BlockID(); ok {
+		if _, err := om.blockMgr.BlockInfo(ctx, blockID); err != nil {
+			return err
+		}
+
+		p.BlockIDs = append(p.BlockIDs, blockID)
+		*lines = append(*lines, blockID)
+		return nil
+	}
+
+	return fmt.Errorf("unsupported object ID: %v", objectID)
+}
@@ -7,8 +7,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/kopia/repo/block"
+	"github.com/kopia/repo/internal/retry"
+	"github.com/kopia/repo/storage"
 	"github.com/pkg/errors"
 )
 
@@ -24,6 +27,9 @@ type blockManager interface {
 	BlockInfo(ctx context.Context, blockID string) (block.Info, error)
 	GetBlock(ctx context.Context, blockID string) ([]byte, error)
 	WriteBlock(ctx context.Context, data []byte, prefix string) (string, error)
+	BlockIDForData(data []byte, prefix string) (string, error)
+	CommittedIndexBlocks(blockIDs []string) ([]string, error)
+	Flush(ctx context.Context) error
 }
 
 // Format describes the format of objects in a repository.
@@ -32,6 +38,15 @@ type Format struct {
 	MinBlockSize int    `json:"minBlockSize,omitempty"` // minimum block size used with dynamic splitter
 	AvgBlockSize int    `json:"avgBlockSize,omitempty"` // approximate size of storage block (used with dynamic splitter)
 	MaxBlockSize int    `json:"maxBlockSize,omitempty"` // maximum size of storage block
+
+	// SplitterWindowSize is the number of bytes the rolling hash of the BUZHASH splitter is computed over,
+	// zero selects the default of 32 bytes.
+	SplitterWindowSize int `json:"splitterWindowSize,omitempty"`
+
+	// Default compression policy, applied to writes that don't specify compression in WriterOptions.
+	Compression        string `json:"compression,omitempty"`        // name of the compression algorithm, empty or NoCompression disables it
+	CompressionLevel   int    `json:"compressionLevel,omitempty"`   // compression level, zero selects the default of the algorithm
+	MinCompressionSize int    `json:"minCompressionSize,omitempty"` // blocks smaller than this are stored uncompressed
 }
 
 // Manager implements a content-addressable storage on top of blob storage.
@@ -42,17 +57,143 @@ type Manager struct {
 	trace    func(message string, args ...interface{})
 
 	newSplitter func() objectSplitter
+
+	isRetriableReadError retry.IsRetriableFunc
+
+	maxDecompressedBlockSize  int64
+	maxDecompressedObjectSize int64
+
+	prefetchBlocks int
+
+	repackedChunksMutex sync.Mutex
+	repackedChunks      map[string][]indirectObjectEntry // locations of chunks written by repacking writers by chunk block ID
 }
 
 // NewWriter creates an ObjectWriter for writing to the repository.
 func (om *Manager) NewWriter(ctx context.Context, opt WriterOptions) Writer {
-	return &objectWriter{
+	if opt.StorageBlockSize > 0 {
+		return newRepackingWriter(ctx, om, opt)
+	}
+
+	if opt.DeltaBase != "" {
+		return newDeltaWriter(ctx, om, opt)
+	}
+
+	if opt.Timings != nil && opt.AsyncUploads <= 0 {
+		// block manager timings are not safe for concurrent use.
+		ctx = block.WithTimings(ctx, &opt.Timings.Timings)
+	}
+
+	w := &objectWriter{
 		ctx:         ctx,
 		repo:        om,
 		splitter:    om.newSplitter(),
 		description: opt.Description,
 		prefix:      opt.Prefix,
+		timings:     opt.Timings,
+		digest:      opt.Digest,
+
+		maxObjectSize: opt.MaxObjectSize,
+
+		checkpointInterval: opt.CheckpointInterval,
+		onCheckpoint:       opt.OnCheckpoint,
+		resumeFrom:         opt.ResumeFrom,
+	}
+
+	if opt.ResumeFrom != nil {
+		// the chunks of the checkpoint have already been flushed.
+		w.lastCheckpoint = opt.ResumeFrom.Length
+	}
+
+	if opt.AsyncUploads > 0 {
+		w.uploads = &asyncUploads{slots: make(chan struct{}, opt.AsyncUploads)}
+	}
+
+	compression, level := opt.Compression, opt.CompressionLevel
+	if compression == "" {
+		compression, level = om.Format.Compression, om.Format.CompressionLevel
+		w.minCompressionSize = om.Format.MinCompressionSize
+	}
+
+	if compression != "" && compression != NoCompression {
+		w.compressor, w.compressionLevel, w.compressorErr = getCompressor(compression, level)
+	}
+
+	return w
+}
+
+// repackedChunkLocations returns the entries referencing the parts of the chunk with the provided block ID
+// written by a repacking writer, with offsets relative to the beginning of the chunk.
+func (om *Manager) repackedChunkLocations(key string) ([]indirectObjectEntry, bool) {
+	om.repackedChunksMutex.Lock()
+	defer om.repackedChunksMutex.Unlock()
+
+	l, ok := om.repackedChunks[key]
+	return l, ok
+}
+
+// rememberRepackedChunk records the entries referencing the parts of a chunk written by a repacking writer.
+// Once maxRepackedChunks chunks have been recorded, new ones are no longer deduplicated.
+func (om *Manager) rememberRepackedChunk(key string, entries []indirectObjectEntry) {
+	om.repackedChunksMutex.Lock()
+	defer om.repackedChunksMutex.Unlock()
+
+	if om.repackedChunks == nil {
+		om.repackedChunks = map[string][]indirectObjectEntry{}
+	}
+
+	if len(om.repackedChunks) >= maxRepackedChunks {
+		return
 	}
+
+	locations := make([]indirectObjectEntry, len(entries))
+	for i, e := range entries {
+		locations[i] = indirectObjectEntry{Start: e.Start - entries[0].Start, Length: e.Length, Object: e.Object}
+	}
+
+	om.repackedChunks[key] = locations
+}
+
+// WriteRequest describes a single object to be written using WriteAll().
+type WriteRequest struct {
+	Reader  io.Reader
+	Options WriterOptions
+}
+
+// WriteAll is a convenience function that writes the objects described by the provided requests one after another
+// using WriteFrom and returns their object IDs in the same order. Because the objects are written through the shared
+// block manager, small objects are coalesced into shared pack blocks and identical contents are deduplicated across
+// the entire batch. Writing stops at the first error.
+func (om *Manager) WriteAll(ctx context.Context, requests []WriteRequest) ([]ID, error) {
+	result := make([]ID, len(requests))
+
+	for i, req := range requests {
+		oid, err := om.WriteFrom(ctx, req.Reader, req.Options)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to write object #%v (%v)", i, req.Options.Description)
+		}
+
+		result[i] = oid
+	}
+
+	return result, nil
+}
+
+// WriteFrom writes an object with the contents read from the provided reader until EOF and returns its object ID.
+// The contents are streamed through the splitter, so memory usage is bounded by the size of the blocks being
+// written rather than by the length of the object.
+//
+// If reading fails, the error is returned without an object ID. Blocks written before the failure are not removed
+// and remain in pack blocks, where they are deduplicated against subsequent writes of the same contents.
+func (om *Manager) WriteFrom(ctx context.Context, r io.Reader, opt WriterOptions) (ID, error) {
+	w := om.NewWriter(ctx, opt)
+	defer w.Close() //nolint:errcheck
+
+	if _, err := io.Copy(w, r); err != nil {
+		return "", errors.Wrapf(err, "unable to write %v", opt.Description)
+	}
+
+	return w.Result()
 }
 
 // Open creates new ObjectReader for reading given object from a repository.
@@ -74,14 +215,41 @@ func (om *Manager) Open(ctx context.Context, objectID ID) (Reader, error) {
 
 		totalLength := seekTable[len(seekTable)-1].endOffset()
 
+		if err := om.checkDecompressedObjectLength(objectID, seekTable); err != nil {
+			return nil, err
+		}
+
 		return &objectReader{
-			ctx:         ctx,
-			repo:        om,
-			seekTable:   seekTable,
-			totalLength: totalLength,
+			ctx:            ctx,
+			repo:           om,
+			seekTable:      seekTable,
+			totalLength:    totalLength,
+			lastChunkIndex: -1,
 		}, nil
 	}
 
+	if compressedObjectID, ok := objectID.Compressed(); ok {
+		return om.newCompressedReader(ctx, compressedObjectID)
+	}
+
+	if baseID, offset, length, ok := objectID.Slice(); ok {
+		rd, err := om.Open(ctx, baseID)
+		if err != nil {
+			return nil, err
+		}
+
+		if offset+length > rd.Length() {
+			rd.Close() //nolint:errcheck
+			return nil, fmt.Errorf("slice %v is out of range of the base object of length %v", objectID, rd.Length())
+		}
+
+		return &sliceReader{base: rd, offset: offset, length: length}, nil
+	}
+
+	if descriptorID, ok := objectID.Delta(); ok {
+		return om.newDeltaReader(ctx, descriptorID)
+	}
+
 	return om.newRawReader(ctx, objectID)
 }
 
@@ -97,6 +265,96 @@ func (om *Manager) VerifyObject(ctx context.Context, oid ID) (int64, []string, e
 	return l, blocks.blockIDs(), nil
 }
 
+// Length returns the length of the provided object without reading its contents. The lengths of indirect objects
+// are determined from their index, which is the only part that's read, and the lengths of direct objects from the
+// block index, which records the original length of blocks compressed by the block manager. Blocks of objects
+// compressed by the writer (see WriterOptions.Compression) must be read to get the length from their header,
+// as must compressed blocks whose index entries predate recording original lengths.
+// Returns storage.ErrBlockNotFound if the object does not exist.
+func (om *Manager) Length(ctx context.Context, oid ID) (int64, error) {
+	if indexObjectID, ok := oid.IndexObjectID(); ok {
+		rd, err := om.Open(ctx, indexObjectID)
+		if err != nil {
+			return 0, err
+		}
+		defer rd.Close() //nolint:errcheck
+
+		seekTable, err := om.flattenListChunk(rd)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(seekTable) == 0 {
+			return 0, nil
+		}
+
+		return seekTable[len(seekTable)-1].endOffset(), nil
+	}
+
+	if compressedObjectID, ok := oid.Compressed(); ok {
+		_, payload, err := om.getCompressedBlock(ctx, compressedObjectID)
+		if err != nil {
+			return 0, err
+		}
+
+		_, length, _, err := parseCompressedBlockHeader(payload)
+		if err != nil {
+			return 0, fmt.Errorf("invalid compressed object %v: %v", oid, err)
+		}
+
+		return length, nil
+	}
+
+	if baseID, offset, length, ok := oid.Slice(); ok {
+		l, err := om.Length(ctx, baseID)
+		if err != nil {
+			return 0, err
+		}
+
+		if offset+length > l {
+			return 0, fmt.Errorf("slice %v is out of range of the base object of length %v", oid, l)
+		}
+
+		return length, nil
+	}
+
+	if descriptorID, ok := oid.Delta(); ok {
+		d, err := om.readDeltaObject(ctx, descriptorID)
+		if err != nil {
+			return 0, err
+		}
+
+		return d.Length, nil
+	}
+
+	if blockID, ok := oid.BlockID(); ok {
+		bi, err := om.blockMgr.BlockInfo(ctx, blockID)
+		if err != nil {
+			return 0, err
+		}
+
+		if bi.Deleted {
+			return 0, storage.ErrBlockNotFound
+		}
+
+		return om.blockContentLength(ctx, bi)
+	}
+
+	return 0, fmt.Errorf("unsupported object ID: %v", oid)
+}
+
+// RequiredIndexBlocks returns the sorted list of committed index blocks needed to read the provided object,
+// which along with the packs of its blocks make up the minimal subset of the repository from which the object
+// can be read.
+func (om *Manager) RequiredIndexBlocks(ctx context.Context, oid ID) ([]string, error) {
+	_, blocks, err := om.VerifyObject(ctx, oid)
+	if err != nil {
+		return nil, err
+	}
+
+	return om.blockMgr.CommittedIndexBlocks(blocks)
+}
+
 func (om *Manager) verifyIndirectObjectInternal(ctx context.Context, indexObjectID ID, blocks *blockTracker) (int64, error) {
 	if _, err := om.verifyObjectInternal(ctx, indexObjectID, blocks); err != nil {
 		return 0, errors.Wrap(err, "unable to read index")
@@ -132,25 +390,115 @@ func (om *Manager) verifyObjectInternal(ctx context.Context, oid ID, blocks *blo
 		return om.verifyIndirectObjectInternal(ctx, indexObjectID, blocks)
 	}
 
+	if compressedObjectID, ok := oid.Compressed(); ok {
+		blockID, _ := compressedObjectID.BlockID()
+		b, err := om.blockMgr.GetBlock(ctx, blockID)
+		if err != nil {
+			return 0, err
+		}
+
+		_, length, _, err := parseCompressedBlockHeader(b)
+		if err != nil {
+			return 0, fmt.Errorf("invalid compressed object %v: %v", oid, err)
+		}
+
+		blocks.addBlock(blockID)
+		return length, nil
+	}
+
+	if baseID, offset, length, ok := oid.Slice(); ok {
+		l, err := om.verifyObjectInternal(ctx, baseID, blocks)
+		if err != nil {
+			return 0, err
+		}
+
+		if offset+length > l {
+			return 0, fmt.Errorf("slice %v is out of range of the base object of length %v", oid, l)
+		}
+
+		return length, nil
+	}
+
+	if descriptorID, ok := oid.Delta(); ok {
+		if _, err := om.verifyObjectInternal(ctx, descriptorID, blocks); err != nil {
+			return 0, errors.Wrap(err, "unable to read delta descriptor")
+		}
+
+		d, err := om.readDeltaObject(ctx, descriptorID)
+		if err != nil {
+			return 0, err
+		}
+
+		l, err := om.verifyObjectInternal(ctx, d.Base, blocks)
+		if err != nil {
+			return 0, err
+		}
+
+		var insertsLength int64
+		if d.Inserts != "" {
+			if insertsLength, err = om.verifyObjectInternal(ctx, d.Inserts, blocks); err != nil {
+				return 0, errors.Wrap(err, "unable to verify delta inserts")
+			}
+		}
+
+		if err := d.checkRanges(l, insertsLength); err != nil {
+			return 0, fmt.Errorf("invalid delta object %v: %v", oid, err)
+		}
+
+		return d.Length, nil
+	}
+
 	if blockID, ok := oid.BlockID(); ok {
 		p, err := om.blockMgr.BlockInfo(ctx, blockID)
 		if err != nil {
 			return 0, err
 		}
 		blocks.addBlock(blockID)
-		return int64(p.Length), nil
+
+		return om.blockContentLength(ctx, p)
 	}
 
 	return 0, fmt.Errorf("unrecognized object type: %v", oid)
 
 }
 
+// blockContentLength returns the length of the contents of the provided block, which is only read when
+// it is compressed and its index entry predates recording the original length of compressed blocks.
+func (om *Manager) blockContentLength(ctx context.Context, bi block.Info) (int64, error) {
+	if l, ok := bi.ContentLength(); ok {
+		return l, nil
+	}
+
+	b, err := om.getBlock(ctx, bi.BlockID)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(b)), nil
+}
+
 func nullTrace(message string, args ...interface{}) {
 }
 
 // ManagerOptions specifies object manager options.
 type ManagerOptions struct {
 	Trace func(message string, args ...interface{})
+
+	// IsRetriableReadError, if set, causes block reads that fail with errors it considers retriable
+	// to be retried with exponential backoff before giving up.
+	IsRetriableReadError func(err error) bool
+
+	// MaxDecompressedBlockSize, if positive, limits the length each compressed block may decompress to and
+	// MaxDecompressedObjectSize the total decompressed length of compressed blocks of an object. Reading data
+	// beyond the limits fails with ErrDecompressionLimitExceeded, which protects readers from running out of memory
+	// because of corrupt or malicious blocks.
+	MaxDecompressedBlockSize  int64
+	MaxDecompressedObjectSize int64
+
+	// PrefetchBlocks, if positive, causes sequential reads of objects split into multiple blocks to fetch up to
+	// that many of the following blocks in the background, which limits the memory used for prefetched data.
+	// Prefetching stops when the reader seeks elsewhere and resumes once the reads are sequential again.
+	PrefetchBlocks int
 }
 
 // NewObjectManager creates an ObjectManager with the specified block manager and format.
@@ -171,6 +519,16 @@ func NewObjectManager(ctx context.Context, bm blockManager, f Format, opts Manag
 		return nil, fmt.Errorf("unsupported splitter %q", f.Splitter)
 	}
 
+	if f.SplitterWindowSize < 0 {
+		return nil, fmt.Errorf("invalid splitter window size %v", f.SplitterWindowSize)
+	}
+
+	if f.Compression != "" && f.Compression != NoCompression {
+		if _, _, err := getCompressor(f.Compression, f.CompressionLevel); err != nil {
+			return nil, errors.Wrap(err, "invalid default compression")
+		}
+	}
+
 	om.newSplitter = func() objectSplitter {
 		return os(&f)
 	}
@@ -181,6 +539,16 @@ func NewObjectManager(ctx context.Context, bm blockManager, f Format, opts Manag
 		om.trace = nullTrace
 	}
 
+	om.maxDecompressedBlockSize = opts.MaxDecompressedBlockSize
+	om.maxDecompressedObjectSize = opts.MaxDecompressedObjectSize
+	om.prefetchBlocks = opts.PrefetchBlocks
+
+	if opts.IsRetriableReadError != nil {
+		om.isRetriableReadError = func(err error) bool {
+			return err != nil && opts.IsRetriableReadError(err)
+		}
+	}
+
 	return om, nil
 }
 
@@ -213,7 +581,7 @@ func (om *Manager) flattenListChunk(rawReader io.Reader) ([]indirectObjectEntry,
 
 func (om *Manager) newRawReader(ctx context.Context, objectID ID) (Reader, error) {
 	if blockID, ok := objectID.BlockID(); ok {
-		payload, err := om.blockMgr.GetBlock(ctx, blockID)
+		payload, err := om.getBlock(ctx, blockID)
 		if err != nil {
 			return nil, err
 		}
@@ -224,6 +592,62 @@ func (om *Manager) newRawReader(ctx context.Context, objectID ID) (Reader, error
 	return nil, fmt.Errorf("unsupported object ID: %v", objectID)
 }
 
+// getBlock reads the contents of the provided block, retrying if configured.
+func (om *Manager) getBlock(ctx context.Context, blockID string) ([]byte, error) {
+	if om.isRetriableReadError == nil {
+		return om.blockMgr.GetBlock(ctx, blockID)
+	}
+
+	v, err := retry.WithExponentialBackoff("GetBlock("+blockID+")", func() (interface{}, error) {
+		return om.blockMgr.GetBlock(ctx, blockID)
+	}, om.isRetriableReadError)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]byte), nil
+}
+
+func (om *Manager) newCompressedReader(ctx context.Context, compressedObjectID ID) (Reader, error) {
+	_, payload, err := om.getCompressedBlock(ctx, compressedObjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	maxLength := om.maxDecompressedBlockSize
+	if om.maxDecompressedObjectSize > 0 && (maxLength <= 0 || om.maxDecompressedObjectSize < maxLength) {
+		maxLength = om.maxDecompressedObjectSize
+	}
+
+	data, err := decompressBlock(payload, maxLength)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to decompress %v", compressedObjectID)
+	}
+
+	return newObjectReaderWithData(data), nil
+}
+
+// checkDecompressedObjectLength ensures that the total length of compressed parts of the indirect object with
+// the provided seek table does not exceed the configured limit.
+func (om *Manager) checkDecompressedObjectLength(objectID ID, seekTable []indirectObjectEntry) error {
+	if om.maxDecompressedObjectSize <= 0 {
+		return nil
+	}
+
+	var total int64
+	for _, e := range seekTable {
+		if _, ok := e.Object.Compressed(); ok {
+			total += e.Length
+		}
+	}
+
+	if total > om.maxDecompressedObjectSize {
+		return errors.Wrapf(ErrDecompressionLimitExceeded, "object %v decompresses to %v bytes, limit is %v", objectID, total, om.maxDecompressedObjectSize)
+	}
+
+	return nil
+}
+
 type readerWithData struct {
 	io.ReadSeeker
 	length int64
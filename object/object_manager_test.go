@@ -2,21 +2,26 @@ package object
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	cryptorand "crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"reflect"
 	"runtime/debug"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/kopia/repo/block"
 	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
 )
 
 type fakeBlockManager struct {
@@ -47,6 +52,16 @@ func (f *fakeBlockManager) WriteBlock(ctx context.Context, data []byte, prefix s
 	return blockID, nil
 }
 
+func (f *fakeBlockManager) CommittedIndexBlocks(blockIDs []string) ([]string, error) {
+	return nil, errors.New("not supported")
+}
+
+func (f *fakeBlockManager) BlockIDForData(data []byte, prefix string) (string, error) {
+	h := sha256.New()
+	h.Write(data) //nolint:errcheck
+	return prefix + string(hex.EncodeToString(h.Sum(nil))), nil
+}
+
 func (f *fakeBlockManager) BlockInfo(ctx context.Context, blockID string) (block.Info, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -67,8 +82,12 @@ func setupTest(t *testing.T) (map[string][]byte, *Manager) {
 }
 
 func setupTestWithData(t *testing.T, data map[string][]byte, opts ManagerOptions) (map[string][]byte, *Manager) {
+	return setupTestWithBlockSize(t, data, 400, opts)
+}
+
+func setupTestWithBlockSize(t *testing.T, data map[string][]byte, blockSize int, opts ManagerOptions) (map[string][]byte, *Manager) {
 	r, err := NewObjectManager(context.Background(), &fakeBlockManager{data: data}, Format{
-		MaxBlockSize: 400,
+		MaxBlockSize: blockSize,
 		Splitter:     "FIXED",
 	}, opts)
 	if err != nil {
@@ -123,6 +142,219 @@ func TestWriters(t *testing.T) {
 	}
 }
 
+func TestWriterDigest(t *testing.T) {
+	ctx := context.Background()
+	_, om := setupTest(t)
+
+	content := make([]byte, 3000000)
+	rand.Read(content) //nolint:errcheck
+
+	digest := sha256.New()
+	writer := om.NewWriter(ctx, WriterOptions{Digest: digest})
+	for _, chunk := range [][]byte{content[0:1], content[1:1000000], content[1000000:]} {
+		if _, err := writer.Write(chunk); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+
+	oid, err := writer.Result()
+	if err != nil {
+		t.Fatalf("result error: %v", err)
+	}
+
+	if _, ok := oid.IndexObjectID(); !ok {
+		t.Errorf("expected an indirect object, got %v", oid)
+	}
+
+	if got, want := digest.Sum(nil), sha256.Sum256(content); !bytes.Equal(got, want[:]) {
+		t.Errorf("unexpected digest: %x, wanted %x", got, want)
+	}
+
+	verify(ctx, t, om, oid, content, "digest")
+}
+
+func TestWalkObjects(t *testing.T) {
+	ctx := context.Background()
+	_, om := setupTest(t)
+
+	write := func(data []byte) ID {
+		w := om.NewWriter(ctx, WriterOptions{})
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+
+		oid, err := w.Result()
+		if err != nil {
+			t.Fatalf("result error: %v", err)
+		}
+
+		return oid
+	}
+
+	const dirPrefix = "DIR:"
+	writeDir := func(entries ...ID) ID {
+		b, err := json.Marshal(entries)
+		if err != nil {
+			t.Fatalf("marshal error: %v", err)
+		}
+
+		return write(append([]byte(dirPrefix), b...))
+	}
+
+	references := func(ctx context.Context, oid ID) ([]ID, error) {
+		r, err := om.Open(ctx, oid)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close() //nolint:errcheck
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.HasPrefix(b, []byte(dirPrefix)) {
+			return nil, err
+		}
+
+		var entries []ID
+		err = json.Unmarshal(b[len(dirPrefix):], &entries)
+		return entries, err
+	}
+
+	leaf1 := write([]byte("leaf1"))
+	leaf2 := write(make([]byte, 1000)) // indirect object
+	leaf3 := write([]byte("leaf3"))
+	dir1 := writeDir(leaf1, leaf2)
+	dir2 := writeDir(leaf2, leaf3)
+	root := writeDir(dir1, dir2, leaf1)
+
+	var visited []ID
+	if err := om.WalkObjects(ctx, root, references, func(oid ID) error {
+		visited = append(visited, oid)
+		return nil
+	}); err != nil {
+		t.Fatalf("walk error: %v", err)
+	}
+
+	if got, want := visited, []ID{root, dir1, leaf1, leaf2, dir2, leaf3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected visited objects: %v, wanted %v", got, want)
+	}
+
+	errStop := errors.New("stop")
+	visited = nil
+	if err := om.WalkObjects(ctx, root, references, func(oid ID) error {
+		visited = append(visited, oid)
+		if oid == dir1 {
+			return errStop
+		}
+		return nil
+	}); err != errStop {
+		t.Errorf("unexpected walk error: %v, wanted %v", err, errStop)
+	}
+
+	if got, want := len(visited), 2; got != want {
+		t.Errorf("unexpected number of objects visited before error: %v, wanted %v", got, want)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	ctx := context.Background()
+	data, om := setupTest(t)
+
+	content := make([]byte, 2000)
+	rand.Read(content) //nolint:errcheck
+
+	writer := om.NewWriter(ctx, WriterOptions{})
+	writer.Write(content) //nolint:errcheck
+	oid, err := writer.Result()
+	if err != nil {
+		t.Fatalf("result error: %v", err)
+	}
+
+	stored, err := om.Chunks(ctx, oid)
+	if err != nil {
+		t.Fatalf("unable to get chunks: %v", err)
+	}
+
+	if got, want := len(stored), 5; got != want {
+		t.Fatalf("unexpected number of chunks: %v, wanted %v", got, want)
+	}
+
+	storedBlocks := len(data)
+
+	// modify a single byte of the local copy, which only changes the chunk containing it.
+	local := append([]byte(nil), content...)
+	local[900] ^= 1
+
+	localChunks, err := om.LocalChunks(ctx, bytes.NewReader(local), WriterOptions{})
+	if err != nil {
+		t.Fatalf("unable to get local chunks: %v", err)
+	}
+
+	if got, want := len(data), storedBlocks; got != want {
+		t.Errorf("LocalChunks() wrote blocks: %v, wanted %v", got, want)
+	}
+
+	var differing []int
+	for i := range stored {
+		if stored[i].Start != localChunks[i].Start || stored[i].Length != localChunks[i].Length {
+			t.Fatalf("chunk boundaries differ: %+v vs %+v", stored[i], localChunks[i])
+		}
+
+		if stored[i].Object != localChunks[i].Object {
+			differing = append(differing, i)
+		}
+	}
+
+	if got, want := differing, []int{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected differing chunks: %v, wanted %v", got, want)
+	}
+
+	// small objects consist of a single chunk.
+	writer = om.NewWriter(ctx, WriterOptions{})
+	writer.Write([]byte{1, 2, 3}) //nolint:errcheck
+	oid, err = writer.Result()
+	if err != nil {
+		t.Fatalf("result error: %v", err)
+	}
+
+	if got, err := om.Chunks(ctx, oid); err != nil || !reflect.DeepEqual(got, []Chunk{{Start: 0, Length: 3, Object: oid}}) {
+		t.Errorf("unexpected chunks of direct object: %v %v", got, err)
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	ctx := context.Background()
+	_, om := setupTest(t)
+
+	writer := om.NewWriter(ctx, WriterOptions{MaxObjectSize: 1000})
+	if n, err := writer.Write(make([]byte, 600)); n != 600 || err != nil {
+		t.Fatalf("unexpected write result: %v %v", n, err)
+	}
+
+	if n, err := writer.Write(make([]byte, 600)); n != 400 || errors.Cause(err) != ErrObjectTooLarge {
+		t.Fatalf("unexpected write result past the limit: %v %v, wanted 400 %v", n, err, ErrObjectTooLarge)
+	}
+
+	if n, err := writer.Write([]byte{1}); n != 0 || errors.Cause(err) != ErrObjectTooLarge {
+		t.Errorf("unexpected write result after the limit: %v %v", n, err)
+	}
+
+	if oid, err := writer.Result(); oid != "" || errors.Cause(err) != ErrObjectTooLarge {
+		t.Errorf("unexpected result: %v %v, wanted %v", oid, err, ErrObjectTooLarge)
+	}
+
+	// objects of exactly the maximum size are fine.
+	writer = om.NewWriter(ctx, WriterOptions{MaxObjectSize: 1000})
+	if _, err := writer.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	oid, err := writer.Result()
+	if err != nil {
+		t.Fatalf("result error: %v", err)
+	}
+
+	verify(ctx, t, om, oid, make([]byte, 1000), "max-size")
+}
+
 func objectIDsEqual(o1 ID, o2 ID) bool {
 	return reflect.DeepEqual(o1, o2)
 }
@@ -220,6 +452,106 @@ func indirectionLevel(oid ID) int {
 	return 1 + indirectionLevel(indexObjectID)
 }
 
+func TestWriterStorageBlockSize(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	om, err := NewObjectManager(ctx, &fakeBlockManager{data: data}, Format{
+		Splitter:     "DYNAMIC",
+		MinBlockSize: 50,
+		AvgBlockSize: 256,
+		MaxBlockSize: 1000,
+	}, ManagerOptions{})
+	if err != nil {
+		t.Fatalf("can't create object manager: %v", err)
+	}
+
+	const storageBlockSize = 100
+
+	common := make([]byte, 10000)
+	cryptorand.Read(common) //nolint:errcheck
+
+	var storedBefore int
+	for i := 0; i < 2; i++ {
+		tail := make([]byte, 1234)
+		cryptorand.Read(tail) //nolint:errcheck
+		content := append(append([]byte(nil), common...), tail...)
+
+		blocksBefore := map[string]bool{}
+		for k := range data {
+			blocksBefore[k] = true
+		}
+
+		w := om.NewWriter(ctx, WriterOptions{StorageBlockSize: storageBlockSize})
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+
+		oid, err := w.Result()
+		if err != nil {
+			t.Fatalf("result error: %v", err)
+		}
+		verify(ctx, t, om, oid, content, fmt.Sprintf("object-%v", i))
+
+		r, err := om.Open(ctx, oid)
+		if err != nil {
+			t.Fatalf("unable to open %v: %v", oid, err)
+		}
+		or, ok := r.(*objectReader)
+		if !ok {
+			t.Fatalf("expected indirect object reader for %v, got %T", oid, r)
+		}
+		r.Close() //nolint:errcheck
+
+		// all new storage blocks of the object except the last one have the same size.
+		var shorter, stored int
+		for _, e := range or.seekTable {
+			base, _, _, ok := e.Object.Slice()
+			if !ok {
+				t.Fatalf("unexpected entry of %v: %v", oid, e.Object)
+			}
+
+			blockID, _ := base.BlockID()
+			if blocksBefore[blockID] {
+				continue
+			}
+			blocksBefore[blockID] = true
+
+			stored += len(data[blockID])
+			if len(data[blockID]) != storageBlockSize {
+				shorter++
+			}
+		}
+
+		if shorter > 1 {
+			t.Errorf("object-%v has %v storage blocks shorter than %v bytes", i, shorter, storageBlockSize)
+		}
+
+		if i == 0 {
+			storedBefore = stored
+			continue
+		}
+
+		// only the chunks of the tail and the chunk at its boundary are stored again.
+		if stored > len(tail)+2000 {
+			t.Errorf("common chunks were not deduplicated, stored %v bytes, first object stored %v", stored, storedBefore)
+		}
+	}
+
+	w := om.NewWriter(ctx, WriterOptions{StorageBlockSize: storageBlockSize, AsyncUploads: 2})
+	if _, err := w.Write(common); err == nil {
+		t.Errorf("unexpected success writing with incompatible options")
+	}
+
+	empty := om.NewWriter(ctx, WriterOptions{StorageBlockSize: storageBlockSize})
+	oid, err := empty.Result()
+	if err != nil {
+		t.Fatalf("result error: %v", err)
+	}
+	if l, err := om.Length(ctx, oid); err != nil || l != 0 {
+		t.Errorf("unexpected length of empty object: %v %v", l, err)
+	}
+}
+
 func TestHMAC(t *testing.T) {
 	ctx := context.Background()
 	content := bytes.Repeat([]byte{0xcd}, 50)
@@ -311,34 +643,1002 @@ func TestEndToEndReadAndSeek(t *testing.T) {
 	}
 }
 
-func verify(ctx context.Context, t *testing.T, om *Manager, objectID ID, expectedData []byte, testCaseID string) {
-	t.Helper()
-	reader, err := om.Open(ctx, objectID)
+func TestSliceObject(t *testing.T) {
+	ctx := context.Background()
+	_, om := setupTest(t)
+
+	baseData := make([]byte, 512434)
+	cryptorand.Read(baseData) //nolint:errcheck
+
+	writer := om.NewWriter(ctx, WriterOptions{})
+	if _, err := writer.Write(baseData); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	baseID, err := writer.Result()
+	writer.Close()
 	if err != nil {
-		t.Errorf("cannot get reader for %v (%v): %v %v", testCaseID, objectID, err, string(debug.Stack()))
-		return
+		t.Fatalf("cannot get writer result: %v", err)
 	}
 
-	for i := 0; i < 20; i++ {
-		sampleSize := int(rand.Int31n(300))
-		seekOffset := int(rand.Int31n(int32(len(expectedData))))
-		if seekOffset+sampleSize > len(expectedData) {
-			sampleSize = len(expectedData) - seekOffset
+	cases := []struct {
+		offset, length int64
+	}{
+		{0, 1},
+		{0, 512434},
+		{1000, 300},
+		{199, 202},
+		{100000, 300000},
+		{512433, 1},
+	}
+
+	for _, tc := range cases {
+		sliceID := SliceObjectID(baseID, tc.offset, tc.length)
+		if err := sliceID.Validate(); err != nil {
+			t.Errorf("invalid slice object ID %v: %v", sliceID, err)
 		}
-		if sampleSize > 0 {
-			got := make([]byte, sampleSize)
-			if offset, err := reader.Seek(int64(seekOffset), 0); err != nil || offset != int64(seekOffset) {
-				t.Errorf("seek error: %v offset=%v expected:%v", err, offset, seekOffset)
-			}
-			if n, err := reader.Read(got); err != nil || n != sampleSize {
-				t.Errorf("invalid data: n=%v, expected=%v, err:%v", n, sampleSize, err)
-			}
 
-			expected := expectedData[seekOffset : seekOffset+sampleSize]
+		expected := baseData[tc.offset : tc.offset+tc.length]
+		verify(ctx, t, om, sliceID, expected, fmt.Sprintf("slice %v", sliceID))
 
-			if !bytes.Equal(expected, got) {
-				t.Errorf("incorrect data read for %v: expected: %x, got: %x", testCaseID, expected, got)
-			}
+		r, err := om.Open(ctx, sliceID)
+		if err != nil {
+			t.Fatalf("unable to open %v: %v", sliceID, err)
+		}
+
+		if got, want := r.Length(), tc.length; got != want {
+			t.Errorf("unexpected length of %v: %v, wanted %v", sliceID, got, want)
+		}
+
+		got, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(got, expected) {
+			t.Errorf("unexpected contents of %v: %v", sliceID, err)
+		}
+		r.Close()
+
+		l, _, err := om.VerifyObject(ctx, sliceID)
+		if err != nil || l != tc.length {
+			t.Errorf("unexpected verification result for %v: %v %v, wanted %v", sliceID, l, err, tc.length)
+		}
+	}
+
+	nested := SliceObjectID(SliceObjectID(baseID, 1000, 5000), 100, 200)
+	verify(ctx, t, om, nested, baseData[1100:1300], "nested slice")
+
+	for _, oid := range []ID{
+		SliceObjectID(baseID, 512434, 1),
+		SliceObjectID(baseID, 0, 512435),
+		SliceObjectID(SliceObjectID(baseID, 1000, 5000), 4000, 2000),
+	} {
+		if _, err := om.Open(ctx, oid); err == nil {
+			t.Errorf("unexpected success opening out-of-range slice %v", oid)
 		}
+		if _, _, err := om.VerifyObject(ctx, oid); err == nil {
+			t.Errorf("unexpected success verifying out-of-range slice %v", oid)
+		}
+	}
+}
+
+// failingReader returns an error after reading the provided number of bytes from the underlying reader.
+type failingReader struct {
+	r         io.Reader
+	remaining int
+	err       error
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, r.err
+	}
+
+	if len(b) > r.remaining {
+		b = b[0:r.remaining]
+	}
+
+	n, err := r.r.Read(b)
+	r.remaining -= n
+	return n, err
+}
+
+func TestWriteFrom(t *testing.T) {
+	ctx := context.Background()
+	_, om := setupTestWithBlockSize(t, map[string][]byte{}, 65536, ManagerOptions{})
+
+	const length = 5000000
+	oid, err := om.WriteFrom(ctx, io.LimitReader(rand.New(rand.NewSource(1)), length), WriterOptions{})
+	if err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+
+	expected := make([]byte, length)
+	rand.New(rand.NewSource(1)).Read(expected) //nolint:errcheck
+	verify(ctx, t, om, oid, expected, "large reader")
+
+	if l, err := om.Length(ctx, oid); err != nil || l != length {
+		t.Errorf("unexpected length: %v %v, wanted %v", l, err, length)
+	}
+
+	readErr := errors.New("read failure")
+	r := &failingReader{r: rand.New(rand.NewSource(1)), remaining: 1000000, err: readErr}
+	if oid, err := om.WriteFrom(ctx, r, WriterOptions{Description: "failing"}); errors.Cause(err) != readErr {
+		t.Errorf("unexpected result of writing from failing reader: %v %v, wanted %v", oid, err, readErr)
+	}
+}
+
+func TestConcatenate(t *testing.T) {
+	ctx := context.Background()
+	data, om := setupTestWithBlockSize(t, map[string][]byte{}, 1000, ManagerOptions{})
+
+	var parts []ID
+	var expected []byte
+	for i, length := range []int{0, 300, 5000, 0, 1, 2500} {
+		b := make([]byte, length)
+		rand.New(rand.NewSource(int64(i))).Read(b) //nolint:errcheck
+		oid, err := om.WriteFrom(ctx, bytes.NewReader(b), WriterOptions{})
+		if err != nil {
+			t.Fatalf("unable to write part %v: %v", i, err)
+		}
+
+		parts = append(parts, oid)
+		expected = append(expected, b...)
+	}
+
+	storedBefore := totalStoredBytes(data)
+	oid, err := om.Concatenate(ctx, parts)
+	if err != nil {
+		t.Fatalf("unable to concatenate: %v", err)
+	}
+
+	if _, ok := oid.IndexObjectID(); !ok {
+		t.Errorf("unexpected concatenated object ID: %v, wanted indirect object", oid)
+	}
+
+	if stored := totalStoredBytes(data) - storedBefore; stored >= len(expected)/2 {
+		t.Errorf("concatenation stored %v bytes of %v", stored, len(expected))
+	}
+
+	verify(ctx, t, om, oid, expected, "concatenated")
+
+	// seeks and reads straddling the boundaries of the parts.
+	r, err := om.Open(ctx, oid)
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+	defer r.Close() //nolint:errcheck
+
+	for _, join := range []int64{300, 5300, 5301} {
+		if _, err := r.Seek(join-3, io.SeekStart); err != nil {
+			t.Fatalf("unable to seek: %v", err)
+		}
+
+		got := make([]byte, 6)
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("unable to read at %v: %v", join-3, err)
+		}
+
+		if want := expected[join-3 : join+3]; !bytes.Equal(got, want) {
+			t.Errorf("unexpected data at %v: %x, wanted %x", join-3, got, want)
+		}
+	}
+
+	// concatenation of concatenated objects.
+	oid2, err := om.Concatenate(ctx, []ID{oid, parts[1], oid})
+	if err != nil {
+		t.Fatalf("unable to concatenate: %v", err)
+	}
+
+	var expected2 []byte
+	expected2 = append(expected2, expected...)
+	expected2 = append(expected2, expected[0:300]...)
+	expected2 = append(expected2, expected...)
+	verify(ctx, t, om, oid2, expected2, "concatenated twice")
+
+	if got, err := om.Concatenate(ctx, parts[2:3]); err != nil || got != parts[2] {
+		t.Errorf("unexpected result of concatenating single part: %v %v, wanted %v", got, err, parts[2])
+	}
+
+	if got, err := om.Concatenate(ctx, []ID{parts[0], parts[2], parts[3]}); err != nil || got != parts[2] {
+		t.Errorf("unexpected result of concatenating single non-empty part: %v %v, wanted %v", got, err, parts[2])
+	}
+
+	empty, err := om.Concatenate(ctx, []ID{parts[0], parts[3]})
+	if err != nil {
+		t.Fatalf("unable to concatenate empty parts: %v", err)
+	}
+
+	if l, err := om.Length(ctx, empty); err != nil || l != 0 {
+		t.Errorf("unexpected length of concatenated empty parts: %v %v", l, err)
+	}
+
+	if _, err := om.Concatenate(ctx, []ID{parts[1], "Dfoo"}); err == nil {
+		t.Errorf("unexpected success concatenating missing object")
+	}
+}
+
+func TestDeltaObject(t *testing.T) {
+	ctx := context.Background()
+	data, om := setupTestWithBlockSize(t, map[string][]byte{}, 4096, ManagerOptions{})
+
+	baseData := make([]byte, 100000)
+	cryptorand.Read(baseData) //nolint:errcheck
+
+	write := func(b []byte, opt WriterOptions) ID {
+		writer := om.NewWriter(ctx, opt)
+		defer writer.Close()
+
+		if _, err := writer.Write(b); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+		oid, err := writer.Result()
+		if err != nil {
+			t.Fatalf("cannot get writer result: %v", err)
+		}
+		return oid
+	}
+
+	baseID := write(baseData, WriterOptions{})
+	storedBefore := totalStoredBytes(data)
+
+	appended := append(append([]byte(nil), baseData...), []byte("extra")...)
+	deltaID := write(appended, WriterOptions{DeltaBase: baseID})
+
+	if _, ok := deltaID.Delta(); !ok {
+		t.Fatalf("unexpected object ID of delta: %v", deltaID)
+	}
+
+	if err := deltaID.Validate(); err != nil {
+		t.Errorf("invalid delta object ID %v: %v", deltaID, err)
+	}
+
+	if got := totalStoredBytes(data) - storedBefore; got > 200 {
+		t.Errorf("delta object stored %v bytes, expected a tiny delta block", got)
+	}
+
+	verify(ctx, t, om, deltaID, appended, "delta")
+
+	l, _, err := om.VerifyObject(ctx, deltaID)
+	if err != nil || l != int64(len(appended)) {
+		t.Errorf("unexpected verification result for %v: %v %v, wanted %v", deltaID, l, err, len(appended))
+	}
+
+	// changes in the middle of the object copy both the prefix and suffix of the base.
+	modified := append([]byte(nil), baseData...)
+	copy(modified[50000:], "modified")
+	modifiedID := write(modified, WriterOptions{DeltaBase: baseID})
+	if _, ok := modifiedID.Delta(); !ok {
+		t.Errorf("unexpected object ID of modified delta: %v", modifiedID)
+	}
+	verify(ctx, t, om, modifiedID, modified, "modified delta")
+
+	// scattered changes written in small chunks are matched with blocks of the base.
+	scattered := append([]byte(nil), baseData[0:40000]...)
+	scattered = append(scattered, []byte("inserted")...)
+	scattered = append(scattered, baseData[40000:]...)
+	copy(scattered[20000:], "changed")
+	copy(scattered[70000:], "changed")
+	storedBefore = totalStoredBytes(data)
+	writer := om.NewWriter(ctx, WriterOptions{DeltaBase: baseID})
+	for i := 0; i < len(scattered); i += 1000 {
+		end := i + 1000
+		if end > len(scattered) {
+			end = len(scattered)
+		}
+
+		if _, err := writer.Write(scattered[i:end]); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	scatteredID, err := writer.Result()
+	writer.Close()
+	if err != nil {
+		t.Fatalf("cannot get writer result: %v", err)
+	}
+	if _, ok := scatteredID.Delta(); !ok {
+		t.Errorf("unexpected object ID of scattered delta: %v", scatteredID)
+	}
+	if got := totalStoredBytes(data) - storedBefore; got > 20000 {
+		t.Errorf("scattered delta object stored %v bytes", got)
+	}
+	verify(ctx, t, om, scatteredID, scattered, "scattered delta")
+
+	// deltas of deltas are supported.
+	nested := append(append([]byte(nil), appended...), []byte("more")...)
+	verify(ctx, t, om, write(nested, WriterOptions{DeltaBase: deltaID}), nested, "nested delta")
+
+	// unrelated contents are stored as regular objects.
+	unrelated := make([]byte, 10000)
+	cryptorand.Read(unrelated) //nolint:errcheck
+	unrelatedID := write(unrelated, WriterOptions{DeltaBase: baseID})
+	if _, ok := unrelatedID.Delta(); ok {
+		t.Errorf("unexpected delta object ID of unrelated contents: %v", unrelatedID)
+	}
+	verify(ctx, t, om, unrelatedID, unrelated, "unrelated")
+
+	checkpointed := om.NewWriter(ctx, WriterOptions{DeltaBase: baseID, CheckpointInterval: 1000})
+	defer checkpointed.Close()
+	if _, err := checkpointed.Write(appended); err == nil {
+		t.Errorf("unexpected success writing delta with checkpoints")
+	}
+}
+
+// compressibleData returns pseudo-random text made of words from a small vocabulary.
+func compressibleData(length int) []byte {
+	words := []string{"lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing", "elit", "sed", "do"}
+	rnd := rand.New(rand.NewSource(1))
+
+	var buf bytes.Buffer
+	for buf.Len() < length {
+		buf.WriteString(words[rnd.Intn(len(words))])
+		buf.WriteString(fmt.Sprintf(" %v ", rnd.Intn(1000)))
+	}
+
+	return buf.Bytes()[0:length]
+}
+
+func totalStoredBytes(data map[string][]byte) int {
+	var total int
+	for _, v := range data {
+		total += len(v)
+	}
+	return total
+}
+
+func TestCompressionLevels(t *testing.T) {
+	ctx := context.Background()
+	content := compressibleData(1000000)
+
+	storedBytes := map[int]int{}
+	for _, level := range []int{1, 0, 9} {
+		data, om := setupTestWithBlockSize(t, map[string][]byte{}, 65536, ManagerOptions{})
+
+		writer := om.NewWriter(ctx, WriterOptions{Compression: "GZIP", CompressionLevel: level})
+		if _, err := writer.Write(content); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+		oid, err := writer.Result()
+		if err != nil {
+			t.Fatalf("unable to get result for level %v: %v", level, err)
+		}
+
+		verify(ctx, t, om, oid, content, fmt.Sprintf("level %v", level))
+
+		l, _, err := om.VerifyObject(ctx, oid)
+		if err != nil || l != int64(len(content)) {
+			t.Errorf("unexpected verification result for level %v: %v %v", level, l, err)
+		}
+
+		for _, e := range indirectObjectEntries(ctx, t, om, oid) {
+			if _, ok := e.Object.Compressed(); !ok {
+				t.Errorf("block %v of compressible data was not compressed at level %v", e.Object, level)
+			}
+		}
+
+		storedBytes[level] = totalStoredBytes(data)
+	}
+
+	if !(storedBytes[9] < storedBytes[0] && storedBytes[0] < storedBytes[1]) {
+		t.Errorf("higher compression levels did not produce smaller blocks: %v", storedBytes)
+	}
+
+	if storedBytes[9] >= len(content)/2 {
+		t.Errorf("data was not compressed: %v", storedBytes)
+	}
+}
+
+func TestDecompressionLimits(t *testing.T) {
+	ctx := context.Background()
+	data, om := setupTestWithBlockSize(t, map[string][]byte{}, 65536, ManagerOptions{})
+
+	// a block of zeros decompressing to much more than its stored length.
+	bomb, err := compressBlock(compressors["GZIP"], gzip.BestCompression, make([]byte, 1<<20))
+	if err != nil {
+		t.Fatalf("unable to compress: %v", err)
+	}
+
+	bombID, _ := om.blockMgr.WriteBlock(ctx, bomb, "")
+
+	// the same payload with a header claiming a tiny decompressed length.
+	lying := append([]byte{bomb[0], 100}, bomb[1+varintLength(1<<20):]...)
+	lyingID, _ := om.blockMgr.WriteBlock(ctx, lying, "")
+
+	writer := om.NewWriter(ctx, WriterOptions{Compression: "GZIP"})
+	if _, err := writer.Write(make([]byte, 300000)); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	indirectID, err := writer.Result()
+	if err != nil {
+		t.Fatalf("unable to get result: %v", err)
+	}
+
+	_, limited := setupTestWithBlockSize(t, data, 65536, ManagerOptions{
+		MaxDecompressedBlockSize:  100000,
+		MaxDecompressedObjectSize: 200000,
+	})
+
+	for _, oid := range []ID{
+		CompressedObjectID(DirectObjectID(bombID)),
+		CompressedObjectID(DirectObjectID(lyingID)),
+		indirectID,
+	} {
+		if _, err := limited.Open(ctx, oid); errors.Cause(err) != ErrDecompressionLimitExceeded {
+			t.Errorf("unexpected error opening %v: %v, wanted %v", oid, err, ErrDecompressionLimitExceeded)
+		}
+	}
+
+	// the lying header is detected even without limits.
+	if _, err := om.Open(ctx, CompressedObjectID(DirectObjectID(lyingID))); errors.Cause(err) != ErrDecompressionLimitExceeded {
+		t.Errorf("unexpected error opening block with invalid header: %v, wanted %v", err, ErrDecompressionLimitExceeded)
+	}
+
+	verify(ctx, t, om, CompressedObjectID(DirectObjectID(bombID)), make([]byte, 1<<20), "without limits")
+	verify(ctx, t, om, indirectID, make([]byte, 300000), "indirect without limits")
+}
+
+func varintLength(v uint64) int {
+	return binary.PutUvarint(make([]byte, binary.MaxVarintLen64), v)
+}
+
+func TestCompressionIncompressibleData(t *testing.T) {
+	ctx := context.Background()
+	_, om := setupTestWithBlockSize(t, map[string][]byte{}, 2000, ManagerOptions{})
+
+	content := make([]byte, 1000)
+	cryptorand.Read(content) //nolint:errcheck
+
+	writer := om.NewWriter(ctx, WriterOptions{Compression: "GZIP"})
+	if _, err := writer.Write(content); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	oid, err := writer.Result()
+	if err != nil {
+		t.Fatalf("unable to get result: %v", err)
+	}
+
+	if _, ok := oid.BlockID(); !ok {
+		t.Errorf("incompressible data was stored compressed: %v", oid)
+	}
+
+	verify(ctx, t, om, oid, content, "incompressible")
+}
+
+func TestCompressionInvalidOptions(t *testing.T) {
+	ctx := context.Background()
+	_, om := setupTest(t)
+
+	for _, opt := range []WriterOptions{
+		{Compression: "NO-SUCH-COMPRESSION"},
+		{Compression: "GZIP", CompressionLevel: 10},
+		{Compression: "GZIP", CompressionLevel: -2},
+	} {
+		writer := om.NewWriter(ctx, opt)
+		writer.Write([]byte{1, 2, 3}) //nolint:errcheck
+		if _, err := writer.Result(); err == nil {
+			t.Errorf("unexpected success writing with %+v", opt)
+		}
+	}
+}
+
+func TestOpenCompressed(t *testing.T) {
+	ctx := context.Background()
+	_, om := setupTestWithBlockSize(t, map[string][]byte{}, 1000, ManagerOptions{})
+
+	incompressible := make([]byte, 1000)
+	cryptorand.Read(incompressible) //nolint:errcheck
+
+	var content []byte
+	content = append(content, compressibleData(3000)...)
+	content = append(content, incompressible...)
+	content = append(content, compressibleData(2000)...)
+
+	writer := om.NewWriter(ctx, WriterOptions{Compression: "GZIP"})
+	if _, err := writer.Write(content); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	oid, err := writer.Result()
+	if err != nil {
+		t.Fatalf("unable to get result: %v", err)
+	}
+
+	var uncompressedBlocks int
+	for _, e := range indirectObjectEntries(ctx, t, om, oid) {
+		if _, ok := e.Object.Compressed(); !ok {
+			uncompressedBlocks++
+		}
+	}
+	if uncompressedBlocks == 0 {
+		t.Fatalf("expected some blocks to be stored uncompressed")
+	}
+
+	rd, encoding, err := om.OpenCompressed(ctx, oid)
+	if err != nil {
+		t.Fatalf("unable to open compressed stream: %v", err)
+	}
+	defer rd.Close() //nolint:errcheck
+
+	if got, want := encoding, "gzip"; got != want {
+		t.Errorf("unexpected content encoding: %v, wanted %v", got, want)
+	}
+
+	raw, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatalf("unable to read compressed stream: %v", err)
+	}
+
+	if len(raw) >= len(content) {
+		t.Errorf("compressed stream is not smaller than the data: %v, data %v", len(raw), len(content))
+	}
+
+	// decompress the way an HTTP client would.
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("unable to decompress stream: %v", err)
+	}
+
+	decompressed, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("unable to decompress stream: %v", err)
+	}
+
+	if !bytes.Equal(decompressed, content) {
+		t.Errorf("decompressed stream does not match original data")
+	}
+
+	// uncompressed objects can't be passed through.
+	writer = om.NewWriter(ctx, WriterOptions{})
+	writer.Write(content) //nolint:errcheck
+	oid, err = writer.Result()
+	if err != nil {
+		t.Fatalf("unable to get result: %v", err)
+	}
+
+	if _, _, err := om.OpenCompressed(ctx, oid); err != ErrNotCompressed {
+		t.Errorf("unexpected error opening uncompressed object: %v, wanted %v", err, ErrNotCompressed)
+	}
+}
+
+func indirectObjectEntries(ctx context.Context, t *testing.T, om *Manager, oid ID) []indirectObjectEntry {
+	t.Helper()
+
+	indexObjectID, ok := oid.IndexObjectID()
+	if !ok {
+		t.Fatalf("expected indirect object, got %v", oid)
+	}
+
+	rd, err := om.Open(ctx, indexObjectID)
+	if err != nil {
+		t.Fatalf("unable to open index: %v", err)
+	}
+	defer rd.Close() //nolint:errcheck
+
+	entries, err := om.flattenListChunk(rd)
+	if err != nil {
+		t.Fatalf("unable to read index: %v", err)
+	}
+
+	return entries
+}
+
+// flakyBlockManager fails the provided number of block reads before succeeding.
+type flakyBlockManager struct {
+	*fakeBlockManager
+	failures int
+}
+
+var errFlakyRead = fmt.Errorf("simulated read failure")
+
+func (f *flakyBlockManager) GetBlock(ctx context.Context, blockID string) ([]byte, error) {
+	f.mu.Lock()
+	fail := f.failures > 0
+	if fail {
+		f.failures--
+	}
+	f.mu.Unlock()
+
+	if fail {
+		return nil, errFlakyRead
+	}
+
+	return f.fakeBlockManager.GetBlock(ctx, blockID)
+}
+
+func TestReaderRetriesFailedBlockReads(t *testing.T) {
+	ctx := context.Background()
+	data, om := setupTest(t)
+
+	content := make([]byte, 1000)
+	cryptorand.Read(content) //nolint:errcheck
+
+	writer := om.NewWriter(ctx, WriterOptions{})
+	writer.Write(content) //nolint:errcheck
+	oid, err := writer.Result()
+	if err != nil {
+		t.Fatalf("unable to write object: %v", err)
+	}
+
+	bm := &flakyBlockManager{fakeBlockManager: &fakeBlockManager{data: data}, failures: 1}
+
+	noRetry, err := NewObjectManager(ctx, bm, om.Format, ManagerOptions{})
+	if err != nil {
+		t.Fatalf("can't create object manager: %v", err)
+	}
+	if _, err := noRetry.Open(ctx, oid); err != errFlakyRead {
+		t.Errorf("unexpected error without retries: %v, wanted %v", err, errFlakyRead)
+	}
+
+	bm.failures = 1
+	om2, err := NewObjectManager(ctx, bm, om.Format, ManagerOptions{
+		IsRetriableReadError: func(err error) bool { return err == errFlakyRead },
+	})
+	if err != nil {
+		t.Fatalf("can't create object manager: %v", err)
+	}
+
+	rd, err := om2.Open(ctx, oid)
+	if err != nil {
+		t.Fatalf("unable to open object: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatalf("unable to read object: %v", err)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Errorf("unexpected object contents")
+	}
+}
+
+func verify(ctx context.Context, t *testing.T, om *Manager, objectID ID, expectedData []byte, testCaseID string) {
+	t.Helper()
+	reader, err := om.Open(ctx, objectID)
+	if err != nil {
+		t.Errorf("cannot get reader for %v (%v): %v %v", testCaseID, objectID, err, string(debug.Stack()))
+		return
+	}
+
+	for i := 0; i < 20; i++ {
+		sampleSize := int(rand.Int31n(300))
+		seekOffset := int(rand.Int31n(int32(len(expectedData))))
+		if seekOffset+sampleSize > len(expectedData) {
+			sampleSize = len(expectedData) - seekOffset
+		}
+		if sampleSize > 0 {
+			got := make([]byte, sampleSize)
+			if offset, err := reader.Seek(int64(seekOffset), 0); err != nil || offset != int64(seekOffset) {
+				t.Errorf("seek error: %v offset=%v expected:%v", err, offset, seekOffset)
+			}
+			if n, err := reader.Read(got); err != nil || n != sampleSize {
+				t.Errorf("invalid data: n=%v, expected=%v, err:%v", n, sampleSize, err)
+			}
+
+			expected := expectedData[seekOffset : seekOffset+sampleSize]
+
+			if !bytes.Equal(expected, got) {
+				t.Errorf("incorrect data read for %v: expected: %x, got: %x", testCaseID, expected, got)
+			}
+		}
+	}
+}
+
+// slowBlockManager delays block reads and tracks how many of them are in progress at the same time.
+type slowBlockManager struct {
+	*fakeBlockManager
+	delay time.Duration
+
+	statsMu       sync.Mutex
+	reads         int
+	inProgress    int
+	maxInProgress int
+}
+
+func (s *slowBlockManager) GetBlock(ctx context.Context, blockID string) ([]byte, error) {
+	s.statsMu.Lock()
+	s.reads++
+	s.inProgress++
+	if s.inProgress > s.maxInProgress {
+		s.maxInProgress = s.inProgress
+	}
+	s.statsMu.Unlock()
+
+	defer func() {
+		s.statsMu.Lock()
+		s.inProgress--
+		s.statsMu.Unlock()
+	}()
+
+	time.Sleep(s.delay)
+	return s.fakeBlockManager.GetBlock(ctx, blockID)
+}
+
+func (s *slowBlockManager) resetStats() (reads, maxInProgress int) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	reads, maxInProgress = s.reads, s.maxInProgress
+	s.reads, s.maxInProgress = 0, 0
+	return reads, maxInProgress
+}
+
+func writeTestObject(ctx context.Context, t testing.TB, om *Manager, length int) ([]byte, ID) {
+	t.Helper()
+
+	content := make([]byte, length)
+	cryptorand.Read(content) //nolint:errcheck
+
+	writer := om.NewWriter(ctx, WriterOptions{})
+	writer.Write(content) //nolint:errcheck
+	oid, err := writer.Result()
+	if err != nil {
+		t.Fatalf("unable to write object: %v", err)
+	}
+
+	return content, oid
+}
+
+func TestReaderPrefetch(t *testing.T) {
+	ctx := context.Background()
+	data, om := setupTest(t)
+
+	// 100 blocks of 400 bytes each
+	content, oid := writeTestObject(ctx, t, om, 40000)
+
+	bm := &slowBlockManager{fakeBlockManager: &fakeBlockManager{data: data}, delay: time.Millisecond}
+	om2, err := NewObjectManager(ctx, bm, om.Format, ManagerOptions{PrefetchBlocks: 4})
+	if err != nil {
+		t.Fatalf("can't create object manager: %v", err)
+	}
+
+	rd, err := om2.Open(ctx, oid)
+	if err != nil {
+		t.Fatalf("unable to open object: %v", err)
+	}
+	defer rd.Close() //nolint:errcheck
+
+	bm.resetStats()
+
+	got, err := ioutil.ReadAll(rd)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("unexpected contents read with prefetching: %v", err)
+	}
+
+	// each block is read only once, up to 4 blocks are prefetched while the current one is being read.
+	if reads, maxInProgress := bm.resetStats(); reads != 100 || maxInProgress < 2 || maxInProgress > 4 {
+		t.Errorf("unexpected block reads: %v, %v in parallel", reads, maxInProgress)
+	}
+
+	// seeks to blocks that don't follow the current one don't prefetch anything.
+	for _, chunk := range []int{50, 10, 30, 70, 20} {
+		offset := int64(chunk*400 + 7)
+		if _, err := rd.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("unable to seek: %v", err)
+		}
+
+		b := make([]byte, 10)
+		if _, err := io.ReadFull(rd, b); err != nil || !bytes.Equal(b, content[offset:offset+10]) {
+			t.Fatalf("unexpected contents at offset %v: %v", offset, err)
+		}
+	}
+
+	if reads, _ := bm.resetStats(); reads != 5 {
+		t.Errorf("unexpected number of block reads after seeks: %v, wanted 5", reads)
+	}
+
+	// once the reads are sequential again, the following blocks are prefetched.
+	if _, err := rd.Seek(20*400+390, io.SeekStart); err != nil {
+		t.Fatalf("unable to seek: %v", err)
+	}
+
+	b := make([]byte, 20)
+	if _, err := io.ReadFull(rd, b); err != nil || !bytes.Equal(b, content[20*400+390:20*400+410]) {
+		t.Fatalf("unexpected contents: %v", err)
+	}
+
+	// wait for the prefetched blocks, which are all read despite not being needed.
+	time.Sleep(50 * time.Millisecond)
+	if reads, _ := bm.resetStats(); reads != 5 {
+		t.Errorf("unexpected number of block reads after sequential read: %v, wanted 5", reads)
+	}
+}
+
+func BenchmarkSequentialRead(b *testing.B) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+
+	om, err := NewObjectManager(ctx, &fakeBlockManager{data: data}, Format{
+		MaxBlockSize: 65536,
+		Splitter:     "FIXED",
+	}, ManagerOptions{})
+	if err != nil {
+		b.Fatalf("can't create object manager: %v", err)
+	}
+
+	content, oid := writeTestObject(ctx, b, om, 4<<20)
+
+	for _, prefetchBlocks := range []int{0, 8} {
+		b.Run(fmt.Sprintf("prefetch=%v", prefetchBlocks), func(b *testing.B) {
+			bm := &slowBlockManager{fakeBlockManager: &fakeBlockManager{data: data}, delay: time.Millisecond}
+			om2, err := NewObjectManager(ctx, bm, om.Format, ManagerOptions{PrefetchBlocks: prefetchBlocks})
+			if err != nil {
+				b.Fatalf("can't create object manager: %v", err)
+			}
+
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				rd, err := om2.Open(ctx, oid)
+				if err != nil {
+					b.Fatalf("unable to open object: %v", err)
+				}
+
+				n, err := io.Copy(ioutil.Discard, rd)
+				if err != nil || n != int64(len(content)) {
+					b.Fatalf("unexpected result of reading object: %v %v", n, err)
+				}
+
+				rd.Close() //nolint:errcheck
+			}
+		})
+	}
+}
+
+func TestIntegrityProof(t *testing.T) {
+	ctx := context.Background()
+	_, om := setupTest(t)
+
+	content := make([]byte, 1000)
+	cryptorand.Read(content) //nolint:errcheck
+
+	write := func(data []byte) ID {
+		w := om.NewWriter(ctx, WriterOptions{})
+		w.Write(data) //nolint:errcheck
+		oid, err := w.Result()
+		if err != nil {
+			t.Fatalf("unable to write object: %v", err)
+		}
+		return oid
+	}
+
+	p1, err := om.IntegrityProof(ctx, write(content))
+	if err != nil {
+		t.Fatalf("unable to compute proof: %v", err)
+	}
+
+	// index block followed by 3 data blocks.
+	if got, want := len(p1.BlockIDs), 4; got != want {
+		t.Errorf("unexpected number of blocks in proof: %v, wanted %v", got, want)
+	}
+
+	p2, err := om.IntegrityProof(ctx, write(append([]byte(nil), content...)))
+	if err != nil {
+		t.Fatalf("unable to compute proof: %v", err)
+	}
+
+	if !reflect.DeepEqual(p1, p2) {
+		t.Errorf("identical objects have different proofs: %+v and %+v", p1, p2)
+	}
+
+	modified := append([]byte(nil), content...)
+	modified[500] ^= 1
+
+	p3, err := om.IntegrityProof(ctx, write(modified))
+	if err != nil {
+		t.Fatalf("unable to compute proof: %v", err)
+	}
+
+	if p3.Digest == p1.Digest || reflect.DeepEqual(p3.BlockIDs, p1.BlockIDs) {
+		t.Errorf("modified object has the same proof: %+v", p3)
+	}
+
+	// slices of the same object are distinguished by their range.
+	p4, err := om.IntegrityProof(ctx, SliceObjectID(write(content), 0, 100))
+	if err != nil {
+		t.Fatalf("unable to compute proof: %v", err)
+	}
+
+	if p4.Digest == p1.Digest || !reflect.DeepEqual(p4.BlockIDs, p1.BlockIDs) {
+		t.Errorf("unexpected proof of a slice: %+v", p4)
+	}
+
+	if _, err := om.IntegrityProof(ctx, DirectObjectID("no-such-block")); err != storage.ErrBlockNotFound {
+		t.Errorf("unexpected error computing proof of missing object: %v", err)
+	}
+}
+
+// writeCountingBlockManager counts blocks written by WriteBlock().
+type writeCountingBlockManager struct {
+	*fakeBlockManager
+	writes int
+}
+
+func (c *writeCountingBlockManager) WriteBlock(ctx context.Context, data []byte, prefix string) (string, error) {
+	c.writes++
+	return c.fakeBlockManager.WriteBlock(ctx, data, prefix)
+}
+
+func TestResumableWriter(t *testing.T) {
+	ctx := context.Background()
+
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(content) //nolint:errcheck
+
+	const expectedObjectID = "I17150ba14fcf16fcf8598469ee56985e7ea6591c0e216bf7fcb813ce314bf442"
+
+	bm := &writeCountingBlockManager{fakeBlockManager: &fakeBlockManager{data: map[string][]byte{}}}
+	om, err := NewObjectManager(ctx, bm, Format{
+		Splitter:     "RABIN",
+		MinBlockSize: 1000,
+		AvgBlockSize: 4000,
+		MaxBlockSize: 10000,
+	}, ManagerOptions{})
+	if err != nil {
+		t.Fatalf("can't create object manager: %v", err)
+	}
+
+	// write half of the data and "crash", keeping only the persisted checkpoint.
+	var persisted []byte
+	w := om.NewWriter(ctx, WriterOptions{
+		CheckpointInterval: 10000,
+		OnCheckpoint: func(cp WriterCheckpoint) error {
+			persisted, err = json.Marshal(cp)
+			return err
+		},
+	})
+
+	if _, err := w.Write(content[0 : len(content)/2]); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	var cp WriterCheckpoint
+	if err := json.Unmarshal(persisted, &cp); err != nil {
+		t.Fatalf("invalid checkpoint: %v", err)
+	}
+
+	if cp.Length < 30000 || cp.Length > int64(len(content)/2) || len(cp.Chunks) == 0 {
+		t.Fatalf("unexpected checkpoint: %v bytes in %v chunks", cp.Length, len(cp.Chunks))
+	}
+
+	// resume writing, only the chunks not covered by the checkpoint are written.
+	writesBefore := bm.writes
+	w = om.NewWriter(ctx, WriterOptions{ResumeFrom: &cp})
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	oid, err := w.Result()
+	if err != nil {
+		t.Fatalf("unable to resume writing: %v", err)
+	}
+
+	if oid != expectedObjectID {
+		t.Errorf("unexpected object ID %v, wanted %v", oid, expectedObjectID)
+	}
+
+	chunks, err := om.Chunks(ctx, oid)
+	if err != nil {
+		t.Fatalf("unable to get chunks: %v", err)
+	}
+
+	// the index object is written in addition to the chunks.
+	if got, want := bm.writes-writesBefore, len(chunks)-len(cp.Chunks)+1; got != want {
+		t.Errorf("unexpected number of blocks written by the resumed writer: %v, wanted %v", got, want)
+	}
+
+	// the object ID is the same as of an uninterrupted write.
+	w = om.NewWriter(ctx, WriterOptions{})
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	if oid2, err := w.Result(); err != nil || oid2 != oid {
+		t.Errorf("unexpected object ID of uninterrupted write: %v %v, wanted %v", oid2, err, oid)
+	}
+
+	verify(ctx, t, om, oid, content, "resumed")
+
+	// resuming fails when blocks of the checkpoint are missing.
+	blockID, _ := cp.Chunks[0].Object.BlockID()
+	delete(bm.data, blockID)
+
+	w = om.NewWriter(ctx, WriterOptions{ResumeFrom: &cp})
+	if _, err := w.Write(content); err == nil {
+		t.Errorf("unexpected success resuming with missing block")
 	}
 }
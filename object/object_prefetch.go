@@ -0,0 +1,88 @@
+package object
+
+import (
+	"context"
+)
+
+// prefetchedChunk is a chunk of an indirect object being fetched in the background.
+type prefetchedChunk struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	data   []byte
+	err    error
+}
+
+func (p *prefetchedChunk) wait(ctx context.Context) ([]byte, error) {
+	select {
+	case <-p.done:
+		return p.data, p.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// prefetch starts fetching the chunks following the current one after a sequential access, so that up to
+// prefetchBlocks chunks are fetched or waiting to be read at any time. Any other access cancels all prefetches.
+func (r *objectReader) prefetch(sequential bool) {
+	if r.repo.prefetchBlocks <= 0 {
+		return
+	}
+
+	if !sequential {
+		r.cancelPrefetches()
+		return
+	}
+
+	last := r.currentChunkIndex + r.repo.prefetchBlocks
+	for i, p := range r.prefetched {
+		if i <= r.currentChunkIndex || i > last {
+			p.cancel()
+			delete(r.prefetched, i)
+		}
+	}
+
+	for i := r.currentChunkIndex + 1; i <= last && i < len(r.seekTable); i++ {
+		if r.prefetched[i] != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(r.ctx)
+		p := &prefetchedChunk{cancel: cancel, done: make(chan struct{})}
+		if r.prefetched == nil {
+			r.prefetched = map[int]*prefetchedChunk{}
+		}
+		r.prefetched[i] = p
+
+		go func(st indirectObjectEntry) {
+			defer close(p.done)
+			p.data, p.err = r.repo.readChunk(ctx, st)
+		}(r.seekTable[i])
+	}
+}
+
+// takePrefetched returns the data of the provided chunk if it has been prefetched successfully.
+func (r *objectReader) takePrefetched(index int) []byte {
+	p := r.prefetched[index]
+	if p == nil {
+		return nil
+	}
+
+	delete(r.prefetched, index)
+	defer p.cancel()
+
+	data, err := p.wait(r.ctx)
+	if err != nil {
+		// the chunk is fetched again and the error, if any, is reported by the regular read.
+		r.repo.trace("unable to prefetch chunk %v: %v", index, err)
+		return nil
+	}
+
+	return data
+}
+
+func (r *objectReader) cancelPrefetches() {
+	for i, p := range r.prefetched {
+		p.cancel()
+		delete(r.prefetched, i)
+	}
+}
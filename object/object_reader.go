@@ -22,6 +22,9 @@ type objectReader struct {
 	currentChunkIndex    int    // Index of current chunk in the seek table
 	currentChunkData     []byte // Current chunk data
 	currentChunkPosition int    // Read position in the current chunk
+
+	lastChunkIndex int                      // Index of the most recently opened chunk, -1 if none
+	prefetched     map[int]*prefetchedChunk // Chunks being fetched in the background by their index
 }
 
 func (r *objectReader) Read(buffer []byte) (int, error) {
@@ -66,21 +69,37 @@ func (r *objectReader) Read(buffer []byte) (int, error) {
 }
 
 func (r *objectReader) openCurrentChunk() error {
-	st := r.seekTable[r.currentChunkIndex]
-	blockData, err := r.repo.Open(r.ctx, st.Object)
+	sequential := r.currentChunkIndex == r.lastChunkIndex+1
+	r.lastChunkIndex = r.currentChunkIndex
+
+	b := r.takePrefetched(r.currentChunkIndex)
+	if b == nil {
+		var err error
+		if b, err = r.repo.readChunk(r.ctx, r.seekTable[r.currentChunkIndex]); err != nil {
+			return err
+		}
+	}
+
+	r.currentChunkData = b
+	r.currentChunkPosition = 0
+	r.prefetch(sequential)
+	return nil
+}
+
+// readChunk returns the contents of the provided entry of the seek table.
+func (om *Manager) readChunk(ctx context.Context, st indirectObjectEntry) ([]byte, error) {
+	blockData, err := om.Open(ctx, st.Object)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer blockData.Close() //nolint:errcheck
 
 	b := make([]byte, st.Length)
 	if _, err := io.ReadFull(blockData, b); err != nil {
-		return err
+		return nil, err
 	}
 
-	r.currentChunkData = b
-	r.currentChunkPosition = 0
-	return nil
+	return b, nil
 }
 
 func (r *objectReader) closeCurrentChunk() {
@@ -151,9 +170,69 @@ func (r *objectReader) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (r *objectReader) Close() error {
+	r.cancelPrefetches()
 	return nil
 }
 
 func (r *objectReader) Length() int64 {
 	return r.totalLength
 }
+
+// sliceReader reads a byte range of the base object.
+type sliceReader struct {
+	base     Reader
+	offset   int64
+	length   int64
+	position int64 // position within the slice
+}
+
+func (r *sliceReader) Read(buffer []byte) (int, error) {
+	remaining := r.length - r.position
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(buffer)) > remaining {
+		buffer = buffer[0:remaining]
+	}
+
+	if _, err := r.base.Seek(r.offset+r.position, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := r.base.Read(buffer)
+	r.position += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (r *sliceReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.position
+	case io.SeekEnd:
+		offset += r.length
+	}
+
+	if offset < 0 {
+		return -1, fmt.Errorf("invalid seek %v %v", offset, whence)
+	}
+
+	if offset > r.length {
+		offset = r.length
+	}
+
+	r.position = offset
+	return r.position, nil
+}
+
+func (r *sliceReader) Close() error {
+	return r.base.Close()
+}
+
+func (r *sliceReader) Length() int64 {
+	return r.length
+}
@@ -0,0 +1,284 @@
+package object
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxRepackedChunks is the maximum number of chunk locations remembered by the manager for deduplication
+// of chunks written by repacking writers.
+const maxRepackedChunks = 100000
+
+// repackedSlice is an entry of the object referencing a range of the storage block being assembled.
+type repackedSlice struct {
+	entry  int
+	offset int64
+}
+
+// repackedChunk is a chunk of the object, made up of the entries in the provided range.
+type repackedChunk struct {
+	key        string
+	start, end int
+}
+
+// repackingWriter splits the object into chunks using the splitter of the repository, then regroups chunks that
+// haven't been written before into storage blocks of WriterOptions.StorageBlockSize bytes. The object is stored
+// as an indirect object, each entry of which references the range of a storage block holding a part of a chunk.
+// Chunks are identified by their block IDs, which are computed without writing them, and their locations
+// are remembered by the manager, so that subsequent writes reference them instead of storing them again.
+type repackingWriter struct {
+	ctx       context.Context
+	repo      *Manager
+	opt       WriterOptions
+	splitter  objectSplitter
+	blockSize int64
+	digest    hash.Hash
+	err       error
+
+	chunk   []byte                // bytes of the chunk being split
+	block   []byte                // contents of the storage block being assembled
+	slices  []repackedSlice       // entries referencing the storage block being assembled
+	chunks  []repackedChunk       // chunks with entries referencing storage blocks that haven't been written yet
+	entries []indirectObjectEntry // entries of the object written so far
+	length  int64
+}
+
+func newRepackingWriter(ctx context.Context, om *Manager, opt WriterOptions) *repackingWriter {
+	w := &repackingWriter{
+		ctx:       ctx,
+		repo:      om,
+		opt:       opt,
+		splitter:  om.newSplitter(),
+		blockSize: int64(opt.StorageBlockSize),
+		digest:    opt.Digest,
+	}
+
+	switch {
+	case opt.DeltaBase != "":
+		w.err = errors.New("objects with fixed storage block size can't be written as deltas")
+	case opt.CheckpointInterval > 0 || opt.ResumeFrom != nil:
+		w.err = errors.New("objects with fixed storage block size can't be written with checkpoints")
+	case opt.AsyncUploads > 0:
+		w.err = errors.New("objects with fixed storage block size can't be written asynchronously")
+	}
+
+	return w
+}
+
+func (w *repackingWriter) Close() error {
+	return nil
+}
+
+func (w *repackingWriter) Write(data []byte) (int, error) {
+	if w.opt.Timings != nil {
+		defer func(start time.Time) {
+			w.opt.Timings.Total += time.Since(start)
+		}(time.Now())
+	}
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	// only accept data up to the limit.
+	tooLarge := w.opt.MaxObjectSize > 0 && w.length+int64(len(data)) > w.opt.MaxObjectSize
+	if tooLarge {
+		data = data[0 : w.opt.MaxObjectSize-w.length]
+	}
+
+	if w.digest != nil {
+		w.digest.Write(data) //nolint:errcheck
+	}
+
+	w.length += int64(len(data))
+
+	for _, d := range data {
+		w.chunk = append(w.chunk, d)
+
+		if w.splitter.add(d) {
+			if w.err = w.flushChunk(); w.err != nil {
+				return 0, w.err
+			}
+		}
+	}
+
+	if tooLarge {
+		w.err = errors.Wrapf(ErrObjectTooLarge, "%v exceeds %v bytes", w.opt.Description, w.opt.MaxObjectSize)
+		return len(data), w.err
+	}
+
+	return len(data), nil
+}
+
+// flushChunk references the locations of the current chunk if it has been written before, otherwise appends
+// it to the storage blocks being assembled.
+func (w *repackingWriter) flushChunk() error {
+	chunk := w.chunk
+	w.chunk = nil
+
+	key, err := w.repo.blockMgr.BlockIDForData(chunk, w.opt.Prefix)
+	if err != nil {
+		return fmt.Errorf("unable to hash chunk of %v: %v", w.opt.Description, err)
+	}
+
+	if locations, ok := w.repo.repackedChunkLocations(key); ok {
+		for _, l := range locations {
+			w.addEntry(l.Object, l.Length)
+		}
+
+		return nil
+	}
+
+	c := repackedChunk{key: key, start: len(w.entries)}
+	for len(chunk) > 0 {
+		n := w.blockSize - int64(len(w.block))
+		if n > int64(len(chunk)) {
+			n = int64(len(chunk))
+		}
+
+		w.slices = append(w.slices, repackedSlice{entry: len(w.entries), offset: int64(len(w.block))})
+		w.addEntry("", n)
+		w.block = append(w.block, chunk[0:n]...)
+		chunk = chunk[n:]
+
+		if int64(len(w.block)) == w.blockSize {
+			if err := w.flushBlock(); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.end = len(w.entries)
+	w.chunks = append(w.chunks, c)
+	w.rememberWrittenChunks()
+	return nil
+}
+
+func (w *repackingWriter) addEntry(oid ID, length int64) {
+	var start int64
+	if n := len(w.entries); n > 0 {
+		start = w.entries[n-1].Start + w.entries[n-1].Length
+	}
+
+	w.entries = append(w.entries, indirectObjectEntry{Start: start, Length: length, Object: oid})
+}
+
+// flushBlock writes the storage block being assembled and points the entries referencing it at the written block.
+func (w *repackingWriter) flushBlock() error {
+	blockID, err := w.repo.blockMgr.WriteBlock(w.ctx, w.block, w.opt.Prefix)
+	if err != nil {
+		return fmt.Errorf("error writing storage block of %v: %v", w.opt.Description, err)
+	}
+
+	w.repo.trace("REPACKING_WRITER(%q) stored %v (%v bytes)", w.opt.Description, blockID, len(w.block))
+
+	for _, s := range w.slices {
+		e := &w.entries[s.entry]
+		e.Object = SliceObjectID(DirectObjectID(blockID), s.offset, e.Length)
+	}
+
+	w.block = nil
+	w.slices = nil
+	return nil
+}
+
+// rememberWrittenChunks records the locations of chunks all storage blocks of which have been written.
+func (w *repackingWriter) rememberWrittenChunks() {
+	for len(w.chunks) > 0 {
+		c := w.chunks[0]
+		if w.entries[c.end-1].Object == "" {
+			return
+		}
+
+		w.repo.rememberRepackedChunk(c.key, w.entries[c.start:c.end])
+		w.chunks = w.chunks[1:]
+	}
+}
+
+func (w *repackingWriter) Result() (ID, error) {
+	if w.opt.Timings != nil {
+		defer func(start time.Time) {
+			w.opt.Timings.Total += time.Since(start)
+		}(time.Now())
+	}
+
+	if w.err != nil {
+		return "", w.err
+	}
+
+	if len(w.chunk) > 0 {
+		if err := w.flushChunk(); err != nil {
+			return "", err
+		}
+	}
+
+	if len(w.entries) == 0 {
+		// empty objects are stored as an empty block, like by other writers.
+		blockID, err := w.repo.blockMgr.WriteBlock(w.ctx, nil, w.opt.Prefix)
+		if err != nil {
+			return "", fmt.Errorf("error writing empty block of %v: %v", w.opt.Description, err)
+		}
+
+		return DirectObjectID(blockID), nil
+	}
+
+	if len(w.block) > 0 {
+		// the last storage block of the object may be shorter.
+		if err := w.flushBlock(); err != nil {
+			return "", err
+		}
+
+		w.rememberWrittenChunks()
+	}
+
+	iw := w.repo.NewWriter(w.ctx, WriterOptions{
+		Description: "LIST(" + w.opt.Description + ")",
+		Prefix:      w.opt.Prefix,
+	})
+	defer iw.Close() //nolint:errcheck
+
+	ind := indirectObject{
+		StreamID: "kopia:indirect",
+		Entries:  mergeContiguousSlices(w.entries),
+	}
+
+	if err := json.NewEncoder(iw).Encode(ind); err != nil {
+		return "", errors.Wrap(err, "unable to write indirect block index")
+	}
+
+	oid, err := iw.Result()
+	if err != nil {
+		return "", err
+	}
+
+	return IndirectObjectID(oid), nil
+}
+
+// mergeContiguousSlices returns the entries with consecutive entries referencing adjacent ranges of the same
+// storage block merged, which keeps the index small when consecutive chunks are written to the same storage block.
+func mergeContiguousSlices(entries []indirectObjectEntry) []indirectObjectEntry {
+	var result []indirectObjectEntry
+
+	for _, e := range entries {
+		if n := len(result); n > 0 {
+			last := &result[n-1]
+			lastBase, lastOffset, lastLength, ok1 := last.Object.Slice()
+			base, offset, _, ok2 := e.Object.Slice()
+
+			if ok1 && ok2 && lastBase == base && lastOffset+lastLength == offset {
+				last.Length += e.Length
+				last.Object = SliceObjectID(base, lastOffset, last.Length)
+				continue
+			}
+		}
+
+		result = append(result, e)
+	}
+
+	return result
+}
@@ -1,6 +1,7 @@
 package object
 
 import (
+	"fmt"
 	"math"
 	"sort"
 
@@ -16,6 +17,8 @@ type objectSplitter interface {
 //    NEVER    - prevents objects from ever splitting
 //    FIXED    - always splits large objects exactly at the maximum block size boundary
 //    DYNAMIC  - dynamically splits large objects based on rolling hash of contents.
+//    RABIN    - dynamically splits large objects based on Rabin fingerprint of contents.
+//    BUZHASH  - dynamically splits large objects based on Buzhash of contents over a configurable window.
 var SupportedSplitters []string
 
 var splitterFactories = map[string]func(*Format) objectSplitter{
@@ -26,7 +29,13 @@ var splitterFactories = map[string]func(*Format) objectSplitter{
 		return newFixedSplitter(f.MaxBlockSize)
 	},
 	"DYNAMIC": func(f *Format) objectSplitter {
-		return newRollingHashSplitter(buzhash.NewBuzHash(32), f.MinBlockSize, f.AvgBlockSize, f.MaxBlockSize)
+		return newRollingHashSplitter(buzhash.NewBuzHash(defaultBuzhashWindowSize), f.MinBlockSize, f.AvgBlockSize, f.MaxBlockSize)
+	},
+	"BUZHASH": func(f *Format) objectSplitter {
+		return newRollingHashSplitter(buzhash.NewBuzHash(uint32(buzhashWindowSize(f))), f.MinBlockSize, f.AvgBlockSize, f.MaxBlockSize)
+	},
+	"RABIN": func(f *Format) objectSplitter {
+		return newRollingHashSplitter(newRabinHash(), f.MinBlockSize, f.AvgBlockSize, f.MaxBlockSize)
 	},
 }
 
@@ -37,6 +46,47 @@ func init() {
 	sort.Strings(SupportedSplitters)
 }
 
+// contentDefinedSplitters are the splitters that use MinBlockSize and AvgBlockSize in addition to MaxBlockSize.
+var contentDefinedSplitters = map[string]bool{
+	"BUZHASH": true,
+	"DYNAMIC": true,
+	"RABIN":   true,
+}
+
+// ValidateBlockSizes ensures that the block sizes of the format are usable by its splitter. Content-defined splitters
+// require 0 <= MinBlockSize <= AvgBlockSize <= MaxBlockSize, the FIXED splitter only uses MaxBlockSize.
+func (f *Format) ValidateBlockSizes() error {
+	splitterID := f.Splitter
+	if splitterID == "" {
+		splitterID = "FIXED"
+	}
+
+	switch {
+	case splitterID == "FIXED":
+		if f.MaxBlockSize <= 0 {
+			return fmt.Errorf("invalid maximum block size %v of splitter %v", f.MaxBlockSize, splitterID)
+		}
+
+	case contentDefinedSplitters[splitterID]:
+		if f.MinBlockSize < 0 || f.MinBlockSize > f.AvgBlockSize || f.AvgBlockSize > f.MaxBlockSize || f.MaxBlockSize <= 0 {
+			return fmt.Errorf("invalid block sizes of splitter %v: min %v, avg %v, max %v, must be 0 <= min <= avg <= max", splitterID, f.MinBlockSize, f.AvgBlockSize, f.MaxBlockSize)
+		}
+	}
+
+	return nil
+}
+
+// defaultBuzhashWindowSize is the window size of the BUZHASH splitter, which the DYNAMIC splitter always uses.
+const defaultBuzhashWindowSize = 32
+
+func buzhashWindowSize(f *Format) int {
+	if f.SplitterWindowSize > 0 {
+		return f.SplitterWindowSize
+	}
+
+	return defaultBuzhashWindowSize
+}
+
 // DefaultSplitter is the name of the splitter used by default for new repositories.
 const DefaultSplitter = "DYNAMIC"
 
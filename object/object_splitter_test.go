@@ -3,6 +3,7 @@ package object
 import (
 	"math"
 	"math/rand"
+	"reflect"
 	"testing"
 
 	"github.com/silvasur/buzhash"
@@ -15,6 +16,7 @@ func TestSplitters(t *testing.T) {
 	}{
 		{"rolling buzhash with 3 bits", func() objectSplitter { return newRollingHashSplitter(buzhash.NewBuzHash(32), 0, 8, 20) }},
 		{"rolling buzhash with 5 bits", func() objectSplitter { return newRollingHashSplitter(buzhash.NewBuzHash(32), 0, 32, 20) }},
+		{"rabin with 5 bits", func() objectSplitter { return newRollingHashSplitter(newRabinHash(), 0, 32, 20) }},
 	}
 
 	for _, tc := range cases {
@@ -63,6 +65,12 @@ func TestSplitterStability(t *testing.T) {
 		{newRollingHashSplitter(buzhash.NewBuzHash(32), 0, 2048, 10000), 2490, 2008, 1, 10000},
 		{newRollingHashSplitter(buzhash.NewBuzHash(32), 500, 32768, 100000), 183, 27322, 522, 100000},
 		{newRollingHashSplitter(buzhash.NewBuzHash(32), 500, 65536, 100000), 113, 44247, 522, 100000},
+
+		{newRollingHashSplitter(newRabinHash(), 0, 32, math.MaxInt32), 155833, 32, 1, 453},
+		{newRollingHashSplitter(newRabinHash(), 0, 1024, math.MaxInt32), 4856, 1029, 1, 10003},
+		{newRollingHashSplitter(newRabinHash(), 0, 65536, math.MaxInt32), 80, 62500, 85, 246894},
+		{newRollingHashSplitter(newRabinHash(), 0, 32, 64), 179494, 27, 1, 64},
+		{newRollingHashSplitter(newRabinHash(), 500, 32768, 100000), 152, 32894, 1006, 100000},
 	}
 
 	for _, tc := range cases {
@@ -107,6 +115,123 @@ func TestSplitterStability(t *testing.T) {
 	}
 }
 
+func TestRabinHash(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 10000)
+	r.Read(data) //nolint:errcheck
+
+	h := newRabinHash()
+	for i, b := range data {
+		h.HashByte(b)
+		if i < rabinWindowSize {
+			continue
+		}
+
+		// the rolling fingerprint must be the fingerprint of the window computed from scratch.
+		var want uint64
+		for _, c := range data[i-rabinWindowSize+1 : i+1] {
+			want = polAppendByte(want, c, rabinPolynomial)
+		}
+
+		if h.digest != want {
+			t.Fatalf("invalid fingerprint at offset %v: %x, wanted %x", i, h.digest, want)
+		}
+	}
+}
+
+func TestRabinSplitterShiftedData(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	data := make([]byte, 4000000)
+	r.Read(data) //nolint:errcheck
+
+	boundaries := func(b []byte) map[int]bool {
+		s := newRollingHashSplitter(newRabinHash(), 1024, 4096, 16384)
+		result := map[int]bool{}
+		for i, c := range b {
+			if s.add(c) {
+				result[i] = true
+			}
+		}
+		return result
+	}
+
+	const shift = 3
+	original := boundaries(data)
+	shifted := boundaries(append([]byte("abc"), data...))
+
+	var preserved int
+	for off := range original {
+		if shifted[off+shift] {
+			preserved++
+		}
+	}
+
+	if preserved*10 < len(original)*9 {
+		t.Errorf("only %v of %v boundaries were preserved after shifting data by %v bytes", preserved, len(original), shift)
+	}
+}
+
+func TestBuzhashSplitterBoundaries(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	rnd := make([]byte, 20000)
+	r.Read(rnd) //nolint:errcheck
+
+	cases := []struct {
+		splitter   string
+		windowSize int
+		boundaries []int
+	}{
+		{"BUZHASH", 0, []int{974, 2734, 4715, 6704, 10800, 14097, 15553, 16155}},
+		{"BUZHASH", 16, []int{1496, 4159, 8255, 9459, 13555, 14834, 15642, 16775, 19349}},
+		{"BUZHASH", 64, []int{572, 1923, 3221, 3776, 6373, 7088, 10915, 14649, 18171}},
+
+		// DYNAMIC is BUZHASH with the default window size.
+		{"DYNAMIC", 64, []int{974, 2734, 4715, 6704, 10800, 14097, 15553, 16155}},
+	}
+
+	for _, tc := range cases {
+		f := &Format{MinBlockSize: 500, AvgBlockSize: 2048, MaxBlockSize: 4096, SplitterWindowSize: tc.windowSize}
+		s := splitterFactories[tc.splitter](f)
+
+		var boundaries []int
+		lastSplit := -1
+		for i, b := range rnd {
+			if s.add(b) {
+				if l := i - lastSplit; l <= f.MinBlockSize || l > f.MaxBlockSize {
+					t.Errorf("%v with window %v: invalid block length %v", tc.splitter, tc.windowSize, l)
+				}
+
+				boundaries = append(boundaries, i)
+				lastSplit = i
+			}
+		}
+
+		if !reflect.DeepEqual(boundaries, tc.boundaries) {
+			t.Errorf("%v with window %v: unexpected boundaries %v, wanted %v", tc.splitter, tc.windowSize, boundaries, tc.boundaries)
+		}
+	}
+}
+
+func BenchmarkSplitters(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	rnd := make([]byte, 1<<20)
+	r.Read(rnd) //nolint:errcheck
+
+	f := &Format{MinBlockSize: 1 << 10, AvgBlockSize: 4 << 10, MaxBlockSize: 16 << 10}
+	for _, name := range SupportedSplitters {
+		newSplitter := splitterFactories[name]
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(rnd)))
+			for i := 0; i < b.N; i++ {
+				s := newSplitter(f)
+				for _, c := range rnd {
+					s.add(c)
+				}
+			}
+		})
+	}
+}
+
 func TestRollingHashBits(t *testing.T) {
 	cases := []struct {
 		blockSize int
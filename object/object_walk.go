@@ -0,0 +1,51 @@
+package object
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ReferencesFunc returns IDs of objects referenced by the contents of the provided object, such as entries of
+// a directory manifest. The object manager only understands its own indirect objects, so the format of objects
+// referencing other objects is defined by the caller.
+type ReferencesFunc func(ctx context.Context, oid ID) ([]ID, error)
+
+// WalkObjects invokes visit for the provided root and all objects transitively referenced by it, as determined
+// by the provided ReferencesFunc, which is used for each visited object. Each object is visited exactly once,
+// before the objects it references. Walking stops at the first error returned by visit or references.
+//
+// Indirect objects are visited as a whole, use VerifyObject() to determine the storage blocks of each visited object.
+func (om *Manager) WalkObjects(ctx context.Context, root ID, references ReferencesFunc, visit func(ID) error) error {
+	visited := map[ID]bool{}
+	pending := []ID{root}
+
+	for len(pending) > 0 {
+		oid := pending[len(pending)-1]
+		pending = pending[0 : len(pending)-1]
+
+		if visited[oid] {
+			continue
+		}
+
+		visited[oid] = true
+
+		if err := visit(oid); err != nil {
+			return err
+		}
+
+		refs, err := references(ctx, oid)
+		if err != nil {
+			return errors.Wrapf(err, "unable to determine objects referenced by %v", oid)
+		}
+
+		// push in reverse order, so that references are visited in the order they were returned.
+		for i := len(refs) - 1; i >= 0; i-- {
+			if !visited[refs[i]] {
+				pending = append(pending, refs[i])
+			}
+		}
+	}
+
+	return nil
+}
@@ -5,12 +5,18 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"sync"
+	"time"
 
+	"github.com/kopia/repo/block"
 	"github.com/pkg/errors"
 )
 
+// ErrObjectTooLarge is returned by Write() and Result() when the object exceeds WriterOptions.MaxObjectSize.
+var ErrObjectTooLarge = errors.New("object is too large")
+
 // Writer allows writing content to the storage and supports automatic deduplication and encryption
 // of written data.
 type Writer interface {
@@ -59,16 +65,61 @@ type objectWriter struct {
 	description string
 
 	splitter objectSplitter
+
+	timings  *WriteTimings
+	digest   hash.Hash
+	nested   bool // writer of an indirect index stream, whose total time is accounted for by the parent writer
+	hashOnly bool // only compute block IDs without writing blocks
+
+	compressor         *compressor
+	compressionLevel   int
+	compressorErr      error
+	minCompressionSize int // blocks smaller than this are not compressed
+
+	maxObjectSize int64 // maximum length of the object, zero means no limit
+	sizeErr       error // set once the object has exceeded maxObjectSize
+
+	checkpointInterval int64
+	lastCheckpoint     int64 // position of the last checkpoint
+	onCheckpoint       func(cp WriterCheckpoint) error
+	resumeFrom         *WriterCheckpoint
+
+	uploads *asyncUploads // blocks being written in the background, nil if blocks are written synchronously
+	mu      sync.Mutex    // protects blockIndex while blocks are written in the background
 }
 
 func (w *objectWriter) Close() error {
+	// don't leave blocks being written after the writer has been closed.
+	w.waitForUploads() //nolint:errcheck
 	return nil
 }
 
 func (w *objectWriter) Write(data []byte) (n int, err error) {
+	if w.timings != nil {
+		defer w.recordWriteTime(time.Now(), w.timings.accounted)
+	}
+
+	if w.sizeErr != nil {
+		return 0, w.sizeErr
+	}
+
+	if err := w.uploadError(); err != nil {
+		return 0, err
+	}
+
+	// only accept data up to the limit.
+	tooLarge := w.maxObjectSize > 0 && w.totalLength+int64(len(data)) > w.maxObjectSize
+	if tooLarge {
+		data = data[0 : w.maxObjectSize-w.totalLength]
+	}
+
 	dataLen := len(data)
 	w.totalLength += int64(dataLen)
 
+	if w.digest != nil {
+		w.digest.Write(data) //nolint:errcheck
+	}
+
 	for _, d := range data {
 		w.buffer.WriteByte(d)
 
@@ -76,41 +127,131 @@ func (w *objectWriter) Write(data []byte) (n int, err error) {
 			if err := w.flushBuffer(); err != nil {
 				return 0, err
 			}
+
+			if err := w.maybeCheckpoint(); err != nil {
+				return 0, err
+			}
 		}
 	}
 
+	if tooLarge {
+		w.sizeErr = errors.Wrapf(ErrObjectTooLarge, "%v exceeds %v bytes", w.description, w.maxObjectSize)
+		return dataLen, w.sizeErr
+	}
+
 	return dataLen, nil
 }
 
 func (w *objectWriter) flushBuffer() error {
 	length := w.buffer.Len()
+	w.mu.Lock()
 	chunkID := len(w.blockIndex)
 	w.blockIndex = append(w.blockIndex, indirectObjectEntry{})
 	w.blockIndex[chunkID].Start = w.currentPosition
 	w.blockIndex[chunkID].Length = int64(length)
+	w.mu.Unlock()
 	w.currentPosition += int64(length)
 
 	var b2 bytes.Buffer
 	w.buffer.WriteTo(&b2) //nolint:errcheck
 	w.buffer.Reset()
 
-	blockID, err := w.repo.blockMgr.WriteBlock(w.ctx, b2.Bytes(), w.prefix)
+	if w.resumeFrom != nil && chunkID < len(w.resumeFrom.Chunks) {
+		return w.skipResumedChunk(chunkID)
+	}
+
+	t0 := time.Now()
+	data, compressed, err := w.maybeCompress(b2.Bytes())
+	if w.timings != nil {
+		w.timings.Compression += time.Since(t0)
+		w.timings.accounted += time.Since(t0)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to compress chunk %d of %s: %v", chunkID, w.description, err)
+	}
+
+	if w.uploads != nil && !w.hashOnly {
+		return w.startUpload(chunkID, data, compressed)
+	}
+
+	t0 = time.Now()
+	var blockID string
+	if w.hashOnly {
+		blockID, err = w.repo.blockMgr.BlockIDForData(data, w.prefix)
+	} else {
+		blockID, err = w.repo.blockMgr.WriteBlock(w.ctx, data, w.prefix)
+	}
+	if w.timings != nil {
+		w.timings.accounted += time.Since(t0)
+	}
 	w.repo.trace("OBJECT_WRITER(%q) stored %v (%v bytes)", w.description, blockID, length)
 	if err != nil {
 		return fmt.Errorf("error when flushing chunk %d of %s: %v", chunkID, w.description, err)
 	}
 
-	w.blockIndex[chunkID].Object = DirectObjectID(blockID)
+	w.setChunkObject(chunkID, blockID, compressed)
 	return nil
 }
 
+func (w *objectWriter) setChunkObject(chunkID int, blockID string, compressed bool) {
+	w.blockIndex[chunkID].Object = DirectObjectID(blockID)
+	if compressed {
+		w.blockIndex[chunkID].Object = CompressedObjectID(w.blockIndex[chunkID].Object)
+	}
+}
+
+// maybeCompress returns compressed data if compression is enabled and reduces the size of the data.
+func (w *objectWriter) maybeCompress(data []byte) ([]byte, bool, error) {
+	if w.compressorErr != nil {
+		return nil, false, w.compressorErr
+	}
+
+	if w.compressor == nil || len(data) < w.minCompressionSize {
+		return data, false, nil
+	}
+
+	compressed, err := compressBlock(w.compressor, w.compressionLevel, data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(compressed) >= len(data) {
+		return data, false, nil
+	}
+
+	return compressed, true, nil
+}
+
+// recordWriteTime records the time elapsed since start, excluding compression and block writes in that period, as splitting time.
+func (w *objectWriter) recordWriteTime(start time.Time, accountedAtStart time.Duration) {
+	elapsed := time.Since(start)
+	w.timings.Splitting += elapsed - (w.timings.accounted - accountedAtStart)
+	if !w.nested {
+		w.timings.Total += elapsed
+	}
+}
+
 func (w *objectWriter) Result() (ID, error) {
+	if w.sizeErr != nil {
+		return "", w.sizeErr
+	}
+
+	if w.timings != nil && !w.nested {
+		defer func(start time.Time) {
+			w.timings.Total += time.Since(start)
+		}(time.Now())
+	}
+
 	if w.buffer.Len() > 0 || len(w.blockIndex) == 0 {
 		if err := w.flushBuffer(); err != nil {
 			return "", err
 		}
 	}
 
+	if err := w.waitForUploads(); err != nil {
+		return "", err
+	}
+
 	if len(w.blockIndex) == 1 {
 		return w.blockIndex[0].Object, nil
 	}
@@ -121,6 +262,12 @@ func (w *objectWriter) Result() (ID, error) {
 		description: "LIST(" + w.description + ")",
 		splitter:    w.repo.newSplitter(),
 		prefix:      w.prefix,
+		timings:     w.timings,
+		nested:      true,
+
+		compressor:         w.compressor,
+		compressionLevel:   w.compressionLevel,
+		minCompressionSize: w.minCompressionSize,
 	}
 
 	ind := indirectObject{
@@ -142,4 +289,83 @@ func (w *objectWriter) Result() (ID, error) {
 type WriterOptions struct {
 	Description string
 	Prefix      string // empty string or a single-character ('g'..'z')
+
+	// Timings, when not nil, receives the breakdown of time spent writing the object.
+	Timings *WriteTimings
+
+	// Compression is the name of the algorithm used to compress storage blocks of the object (see SupportedCompression),
+	// NoCompression disables compression and empty string selects the default compression policy of the repository
+	// format. Blocks that don't become smaller when compressed are stored uncompressed.
+	Compression string
+
+	// CompressionLevel trades CPU for compression ratio, valid range depends on the algorithm.
+	// Zero selects a balanced default level. The level is not needed for decompression.
+	CompressionLevel int
+
+	// Digest, when not nil, receives all data written to the object, which allows computing an external checksum
+	// (e.g. SHA-256 or MD5 of the original content) in the same pass. It should be read after Result() returns.
+	Digest hash.Hash
+
+	// MaxObjectSize, if positive, limits the length of the object. Write() accepts data up to the limit and then
+	// returns ErrObjectTooLarge, as does Result(), so that no object is created. Blocks already written for the object
+	// are not deleted, since they may be shared with other objects, but they remain unreferenced by it.
+	MaxObjectSize int64
+
+	// DeltaBase, if not empty, is the ID of an object the new object is likely to share most of its contents with,
+	// such as a previous version of the same file. The object is then stored as a delta that references the bytes
+	// it shares with the base object, found by looking up blocks of the base object in the data as it is written,
+	// or as a regular object if it shares none. Only the hashes of the base blocks are kept in memory.
+	// The base object must remain in the repository as long as the delta object does. Deltas can't be written
+	// with checkpoints (see CheckpointInterval and ResumeFrom).
+	DeltaBase ID
+
+	// CheckpointInterval, if positive, makes the write resumable. Each time at least that many bytes have been
+	// written since the previous checkpoint, blocks written so far are flushed to the storage and OnCheckpoint
+	// is invoked with a checkpoint, which the caller can persist. Flushing commits pending blocks of
+	// the entire repository, not just of the object. An error returned by OnCheckpoint is returned by Write().
+	CheckpointInterval int64
+	OnCheckpoint       func(cp WriterCheckpoint) error
+
+	// ResumeFrom, if not nil, is the last checkpoint of an interrupted write of the same data with the same options.
+	// The data must be written again from the beginning: the bytes covered by the checkpoint are only fed to
+	// the splitter, which then splits the rest of the data exactly like an uninterrupted write would, whichever
+	// splitter is used, but they are not compressed nor stored again. The resulting object ID is therefore
+	// the same as the ID of an uninterrupted write.
+	ResumeFrom *WriterCheckpoint
+
+	// AsyncUploads, if positive, causes blocks of the object to be written in the background as soon as they are
+	// split, with up to that many blocks being written at the same time. Write() blocks while all of them
+	// are in progress and returns the first error writing a block, so that the producer can stop early instead
+	// of learning about the error from Result(). The resulting object ID is the same as with synchronous writes.
+	// Timings of background writes don't include the time spent in the block manager.
+	AsyncUploads int
+
+	// StorageBlockSize, if positive, decouples the size of storage blocks from the granularity of deduplication,
+	// for interoperability with systems that expect uniformly sized blocks. The object is still split into chunks
+	// by the splitter of the repository, but chunks that haven't been written before are regrouped into storage
+	// blocks of exactly StorageBlockSize bytes, except for the last block of each object, and the object is stored
+	// as an indirect object referencing the ranges of storage blocks holding its chunks.
+	//
+	// The trade-offs are that chunks are only deduplicated against the chunks written with this option by the same
+	// Manager (up to a limit), since their locations within storage blocks are only remembered in memory; chunks
+	// written earlier are deduplicated only when they happen to be regrouped into identical storage blocks.
+	// Reads fetch entire storage blocks even for small parts of chunks, indexes are larger, since each chunk
+	// may span multiple storage blocks, and storage blocks are not compressed by the writer. Indexes of the objects
+	// are written as regular objects. The option can't be combined with DeltaBase, checkpoints or AsyncUploads.
+	StorageBlockSize int
+}
+
+// WriteTimings is a breakdown of time spent writing an object.
+//
+// Splitting, compression and hashing times are spent on the blocks of the object itself.
+// Encryption and storage times are not per-object: the block manager encrypts and uploads blocks only when
+// a pack is completed, so they measure the pack writes triggered by the writer, which may include blocks of
+// other objects sharing the pack, and exclude blocks of the object that remain pending until the next flush.
+type WriteTimings struct {
+	Total       time.Duration `json:"total"`       // total time spent in Write() and Result()
+	Splitting   time.Duration `json:"splitting"`   // time spent buffering and splitting data into blocks
+	Compression time.Duration `json:"compression"` // time spent compressing blocks
+	block.Timings
+
+	accounted time.Duration // time spent in compression and block manager WriteBlock()
 }
@@ -0,0 +1,74 @@
+package object
+
+import (
+	"fmt"
+	"sync"
+)
+
+// asyncUploads tracks blocks of an object being written in the background (see WriterOptions.AsyncUploads).
+type asyncUploads struct {
+	slots chan struct{} // one element per block being written
+	wg    sync.WaitGroup
+	err   error // first error writing a block, protected by objectWriter.mu
+}
+
+// startUpload writes the provided chunk in the background, once fewer than WriterOptions.AsyncUploads blocks
+// are being written, which applies backpressure to the producer.
+func (w *objectWriter) startUpload(chunkID int, data []byte, compressed bool) error {
+	select {
+	case w.uploads.slots <- struct{}{}:
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+
+	if err := w.uploadError(); err != nil {
+		<-w.uploads.slots
+		return err
+	}
+
+	w.uploads.wg.Add(1)
+	go func() {
+		defer w.uploads.wg.Done()
+		defer func() { <-w.uploads.slots }()
+
+		blockID, err := w.repo.blockMgr.WriteBlock(w.ctx, data, w.prefix)
+		w.repo.trace("OBJECT_WRITER(%q) stored %v (%v bytes) in the background", w.description, blockID, len(data))
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		if err != nil {
+			if w.uploads.err == nil {
+				w.uploads.err = fmt.Errorf("error when flushing chunk %d of %s: %v", chunkID, w.description, err)
+			}
+			return
+		}
+
+		w.setChunkObject(chunkID, blockID, compressed)
+	}()
+
+	return nil
+}
+
+// uploadError returns the first error writing a block in the background.
+func (w *objectWriter) uploadError() error {
+	if w.uploads == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.uploads.err
+}
+
+// waitForUploads waits until all blocks being written in the background have been written and returns
+// the first error writing them.
+func (w *objectWriter) waitForUploads() error {
+	if w.uploads == nil {
+		return nil
+	}
+
+	w.uploads.wg.Wait()
+	return w.uploadError()
+}
@@ -0,0 +1,91 @@
+package object
+
+import (
+	"github.com/pkg/errors"
+)
+
+// WriterCheckpoint records the progress of a resumable write (see WriterOptions.CheckpointInterval), consisting of
+// the chunks of the object that have been written and flushed to the storage and the number of bytes they cover.
+type WriterCheckpoint struct {
+	Length int64   `json:"length"`
+	Chunks []Chunk `json:"chunks"`
+}
+
+// maybeCheckpoint flushes the blocks written so far and reports a checkpoint once WriterOptions.CheckpointInterval
+// bytes have been written since the previous one.
+func (w *objectWriter) maybeCheckpoint() error {
+	if w.checkpointInterval <= 0 || w.currentPosition-w.lastCheckpoint < w.checkpointInterval {
+		return nil
+	}
+
+	if err := w.waitForUploads(); err != nil {
+		return err
+	}
+
+	// blocks in the checkpoint must survive the writer being interrupted.
+	if err := w.repo.blockMgr.Flush(w.ctx); err != nil {
+		return errors.Wrapf(err, "unable to flush blocks of %v", w.description)
+	}
+
+	cp := WriterCheckpoint{Length: w.currentPosition}
+	for _, e := range w.blockIndex {
+		cp.Chunks = append(cp.Chunks, Chunk{Start: e.Start, Length: e.Length, Object: e.Object})
+	}
+
+	w.lastCheckpoint = w.currentPosition
+	if w.onCheckpoint == nil {
+		return nil
+	}
+
+	return w.onCheckpoint(cp)
+}
+
+// skipResumedChunk uses the object of the chunk recorded in the checkpoint the writer resumes from instead of
+// writing it again, after verifying that the data has been split the same way.
+func (w *objectWriter) skipResumedChunk(chunkID int) error {
+	if chunkID == 0 {
+		if err := w.verifyResumeCheckpoint(); err != nil {
+			return err
+		}
+	}
+
+	c := w.resumeFrom.Chunks[chunkID]
+	e := &w.blockIndex[chunkID]
+	if e.Start != c.Start || e.Length != c.Length {
+		return errors.Errorf("chunk %d of %s at %v of length %v does not match the checkpoint (%v of length %v)", chunkID, w.description, e.Start, e.Length, c.Start, c.Length)
+	}
+
+	e.Object = c.Object
+	return nil
+}
+
+// verifyResumeCheckpoint ensures that the chunks of the checkpoint are contiguous and all their blocks exist.
+func (w *objectWriter) verifyResumeCheckpoint() error {
+	var length int64
+	for i, c := range w.resumeFrom.Chunks {
+		if c.Start != length || c.Length <= 0 {
+			return errors.Errorf("invalid chunk %d of checkpoint of %v", i, w.description)
+		}
+		length += c.Length
+
+		oid := c.Object
+		if compressed, ok := oid.Compressed(); ok {
+			oid = compressed
+		}
+
+		blockID, ok := oid.BlockID()
+		if !ok {
+			return errors.Errorf("invalid object %v of chunk %d of checkpoint of %v", c.Object, i, w.description)
+		}
+
+		if _, err := w.repo.blockMgr.BlockInfo(w.ctx, blockID); err != nil {
+			return errors.Wrapf(err, "block %v of chunk %d of checkpoint of %v", blockID, i, w.description)
+		}
+	}
+
+	if length != w.resumeFrom.Length {
+		return errors.Errorf("invalid length of checkpoint of %v: %v, chunks cover %v bytes", w.description, w.resumeFrom.Length, length)
+	}
+
+	return nil
+}
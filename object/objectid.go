@@ -3,6 +3,7 @@ package object
 import (
 	"encoding/hex"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -11,6 +12,11 @@ import (
 // 1. In a single content block, this is the most common case for small objects.
 // 2. In a series of content blocks with an indirect block pointing at them (multiple indirections are allowed).
 //    This is used for larger files. Object IDs using indirect blocks start with "I"
+// 3. In a content block holding compressed data, object IDs of compressed blocks start with "Z".
+// 4. As a byte range of another object. Object IDs of slices start with "S" followed by the offset and length
+//    of the range and the base object ID, separated by commas, e.g. "S100,200,Df0f0".
+// 5. As a delta against a base object, stored in a descriptor object listing the byte ranges copied from the base
+//    object and the bytes inserted between them. Object IDs of deltas start with "X" followed by the descriptor ID.
 type ID string
 
 // HasObjectID exposes the identifier of an object.
@@ -32,12 +38,54 @@ func (i ID) IndexObjectID() (ID, bool) {
 	return "", false
 }
 
+// Compressed returns the object ID of the underlying object holding compressed data.
+func (i ID) Compressed() (ID, bool) {
+	if strings.HasPrefix(string(i), "Z") {
+		return i[1:], true
+	}
+
+	return "", false
+}
+
+// Delta returns the object ID of the descriptor of a delta object.
+func (i ID) Delta() (ID, bool) {
+	if strings.HasPrefix(string(i), "X") {
+		return i[1:], true
+	}
+
+	return "", false
+}
+
+// Slice returns the base object ID, offset and length of the byte range referenced by a slice object ID.
+func (i ID) Slice() (base ID, offset, length int64, ok bool) {
+	if !strings.HasPrefix(string(i), "S") {
+		return "", 0, 0, false
+	}
+
+	parts := strings.SplitN(string(i[1:]), ",", 3)
+	if len(parts) != 3 {
+		return "", 0, 0, false
+	}
+
+	offset, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+
+	length, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+
+	return ID(parts[2]), offset, length, true
+}
+
 // BlockID returns the block ID of the underlying content storage block.
 func (i ID) BlockID() (string, bool) {
 	if strings.HasPrefix(string(i), "D") {
 		return string(i[1:]), true
 	}
-	if strings.HasPrefix(string(i), "I") {
+	if strings.HasPrefix(string(i), "I") || strings.HasPrefix(string(i), "S") || strings.HasPrefix(string(i), "X") || strings.HasPrefix(string(i), "Z") {
 		return "", false
 	}
 
@@ -54,6 +102,43 @@ func (i ID) Validate() error {
 		return nil
 	}
 
+	if compressedObjectID, ok := i.Compressed(); ok {
+		if _, ok := compressedObjectID.BlockID(); !ok {
+			return fmt.Errorf("invalid compressed object ID %v: must be a direct object", i)
+		}
+
+		if err := compressedObjectID.Validate(); err != nil {
+			return fmt.Errorf("invalid compressed object ID %v: %v", i, err)
+		}
+
+		return nil
+	}
+
+	if descriptorID, ok := i.Delta(); ok {
+		if err := descriptorID.Validate(); err != nil {
+			return fmt.Errorf("invalid delta object ID %v: %v", i, err)
+		}
+
+		return nil
+	}
+
+	if strings.HasPrefix(string(i), "S") {
+		base, offset, length, ok := i.Slice()
+		if !ok {
+			return fmt.Errorf("malformed slice object ID %v", i)
+		}
+
+		if offset < 0 || length < 0 {
+			return fmt.Errorf("invalid range in slice object ID %v", i)
+		}
+
+		if err := base.Validate(); err != nil {
+			return fmt.Errorf("invalid base of slice object ID %v: %v", i, err)
+		}
+
+		return nil
+	}
+
 	if blockID, ok := i.BlockID(); ok {
 		if len(blockID) < 2 {
 			return fmt.Errorf("missing block ID")
@@ -87,6 +172,21 @@ func IndirectObjectID(indexObjectID ID) ID {
 	return "I" + indexObjectID
 }
 
+// CompressedObjectID returns object ID of the compressed object stored in the provided direct object.
+func CompressedObjectID(compressed ID) ID {
+	return "Z" + compressed
+}
+
+// SliceObjectID returns object ID referencing length bytes of the base object starting at the provided offset.
+func SliceObjectID(base ID, offset, length int64) ID {
+	return ID(fmt.Sprintf("S%v,%v,%v", offset, length, base))
+}
+
+// DeltaObjectID returns object ID of the delta object described by the provided descriptor object.
+func DeltaObjectID(descriptor ID) ID {
+	return "X" + descriptor
+}
+
 // ParseID converts the specified string into object ID
 func ParseID(s string) (ID, error) {
 	i := ID(s)
@@ -33,6 +33,22 @@ func TestParseObjectID(t *testing.T) {
 		{"I1,", false},
 		{"I-1,X", false},
 		{"Xsomething", false},
+		{"ZDf0f0", true},
+		{"Zxf0f0", true},
+		{"ZIDf0f0", false},
+		{"ZZDf0f0", false},
+		{"Zxf0f", false},
+		{"IZDf0f0", true},
+		{"S0,10,ZDf0f0", true},
+		{"S0,10,Df0f0", true},
+		{"S5,0,IDxf0f0", true},
+		{"S1,2,S3,4,Df0f0", true},
+		{"S0,10", false},
+		{"S0,10,", false},
+		{"S-1,10,Df0f0", false},
+		{"S0,-1,Df0f0", false},
+		{"Sx,10,Df0f0", false},
+		{"S0,10,Dxf0f", false},
 	}
 
 	for _, tc := range cases {
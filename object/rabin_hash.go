@@ -0,0 +1,83 @@
+package object
+
+import "math/bits"
+
+// rabinPolynomial is an irreducible polynomial of degree 53 over GF(2) used to compute Rabin fingerprints.
+// Changing it changes the boundaries of all blocks written with the RABIN splitter.
+const rabinPolynomial = 0x3DA3358B4DC173
+
+// rabinWindowSize is the number of most recent bytes the fingerprint is computed over.
+const rabinWindowSize = 64
+
+type rabinTables struct {
+	out [256]uint64 // contribution of a byte leaving the window
+	mod [256]uint64 // reduction of the bits shifted above the degree of the polynomial
+}
+
+var rabinTab = newRabinTables(rabinPolynomial)
+
+func polDeg(p uint64) int {
+	return 63 - bits.LeadingZeros64(p)
+}
+
+// polMod returns the remainder of dividing x by d over GF(2).
+func polMod(x, d uint64) uint64 {
+	dd := polDeg(d)
+	for x != 0 && polDeg(x) >= dd {
+		x ^= d << uint(polDeg(x)-dd)
+	}
+
+	return x
+}
+
+func polAppendByte(h uint64, b byte, pol uint64) uint64 {
+	return polMod(h<<8|uint64(b), pol)
+}
+
+func newRabinTables(pol uint64) *rabinTables {
+	t := &rabinTables{}
+	k := uint(polDeg(pol))
+
+	for b := 0; b < 256; b++ {
+		h := polAppendByte(0, byte(b), pol)
+		for i := 0; i < rabinWindowSize-1; i++ {
+			h = polAppendByte(h, 0, pol)
+		}
+		t.out[b] = h
+
+		t.mod[b] = polMod(uint64(b)<<k, pol) | uint64(b)<<k
+	}
+
+	return t
+}
+
+// rabinHash computes the Rabin fingerprint of the last rabinWindowSize bytes.
+type rabinHash struct {
+	tab    *rabinTables
+	shift  uint
+	digest uint64
+	window [rabinWindowSize]byte
+	wpos   int
+}
+
+func newRabinHash() *rabinHash {
+	return &rabinHash{
+		tab:   rabinTab,
+		shift: uint(polDeg(rabinPolynomial) - 8),
+	}
+}
+
+// HashByte slides the window by the provided byte and returns the low 32 bits of the fingerprint.
+func (h *rabinHash) HashByte(b byte) uint32 {
+	out := h.window[h.wpos]
+	h.window[h.wpos] = b
+	h.digest ^= h.tab.out[out]
+	h.wpos = (h.wpos + 1) % rabinWindowSize
+
+	index := byte(h.digest >> h.shift)
+	h.digest <<= 8
+	h.digest |= uint64(b)
+	h.digest ^= h.tab.mod[index]
+
+	return uint32(h.digest)
+}
@@ -24,6 +24,44 @@ var (
 type Options struct {
 	TraceStorage         func(f string, args ...interface{}) // Logs all storage access using provided Printf-style function
 	ObjectManagerOptions object.ManagerOptions
+
+	// FormatFingerprint, if set, causes Open to fail with ErrFormatFingerprintMismatch unless the format block
+	// in storage matches the given value, as returned by Repository.FormatFingerprint(). The format block is then
+	// always read from storage rather than from the cache directory.
+	FormatFingerprint string
+
+	// PerformancePreset selects named defaults for performance-related settings (see PresetLowMemory,
+	// PresetBalanced and PresetHighThroughput), individual non-zero values in Performance take precedence.
+	PerformancePreset string
+	Performance       PerformanceSettings
+
+	// Decryptor, if set, is used to decrypt all blocks read from the repository, which allows decryption
+	// to be performed by an HSM. It only routes reads of blocks: the format block is still decrypted using
+	// the password and the in-process encryptor, which is derived from the repository keys, is still built
+	// and used to encrypt blocks being written.
+	Decryptor block.Decryptor
+
+	// StrictIndexes causes Open to fail if any listed index block is missing, instead of skipping it.
+	// Corrupt index blocks always cause Open to fail.
+	StrictIndexes bool
+
+	// MaxIndexBlocks, if positive, causes Open to fail with block.ErrTooManyIndexBlocks instead of loading more
+	// index blocks than that into memory. Such repositories need to be compacted after opening them without the limit.
+	MaxIndexBlocks int
+
+	// BackgroundFlushQueue, if positive, causes finished packs to be uploaded in the background so that writes
+	// return without waiting for the storage. Writes block while that many packs are waiting to be uploaded.
+	// Flush() waits for all queued packs and returns any upload errors.
+	BackgroundFlushQueue int
+
+	// ParallelPackUploads, if greater than one, causes that many packs to be uploaded concurrently in the background,
+	// which speeds up writes to high-latency storage. When one of the uploads fails, the others are canceled and
+	// Flush() returns the error without committing the index of any of them.
+	ParallelPackUploads int
+
+	// Index, if not nil, is used as the committed index of the repository instead of loading it from the storage,
+	// which speeds up opening in short-lived processes that already know it (see block.Manager.ListBlockInfos).
+	Index []block.Info
 }
 
 // Open opens a Repository specified in the configuration file.
@@ -76,13 +114,25 @@ func Open(ctx context.Context, configFile string, password string, options *Opti
 
 // OpenWithConfig opens the repository with a given configuration, avoiding the need for a config file.
 func OpenWithConfig(ctx context.Context, st storage.Storage, lc *LocalConfig, password string, options *Options, caching block.CachingOptions) (*Repository, error) {
+	perf, err := resolvePerformanceSettings(options.PerformancePreset, options.Performance)
+	if err != nil {
+		return nil, err
+	}
+
 	log.Debugf("reading encrypted format block")
-	// Read cache block, potentially from cache.
-	fb, err := readAndCacheFormatBlockBytes(ctx, st, caching.CacheDirectory)
+	// Read cache block, potentially from cache. The cached copy may be stale, so a pinned fingerprint
+	// is always verified against the format block in storage, which then replaces the cached copy.
+	fb, err := readAndCacheFormatBlockBytes(ctx, st, caching.CacheDirectory, options.FormatFingerprint != "")
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to read format block")
 	}
 
+	if options.FormatFingerprint != "" {
+		if fp := formatBlockFingerprint(fb); fp != options.FormatFingerprint {
+			return nil, errors.Wrapf(ErrFormatFingerprintMismatch, "got %v, expected %v", fp, options.FormatFingerprint)
+		}
+	}
+
 	f, err := parseFormatBlock(fb)
 	if err != nil {
 		return nil, errors.Wrap(err, "can't parse format block")
@@ -103,6 +153,10 @@ func OpenWithConfig(ctx context.Context, st storage.Storage, lc *LocalConfig, pa
 		return nil, errors.Wrap(err, "unable to decrypt repository config")
 	}
 
+	if err := validateRepositoryFormat(repoConfig); err != nil {
+		return nil, err
+	}
+
 	caching.HMACSecret = deriveKeyFromMasterKey(masterKey, f.UniqueID, []byte("local-cache-integrity"), 16)
 
 	fo := repoConfig.FormattingOptions
@@ -110,8 +164,20 @@ func OpenWithConfig(ctx context.Context, st storage.Storage, lc *LocalConfig, pa
 		fo.MaxPackSize = repoConfig.MaxBlockSize
 	}
 
+	perf.apply(&fo, &caching)
+	fo.Decryptor = options.Decryptor
+	caching.StrictIndexes = options.StrictIndexes
+	caching.MaxIndexBlocks = options.MaxIndexBlocks
+	caching.BackgroundFlushQueue = options.BackgroundFlushQueue
+	caching.ParallelPackUploads = options.ParallelPackUploads
+
 	log.Debugf("initializing block manager")
-	bm, err := block.NewManager(ctx, st, fo, caching, fb)
+	var bm *block.Manager
+	if options.Index != nil {
+		bm, err = block.NewManagerWithIndex(ctx, st, fo, caching, fb, options.Index)
+	} else {
+		bm, err = block.NewManager(ctx, st, fo, caching, fb)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to open block manager")
 	}
@@ -141,6 +207,34 @@ func OpenWithConfig(ctx context.Context, st storage.Storage, lc *LocalConfig, pa
 	}, nil
 }
 
+// validateRepositoryFormat ensures that all algorithms referenced by the repository format
+// are supported by this build.
+func validateRepositoryFormat(f *repositoryObjectFormat) error {
+	if !isSupported(block.SupportedHashAlgorithms(), f.Hash) {
+		return fmt.Errorf("unsupported hash algorithm %q", f.Hash)
+	}
+
+	if !isSupported(block.SupportedEncryptionAlgorithms(), f.Encryption) {
+		return fmt.Errorf("unsupported encryption algorithm %q", f.Encryption)
+	}
+
+	if f.Splitter != "" && !isSupported(object.SupportedSplitters, f.Splitter) {
+		return fmt.Errorf("unsupported splitter %q", f.Splitter)
+	}
+
+	return nil
+}
+
+func isSupported(supported []string, name string) bool {
+	for _, s := range supported {
+		if s == name {
+			return true
+		}
+	}
+
+	return false
+}
+
 // SetCachingConfig changes caching configuration for a given repository config file.
 func SetCachingConfig(ctx context.Context, configFile string, opt block.CachingOptions) error {
 	configFile, err := filepath.Abs(configFile)
@@ -158,7 +252,7 @@ func SetCachingConfig(ctx context.Context, configFile string, opt block.CachingO
 		return errors.Wrap(err, "cannot open storage")
 	}
 
-	fb, err := readAndCacheFormatBlockBytes(ctx, st, "")
+	fb, err := readAndCacheFormatBlockBytes(ctx, st, "", false)
 	if err != nil {
 		return errors.Wrap(err, "can't read format block")
 	}
@@ -184,9 +278,9 @@ func SetCachingConfig(ctx context.Context, configFile string, opt block.CachingO
 	return nil
 }
 
-func readAndCacheFormatBlockBytes(ctx context.Context, st storage.Storage, cacheDirectory string) ([]byte, error) {
+func readAndCacheFormatBlockBytes(ctx context.Context, st storage.Storage, cacheDirectory string, bypassCache bool) ([]byte, error) {
 	cachedFile := filepath.Join(cacheDirectory, "kopia.repository")
-	if cacheDirectory != "" {
+	if cacheDirectory != "" && !bypassCache {
 		b, err := ioutil.ReadFile(cachedFile)
 		if err == nil {
 			// read from cache.
@@ -194,7 +288,7 @@ func readAndCacheFormatBlockBytes(ctx context.Context, st storage.Storage, cache
 		}
 	}
 
-	b, err := st.GetBlock(ctx, FormatBlockID, 0, -1)
+	b, err := readFormatBlockBytes(ctx, st)
 	if err != nil {
 		return nil, err
 	}
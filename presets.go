@@ -0,0 +1,92 @@
+package repo
+
+import (
+	"fmt"
+
+	"github.com/kopia/repo/block"
+)
+
+// Names of performance presets.
+const (
+	PresetLowMemory      = "low-memory"
+	PresetBalanced       = "balanced"
+	PresetHighThroughput = "high-throughput"
+)
+
+// PerformanceSettings groups performance-related settings applied when the repository is opened.
+// Zero values leave the corresponding setting unchanged.
+type PerformanceSettings struct {
+	MaxPackSize          int   // maximum size of newly written pack blocks
+	ParallelIndexFetches int   // number of index blocks fetched in parallel
+	MaxCacheSizeBytes    int64 // maximum size of the local block cache, only applies when caching is enabled
+}
+
+// performancePresets contains the values of settings for each named preset:
+//
+//    low-memory      - 8 MiB packs, 2 parallel index fetches, 100 MiB cache
+//    balanced        - 20 MiB packs, 5 parallel index fetches, 500 MiB cache
+//    high-throughput - 64 MiB packs, 16 parallel index fetches, 2 GiB cache
+var performancePresets = map[string]PerformanceSettings{
+	PresetLowMemory: {
+		MaxPackSize:          8 << 20,
+		ParallelIndexFetches: 2,
+		MaxCacheSizeBytes:    100 << 20,
+	},
+	PresetBalanced: {
+		MaxPackSize:          20 << 20,
+		ParallelIndexFetches: 5,
+		MaxCacheSizeBytes:    500 << 20,
+	},
+	PresetHighThroughput: {
+		MaxPackSize:          64 << 20,
+		ParallelIndexFetches: 16,
+		MaxCacheSizeBytes:    2 << 30,
+	},
+}
+
+// PerformancePresetSettings returns the settings of a named performance preset.
+func PerformancePresetSettings(name string) (PerformanceSettings, error) {
+	s, ok := performancePresets[name]
+	if !ok {
+		return PerformanceSettings{}, fmt.Errorf("unknown performance preset %q", name)
+	}
+
+	return s, nil
+}
+
+// resolvePerformanceSettings returns the settings of the preset with individual overrides applied.
+func resolvePerformanceSettings(preset string, overrides PerformanceSettings) (PerformanceSettings, error) {
+	var s PerformanceSettings
+	if preset != "" {
+		var err error
+		if s, err = PerformancePresetSettings(preset); err != nil {
+			return PerformanceSettings{}, err
+		}
+	}
+
+	if overrides.MaxPackSize != 0 {
+		s.MaxPackSize = overrides.MaxPackSize
+	}
+	if overrides.ParallelIndexFetches != 0 {
+		s.ParallelIndexFetches = overrides.ParallelIndexFetches
+	}
+	if overrides.MaxCacheSizeBytes != 0 {
+		s.MaxCacheSizeBytes = overrides.MaxCacheSizeBytes
+	}
+
+	return s, nil
+}
+
+func (s PerformanceSettings) apply(fo *block.FormattingOptions, caching *block.CachingOptions) {
+	if s.MaxPackSize != 0 {
+		fo.MaxPackSize = s.MaxPackSize
+	}
+
+	if s.ParallelIndexFetches != 0 {
+		caching.ParallelIndexFetches = s.ParallelIndexFetches
+	}
+
+	if s.MaxCacheSizeBytes != 0 && caching.MaxCacheSizeBytes > 0 {
+		caching.MaxCacheSizeBytes = s.MaxCacheSizeBytes
+	}
+}
@@ -49,6 +49,69 @@ func (r *Repository) Flush(ctx context.Context) error {
 	return r.Blocks.Flush(ctx)
 }
 
+// PurgeCache immediately removes locally cached data that is not currently in use
+// in order to reclaim disk space.
+func (r *Repository) PurgeCache(ctx context.Context) error {
+	if err := r.Blocks.PurgeIndexCache(ctx); err != nil {
+		return errors.Wrap(err, "error purging index cache")
+	}
+
+	return nil
+}
+
+// FormatFingerprint returns the fingerprint of the repository format block currently in storage,
+// which can be pinned using Options.FormatFingerprint to detect unexpected format changes on subsequent opens.
+func (r *Repository) FormatFingerprint(ctx context.Context) (string, error) {
+	b, err := readFormatBlockBytes(ctx, r.Storage)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read format block")
+	}
+
+	return formatBlockFingerprint(b), nil
+}
+
+// Quarantined returns the list of storage blocks that have been quarantined because they were found to be corrupt.
+func (r *Repository) Quarantined(ctx context.Context) ([]block.QuarantinedBlock, error) {
+	return r.Blocks.Quarantined(ctx)
+}
+
+// VerifyContents verifies that committed blocks are readable and their contents match their IDs, reporting
+// failures via opt.OnFailure. See block.Manager.VerifyContents for details.
+func (r *Repository) VerifyContents(ctx context.Context, opt block.VerifyContentsOptions) (*block.VerifyContentsResult, error) {
+	return r.Blocks.VerifyContents(ctx, opt)
+}
+
+// WalkObjects invokes visit for the provided root and all objects reachable from it, as determined by the
+// provided function returning objects referenced by each object, which is useful for marking objects in use.
+// See object.Manager.WalkObjects for details.
+func (r *Repository) WalkObjects(ctx context.Context, root object.ID, references object.ReferencesFunc, visit func(object.ID) error) error {
+	return r.Objects.WalkObjects(ctx, root, references, visit)
+}
+
+// CommitToken flushes all pending writes and returns a token capturing the current state of the repository,
+// which can be restored using RollbackTo().
+func (r *Repository) CommitToken(ctx context.Context) (block.CommitToken, error) {
+	if err := r.Flush(ctx); err != nil {
+		return block.CommitToken{}, errors.Wrap(err, "error flushing repository")
+	}
+
+	return r.Blocks.CommitToken(ctx)
+}
+
+// RollbackTo restores the state of the repository captured by the provided commit token, which hides objects and
+// manifests written afterwards. See block.Manager.RollbackTo for details.
+func (r *Repository) RollbackTo(ctx context.Context, token block.CommitToken) error {
+	if err := r.Blocks.RollbackTo(ctx, token); err != nil {
+		return errors.Wrap(err, "error rolling back block index")
+	}
+
+	if err := r.Manifests.Refresh(ctx); err != nil {
+		return errors.Wrap(err, "error reloading manifests")
+	}
+
+	return nil
+}
+
 // Refresh periodically makes external changes visible to repository.
 func (r *Repository) Refresh(ctx context.Context) error {
 	updated, err := r.Blocks.Refresh(ctx)
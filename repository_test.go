@@ -4,18 +4,26 @@ import (
 	"bytes"
 	"context"
 	cryptorand "crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"reflect"
 	"runtime/debug"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/kopia/repo"
 	"github.com/kopia/repo/block"
 	"github.com/kopia/repo/internal/repotesting"
+	"github.com/kopia/repo/internal/storagetesting"
 	"github.com/kopia/repo/object"
 	"github.com/kopia/repo/storage"
+	"github.com/kopia/repo/storage/filesystem"
+	"github.com/pkg/errors"
 )
 
 func TestWriters(t *testing.T) {
@@ -122,7 +130,7 @@ func TestPackingSimple(t *testing.T) {
 	verify(ctx, t, env.Repository, oid2a, []byte(content2), "packed-object-2")
 	verify(ctx, t, env.Repository, oid3a, []byte(content3), "packed-object-3")
 
-	if err := env.Repository.Blocks.CompactIndexes(ctx, block.CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1}); err != nil {
+	if err := env.Repository.Blocks.CompactIndexes(ctx, block.CompactOptions{AllBlocks: true}); err != nil {
 		t.Errorf("optimize error: %v", err)
 	}
 
@@ -132,7 +140,7 @@ func TestPackingSimple(t *testing.T) {
 	verify(ctx, t, env.Repository, oid2a, []byte(content2), "packed-object-2")
 	verify(ctx, t, env.Repository, oid3a, []byte(content3), "packed-object-3")
 
-	if err := env.Repository.Blocks.CompactIndexes(ctx, block.CompactOptions{MinSmallBlocks: 1, MaxSmallBlocks: 1}); err != nil {
+	if err := env.Repository.Blocks.CompactIndexes(ctx, block.CompactOptions{AllBlocks: true}); err != nil {
 		t.Errorf("optimize error: %v", err)
 	}
 
@@ -143,6 +151,61 @@ func TestPackingSimple(t *testing.T) {
 	verify(ctx, t, env.Repository, oid3a, []byte(content3), "packed-object-3")
 }
 
+func TestWriteAllPacksSmallObjects(t *testing.T) {
+	var env repotesting.Environment
+	defer env.Setup(t, func(opt *repo.NewRepositoryOptions) {
+		opt.BlockFormat.MaxPackSize = 1 << 20
+	}).Close(t)
+
+	ctx := context.Background()
+
+	const objectCount = 5000
+
+	var requests []object.WriteRequest
+	for i := 0; i < objectCount; i++ {
+		// every 10th object is a duplicate of the previous one.
+		content := fmt.Sprintf("tiny-object-%v", i-i%10/9)
+		requests = append(requests, object.WriteRequest{
+			Reader:  bytes.NewReader([]byte(content)),
+			Options: object.WriterOptions{Description: content},
+		})
+	}
+
+	oids, err := env.Repository.Objects.WriteAll(ctx, requests)
+	if err != nil {
+		t.Fatalf("WriteAll failed: %v", err)
+	}
+
+	if got, want := len(oids), objectCount; got != want {
+		t.Fatalf("unexpected number of object IDs: %v, wanted %v", got, want)
+	}
+
+	for i := 9; i < objectCount; i += 10 {
+		if oids[i] != oids[i-1] {
+			t.Errorf("duplicate object was not deduplicated: %v vs %v", oids[i], oids[i-1])
+		}
+	}
+
+	if err := env.Repository.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	packs, err := storage.ListAllBlocks(ctx, env.Repository.Storage, block.PackBlockPrefix)
+	if err != nil {
+		t.Fatalf("unable to list packs: %v", err)
+	}
+
+	if got, want := len(packs), 1; got != want {
+		t.Errorf("unexpected number of pack blocks: %v, wanted %v", got, want)
+	}
+
+	env.MustReopen(t)
+
+	for i := 0; i < objectCount; i += 97 {
+		verify(ctx, t, env.Repository, oids[i], []byte(fmt.Sprintf("tiny-object-%v", i-i%10/9)), fmt.Sprintf("object-%v", i))
+	}
+}
+
 func TestHMAC(t *testing.T) {
 	var env repotesting.Environment
 	defer env.Setup(t).Close(t)
@@ -163,6 +226,32 @@ func TestUpgrade(t *testing.T) {
 	defer env.Setup(t).Close(t)
 	ctx := context.Background()
 
+	indexSetCount := func() int {
+		sets, err := storage.ListAllBlocks(ctx, env.Repository.Storage, "x")
+		if err != nil {
+			t.Fatalf("unable to list index sets: %v", err)
+		}
+		return len(sets)
+	}
+
+	// new repositories use the default format version, which doesn't write index sets.
+	if got, want := env.Repository.Blocks.Format.Version, block.DefaultFormatVersion; got != want {
+		t.Errorf("unexpected format version of new repository: %v, wanted %v", got, want)
+	}
+
+	writeObject(ctx, t, env.Repository, []byte{1, 2, 3}, "before-upgrade")
+	if err := env.Repository.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	if err := env.Repository.Blocks.CompactIndexes(ctx, block.CompactOptions{AllBlocks: true}); err != nil {
+		t.Fatalf("unable to compact indexes: %v", err)
+	}
+
+	if got := indexSetCount(); got != 0 {
+		t.Errorf("unexpected index sets before upgrade: %v", got)
+	}
+
 	if err := env.Repository.Upgrade(ctx); err != nil {
 		t.Errorf("upgrade error: %v", err)
 	}
@@ -170,6 +259,28 @@ func TestUpgrade(t *testing.T) {
 	if err := env.Repository.Upgrade(ctx); err != nil {
 		t.Errorf("2nd upgrade error: %v", err)
 	}
+
+	env.MustReopen(t)
+
+	if got, want := env.Repository.Blocks.Format.Version, block.LatestFormatVersion; got != want {
+		t.Errorf("unexpected format version after upgrade: %v, wanted %v", got, want)
+	}
+
+	oid := writeObject(ctx, t, env.Repository, []byte{4, 5, 6}, "after-upgrade")
+	if err := env.Repository.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	if err := env.Repository.Blocks.CompactIndexes(ctx, block.CompactOptions{AllBlocks: true}); err != nil {
+		t.Fatalf("unable to compact indexes: %v", err)
+	}
+
+	if got := indexSetCount(); got == 0 {
+		t.Errorf("no index sets written after upgrade")
+	}
+
+	env.MustReopen(t)
+	verify(ctx, t, env.Repository, oid, []byte{4, 5, 6}, "after-upgrade")
 }
 
 func TestReaderStoredBlockNotFound(t *testing.T) {
@@ -210,6 +321,106 @@ func TestEndToEndReadAndSeek(t *testing.T) {
 	}
 }
 
+func TestObjectLength(t *testing.T) {
+	var env repotesting.Environment
+	defer env.Setup(t).Close(t)
+	ctx := context.Background()
+
+	for _, size := range []int{1, 199, 200, 201, 9999, 512434} {
+		randomData := make([]byte, size)
+		cryptorand.Read(randomData) //nolint:errcheck
+
+		oid := writeObject(ctx, t, env.Repository, randomData, fmt.Sprintf("%v", size))
+		if err := env.Repository.Flush(ctx); err != nil {
+			t.Fatalf("flush error: %v", err)
+		}
+
+		env.Repository.Blocks.ResetStats()
+
+		l, err := env.Repository.Objects.Length(ctx, oid)
+		if err != nil || l != int64(size) {
+			t.Errorf("unexpected length of %v: %v %v, wanted %v", oid, l, err, size)
+		}
+
+		// direct objects aren't read and only indexes of indirect objects are read.
+		got := env.Repository.Blocks.Stats().ReadBytes
+		if _, indirect := oid.IndexObjectID(); (!indirect && got != 0) || got >= int64(size) {
+			t.Errorf("Length(%v) of %v bytes read %v bytes", oid, size, got)
+		}
+	}
+
+	// an ID of the same length as IDs of existing blocks, which is not present in the indexes.
+	existing, _ := writeObject(ctx, t, env.Repository, []byte{1, 2, 3}, "existing").BlockID()
+	oid, err := object.ParseID("D" + strings.Repeat("0", len(existing)))
+	if err != nil {
+		t.Fatalf("cannot parse object ID: %v", err)
+	}
+
+	if _, err := env.Repository.Objects.Length(ctx, oid); err != storage.ErrBlockNotFound {
+		t.Errorf("unexpected error getting length of missing object: %v", err)
+	}
+}
+
+// readCountingStorage counts reads of storage blocks.
+type readCountingStorage struct {
+	storage.Storage
+	reads int32
+}
+
+func (s *readCountingStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	atomic.AddInt32(&s.reads, 1)
+	return s.Storage.GetBlock(ctx, id, offset, length)
+}
+
+func TestObjectLengthOfCompressedBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	st := &readCountingStorage{Storage: storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)}
+	opt := &repo.NewRepositoryOptions{}
+	opt.BlockFormat.Compression = "GZIP"
+	if err := repo.Initialize(ctx, st, opt, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	contents := bytes.Repeat([]byte("compressible "), 1000)
+	oid := writeObject(ctx, t, r, contents, "compressible")
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	// reopen the repository, so that the length comes from the committed index.
+	r2, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to reopen: %v", err)
+	}
+
+	blockID, _ := oid.BlockID()
+	if bi, err := r2.Blocks.BlockInfo(ctx, blockID); err != nil || bi.Compression == 0 {
+		t.Fatalf("block of %v is not compressed: %+v %v", oid, bi, err)
+	}
+
+	readsBefore := atomic.LoadInt32(&st.reads)
+
+	l, err := r2.Objects.Length(ctx, oid)
+	if err != nil || l != int64(len(contents)) {
+		t.Errorf("unexpected length of %v: %v %v, wanted %v", oid, l, err, len(contents))
+	}
+
+	if _, _, err := r2.Objects.VerifyObject(ctx, oid); err != nil {
+		t.Errorf("unable to verify %v: %v", oid, err)
+	}
+
+	if got := atomic.LoadInt32(&st.reads) - readsBefore; got != 0 {
+		t.Errorf("getting the length of a compressed block read %v storage blocks", got)
+	}
+}
+
 func writeObject(ctx context.Context, t *testing.T, rep *repo.Repository, data []byte, testCaseID string) object.ID {
 	w := rep.Objects.NewWriter(ctx, object.WriterOptions{})
 	if _, err := w.Write(data); err != nil {
@@ -293,6 +504,24 @@ func TestFormats(t *testing.T) {
 				"The quick brown fox jumps over the lazy dog": "f7bc83f430538424b13298e6aa6fb143",
 			},
 		},
+		{
+			format: makeFormat("HMAC-SHA256", "CHACHA20-POLY1305"),
+			oids: map[string]object.ID{
+				"The quick brown fox jumps over the lazy dog": "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+			},
+		},
+		{
+			format: makeFormat("HMAC-BLAKE2B-256", "NONE"),
+			oids: map[string]object.ID{
+				"The quick brown fox jumps over the lazy dog": "bb3e1cd6f38b5df1cb87983ec29d6116587c1b9bf6e5cd167ac7f2bc741d3817",
+			},
+		},
+		{
+			format: makeFormat("BLAKE3-256", "NONE"),
+			oids: map[string]object.ID{
+				"The quick brown fox jumps over the lazy dog": "a069bdb7a9c0258e85ac694fc02bf5baf75ece2d4c1a29b1285a8ad40b68dfaa",
+			},
+		},
 	}
 
 	for caseIndex, c := range cases {
@@ -324,5 +553,1208 @@ func TestFormats(t *testing.T) {
 				t.Errorf("data mismatch, read:%x vs written:%v", bytesRead, bytesToWrite)
 			}
 		}
+
+		// the hash persisted in the repository format is used to verify blocks after reopening.
+		env.MustReopen(t)
+		for k, v := range c.oids {
+			rc, err := env.Repository.Objects.Open(ctx, v)
+			if err != nil {
+				t.Errorf("open failed after reopening #%v: %v", caseIndex, err)
+				continue
+			}
+			bytesRead, err := ioutil.ReadAll(rc)
+			if err != nil || !bytes.Equal(bytesRead, []byte(k)) {
+				t.Errorf("data mismatch after reopening #%v: %x, %v", caseIndex, bytesRead, err)
+			}
+		}
+	}
+}
+
+func TestOpenUnsupportedAlgorithms(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		desc        string
+		opt         repo.NewRepositoryOptions
+		wantInitErr string // algorithms of the block format are validated when initializing
+		wantErr     string
+	}{
+		{
+			desc:        "hash",
+			opt:         repo.NewRepositoryOptions{BlockFormat: block.FormattingOptions{Hash: "NO-SUCH-HASH"}},
+			wantInitErr: `unknown hash function "NO-SUCH-HASH", supported: `,
+		},
+		{
+			desc:        "encryption",
+			opt:         repo.NewRepositoryOptions{BlockFormat: block.FormattingOptions{Encryption: "NO-SUCH-ENCRYPTION"}},
+			wantInitErr: `unknown encryption algorithm "NO-SUCH-ENCRYPTION", supported: `,
+		},
+		{
+			desc:    "splitter",
+			opt:     repo.NewRepositoryOptions{ObjectFormat: object.Format{Splitter: "NO-SUCH-SPLITTER"}},
+			wantErr: `unsupported splitter "NO-SUCH-SPLITTER"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			storageDir, err := ioutil.TempDir("", "kopia-repo")
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			st, err := filesystem.New(ctx, &filesystem.Options{Path: storageDir})
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			opt := tc.opt
+			err = repo.Initialize(ctx, st, &opt, "password")
+			if tc.wantInitErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantInitErr) {
+					t.Errorf("unexpected initialize error: %v, wanted %q", err, tc.wantInitErr)
+				}
+
+				if _, err := st.GetBlock(ctx, "kopia.repository", 0, -1); err != storage.ErrBlockNotFound {
+					t.Errorf("unexpected format block after failed initialization: %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unable to initialize: %v", err)
+			}
+
+			lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+			_, err = repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("unexpected error: %v, wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// xorEncryptor is a trivial encryption algorithm registered by tests.
+type xorEncryptor struct {
+	key byte
+}
+
+func (e xorEncryptor) Encrypt(plainText []byte, blockID []byte) ([]byte, error) {
+	result := make([]byte, len(plainText))
+	for i, b := range plainText {
+		result[i] = b ^ e.key ^ blockID[i%len(blockID)]
+	}
+	return result, nil
+}
+
+func (e xorEncryptor) Decrypt(cipherText []byte, blockID []byte) ([]byte, error) {
+	return e.Encrypt(cipherText, blockID)
+}
+
+func TestRegisteredAlgorithms(t *testing.T) {
+	ctx := context.Background()
+
+	block.RegisterHash("TEST-SHA256", func(o block.FormattingOptions) (block.HashFunc, error) {
+		return func(data []byte) []byte {
+			h := sha256.Sum256(append(append([]byte(nil), o.HMACSecret...), data...))
+			return h[:16]
+		}, nil
+	})
+	block.RegisterEncryption("TEST-XOR", func(o block.FormattingOptions) (block.Encryptor, error) {
+		return xorEncryptor{o.MasterKey[0]}, nil
+	})
+
+	var env repotesting.Environment
+	defer env.Setup(t, func(n *repo.NewRepositoryOptions) {
+		n.BlockFormat.Hash = "TEST-SHA256"
+		n.BlockFormat.Encryption = "TEST-XOR"
+	}).Close(t)
+
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	w := env.Repository.Objects.NewWriter(ctx, object.WriterOptions{})
+	w.Write(data) //nolint:errcheck
+	oid, err := w.Result()
+	if err != nil {
+		t.Fatalf("unable to write object: %v", err)
+	}
+	if err := env.Repository.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	env.MustReopen(t)
+	rc, err := env.Repository.Objects.Open(ctx, oid)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	bytesRead, err := ioutil.ReadAll(rc)
+	if err != nil || !bytes.Equal(bytesRead, data) {
+		t.Errorf("data mismatch after reopening: %x, %v", bytesRead, err)
+	}
+}
+
+func TestOpenWithPinnedFormatFingerprint(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "kopia-cache")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(cacheDir) //nolint:errcheck
+
+	for _, caching := range []block.CachingOptions{
+		{},
+		{CacheDirectory: cacheDir},
+	} {
+		verifyOpenWithPinnedFormatFingerprint(t, caching)
+	}
+}
+
+func verifyOpenWithPinnedFormatFingerprint(t *testing.T, caching block.CachingOptions) {
+	ctx := context.Background()
+
+	data := map[string][]byte{}
+	st := storagetesting.NewMapStorage(data, nil, nil)
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, caching)
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	fingerprint, err := r.FormatFingerprint(ctx)
+	if err != nil {
+		t.Fatalf("unable to get format fingerprint: %v", err)
+	}
+
+	if _, err = repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{FormatFingerprint: fingerprint}, caching); err != nil {
+		t.Fatalf("unable to open with pinned fingerprint: %v", err)
+	}
+
+	// replace format block with one from another repository using the same password.
+	otherData := map[string][]byte{}
+	if err := repo.Initialize(ctx, storagetesting.NewMapStorage(otherData, nil, nil), &repo.NewRepositoryOptions{}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+	data[repo.FormatBlockID] = otherData[repo.FormatBlockID]
+
+	if _, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, caching); err != nil {
+		t.Fatalf("unable to open altered repository without pinned fingerprint: %v", err)
+	}
+
+	// the cached copy of the original format block must not satisfy the pinned fingerprint.
+	_, err = repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{FormatFingerprint: fingerprint}, caching)
+	if errors.Cause(err) != repo.ErrFormatFingerprintMismatch {
+		t.Errorf("unexpected error when opening altered repository with %+v: %v, wanted %v", caching, err, repo.ErrFormatFingerprintMismatch)
+	}
+}
+
+func TestOpenWithRedundantFormatBlock(t *testing.T) {
+	ctx := context.Background()
+
+	storageDir, err := ioutil.TempDir("", "kopia-repo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	st, err := filesystem.New(ctx, &filesystem.Options{Path: storageDir})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{FormatBlockCopies: 2}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	formatBlocks, err := storage.ListAllBlocks(ctx, st, repo.FormatBlockID)
+	if err != nil {
+		t.Fatalf("unable to list blocks: %v", err)
+	}
+	if got, want := len(formatBlocks), 3; got != want {
+		t.Fatalf("unexpected number of format blocks: %v, wanted %v", got, want)
+	}
+
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{}, "password"); err == nil {
+		t.Errorf("unexpected success initializing repository twice")
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+
+	// delete primary format block, the repository can still be opened using a surviving copy.
+	if err := st.DeleteBlock(ctx, repo.FormatBlockID); err != nil {
+		t.Fatalf("unable to delete format block: %v", err)
+	}
+
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open repository without primary format block: %v", err)
+	}
+
+	oid := writeObject(ctx, t, r, []byte{1, 2, 3}, "redundant")
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	// add another copy and corrupt one of them, the contents shared by most copies win.
+	formatBytes, err := st.GetBlock(ctx, repo.FormatBlockID+".1", 0, -1)
+	if err != nil {
+		t.Fatalf("unable to read format block: %v", err)
+	}
+	if err := st.PutBlock(ctx, repo.FormatBlockID+".3", formatBytes); err != nil {
+		t.Fatalf("unable to write format block: %v", err)
+	}
+	if err := st.PutBlock(ctx, repo.FormatBlockID+".1", []byte("{}")); err != nil {
+		t.Fatalf("unable to write format block: %v", err)
+	}
+
+	r, err = repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open repository with inconsistent format block copies: %v", err)
+	}
+
+	verify(ctx, t, r, oid, []byte{1, 2, 3}, "redundant")
+
+	// the primary format block is preferred over diverging copies.
+	if err := st.PutBlock(ctx, repo.FormatBlockID, formatBytes); err != nil {
+		t.Fatalf("unable to write format block: %v", err)
+	}
+	for _, id := range []string{repo.FormatBlockID + ".2", repo.FormatBlockID + ".3"} {
+		if err := st.PutBlock(ctx, id, []byte("{}")); err != nil {
+			t.Fatalf("unable to write format block: %v", err)
+		}
+	}
+
+	r, err = repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open repository with primary format block: %v", err)
+	}
+
+	verify(ctx, t, r, oid, []byte{1, 2, 3}, "redundant")
+}
+
+func TestWriterTimings(t *testing.T) {
+	var env repotesting.Environment
+	defer env.Setup(t).Close(t)
+	ctx := context.Background()
+
+	data := make([]byte, 100000)
+	cryptorand.Read(data) //nolint:errcheck
+
+	var timings object.WriteTimings
+	writer := env.Repository.Objects.NewWriter(ctx, object.WriterOptions{Timings: &timings, Compression: "GZIP"})
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	oid, err := writer.Result()
+	if err != nil {
+		t.Fatalf("unable to get result: %v", err)
+	}
+
+	verify(ctx, t, env.Repository, oid, data, "timings")
+
+	phases := map[string]time.Duration{
+		"splitting":   timings.Splitting,
+		"compression": timings.Compression,
+		"hashing":     timings.Hashing,
+		"encryption":  timings.Encryption,
+		"storage":     timings.Storage,
+	}
+
+	var sum time.Duration
+	for phase, d := range phases {
+		if d <= 0 {
+			t.Errorf("%v time was not recorded: %+v", phase, timings)
+		}
+		sum += d
+	}
+
+	// all phases are disjoint parts of the total, which also includes some bookkeeping.
+	if sum > timings.Total || sum < timings.Total/2 {
+		t.Errorf("sum of phases %v does not match total %v: %+v", sum, timings.Total, timings)
+	}
+}
+
+func TestOpenWithPerformancePreset(t *testing.T) {
+	ctx := context.Background()
+
+	st := storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	cacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unable to create cache directory: %v", err)
+	}
+	defer os.RemoveAll(cacheDir) //nolint:errcheck
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	caching := block.CachingOptions{CacheDirectory: cacheDir, MaxCacheSizeBytes: 1000}
+
+	cases := []struct {
+		preset       string
+		overrides    repo.PerformanceSettings
+		packSize     int
+		fetches      int
+		maxCacheSize int64
+	}{
+		{repo.PresetLowMemory, repo.PerformanceSettings{}, 8 << 20, 2, 100 << 20},
+		{repo.PresetBalanced, repo.PerformanceSettings{}, 20 << 20, 5, 500 << 20},
+		{repo.PresetHighThroughput, repo.PerformanceSettings{}, 64 << 20, 16, 2 << 30},
+		{repo.PresetHighThroughput, repo.PerformanceSettings{ParallelIndexFetches: 3}, 64 << 20, 3, 2 << 30},
+		{"", repo.PerformanceSettings{MaxPackSize: 1 << 20}, 1 << 20, 5, 1000},
+	}
+
+	for _, tc := range cases {
+		r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{PerformancePreset: tc.preset, Performance: tc.overrides}, caching)
+		if err != nil {
+			t.Fatalf("unable to open with preset %q: %v", tc.preset, err)
+		}
+
+		if got, want := r.Blocks.MaxPackSize(), tc.packSize; got != want {
+			t.Errorf("invalid pack size for %q %+v: %v, wanted %v", tc.preset, tc.overrides, got, want)
+		}
+
+		if got, want := r.Blocks.ParallelIndexFetches(), tc.fetches; got != want {
+			t.Errorf("invalid parallel index fetches for %q %+v: %v, wanted %v", tc.preset, tc.overrides, got, want)
+		}
+
+		if got, want := r.Blocks.CachingOptions().MaxCacheSizeBytes, tc.maxCacheSize; got != want {
+			t.Errorf("invalid cache size for %q %+v: %v, wanted %v", tc.preset, tc.overrides, got, want)
+		}
+	}
+
+	if _, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{PerformancePreset: "no-such-preset"}, caching); err == nil {
+		t.Errorf("unexpected success opening with unknown preset")
+	}
+}
+
+// missingBlockStorage simulates storage blocks that have been removed while still being listed.
+type missingBlockStorage struct {
+	storage.Storage
+	missing map[string]bool
+}
+
+func (s missingBlockStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	if s.missing[id] {
+		return nil, storage.ErrBlockNotFound
+	}
+
+	return s.Storage.GetBlock(ctx, id, offset, length)
+}
+
+func TestOpenWithStrictIndexes(t *testing.T) {
+	ctx := context.Background()
+
+	data := map[string][]byte{}
+	st := storagetesting.NewMapStorage(data, nil, nil)
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	oid1 := writeObject(ctx, t, r, []byte{1, 2, 3}, "first")
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	// remember the index block describing the first object, which will be removed.
+	indexBlocks, err := r.Blocks.IndexBlocks(ctx)
+	if err != nil || len(indexBlocks) != 1 {
+		t.Fatalf("unexpected index blocks: %v %v", indexBlocks, err)
+	}
+	removed := indexBlocks[0].FileName
+
+	oid2 := writeObject(ctx, t, r, []byte{4, 5, 6}, "second")
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	st2 := missingBlockStorage{st, map[string]bool{removed: true}}
+	if _, err := repo.OpenWithConfig(ctx, st2, lc, "password", &repo.Options{StrictIndexes: true}, block.CachingOptions{}); errors.Cause(err) != storage.ErrBlockNotFound {
+		t.Fatalf("unexpected error opening with strict indexes: %v, wanted %v", err, storage.ErrBlockNotFound)
+	}
+
+	r2, err := repo.OpenWithConfig(ctx, st2, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open without strict indexes: %v", err)
+	}
+
+	skipped := r2.Blocks.SkippedIndexBlocks()
+	if len(skipped) != 1 || skipped[0].FileName != removed || skipped[0].Err != storage.ErrBlockNotFound {
+		t.Errorf("unexpected skipped index blocks: %+v", skipped)
+	}
+
+	verify(ctx, t, r2, oid2, []byte{4, 5, 6}, "second")
+	if _, err := r2.Objects.Open(ctx, oid1); err == nil {
+		t.Errorf("unexpected success opening object described by the removed index")
+	}
+
+	// corrupt index blocks are fatal regardless of StrictIndexes.
+	for id, b := range data {
+		if strings.HasPrefix(id, "n") && id != removed {
+			b[len(b)-1] ^= 1
+		}
+	}
+
+	if _, err := repo.OpenWithConfig(ctx, st2, lc, "password", &repo.Options{}, block.CachingOptions{}); err == nil {
+		t.Errorf("unexpected success opening repository with corrupt index")
+	}
+}
+
+func TestOpenWithMaxIndexBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	st := storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	// each flush produces a separate index block.
+	var oids []object.ID
+	for i := 0; i < 10; i++ {
+		oids = append(oids, writeObject(ctx, t, r, []byte{byte(i), 1, 2, 3}, fmt.Sprintf("object-%v", i)))
+		if err := r.Flush(ctx); err != nil {
+			t.Fatalf("flush error: %v", err)
+		}
+	}
+
+	if _, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{MaxIndexBlocks: 5}, block.CachingOptions{}); errors.Cause(err) != block.ErrTooManyIndexBlocks || !strings.Contains(err.Error(), "compact") {
+		t.Fatalf("unexpected error opening with too many index blocks: %v, wanted %v", err, block.ErrTooManyIndexBlocks)
+	}
+
+	// compaction brings the number of index blocks under the limit.
+	if err := r.Blocks.CompactIndexes(ctx, block.CompactOptions{AllBlocks: true}); err != nil {
+		t.Fatalf("unable to compact indexes: %v", err)
+	}
+
+	r2, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{MaxIndexBlocks: 5}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open after compaction: %v", err)
+	}
+
+	for i, oid := range oids {
+		verify(ctx, t, r2, oid, []byte{byte(i), 1, 2, 3}, fmt.Sprintf("object-%v", i))
+	}
+}
+
+// failingPackStorage fails writes of pack blocks while failPacks is set.
+type failingPackStorage struct {
+	storage.Storage
+	failPacks int32
+}
+
+func (s *failingPackStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	if strings.HasPrefix(id, block.PackBlockPrefix) && atomic.LoadInt32(&s.failPacks) != 0 {
+		return errors.Errorf("simulated failure writing %v", id)
+	}
+
+	return s.Storage.PutBlock(ctx, id, data)
+}
+
+func TestBackgroundFlush(t *testing.T) {
+	ctx := context.Background()
+
+	data := map[string][]byte{}
+	st := &failingPackStorage{Storage: storagetesting.NewMapStorage(data, nil, nil)}
+	opt := &repo.NewRepositoryOptions{}
+	opt.BlockFormat.MaxPackSize = 4096
+	if err := repo.Initialize(ctx, st, opt, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{BackgroundFlushQueue: 2}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	contents := map[object.ID][]byte{}
+	writeObjects := func(cnt int) {
+		for i := 0; i < cnt; i++ {
+			b := make([]byte, 1000)
+			cryptorand.Read(b) //nolint:errcheck
+			contents[writeObject(ctx, t, r, b, fmt.Sprintf("object-%v", len(contents)))] = b
+		}
+	}
+
+	// failed uploads are reported by Flush, blocks remain readable and are uploaded again by the next Flush.
+	atomic.StoreInt32(&st.failPacks, 1)
+	writeObjects(20)
+	for oid, b := range contents {
+		verify(ctx, t, r, oid, b, oid.String())
+	}
+
+	if err := r.Flush(ctx); err == nil {
+		t.Fatalf("unexpected success flushing with failing uploads")
+	}
+
+	atomic.StoreInt32(&st.failPacks, 0)
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	writeObjects(30)
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	r2, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to reopen: %v", err)
+	}
+
+	for oid, b := range contents {
+		verify(ctx, t, r2, oid, b, oid.String())
+	}
+}
+
+// slowPackStorage delays writes of pack blocks, tracking how many of them are in progress at the same time,
+// and fails the next pack write while failNextPack is set.
+type slowPackStorage struct {
+	storage.Storage
+	delay time.Duration
+
+	inProgress    int32
+	maxInProgress int32
+	failNextPack  int32
+}
+
+func (s *slowPackStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	if !strings.HasPrefix(id, block.PackBlockPrefix) {
+		return s.Storage.PutBlock(ctx, id, data)
+	}
+
+	n := atomic.AddInt32(&s.inProgress, 1)
+	defer atomic.AddInt32(&s.inProgress, -1)
+
+	for {
+		m := atomic.LoadInt32(&s.maxInProgress)
+		if n <= m || atomic.CompareAndSwapInt32(&s.maxInProgress, m, n) {
+			break
+		}
+	}
+
+	if atomic.CompareAndSwapInt32(&s.failNextPack, 1, 0) {
+		return errors.Errorf("simulated failure writing %v", id)
+	}
+
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return s.Storage.PutBlock(ctx, id, data)
+}
+
+func TestParallelPackUploads(t *testing.T) {
+	ctx := context.Background()
+
+	const parallelUploads = 4
+
+	st := &slowPackStorage{Storage: storagetesting.NewMapStorage(map[string][]byte{}, nil, nil), delay: 50 * time.Millisecond}
+	opt := &repo.NewRepositoryOptions{}
+	opt.BlockFormat.MaxPackSize = 4096
+	if err := repo.Initialize(ctx, st, opt, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{ParallelPackUploads: parallelUploads}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	contents := map[object.ID][]byte{}
+	writeObjects := func(cnt int) {
+		for i := 0; i < cnt; i++ {
+			b := make([]byte, 1000)
+			cryptorand.Read(b) //nolint:errcheck
+			contents[writeObject(ctx, t, r, b, fmt.Sprintf("object-%v", len(contents)))] = b
+		}
+	}
+
+	indexBlockCount := func() int {
+		blocks, err := r.Blocks.IndexBlocks(ctx)
+		if err != nil {
+			t.Fatalf("unable to list index blocks: %v", err)
+		}
+		return len(blocks)
+	}
+
+	writeObjects(40)
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	if got, want := atomic.LoadInt32(&st.maxInProgress), int32(parallelUploads); got != want {
+		t.Errorf("unexpected number of concurrent pack uploads: %v, wanted %v", got, want)
+	}
+
+	// a failed upload fails the flush without committing the index of packs uploaded by it.
+	indexBlocksBefore := indexBlockCount()
+
+	writeObjects(20)
+	atomic.StoreInt32(&st.failNextPack, 1)
+	writeObjects(20)
+
+	if err := r.Flush(ctx); err == nil {
+		t.Fatalf("unexpected success flushing with failing upload")
+	}
+
+	if got := indexBlockCount(); got != indexBlocksBefore {
+		t.Errorf("index committed by failed flush: %v index blocks, wanted %v", got, indexBlocksBefore)
+	}
+
+	for oid, b := range contents {
+		verify(ctx, t, r, oid, b, oid.String())
+	}
+
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	r2, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to reopen: %v", err)
+	}
+
+	for oid, b := range contents {
+		verify(ctx, t, r2, oid, b, oid.String())
+	}
+}
+
+func TestBackgroundUploadsOutliveWriteContext(t *testing.T) {
+	ctx := context.Background()
+
+	st := &slowPackStorage{Storage: storagetesting.NewMapStorage(map[string][]byte{}, nil, nil), delay: 20 * time.Millisecond}
+	opt := &repo.NewRepositoryOptions{}
+	opt.BlockFormat.MaxPackSize = 4096
+	if err := repo.Initialize(ctx, st, opt, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{ParallelPackUploads: 2}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	// contexts of the writes are canceled as soon as they return, while their packs are still being uploaded.
+	contents := map[object.ID][]byte{}
+	for i := 0; i < 20; i++ {
+		b := make([]byte, 1000)
+		cryptorand.Read(b) //nolint:errcheck
+
+		writeCtx, cancel := context.WithCancel(ctx)
+		contents[writeObject(writeCtx, t, r, b, fmt.Sprintf("object-%v", i))] = b
+		cancel()
+	}
+
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	for oid, b := range contents {
+		verify(ctx, t, r, oid, b, oid.String())
+	}
+
+	// Close() waits for the upload workers, including ones in the middle of an upload.
+	b := make([]byte, 5000)
+	cryptorand.Read(b) //nolint:errcheck
+	writeObject(ctx, t, r, b, "unflushed")
+	r.Blocks.Close()
+
+	if got := atomic.LoadInt32(&st.inProgress); got != 0 {
+		t.Errorf("%v pack uploads still in progress after Close()", got)
+	}
+}
+
+// failingNthPackStorage fails the failAt-th write of a pack block.
+type failingNthPackStorage struct {
+	storage.Storage
+	failAt     int32
+	packWrites int32
+}
+
+func (s *failingNthPackStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	if strings.HasPrefix(id, block.PackBlockPrefix) && atomic.AddInt32(&s.packWrites, 1) == s.failAt {
+		return errors.Errorf("simulated failure writing %v", id)
+	}
+
+	return s.Storage.PutBlock(ctx, id, data)
+}
+
+func TestAsyncUploads(t *testing.T) {
+	ctx := context.Background()
+
+	st := &failingNthPackStorage{Storage: storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)}
+	opt := &repo.NewRepositoryOptions{
+		ObjectFormat: object.Format{Splitter: "FIXED", MaxBlockSize: 5000},
+	}
+	opt.BlockFormat.MaxPackSize = 4096
+	if err := repo.Initialize(ctx, st, opt, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	writeInParts := func(data []byte, opt object.WriterOptions) (int, object.ID, error) {
+		w := r.Objects.NewWriter(ctx, opt)
+		defer w.Close() //nolint:errcheck
+
+		for written := 0; written < len(data); written += 1000 {
+			if _, err := w.Write(data[written : written+1000]); err != nil {
+				return written, "", err
+			}
+		}
+
+		oid, err := w.Result()
+		return len(data), oid, err
+	}
+
+	// each block fills a pack, so the third block fails to be written.
+	atomic.StoreInt32(&st.failAt, 3)
+
+	data := make([]byte, 1000000)
+	cryptorand.Read(data) //nolint:errcheck
+
+	written, _, err := writeInParts(data, object.WriterOptions{AsyncUploads: 2})
+	if err == nil {
+		t.Fatalf("unexpected success writing with failing upload")
+	}
+
+	if written >= len(data)/10 {
+		t.Errorf("upload error reported after %v of %v bytes were written", written, len(data))
+	}
+
+	// object IDs don't depend on the order blocks are written in.
+	cryptorand.Read(data) //nolint:errcheck
+
+	_, asyncOID, err := writeInParts(data, object.WriterOptions{AsyncUploads: 4})
+	if err != nil {
+		t.Fatalf("unable to write object: %v", err)
+	}
+
+	_, syncOID, err := writeInParts(data, object.WriterOptions{})
+	if err != nil {
+		t.Fatalf("unable to write object: %v", err)
+	}
+
+	if asyncOID != syncOID {
+		t.Errorf("unexpected object ID %v, wanted %v", asyncOID, syncOID)
+	}
+
+	verify(ctx, t, r, asyncOID, data, "async")
+}
+
+func TestVerifyContents(t *testing.T) {
+	ctx := context.Background()
+
+	data := map[string][]byte{}
+	st := storagetesting.NewMapStorage(data, nil, nil)
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	r, err := repo.OpenWithConfig(ctx, st, &repo.LocalConfig{Storage: st.ConnectionInfo()}, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	var oids []object.ID
+	for i := 0; i < 10; i++ {
+		b := make([]byte, 1000)
+		cryptorand.Read(b) //nolint:errcheck
+		oids = append(oids, writeObject(ctx, t, r, b, fmt.Sprintf("object-%v", i)))
+	}
+
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	verifyContents := func(opt block.VerifyContentsOptions) (*block.VerifyContentsResult, []block.ContentsFailure) {
+		var failures []block.ContentsFailure
+		opt.OnFailure = func(f block.ContentsFailure) {
+			failures = append(failures, f)
+		}
+
+		result, err := r.VerifyContents(ctx, opt)
+		if err != nil {
+			t.Fatalf("unable to verify contents: %v", err)
+		}
+
+		return result, failures
+	}
+
+	result, failures := verifyContents(block.VerifyContentsOptions{})
+	if len(failures) != 0 || result.Failed != 0 {
+		t.Fatalf("unexpected failures: %v", failures)
+	}
+
+	blockCount := result.Verified
+	if blockCount < len(oids) {
+		t.Fatalf("unexpected number of verified blocks: %v, wanted at least %v", blockCount, len(oids))
+	}
+
+	// corrupt a single block in the middle of its pack.
+	corruptedID, _ := oids[3].BlockID()
+	bi, err := r.Blocks.BlockInfo(ctx, corruptedID)
+	if err != nil {
+		t.Fatalf("unable to get block info: %v", err)
+	}
+	data[bi.PackFile][bi.PackOffset+10] ^= 1
+
+	result, failures = verifyContents(block.VerifyContentsOptions{})
+	if len(failures) != 1 || failures[0].Info.BlockID != corruptedID || failures[0].Problem != block.ContentsHashMismatch {
+		t.Fatalf("unexpected failures: %v, wanted hash mismatch of %v", failures, corruptedID)
+	}
+
+	if result.Verified != blockCount || result.Failed != 1 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	if result, _ = verifyContents(block.VerifyContentsOptions{SamplePercent: 1}); result.Verified >= blockCount {
+		t.Errorf("unexpected number of sampled blocks: %v of %v", result.Verified, blockCount)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := r.VerifyContents(canceled, block.VerifyContentsOptions{}); errors.Cause(err) != context.Canceled {
+		t.Errorf("unexpected error: %v, wanted %v", err, context.Canceled)
+	}
+}
+
+func TestRequiredIndexBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	data := map[string][]byte{}
+	st := storagetesting.NewMapStorage(data, nil, nil)
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{
+		ObjectFormat: object.Format{Splitter: "FIXED", MaxBlockSize: 400},
+	}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	// write each object in its own index block.
+	var oids []object.ID
+	var contents [][]byte
+	for i := 0; i < 3; i++ {
+		b := make([]byte, 2000)
+		cryptorand.Read(b) //nolint:errcheck
+		oids = append(oids, writeObject(ctx, t, r, b, fmt.Sprintf("object-%v", i)))
+		contents = append(contents, b)
+
+		if err := r.Flush(ctx); err != nil {
+			t.Fatalf("flush error: %v", err)
+		}
+	}
+
+	if _, ok := oids[1].IndexObjectID(); !ok {
+		t.Fatalf("expected an indirect object, got %v", oids[1])
+	}
+
+	required, err := r.Objects.RequiredIndexBlocks(ctx, oids[1])
+	if err != nil {
+		t.Fatalf("unable to get required index blocks: %v", err)
+	}
+
+	if len(required) != 1 {
+		t.Fatalf("unexpected required index blocks: %v", required)
+	}
+
+	// copy the repository without the index blocks that are not required.
+	subset := map[string][]byte{}
+	for id, b := range data {
+		if !strings.HasPrefix(id, "n") || id == required[0] {
+			subset[id] = b
+		}
+	}
+
+	st2 := storagetesting.NewMapStorage(subset, nil, nil)
+	r2, err := repo.OpenWithConfig(ctx, st2, &repo.LocalConfig{Storage: st2.ConnectionInfo()}, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open subset: %v", err)
+	}
+
+	verify(ctx, t, r2, oids[1], contents[1], "subset")
+	if _, err := r2.Objects.Open(ctx, oids[0]); err == nil {
+		t.Errorf("unexpected success opening object that's not part of the subset")
+	}
+}
+
+func TestDefaultCompressionPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	data := map[string][]byte{}
+	st := storagetesting.NewMapStorage(data, nil, nil)
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{
+		ObjectFormat: object.Format{
+			Splitter:           "FIXED",
+			MaxBlockSize:       400,
+			Compression:        "GZIP",
+			CompressionLevel:   9,
+			MinCompressionSize: 100,
+		},
+	}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	compressible := bytes.Repeat([]byte("compressible "), 100)
+
+	cases := []struct {
+		desc           string
+		data           []byte
+		opt            object.WriterOptions
+		wantCompressed bool
+	}{
+		{"default", compressible, object.WriterOptions{}, true},
+		{"below-threshold", compressible[0:50], object.WriterOptions{}, false},
+		{"overridden", compressible, object.WriterOptions{Compression: object.NoCompression}, false},
+	}
+
+	for _, tc := range cases {
+		w := r.Objects.NewWriter(ctx, tc.opt)
+		if _, err := w.Write(tc.data); err != nil {
+			t.Fatalf("%v: write failed: %v", tc.desc, err)
+		}
+
+		oid, err := w.Result()
+		if err != nil {
+			t.Fatalf("%v: result failed: %v", tc.desc, err)
+		}
+
+		chunks, err := r.Objects.Chunks(ctx, oid)
+		if err != nil {
+			t.Fatalf("%v: unable to get chunks: %v", tc.desc, err)
+		}
+
+		for _, c := range chunks {
+			if _, ok := c.Object.Compressed(); ok != tc.wantCompressed {
+				t.Errorf("%v: unexpected compression of chunk %v: %v, wanted %v", tc.desc, c.Object, ok, tc.wantCompressed)
+			}
+		}
+
+		verify(ctx, t, r, oid, tc.data, tc.desc)
+	}
+}
+
+func TestVerifyObjectWithBlockCompression(t *testing.T) {
+	ctx := context.Background()
+
+	st := storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{
+		BlockFormat: block.FormattingOptions{
+			Compression: "ZSTD",
+		},
+		ObjectFormat: object.Format{
+			Splitter:     "FIXED",
+			MaxBlockSize: 1000,
+		},
+	}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	w := r.Objects.NewWriter(ctx, object.WriterOptions{})
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	oid, err := w.Result()
+	if err != nil {
+		t.Fatalf("unable to get result: %v", err)
+	}
+
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	l, _, err := r.Objects.VerifyObject(ctx, oid)
+	if err != nil {
+		t.Fatalf("verification failed: %v", err)
+	}
+
+	if l != int64(len(data)) {
+		t.Errorf("unexpected length: %v, want %v", l, len(data))
+	}
+}
+
+func TestRollbackTo(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		version := version
+		t.Run(fmt.Sprintf("version-%v", version), func(t *testing.T) {
+			verifyRollbackTo(t, version)
+		})
+	}
+}
+
+func verifyRollbackTo(t *testing.T, version int) {
+	ctx := context.Background()
+
+	st := storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)
+	if err := repo.Initialize(ctx, st, &repo.NewRepositoryOptions{
+		BlockFormat:  block.FormattingOptions{Version: version},
+		ObjectFormat: object.Format{Splitter: "FIXED", MaxBlockSize: 400},
+	}, "password"); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+
+	lc := &repo.LocalConfig{Storage: st.ConnectionInfo()}
+	r, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	before := make([]byte, 2000)
+	cryptorand.Read(before) //nolint:errcheck
+	beforeID := writeObject(ctx, t, r, before, "before")
+	beforeManifest, err := r.Manifests.Put(ctx, map[string]string{"type": "test"}, map[string]string{"v": "before"})
+	if err != nil {
+		t.Fatalf("unable to put manifest: %v", err)
+	}
+
+	token, err := r.CommitToken(ctx)
+	if err != nil {
+		t.Fatalf("unable to get commit token: %v", err)
+	}
+
+	after := make([]byte, 2000)
+	cryptorand.Read(after) //nolint:errcheck
+	afterID := writeObject(ctx, t, r, after, "after")
+	afterManifest, err := r.Manifests.Put(ctx, map[string]string{"type": "test"}, map[string]string{"v": "after"})
+	if err != nil {
+		t.Fatalf("unable to put manifest: %v", err)
+	}
+
+	if err := r.Manifests.Delete(ctx, beforeManifest); err != nil {
+		t.Fatalf("unable to delete manifest: %v", err)
+	}
+
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	if err := r.RollbackTo(ctx, token); err != nil {
+		t.Fatalf("unable to roll back: %v", err)
+	}
+
+	verifyRolledBack := func(r *repo.Repository, desc string) {
+		verify(ctx, t, r, beforeID, before, desc)
+		if _, err := r.Objects.Open(ctx, afterID); err == nil {
+			t.Errorf("%v: unexpected success opening object written after the commit token", desc)
+		}
+
+		var payload map[string]string
+		if err := r.Manifests.Get(ctx, beforeManifest, &payload); err != nil || payload["v"] != "before" {
+			t.Errorf("%v: unable to get manifest deleted after the commit token: %v %v", desc, payload, err)
+		}
+
+		if err := r.Manifests.Get(ctx, afterManifest, &payload); err == nil {
+			t.Errorf("%v: unexpected success getting manifest written after the commit token", desc)
+		}
+	}
+
+	verifyRolledBack(r, "after rollback")
+
+	r2, err := repo.OpenWithConfig(ctx, st, lc, "password", &repo.Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to reopen: %v", err)
+	}
+	verifyRolledBack(r2, "reopened")
+
+	// the packs of objects written after the token are no longer referenced.
+	unreferenced, err := r2.Blocks.FindUnreferencedStorageFiles(ctx)
+	if err != nil || len(unreferenced) == 0 {
+		t.Errorf("unexpected unreferenced storage files after rollback: %v %v", unreferenced, err)
+	}
+
+	// tokens whose index blocks have been compacted can't be restored.
+	writeObject(ctx, t, r2, after, "after rollback")
+	if err := r2.Flush(ctx); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	if err := r2.Blocks.CompactIndexes(ctx, block.CompactOptions{AllBlocks: true}); err != nil {
+		t.Fatalf("unable to compact indexes: %v", err)
+	}
+
+	if err := r2.RollbackTo(ctx, token); errors.Cause(err) != block.ErrCommitTokenExpired {
+		t.Errorf("unexpected error rolling back to compacted token: %v, wanted %v", err, block.ErrCommitTokenExpired)
+	}
+}
+
+func TestSplitterBlockSizes(t *testing.T) {
+	var env repotesting.Environment
+	defer env.Setup(t, func(n *repo.NewRepositoryOptions) {
+		n.ObjectFormat.Splitter = "RABIN"
+		n.ObjectFormat.MinBlockSize = 1000
+		n.ObjectFormat.AvgBlockSize = 4000
+		n.ObjectFormat.MaxBlockSize = 16000
+	}).Close(t)
+
+	env.MustReopen(t)
+
+	f := env.Repository.Objects.Format
+	if f.Splitter != "RABIN" || f.MinBlockSize != 1000 || f.AvgBlockSize != 4000 || f.MaxBlockSize != 16000 {
+		t.Errorf("unexpected object format after reopen: %+v", f)
+	}
+
+	cases := []struct {
+		format object.Format
+		valid  bool
+	}{
+		{object.Format{}, true},
+		{object.Format{MaxBlockSize: 10000}, true},
+		{object.Format{Splitter: "FIXED", MinBlockSize: 5000, AvgBlockSize: 3000, MaxBlockSize: 1000}, true},
+		{object.Format{Splitter: "DYNAMIC", MinBlockSize: 1000, AvgBlockSize: 1000, MaxBlockSize: 1000}, true},
+		{object.Format{Splitter: "DYNAMIC", MinBlockSize: 2000, AvgBlockSize: 1000, MaxBlockSize: 3000}, false},
+		{object.Format{Splitter: "BUZHASH", AvgBlockSize: 4000, MaxBlockSize: 3000}, false},
+		{object.Format{Splitter: "RABIN", MinBlockSize: -1, AvgBlockSize: 2000, MaxBlockSize: 3000}, false},
+	}
+
+	for _, tc := range cases {
+		st := storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)
+		err := repo.Initialize(context.Background(), st, &repo.NewRepositoryOptions{ObjectFormat: tc.format}, "password")
+		if got := err == nil; got != tc.valid {
+			t.Errorf("unexpected result of initializing with %+v: %v", tc.format, err)
+		}
 	}
 }
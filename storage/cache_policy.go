@@ -0,0 +1,31 @@
+package storage
+
+import "context"
+
+var cachePolicyContextKey contextKey = "cache-policy"
+
+// CachePolicy determines how caches treat blocks read using a context, which allows reads that won't be
+// repeated, such as verification scans, to avoid evicting frequently used cache entries.
+type CachePolicy string
+
+// Supported cache policies.
+const (
+	CachePolicyPopulate CachePolicy = "populate"  // read from caches and add blocks fetched on cache misses (default)
+	CachePolicyReadOnly CachePolicy = "read-only" // read from caches without affecting their contents or eviction order
+	CachePolicyBypass   CachePolicy = "bypass"    // always read from the underlying storage
+)
+
+// WithCachePolicy returns a derived context that causes caches to apply the provided policy to reads
+// made using it.
+func WithCachePolicy(ctx context.Context, policy CachePolicy) context.Context {
+	return context.WithValue(ctx, cachePolicyContextKey, policy)
+}
+
+// GetCachePolicy returns the cache policy of the provided context, CachePolicyPopulate by default.
+func GetCachePolicy(ctx context.Context) CachePolicy {
+	if p, ok := ctx.Value(cachePolicyContextKey).(CachePolicy); ok {
+		return p
+	}
+
+	return CachePolicyPopulate
+}
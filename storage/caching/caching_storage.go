@@ -0,0 +1,334 @@
+// Package caching implements a wrapper around Storage that caches the results of GetBlock() on local disk.
+package caching
+
+import (
+	"container/list"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kopia/repo/internal/repologging"
+	"github.com/kopia/repo/storage"
+	"github.com/kopia/repo/storage/filesystem"
+	"github.com/pkg/errors"
+)
+
+var log = repologging.Logger("repo/caching")
+
+// touchThreshold is the minimum age of the modification time of a cached range before it's updated on access,
+// which preserves the order of recently used ranges across instances without writing on every access.
+const touchThreshold = 10 * time.Minute
+
+// cacheEntry describes a cached range of a block.
+type cacheEntry struct {
+	key     string
+	blockID string
+	length  int64
+}
+
+// fetch is an upstream GetBlock() in progress, shared by concurrent readers of the same range.
+type fetch struct {
+	blockID string
+	stale   bool // set when the block is invalidated while fetching, so that the result is not cached
+	done    chan struct{}
+	data    []byte
+	err     error
+}
+
+type cachingStorage struct {
+	base         storage.Storage
+	cache        storage.Storage
+	maxSizeBytes int64
+
+	mu          sync.Mutex
+	lru         *list.List                 // of *cacheEntry, least recently used first
+	entries     map[string]*list.Element   // by cache key
+	blockRanges map[string]map[string]bool // cache keys by block ID
+	fetches     map[string]*fetch          // by cache key
+	totalSize   int64
+}
+
+func cacheKey(blockID string, offset, length int64) string {
+	return fmt.Sprintf("%x.%v.%v", blockID, offset, length)
+}
+
+func (s *cachingStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	key := cacheKey(id, offset, length)
+
+	switch storage.GetCachePolicy(ctx) {
+	case storage.CachePolicyBypass:
+		return s.base.GetBlock(ctx, id, offset, length)
+
+	case storage.CachePolicyReadOnly:
+		if b, ok := s.readCached(ctx, key, false); ok {
+			return b, nil
+		}
+
+		return s.base.GetBlock(ctx, id, offset, length)
+	}
+
+	if b, ok := s.readCached(ctx, key, true); ok {
+		return b, nil
+	}
+
+	s.mu.Lock()
+	if f := s.fetches[key]; f != nil {
+		s.mu.Unlock()
+
+		select {
+		case <-f.done:
+			return cloneBytes(f.data), f.err
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	f := &fetch{blockID: id, done: make(chan struct{})}
+	s.fetches[key] = f
+	s.mu.Unlock()
+
+	f.data, f.err = s.base.GetBlock(ctx, id, offset, length)
+	if f.err == nil {
+		s.store(ctx, key, f)
+	}
+
+	s.mu.Lock()
+	if s.fetches[key] == f {
+		delete(s.fetches, key)
+	}
+	s.mu.Unlock()
+	close(f.done)
+
+	return cloneBytes(f.data), f.err
+}
+
+func (s *cachingStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	// blocks are fetched one by one, so that cached blocks are not fetched from the underlying storage.
+	return storage.GetBlocksInParallel(ctx, s, reqs, storage.DefaultGetBlocksParallelism)
+}
+
+// readCached returns the cached copy of the provided range and, if requested, marks it as most recently used.
+func (s *cachingStorage) readCached(ctx context.Context, key string, markUsed bool) ([]byte, bool) {
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if ok && markUsed {
+		s.lru.MoveToBack(e)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	b, err := s.cache.GetBlock(ctx, key, 0, -1)
+	if err != nil {
+		if err != storage.ErrBlockNotFound {
+			log.Warningf("unable to read cache item %v: %v", key, err)
+		}
+		return nil, false
+	}
+
+	if markUsed {
+		s.cache.TouchBlock(ctx, key, touchThreshold) //nolint:errcheck
+	}
+
+	return b, true
+}
+
+// store persists the result of the provided fetch unless the block has been invalidated since the fetch started,
+// then evicts the least recently used ranges until the cache fits within the limit.
+func (s *cachingStorage) store(ctx context.Context, key string, f *fetch) {
+	if int64(len(f.data)) > s.maxSizeBytes {
+		return
+	}
+
+	if err := s.cache.PutBlock(ctx, key, f.data); err != nil {
+		log.Warningf("unable to write cache item %v: %v", key, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f.stale {
+		s.deleteCacheItem(ctx, key)
+		return
+	}
+
+	s.addEntryLocked(&cacheEntry{key: key, blockID: f.blockID, length: int64(len(f.data))})
+	s.evictLocked(ctx)
+}
+
+// evictLocked removes the least recently used ranges until the cache fits within the limit.
+func (s *cachingStorage) evictLocked(ctx context.Context) {
+	for s.totalSize > s.maxSizeBytes {
+		oldest := s.lru.Front().Value.(*cacheEntry)
+		s.removeEntryLocked(oldest)
+		s.deleteCacheItem(ctx, oldest.key)
+	}
+}
+
+func (s *cachingStorage) addEntryLocked(e *cacheEntry) {
+	if old, ok := s.entries[e.key]; ok {
+		s.removeEntryLocked(old.Value.(*cacheEntry))
+	}
+
+	s.entries[e.key] = s.lru.PushBack(e)
+	s.totalSize += e.length
+
+	if s.blockRanges[e.blockID] == nil {
+		s.blockRanges[e.blockID] = map[string]bool{}
+	}
+	s.blockRanges[e.blockID][e.key] = true
+}
+
+func (s *cachingStorage) removeEntryLocked(e *cacheEntry) {
+	s.lru.Remove(s.entries[e.key])
+	delete(s.entries, e.key)
+	s.totalSize -= e.length
+
+	delete(s.blockRanges[e.blockID], e.key)
+	if len(s.blockRanges[e.blockID]) == 0 {
+		delete(s.blockRanges, e.blockID)
+	}
+}
+
+func (s *cachingStorage) deleteCacheItem(ctx context.Context, key string) {
+	if err := s.cache.DeleteBlock(ctx, key); err != nil {
+		log.Warningf("unable to delete cache item %v: %v", key, err)
+	}
+}
+
+// invalidate removes all cached ranges of the provided block and prevents fetches in progress from caching their results.
+func (s *cachingStorage) invalidate(ctx context.Context, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, f := range s.fetches {
+		if f.blockID == id {
+			f.stale = true
+			delete(s.fetches, key)
+		}
+	}
+
+	for key := range s.blockRanges[id] {
+		s.removeEntryLocked(s.entries[key].Value.(*cacheEntry))
+		s.deleteCacheItem(ctx, key)
+	}
+}
+
+func (s *cachingStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	defer s.invalidate(ctx, id)
+	return s.base.PutBlock(ctx, id, data)
+}
+
+func (s *cachingStorage) DeleteBlock(ctx context.Context, id string) error {
+	defer s.invalidate(ctx, id)
+	return s.base.DeleteBlock(ctx, id)
+}
+
+func (s *cachingStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	return s.base.GetBlockSize(ctx, id)
+}
+
+func (s *cachingStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	return s.base.TouchBlock(ctx, id, threshold)
+}
+
+func (s *cachingStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	return s.base.ListBlocks(ctx, prefix, callback)
+}
+
+func (s *cachingStorage) Close(ctx context.Context) error {
+	if err := s.cache.Close(ctx); err != nil {
+		log.Warningf("unable to close cache: %v", err)
+	}
+
+	return s.base.Close(ctx)
+}
+
+func (s *cachingStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// loadEntries populates the LRU list with the cached ranges left by previous instances, older ones first.
+func (s *cachingStorage) loadEntries(ctx context.Context) error {
+	items, err := storage.ListAllBlocks(ctx, s.cache, "")
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Timestamp.Before(items[j].Timestamp)
+	})
+
+	for _, it := range items {
+		id, ok := parseCacheKey(it.BlockID)
+		if !ok {
+			continue
+		}
+
+		s.addEntryLocked(&cacheEntry{key: it.BlockID, blockID: id, length: it.Length})
+	}
+
+	s.evictLocked(ctx)
+	return nil
+}
+
+// parseCacheKey returns the ID of the block whose range is cached under the provided key.
+func parseCacheKey(key string) (string, bool) {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	id, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+
+	return string(id), true
+}
+
+func cloneBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+// NewWrapper returns a Storage wrapper that caches the results of GetBlock() in the provided local directory,
+// evicting the least recently used ranges when the total size of the cache exceeds maxSizeBytes.
+// Ranges cached in the directory by previous instances are reused.
+func NewWrapper(ctx context.Context, wrapped storage.Storage, cacheDir string, maxSizeBytes int64) (storage.Storage, error) {
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create cache directory")
+	}
+
+	cache, err := filesystem.New(ctx, &filesystem.Options{
+		Path:            cacheDir,
+		DirectoryShards: []int{2},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open cache directory")
+	}
+
+	s := &cachingStorage{
+		base:         wrapped,
+		cache:        cache,
+		maxSizeBytes: maxSizeBytes,
+		lru:          list.New(),
+		entries:      map[string]*list.Element{},
+		blockRanges:  map[string]map[string]bool{},
+		fetches:      map[string]*fetch{},
+	}
+
+	if err := s.loadEntries(ctx); err != nil {
+		return nil, errors.Wrap(err, "unable to list cache directory")
+	}
+
+	return s, nil
+}
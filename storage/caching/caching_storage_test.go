@@ -0,0 +1,228 @@
+package caching
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+)
+
+// countingStorage counts GetBlock() calls reaching the underlying storage, which are delayed to expose concurrent fetches.
+type countingStorage struct {
+	storage.Storage
+	reads int32
+}
+
+func (s *countingStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	atomic.AddInt32(&s.reads, 1)
+	time.Sleep(10 * time.Millisecond)
+	return s.Storage.GetBlock(ctx, id, offset, length)
+}
+
+func (s *countingStorage) takeReads() int32 {
+	return atomic.SwapInt32(&s.reads, 0)
+}
+
+// assertGetFullBlock verifies the contents of the entire block, unlike storagetesting.AssertGetBlock()
+// it reads a single range, so that reads of the underlying storage can be counted.
+func assertGetFullBlock(ctx context.Context, t *testing.T, st storage.Storage, id string, want []byte) {
+	t.Helper()
+
+	b, err := st.GetBlock(ctx, id, 0, -1)
+	if err != nil || !bytes.Equal(b, want) {
+		t.Errorf("GetBlock(%v) returned %x, %v, wanted %x", id, b, err, want)
+	}
+}
+
+func newTestWrapper(t *testing.T, dir string, maxSizeBytes int64) (*countingStorage, storage.Storage) {
+	t.Helper()
+
+	data := map[string][]byte{}
+	base := &countingStorage{Storage: storagetesting.NewMapStorage(data, nil, nil)}
+	st, err := NewWrapper(context.Background(), base, dir, maxSizeBytes)
+	if err != nil {
+		t.Fatalf("unable to create caching storage: %v", err)
+	}
+
+	return base, st
+}
+
+func TestCachingStorage(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "caching")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	_, st := newTestWrapper(t, dir, 1000000)
+	storagetesting.VerifyStorage(ctx, t, st)
+}
+
+func TestCachingStorageHitsAndInvalidation(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "caching")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	base, st := newTestWrapper(t, dir, 1000000)
+
+	if err := st.PutBlock(ctx, "block1", []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+
+	assertGetFullBlock(ctx, t, st, "block1", []byte{1, 2, 3, 4})
+	base.takeReads()
+
+	// cached ranges are served without reading the underlying storage.
+	assertGetFullBlock(ctx, t, st, "block1", []byte{1, 2, 3, 4})
+	if got := base.takeReads(); got != 0 {
+		t.Errorf("unexpected reads of cached ranges: %v", got)
+	}
+
+	// deleting and writing the block again invalidates the cached ranges.
+	if err := st.DeleteBlock(ctx, "block1"); err != nil {
+		t.Fatalf("unable to delete block: %v", err)
+	}
+	storagetesting.AssertGetBlockNotFound(ctx, t, st, "block1")
+
+	if err := st.PutBlock(ctx, "block1", []byte{5, 6}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+	assertGetFullBlock(ctx, t, st, "block1", []byte{5, 6})
+
+	// concurrent reads of the same range are served by a single fetch.
+	if err := st.PutBlock(ctx, "block2", []byte{7, 8, 9}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+	base.takeReads()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			b, err := st.GetBlock(ctx, "block2", 1, 2)
+			if err != nil || len(b) != 2 || b[0] != 8 || b[1] != 9 {
+				t.Errorf("unexpected result: %v %v", b, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := base.takeReads(); got != 1 {
+		t.Errorf("unexpected number of reads of the underlying storage: %v, want 1", got)
+	}
+}
+
+func TestCachingStorageCachePolicy(t *testing.T) {
+	ctx := context.Background()
+	bypass := storage.WithCachePolicy(ctx, storage.CachePolicyBypass)
+	readOnly := storage.WithCachePolicy(ctx, storage.CachePolicyReadOnly)
+
+	dir, err := ioutil.TempDir("", "caching")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	base, st := newTestWrapper(t, dir, 250)
+
+	for _, id := range []string{"block1", "block2", "block3"} {
+		if err := st.PutBlock(ctx, id, make([]byte, 100)); err != nil {
+			t.Fatalf("unable to put block: %v", err)
+		}
+	}
+
+	// bypass and read-only reads don't populate the cache.
+	assertGetFullBlock(bypass, t, st, "block1", make([]byte, 100))
+	assertGetFullBlock(readOnly, t, st, "block1", make([]byte, 100))
+	assertGetFullBlock(ctx, t, st, "block1", make([]byte, 100))
+	if got := base.takeReads(); got != 3 {
+		t.Errorf("unexpected number of reads of the underlying storage: %v, want 3", got)
+	}
+
+	// a normal read populates the cache, which read-only reads use.
+	assertGetFullBlock(ctx, t, st, "block1", make([]byte, 100))
+	assertGetFullBlock(readOnly, t, st, "block1", make([]byte, 100))
+	if got := base.takeReads(); got != 0 {
+		t.Errorf("unexpected reads of cached ranges: %v", got)
+	}
+
+	assertGetFullBlock(bypass, t, st, "block1", make([]byte, 100))
+	if got := base.takeReads(); got != 1 {
+		t.Errorf("bypass read was served from the cache")
+	}
+
+	// read-only reads don't change the eviction order, so block1 is evicted before block2.
+	assertGetFullBlock(ctx, t, st, "block2", make([]byte, 100))
+	assertGetFullBlock(readOnly, t, st, "block1", make([]byte, 100))
+	assertGetFullBlock(ctx, t, st, "block3", make([]byte, 100))
+	base.takeReads()
+
+	assertGetFullBlock(readOnly, t, st, "block2", make([]byte, 100))
+	assertGetFullBlock(readOnly, t, st, "block1", make([]byte, 100))
+	if got := base.takeReads(); got != 1 {
+		t.Errorf("unexpected number of reads after eviction: %v, want 1", got)
+	}
+}
+
+func TestCachingStorageEviction(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "caching")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	base, st := newTestWrapper(t, dir, 250)
+
+	for _, id := range []string{"block1", "block2", "block3"} {
+		if err := st.PutBlock(ctx, id, make([]byte, 100)); err != nil {
+			t.Fatalf("unable to put block: %v", err)
+		}
+	}
+
+	assertGetFullBlock(ctx, t, st, "block1", make([]byte, 100))
+	assertGetFullBlock(ctx, t, st, "block2", make([]byte, 100))
+	// make block1 the most recently used, so that block2 is evicted when block3 is cached.
+	assertGetFullBlock(ctx, t, st, "block1", make([]byte, 100))
+	assertGetFullBlock(ctx, t, st, "block3", make([]byte, 100))
+	base.takeReads()
+
+	assertGetFullBlock(ctx, t, st, "block1", make([]byte, 100))
+	assertGetFullBlock(ctx, t, st, "block3", make([]byte, 100))
+	if got := base.takeReads(); got != 0 {
+		t.Errorf("unexpected reads of cached ranges: %v", got)
+	}
+
+	assertGetFullBlock(ctx, t, st, "block2", make([]byte, 100))
+	if got := base.takeReads(); got != 1 {
+		t.Errorf("evicted range was not read from the underlying storage")
+	}
+
+	// ranges cached on disk are reused by new instances.
+	base2 := &countingStorage{Storage: base.Storage}
+	st2, err := NewWrapper(ctx, base2, dir, 250)
+	if err != nil {
+		t.Fatalf("unable to create caching storage: %v", err)
+	}
+
+	assertGetFullBlock(ctx, t, st2, "block2", make([]byte, 100))
+	if got := base2.takeReads(); got != 0 {
+		t.Errorf("unexpected reads of ranges cached by previous instance: %v", got)
+	}
+}
@@ -3,6 +3,8 @@ package storage
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 )
 
 // ConnectionInfo represents JSON-serializable configuration of a blob storage.
@@ -45,3 +47,89 @@ func (c ConnectionInfo) MarshalJSON() ([]byte, error) {
 		Data: c.Config,
 	})
 }
+
+// InlineSecrets returns JSON names of the non-empty configuration fields tagged with `kopia:"sensitive"`,
+// which would be stored in plain text if the ConnectionInfo was persisted. Tools can use it to warn users
+// before writing the configuration to disk and suggest a reference to the secret instead, if the storage supports it.
+func (c ConnectionInfo) InlineSecrets() []string {
+	v, ok := configStruct(c.Config)
+	if !ok {
+		return nil
+	}
+
+	var result []string
+	for _, i := range sensitiveFields(v) {
+		f := v.Type().Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+
+		result = append(result, name)
+	}
+
+	return result
+}
+
+// Redacted returns a copy of the ConnectionInfo with the non-empty configuration fields tagged with
+// `kopia:"sensitive"` masked, which is suitable for logging and displaying but can't be used to connect to storage.
+func (c ConnectionInfo) Redacted() ConnectionInfo {
+	v, ok := configStruct(c.Config)
+	fields := sensitiveFields(v)
+	if !ok || len(fields) == 0 {
+		return c
+	}
+
+	copied := reflect.New(v.Type())
+	copied.Elem().Set(v)
+	for _, i := range fields {
+		if f := copied.Elem().Field(i); f.Kind() == reflect.String {
+			f.SetString(redactedValue)
+		} else {
+			f.Set(reflect.Zero(f.Type()))
+		}
+	}
+
+	return ConnectionInfo{Type: c.Type, Config: copied.Interface()}
+}
+
+// String returns the JSON representation of the redacted ConnectionInfo.
+func (c ConnectionInfo) String() string {
+	b, err := json.Marshal(c.Redacted())
+	if err != nil {
+		return fmt.Sprintf("%v: <invalid config: %v>", c.Type, err)
+	}
+
+	return string(b)
+}
+
+const redactedValue = "***"
+
+// configStruct returns the struct holding the provided configuration, which is typically referenced by a pointer.
+func configStruct(config interface{}) (reflect.Value, bool) {
+	v := reflect.ValueOf(config)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+
+	return v, v.Kind() == reflect.Struct
+}
+
+// sensitiveFields returns indexes of the non-empty fields of the provided struct tagged with `kopia:"sensitive"`.
+func sensitiveFields(v reflect.Value) []int {
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var result []int
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("kopia") == "sensitive" && !v.Field(i).IsZero() {
+			result = append(result, i)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,82 @@
+// Package deletetolerant implements wrapper around Storage that ignores errors when deleting non-existent blocks.
+package deletetolerant
+
+import (
+	"context"
+	"time"
+
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+type deleteTolerantStorage struct {
+	base       storage.Storage
+	isNotFound func(err error) bool
+}
+
+func (s *deleteTolerantStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	return s.base.GetBlock(ctx, id, offset, length)
+}
+
+func (s *deleteTolerantStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	return s.base.GetBlocks(ctx, reqs)
+}
+
+func (s *deleteTolerantStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	return s.base.GetBlockSize(ctx, id)
+}
+
+func (s *deleteTolerantStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	return s.base.TouchBlock(ctx, id, threshold)
+}
+
+func (s *deleteTolerantStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	return s.base.PutBlock(ctx, id, data)
+}
+
+func (s *deleteTolerantStorage) DeleteBlock(ctx context.Context, id string) error {
+	err := s.base.DeleteBlock(ctx, id)
+	if err != nil && s.isNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *deleteTolerantStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	return s.base.ListBlocks(ctx, prefix, callback)
+}
+
+func (s *deleteTolerantStorage) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
+
+func (s *deleteTolerantStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// Option modifies the behavior of delete-tolerant storage wrapper.
+type Option func(s *deleteTolerantStorage)
+
+// NewWrapper returns a Storage wrapper that converts "not found" errors returned by DeleteBlock() to nil.
+// By default an error is treated as "not found" if its cause is storage.ErrBlockNotFound.
+func NewWrapper(wrapped storage.Storage, options ...Option) storage.Storage {
+	s := &deleteTolerantStorage{base: wrapped, isNotFound: isBlockNotFound}
+	for _, o := range options {
+		o(s)
+	}
+
+	return s
+}
+
+// NotFoundFunc is a delete-tolerant storage option that provides custom classification of backend-specific
+// "not found" errors.
+func NotFoundFunc(isNotFound func(err error) bool) Option {
+	return func(s *deleteTolerantStorage) {
+		s.isNotFound = isNotFound
+	}
+}
+
+func isBlockNotFound(err error) bool {
+	return errors.Cause(err) == storage.ErrBlockNotFound
+}
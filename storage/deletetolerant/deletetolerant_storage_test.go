@@ -0,0 +1,62 @@
+package deletetolerant
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+)
+
+var errCustomNotFound = errors.New("no such object")
+
+// strictDeleteStorage is a storage that fails when deleting a block that does not exist.
+type strictDeleteStorage struct {
+	storage.Storage
+	notFoundErr error
+}
+
+func (s strictDeleteStorage) DeleteBlock(ctx context.Context, id string) error {
+	if _, err := s.GetBlock(ctx, id, 0, -1); err == storage.ErrBlockNotFound {
+		return s.notFoundErr
+	}
+
+	return s.Storage.DeleteBlock(ctx, id)
+}
+
+func TestDeleteTolerantStorage(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	underlying := strictDeleteStorage{storagetesting.NewMapStorage(data, nil, nil), storage.ErrBlockNotFound}
+
+	if err := underlying.DeleteBlock(ctx, "no-such-block"); err != storage.ErrBlockNotFound {
+		t.Fatalf("unexpected error from underlying storage: %v", err)
+	}
+
+	st := NewWrapper(underlying)
+	storagetesting.VerifyStorage(ctx, t, st)
+
+	if err := st.DeleteBlock(ctx, "no-such-block"); err != nil {
+		t.Errorf("unexpected error when deleting non-existent block: %v", err)
+	}
+}
+
+func TestDeleteTolerantStorageCustomError(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	underlying := strictDeleteStorage{storagetesting.NewMapStorage(data, nil, nil), errCustomNotFound}
+
+	if err := NewWrapper(underlying).DeleteBlock(ctx, "no-such-block"); err != errCustomNotFound {
+		t.Errorf("unexpected error when deleting non-existent block without classifier: %v", err)
+	}
+
+	st := NewWrapper(underlying, NotFoundFunc(func(err error) bool {
+		return err == errCustomNotFound
+	}))
+	storagetesting.VerifyStorage(ctx, t, st)
+
+	if err := st.DeleteBlock(ctx, "no-such-block"); err != nil {
+		t.Errorf("unexpected error when deleting non-existent block: %v", err)
+	}
+}
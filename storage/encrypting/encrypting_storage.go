@@ -0,0 +1,155 @@
+// Package encrypting implements wrapper around Storage that encrypts the contents of blocks at rest.
+package encrypting
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidBlock is returned when the contents of a stored block can't be authenticated and decrypted.
+var ErrInvalidBlock = errors.New("unable to decrypt block")
+
+// headerVersion is the first byte of stored blocks, followed by the nonce.
+const headerVersion = 1
+
+type encryptingStorage struct {
+	base storage.Storage
+	aead cipher.AEAD
+}
+
+// overhead returns the number of bytes stored in addition to the contents of each block.
+func (s *encryptingStorage) overhead() int {
+	return 1 + s.aead.NonceSize() + s.aead.Overhead()
+}
+
+func (s *encryptingStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	// authenticated encryption can't verify partial ciphertext, so the entire block is always fetched.
+	stored, err := s.base.GetBlock(ctx, id, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.decrypt(id, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	if length < 0 {
+		return data, nil
+	}
+
+	if offset < 0 || offset > int64(len(data)) {
+		return nil, fmt.Errorf("invalid offset %v of block %q of length %v", offset, id, len(data))
+	}
+
+	data = data[offset:]
+	if length > int64(len(data)) {
+		return nil, fmt.Errorf("invalid length %v at offset %v of block %q", length, offset, id)
+	}
+
+	return data[0:length], nil
+}
+
+func (s *encryptingStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	return storage.GetBlocksInParallel(ctx, s, reqs, storage.DefaultGetBlocksParallelism)
+}
+
+func (s *encryptingStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	l, err := s.base.GetBlockSize(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if l < int64(s.overhead()) {
+		return 0, errors.Wrapf(ErrInvalidBlock, "invalid length of block %q: %v", id, l)
+	}
+
+	return l - int64(s.overhead()), nil
+}
+
+func (s *encryptingStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	return s.base.TouchBlock(ctx, id, threshold)
+}
+
+func (s *encryptingStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	nonceSize := s.aead.NonceSize()
+	header := make([]byte, 1+nonceSize, s.overhead()+len(data))
+	header[0] = headerVersion
+	if _, err := io.ReadFull(rand.Reader, header[1:]); err != nil {
+		return errors.Wrap(err, "unable to generate nonce")
+	}
+
+	// the block ID is authenticated, so that contents of blocks can't be swapped.
+	stored := s.aead.Seal(header, header[1:], data, []byte(id))
+	return s.base.PutBlock(ctx, id, stored)
+}
+
+func (s *encryptingStorage) decrypt(id string, stored []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(stored) < s.overhead() || stored[0] != headerVersion {
+		return nil, errors.Wrapf(ErrInvalidBlock, "invalid header of block %q", id)
+	}
+
+	data, err := s.aead.Open(nil, stored[1:1+nonceSize], stored[1+nonceSize:], []byte(id))
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidBlock, "block %q: %v", id, err)
+	}
+
+	return data, nil
+}
+
+func (s *encryptingStorage) DeleteBlock(ctx context.Context, id string) error {
+	return s.base.DeleteBlock(ctx, id)
+}
+
+func (s *encryptingStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	return s.base.ListBlocks(ctx, prefix, func(bm storage.BlockMetadata) error {
+		// report the length of the contents, which is what GetBlock() returns.
+		if bm.Length >= int64(s.overhead()) {
+			bm.Length -= int64(s.overhead())
+		}
+
+		return callback(bm)
+	})
+}
+
+func (s *encryptingStorage) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
+
+func (s *encryptingStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// NewWrapper returns a Storage wrapper that encrypts the contents of each block with AES-256-GCM using the provided
+// 32-byte key and a random nonce stored in a small header preceding the ciphertext. It is intended for backends
+// without native at-rest encryption (filesystem, sftp, webdav) and is independent of the encryption of the repository.
+//
+// Since the authenticity of partial ciphertext can't be verified, ranged reads fetch and decrypt the entire block
+// and return the requested range of it. The key is not part of ConnectionInfo() and must be provided again
+// when reconnecting.
+func NewWrapper(wrapped storage.Storage, key []byte) (storage.Storage, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key length %v, expected 32 bytes", len(key))
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create cipher")
+	}
+
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create AEAD")
+	}
+
+	return &encryptingStorage{base: wrapped, aead: aead}, nil
+}
@@ -0,0 +1,79 @@
+package encrypting
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+func TestEncryptingStorage(t *testing.T) {
+	ctx := context.Background()
+	key := bytes.Repeat([]byte{7}, 32)
+
+	data := map[string][]byte{}
+	st, err := NewWrapper(storagetesting.NewMapStorage(data, nil, nil), key)
+	if err != nil {
+		t.Fatalf("unable to create wrapper: %v", err)
+	}
+
+	storagetesting.VerifyStorage(ctx, t, st)
+
+	contents := bytes.Repeat([]byte("plaintext "), 100)
+	if err := st.PutBlock(ctx, "block1", contents); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	raw := data["block1"]
+	if bytes.Contains(raw, []byte("plaintext")) {
+		t.Errorf("stored block contains plaintext")
+	}
+
+	if len(raw) <= len(contents) {
+		t.Errorf("unexpected length of stored block: %v, contents have %v bytes", len(raw), len(contents))
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, st, "block1", contents)
+
+	blocks, err := storage.ListAllBlocks(ctx, st, "block1")
+	if err != nil || len(blocks) != 1 || blocks[0].Length != int64(len(contents)) {
+		t.Errorf("unexpected list result: %v %v, wanted length %v", blocks, err, len(contents))
+	}
+
+	// the same contents are stored differently each time.
+	if err := st.PutBlock(ctx, "block2", contents); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	if bytes.Equal(data["block1"], data["block2"]) {
+		t.Errorf("identical ciphertext of blocks with the same contents")
+	}
+
+	// contents of blocks can't be moved to another block ID.
+	data["block3"] = data["block1"]
+	if _, err := st.GetBlock(ctx, "block3", 0, -1); errors.Cause(err) != ErrInvalidBlock {
+		t.Errorf("unexpected error reading moved block: %v, wanted %v", err, ErrInvalidBlock)
+	}
+
+	data["block1"][len(raw)/2] ^= 1
+	if _, err := st.GetBlock(ctx, "block1", 0, -1); errors.Cause(err) != ErrInvalidBlock {
+		t.Errorf("unexpected error reading corrupted block: %v, wanted %v", err, ErrInvalidBlock)
+	}
+
+	// blocks can't be read with a different key.
+	st2, err := NewWrapper(storagetesting.NewMapStorage(data, nil, nil), bytes.Repeat([]byte{8}, 32))
+	if err != nil {
+		t.Fatalf("unable to create wrapper: %v", err)
+	}
+
+	if _, err := st2.GetBlock(ctx, "block2", 0, -1); errors.Cause(err) != ErrInvalidBlock {
+		t.Errorf("unexpected error reading block with a different key: %v, wanted %v", err, ErrInvalidBlock)
+	}
+
+	if _, err := NewWrapper(st, []byte{1, 2, 3}); err == nil {
+		t.Errorf("unexpected success creating wrapper with invalid key")
+	}
+}
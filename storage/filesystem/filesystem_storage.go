@@ -21,6 +21,8 @@ var log = repologging.Logger("repo/filesystem")
 const (
 	fsStorageType        = "filesystem"
 	fsStorageChunkSuffix = ".f"
+
+	maxCreateDirectoryAttempts = 3
 )
 
 var (
@@ -50,19 +52,37 @@ func (fs *fsStorage) GetBlock(ctx context.Context, blockID string, offset, lengt
 		return ioutil.ReadAll(f)
 	}
 
-	if _, err = f.Seek(offset, io.SeekStart); err != nil {
-		return nil, err
+	b := make([]byte, length)
+	n, err := f.ReadAt(b, offset)
+	if err == io.EOF && int64(n) < length {
+		return nil, fmt.Errorf("invalid length")
 	}
-	b, err := ioutil.ReadAll(io.LimitReader(f, length))
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
-	if int64(len(b)) != length {
-		return nil, fmt.Errorf("invalid length")
-	}
 	return b, nil
 }
 
+func (fs *fsStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	// local reads don't benefit from parallelism.
+	return storage.GetBlocksInParallel(ctx, fs, reqs, 1)
+}
+
+func (fs *fsStorage) GetBlockSize(ctx context.Context, blockID string) (int64, error) {
+	_, path := fs.getShardedPathAndFilePath(blockID)
+
+	st, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, storage.ErrBlockNotFound
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return st.Size(), nil
+}
+
 func getstringFromFileName(name string) (string, bool) {
 	if strings.HasSuffix(name, fsStorageChunkSuffix) {
 		return name[0 : len(name)-len(fsStorageChunkSuffix)], true
@@ -80,11 +100,19 @@ func (fs *fsStorage) ListBlocks(ctx context.Context, prefix string, callback fun
 
 	walkDir = func(directory string, currentPrefix string) error {
 		entries, err := ioutil.ReadDir(directory)
+		if os.IsNotExist(err) && directory != fs.Path {
+			// the shard directory has been removed by a concurrent DeleteBlock() after it was listed.
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 
 		for _, e := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			if e.IsDir() {
 				newPrefix := currentPrefix + e.Name()
 				var match bool
@@ -116,7 +144,11 @@ func (fs *fsStorage) ListBlocks(ctx context.Context, prefix string, callback fun
 		return nil
 	}
 
-	return walkDir(fs.Path, "")
+	if err := walkDir(fs.Path, ""); err != storage.ErrStopIteration {
+		return err
+	}
+
+	return nil
 }
 
 // TouchBlock updates file modification time to current time if it's sufficiently old.
@@ -124,6 +156,9 @@ func (fs *fsStorage) TouchBlock(ctx context.Context, blockID string, threshold t
 	_, path := fs.getShardedPathAndFilePath(blockID)
 	st, err := os.Stat(path)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return storage.ErrBlockNotFound
+		}
 		return err
 	}
 
@@ -173,26 +208,48 @@ func (fs *fsStorage) PutBlock(ctx context.Context, blockID string, data []byte)
 func (fs *fsStorage) createTempFileAndDir(tempFile string) (*os.File, error) {
 	flags := os.O_CREATE | os.O_WRONLY | os.O_EXCL
 	f, err := os.OpenFile(tempFile, flags, fs.fileMode())
-	if os.IsNotExist(err) {
+
+	// the shard directory may be removed by a concurrent DeleteBlock() right after it's created, so retry a few times.
+	for attempt := 0; attempt < maxCreateDirectoryAttempts && os.IsNotExist(err); attempt++ {
 		if err = os.MkdirAll(filepath.Dir(tempFile), fs.dirMode()); err != nil {
 			return nil, fmt.Errorf("cannot create directory: %v", err)
 		}
-		return os.OpenFile(tempFile, flags, fs.fileMode())
+		f, err = os.OpenFile(tempFile, flags, fs.fileMode())
 	}
 
 	return f, err
 }
 
 func (fs *fsStorage) DeleteBlock(ctx context.Context, blockID string) error {
-	_, path := fs.getShardedPathAndFilePath(blockID)
+	shardPath, path := fs.getShardedPathAndFilePath(blockID)
 	err := os.Remove(path)
 	if err == nil || os.IsNotExist(err) {
+		if shardPath != fs.Path {
+			fs.removeEmptyShardDirectories(shardPath)
+		}
 		return nil
 	}
 
 	return err
 }
 
+// removeEmptyShardDirectories removes the provided shard directory and its parents up to the storage path,
+// stopping at the first one that is not empty.
+func (fs *fsStorage) removeEmptyShardDirectories(shardPath string) {
+	for _, size := range fs.shards() {
+		if size == 0 {
+			// empty shards don't create directories.
+			continue
+		}
+
+		if err := os.Remove(shardPath); err != nil {
+			return
+		}
+
+		shardPath = filepath.Dir(shardPath)
+	}
+}
+
 func (fs *fsStorage) getShardDirectory(blockID string) (string, string) {
 	shardPath := fs.Path
 	if len(blockID) < 20 {
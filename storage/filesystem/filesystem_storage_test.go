@@ -4,6 +4,7 @@ import (
 	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"testing"
@@ -89,6 +90,10 @@ func TestFileStorageTouch(t *testing.T) {
 
 	assertNoError(t, fs.TouchBlock(ctx, t1, 0)) // moves t1 to the top of the pile
 	verifyBlockTimestampOrder(t, fs, t3, t2, t1)
+
+	if err := fs.TouchBlock(ctx, "missing", 0); err != storage.ErrBlockNotFound {
+		t.Errorf("unexpected error touching missing block: %v", err)
+	}
 }
 
 func verifyBlockTimestampOrder(t *testing.T, st storage.Storage, want ...string) {
@@ -118,3 +123,93 @@ func assertNoError(t *testing.T, err error) {
 		t.Errorf("err: %v", err)
 	}
 }
+
+func TestFileStorageShardDirectories(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	path, _ := ioutil.TempDir("", "r-fs")
+	defer os.RemoveAll(path)
+
+	r, err := New(ctx, &Options{
+		Path:            path,
+		DirectoryShards: []int{2, 2},
+	})
+	if r == nil || err != nil {
+		t.Fatalf("unexpected result: %v %v", r, err)
+	}
+
+	b1 := "abcd1bc299db9f235e046a62625afb84902"
+	b2 := "abef4f29eddbcd4c18fa9e73fec20bbb71f"
+
+	assertNoError(t, r.PutBlock(ctx, b1, []byte{1, 2, 3, 4}))
+	assertNoError(t, r.PutBlock(ctx, b2, []byte{5}))
+
+	if _, err := os.Stat(filepath.Join(path, "ab", "cd", "1bc299db9f235e046a62625afb84902.f")); err != nil {
+		t.Errorf("block not stored in the shard directory: %v", err)
+	}
+
+	if got, err := r.GetBlock(ctx, b1, 1, 2); err != nil || !reflect.DeepEqual(got, []byte{2, 3}) {
+		t.Errorf("unexpected partial read: %v %v", got, err)
+	}
+
+	if _, err := r.GetBlock(ctx, b1, 3, 2); err == nil {
+		t.Errorf("unexpected success reading past the end of the block")
+	}
+
+	assertNoError(t, r.DeleteBlock(ctx, b1))
+	if _, err := os.Stat(filepath.Join(path, "ab", "cd")); !os.IsNotExist(err) {
+		t.Errorf("empty shard directory was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "ab", "ef")); err != nil {
+		t.Errorf("non-empty shard directory was removed: %v", err)
+	}
+
+	assertNoError(t, r.DeleteBlock(ctx, b2))
+	if _, err := os.Stat(filepath.Join(path, "ab")); !os.IsNotExist(err) {
+		t.Errorf("empty shard directory was not removed: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("storage directory was removed: %v", err)
+	}
+
+	// blocks can be written again after their shard directories have been removed.
+	assertNoError(t, r.PutBlock(ctx, b1, []byte{1}))
+	storagetesting.AssertGetBlock(ctx, t, r, b1, []byte{1})
+}
+
+func TestFileStorageListWithConcurrentDelete(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	path, _ := ioutil.TempDir("", "r-fs")
+	defer os.RemoveAll(path)
+
+	r, err := New(ctx, &Options{
+		Path:            path,
+		DirectoryShards: []int{2, 2},
+	})
+	if r == nil || err != nil {
+		t.Fatalf("unexpected result: %v %v", r, err)
+	}
+
+	b1 := "abcd1bc299db9f235e046a62625afb84902"
+	b2 := "abef4f29eddbcd4c18fa9e73fec20bbb71f"
+
+	assertNoError(t, r.PutBlock(ctx, b1, []byte{1}))
+	assertNoError(t, r.PutBlock(ctx, b2, []byte{2}))
+
+	// deleting b2 while listing b1 removes the shard directory of b2 before it's listed.
+	var listed []string
+	assertNoError(t, r.ListBlocks(ctx, "", func(bm storage.BlockMetadata) error {
+		listed = append(listed, bm.BlockID)
+		if bm.BlockID == b1 {
+			return r.DeleteBlock(ctx, b2)
+		}
+		return nil
+	}))
+
+	if want := []string{b1}; !reflect.DeepEqual(listed, want) {
+		t.Errorf("unexpected blocks listed: %v, want %v", listed, want)
+	}
+}
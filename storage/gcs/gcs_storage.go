@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"time"
 
 	"google.golang.org/api/googleapi"
 
@@ -66,6 +67,28 @@ func (gcs *gcsStorage) GetBlock(ctx context.Context, b string, offset, length in
 	return fetched, nil
 }
 
+func (gcs *gcsStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	return storage.GetBlocksInParallel(ctx, gcs, reqs, storage.DefaultGetBlocksParallelism)
+}
+
+func (gcs *gcsStorage) GetBlockSize(ctx context.Context, b string) (int64, error) {
+	attempt := func() (interface{}, error) {
+		return gcs.bucket.Object(gcs.getObjectNameString(b)).Attrs(gcs.ctx)
+	}
+
+	v, err := exponentialBackoff(fmt.Sprintf("GetBlockSize(%q)", b), attempt)
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return v.(*gcsclient.ObjectAttrs).Size, nil
+}
+
+// TouchBlock is not supported, GCS does not allow updating the timestamps of existing objects.
+func (gcs *gcsStorage) TouchBlock(ctx context.Context, b string, threshold time.Duration) error {
+	return nil
+}
+
 func exponentialBackoff(desc string, att retry.AttemptFunc) (interface{}, error) {
 	return retry.WithExponentialBackoff(desc, att, isRetriableError)
 }
@@ -158,11 +181,18 @@ func (gcs *gcsStorage) ListBlocks(ctx context.Context, prefix string, callback f
 
 	oa, err := lst.Next()
 	for err == nil {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
 		if err = callback(storage.BlockMetadata{
 			BlockID:   oa.Name[len(gcs.Prefix):],
 			Length:    oa.Size,
 			Timestamp: oa.Created,
 		}); err != nil {
+			if err == storage.ErrStopIteration {
+				return nil
+			}
 			return err
 		}
 		oa, err = lst.Next()
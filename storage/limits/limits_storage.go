@@ -0,0 +1,93 @@
+// Package limits implements wrapper around Storage that enforces maximum block size.
+package limits
+
+import (
+	"context"
+	"time"
+
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+// ErrBlockTooLarge is returned when the size of a block exceeds the configured limit.
+var ErrBlockTooLarge = errors.New("block too large")
+
+type limitsStorage struct {
+	base         storage.Storage
+	maxBlockSize int64
+	limitReads   bool
+}
+
+func (s *limitsStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	if s.limitReads && length > s.maxBlockSize {
+		return nil, errors.Wrapf(ErrBlockTooLarge, "GetBlock(%q) of %v bytes exceeds the limit of %v", id, length, s.maxBlockSize)
+	}
+
+	result, err := s.base.GetBlock(ctx, id, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.limitReads && int64(len(result)) > s.maxBlockSize {
+		return nil, errors.Wrapf(ErrBlockTooLarge, "GetBlock(%q) returned %v bytes which exceeds the limit of %v", id, len(result), s.maxBlockSize)
+	}
+
+	return result, nil
+}
+
+func (s *limitsStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	return storage.GetBlocksInParallel(ctx, s, reqs, storage.DefaultGetBlocksParallelism)
+}
+
+func (s *limitsStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	return s.base.GetBlockSize(ctx, id)
+}
+
+func (s *limitsStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	return s.base.TouchBlock(ctx, id, threshold)
+}
+
+func (s *limitsStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	if int64(len(data)) > s.maxBlockSize {
+		return errors.Wrapf(ErrBlockTooLarge, "PutBlock(%q) of %v bytes exceeds the limit of %v", id, len(data), s.maxBlockSize)
+	}
+
+	return s.base.PutBlock(ctx, id, data)
+}
+
+func (s *limitsStorage) DeleteBlock(ctx context.Context, id string) error {
+	return s.base.DeleteBlock(ctx, id)
+}
+
+func (s *limitsStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	return s.base.ListBlocks(ctx, prefix, callback)
+}
+
+func (s *limitsStorage) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
+
+func (s *limitsStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// Option modifies the behavior of limits storage wrapper.
+type Option func(s *limitsStorage)
+
+// NewWrapper returns a Storage wrapper that rejects PutBlock() calls with data larger than maxBlockSize.
+func NewWrapper(wrapped storage.Storage, maxBlockSize int64, options ...Option) storage.Storage {
+	s := &limitsStorage{base: wrapped, maxBlockSize: maxBlockSize}
+	for _, o := range options {
+		o(s)
+	}
+
+	return s
+}
+
+// LimitReads is a limits storage option that causes GetBlock() calls that would return more than the maximum
+// block size to be rejected as well.
+func LimitReads() Option {
+	return func(s *limitsStorage) {
+		s.limitReads = true
+	}
+}
@@ -0,0 +1,50 @@
+package limits
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/pkg/errors"
+)
+
+func TestLimitsStorage(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	underlying := storagetesting.NewMapStorage(data, nil, nil)
+	st := NewWrapper(underlying, 20000, LimitReads())
+
+	storagetesting.VerifyStorage(ctx, t, st)
+
+	if err := st.PutBlock(ctx, "too-large", bytes.Repeat([]byte{1}, 20001)); errors.Cause(err) != ErrBlockTooLarge {
+		t.Errorf("unexpected error when writing oversize block: %v", err)
+	}
+	storagetesting.AssertGetBlockNotFound(ctx, t, underlying, "too-large")
+
+	if err := st.PutBlock(ctx, "max-size", bytes.Repeat([]byte{1}, 20000)); err != nil {
+		t.Errorf("unexpected error when writing block: %v", err)
+	}
+	storagetesting.AssertGetBlock(ctx, t, st, "max-size", bytes.Repeat([]byte{1}, 20000))
+
+	// block that was written directly to the underlying storage can't be read in full
+	if err := underlying.PutBlock(ctx, "underlying-large", bytes.Repeat([]byte{1}, 30000)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := st.GetBlock(ctx, "underlying-large", 0, -1); errors.Cause(err) != ErrBlockTooLarge {
+		t.Errorf("unexpected error when reading oversize block: %v", err)
+	}
+
+	if _, err := st.GetBlock(ctx, "underlying-large", 0, 20001); errors.Cause(err) != ErrBlockTooLarge {
+		t.Errorf("unexpected error when reading oversize range: %v", err)
+	}
+
+	if _, err := st.GetBlock(ctx, "underlying-large", 100, 1000); err != nil {
+		t.Errorf("unexpected error when reading range: %v", err)
+	}
+
+	if got, want := st.ConnectionInfo().Type, underlying.ConnectionInfo().Type; got != want {
+		t.Errorf("unexpected connection info %v, want %v", got, want)
+	}
+}
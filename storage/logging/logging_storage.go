@@ -29,6 +29,30 @@ func (s *loggingStorage) GetBlock(ctx context.Context, id string, offset, length
 	return result, err
 }
 
+func (s *loggingStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	t0 := time.Now()
+	results, err := s.base.GetBlocks(ctx, reqs)
+	dt := time.Since(t0)
+	s.printf(s.prefix+"GetBlocks(len=%v)=(len=%v, %#v) took %v", len(reqs), len(results), err, dt)
+	return results, err
+}
+
+func (s *loggingStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	t0 := time.Now()
+	result, err := s.base.GetBlockSize(ctx, id)
+	dt := time.Since(t0)
+	s.printf(s.prefix+"GetBlockSize(%q)=(%v, %#v) took %v", id, result, err, dt)
+	return result, err
+}
+
+func (s *loggingStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	t0 := time.Now()
+	err := s.base.TouchBlock(ctx, id, threshold)
+	dt := time.Since(t0)
+	s.printf(s.prefix+"TouchBlock(%q,%v)=%#v took %v", id, threshold, err, dt)
+	return err
+}
+
 func (s *loggingStorage) PutBlock(ctx context.Context, id string, data []byte) error {
 	t0 := time.Now()
 	err := s.base.PutBlock(ctx, id, data)
@@ -48,11 +72,18 @@ func (s *loggingStorage) DeleteBlock(ctx context.Context, id string) error {
 func (s *loggingStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
 	t0 := time.Now()
 	cnt := 0
+	var stopped bool
 	err := s.base.ListBlocks(ctx, prefix, func(bi storage.BlockMetadata) error {
 		cnt++
-		return callback(bi)
+		err := callback(bi)
+		stopped = err == storage.ErrStopIteration
+		return err
 	})
-	s.printf(s.prefix+"ListBlocks(%q)=%v returned %v items and took %v", prefix, err, cnt, time.Since(t0))
+	if stopped {
+		s.printf(s.prefix+"ListBlocks(%q)=%v was stopped after %v items and took %v", prefix, err, cnt, time.Since(t0))
+	} else {
+		s.printf(s.prefix+"ListBlocks(%q)=%v returned %v items and took %v", prefix, err, cnt, time.Since(t0))
+	}
 	return err
 }
 
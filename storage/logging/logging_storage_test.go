@@ -2,6 +2,7 @@ package logging
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -37,3 +38,25 @@ func TestLoggingStorage(t *testing.T) {
 		t.Errorf("unexpected connection infor %v, want %v", got, want)
 	}
 }
+
+func TestLoggingStorageStoppedList(t *testing.T) {
+	var messages []string
+	myOutput := func(msg string, args ...interface{}) {
+		messages = append(messages, fmt.Sprintf(msg, args...))
+	}
+
+	ctx := context.Background()
+	st := NewWrapper(storagetesting.NewMapStorage(map[string][]byte{}, nil, nil), Output(myOutput))
+	for _, id := range []string{"a", "b", "c"} {
+		if err := st.PutBlock(ctx, id, []byte{1}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	messages = nil
+	storagetesting.AssertListStops(ctx, t, st, "", 2)
+
+	if len(messages) != 1 || !strings.Contains(messages[0], "was stopped after 2 items") {
+		t.Errorf("unexpected output: %v", messages)
+	}
+}
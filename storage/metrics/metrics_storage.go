@@ -0,0 +1,173 @@
+// Package metrics implements wrapper around Storage that records Prometheus metrics of all operations.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/kopia/repo/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Error classes reported in the "class" label of the errors counter.
+const (
+	errorClassNotFound         = "not_found"
+	errorClassCanceled         = "canceled"
+	errorClassDeadlineExceeded = "deadline_exceeded"
+	errorClassOther            = "other"
+)
+
+type collectors struct {
+	operations *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	bytes      *prometheus.CounterVec
+}
+
+func newCollectors() *collectors {
+	return &collectors{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "storage_operations_total",
+			Help: "Number of storage operations.",
+		}, []string{"method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "storage_errors_total",
+			Help: "Number of storage operations that failed, by class of error.",
+		}, []string{"method", "class"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "storage_operation_duration_seconds",
+			Help:    "Duration of storage operations.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 9),
+		}, []string{"method"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "storage_bytes_total",
+			Help: "Number of bytes read or written by storage operations.",
+		}, []string{"method"}),
+	}
+}
+
+// register registers all collectors or none of them.
+func (c *collectors) register(reg prometheus.Registerer) error {
+	var registered []prometheus.Collector
+	for _, col := range []prometheus.Collector{c.operations, c.errors, c.latency, c.bytes} {
+		if err := reg.Register(col); err != nil {
+			for _, r := range registered {
+				reg.Unregister(r)
+			}
+			return err
+		}
+
+		registered = append(registered, col)
+	}
+
+	return nil
+}
+
+type metricsStorage struct {
+	base storage.Storage
+	m    *collectors
+}
+
+func errorClass(err error) string {
+	switch err {
+	case storage.ErrBlockNotFound:
+		return errorClassNotFound
+	case context.Canceled:
+		return errorClassCanceled
+	case context.DeadlineExceeded:
+		return errorClassDeadlineExceeded
+	default:
+		return errorClassOther
+	}
+}
+
+func (s *metricsStorage) record(method string, t0 time.Time, bytes int, err error) {
+	s.m.operations.WithLabelValues(method).Inc()
+	s.m.latency.WithLabelValues(method).Observe(time.Since(t0).Seconds())
+	s.m.bytes.WithLabelValues(method).Add(float64(bytes))
+
+	if err != nil {
+		s.m.errors.WithLabelValues(method, errorClass(err)).Inc()
+	}
+}
+
+func (s *metricsStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	t0 := time.Now()
+	result, err := s.base.GetBlock(ctx, id, offset, length)
+	s.record("GetBlock", t0, len(result), err)
+	return result, err
+}
+
+func (s *metricsStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	t0 := time.Now()
+	results, err := s.base.GetBlocks(ctx, reqs)
+
+	n := 0
+	for _, r := range results {
+		n += len(r.Data)
+	}
+
+	s.record("GetBlocks", t0, n, err)
+	return results, err
+}
+
+func (s *metricsStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	t0 := time.Now()
+	result, err := s.base.GetBlockSize(ctx, id)
+	s.record("GetBlockSize", t0, 0, err)
+	return result, err
+}
+
+func (s *metricsStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	t0 := time.Now()
+	err := s.base.TouchBlock(ctx, id, threshold)
+	s.record("TouchBlock", t0, 0, err)
+	return err
+}
+
+func (s *metricsStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	t0 := time.Now()
+	err := s.base.PutBlock(ctx, id, data)
+
+	n := len(data)
+	if err != nil {
+		n = 0
+	}
+	s.record("PutBlock", t0, n, err)
+	return err
+}
+
+func (s *metricsStorage) DeleteBlock(ctx context.Context, id string) error {
+	t0 := time.Now()
+	err := s.base.DeleteBlock(ctx, id)
+	s.record("DeleteBlock", t0, 0, err)
+	return err
+}
+
+func (s *metricsStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	t0 := time.Now()
+	err := s.base.ListBlocks(ctx, prefix, callback)
+	s.record("ListBlocks", t0, 0, err)
+	return err
+}
+
+func (s *metricsStorage) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
+
+func (s *metricsStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// NewWrapper returns a Storage wrapper that records the number, errors, latency and transferred bytes of operations
+// in metrics registered with the provided Registerer. Callers control the namespace and labels of the metrics
+// by wrapping the Registerer, e.g. using prometheus.WrapRegistererWithPrefix(), which also allows registering
+// metrics of multiple storages with the same registry.
+func NewWrapper(wrapped storage.Storage, reg prometheus.Registerer) (storage.Storage, error) {
+	m := newCollectors()
+	if err := m.register(reg); err != nil {
+		return nil, err
+	}
+
+	return &metricsStorage{base: wrapped, m: m}, nil
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsStorage(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	reg := prometheus.NewRegistry()
+
+	st, err := NewWrapper(storagetesting.NewMapStorage(data, nil, nil), prometheus.WrapRegistererWithPrefix("kopia_", reg))
+	if err != nil {
+		t.Fatalf("unable to create wrapper: %v", err)
+	}
+	m := st.(*metricsStorage).m
+
+	if err := st.PutBlock(ctx, "block1", []byte{1, 2, 3}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+	if _, err := st.GetBlock(ctx, "block1", 1, 2); err != nil {
+		t.Fatalf("unable to get block: %v", err)
+	}
+	if _, err := st.GetBlock(ctx, "no-such-block", 0, -1); err != storage.ErrBlockNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := storage.ListAllBlocks(ctx, st, ""); err != nil {
+		t.Fatalf("unable to list blocks: %v", err)
+	}
+	if err := st.DeleteBlock(ctx, "block1"); err != nil {
+		t.Fatalf("unable to delete block: %v", err)
+	}
+
+	cases := []struct {
+		c    prometheus.Collector
+		want float64
+	}{
+		{m.operations.WithLabelValues("PutBlock"), 1},
+		{m.operations.WithLabelValues("GetBlock"), 2},
+		{m.operations.WithLabelValues("ListBlocks"), 1},
+		{m.operations.WithLabelValues("DeleteBlock"), 1},
+		{m.errors.WithLabelValues("GetBlock", errorClassNotFound), 1},
+		{m.errors.WithLabelValues("PutBlock", errorClassNotFound), 0},
+		{m.bytes.WithLabelValues("PutBlock"), 3},
+		{m.bytes.WithLabelValues("GetBlock"), 2},
+	}
+
+	for i, tc := range cases {
+		if got := testutil.ToFloat64(tc.c); got != tc.want {
+			t.Errorf("case #%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather metrics: %v", err)
+	}
+
+	latencySamples := map[string]uint64{}
+	for _, f := range families {
+		if f.GetName() != "kopia_storage_operation_duration_seconds" {
+			continue
+		}
+
+		for _, metric := range f.GetMetric() {
+			latencySamples[metric.GetLabel()[0].GetValue()] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+
+	if latencySamples["GetBlock"] != 2 || latencySamples["PutBlock"] != 1 || latencySamples["DeleteBlock"] != 1 || latencySamples["ListBlocks"] != 1 {
+		t.Errorf("unexpected latency samples: %v", latencySamples)
+	}
+
+	// metrics of another storage can't be registered under the same names.
+	if _, err := NewWrapper(st, prometheus.WrapRegistererWithPrefix("kopia_", reg)); err == nil {
+		t.Errorf("unexpected success registering duplicate metrics")
+	}
+}
@@ -0,0 +1,167 @@
+// Package overlay implements a Storage that combines an upper storage receiving all writes with a read-only lower storage.
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kopia/repo/storage"
+)
+
+// tombstonePrefix is the prefix of blocks in the upper storage recording that the block with the rest
+// of the name has been deleted, which hides it in the lower storage.
+const tombstonePrefix = "overlay-deleted-"
+
+type overlayStorage struct {
+	upper storage.Storage
+	lower storage.Storage
+}
+
+func (s *overlayStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	b, err := s.upper.GetBlock(ctx, id, offset, length)
+	if err == storage.ErrBlockNotFound {
+		if err := s.checkNotDeleted(ctx, id); err != nil {
+			return nil, err
+		}
+
+		return s.lower.GetBlock(ctx, id, offset, length)
+	}
+
+	return b, err
+}
+
+// checkNotDeleted returns storage.ErrBlockNotFound if the provided block has been deleted from the lower storage.
+func (s *overlayStorage) checkNotDeleted(ctx context.Context, id string) error {
+	_, err := s.upper.GetBlockSize(ctx, tombstonePrefix+id)
+	switch err {
+	case nil:
+		return storage.ErrBlockNotFound
+	case storage.ErrBlockNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+func (s *overlayStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	return storage.GetBlocksInParallel(ctx, s, reqs, storage.DefaultGetBlocksParallelism)
+}
+
+func (s *overlayStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	l, err := s.upper.GetBlockSize(ctx, id)
+	if err == storage.ErrBlockNotFound {
+		if err := s.checkNotDeleted(ctx, id); err != nil {
+			return 0, err
+		}
+
+		return s.lower.GetBlockSize(ctx, id)
+	}
+
+	return l, err
+}
+
+func (s *overlayStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	err := s.upper.TouchBlock(ctx, id, threshold)
+	if err == storage.ErrBlockNotFound {
+		if err := s.checkNotDeleted(ctx, id); err != nil {
+			return err
+		}
+
+		return s.lower.TouchBlock(ctx, id, threshold)
+	}
+
+	return err
+}
+
+func (s *overlayStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	if strings.HasPrefix(id, tombstonePrefix) {
+		return fmt.Errorf("invalid block ID %q, the prefix is reserved for deletion records", id)
+	}
+
+	return s.upper.PutBlock(ctx, id, data)
+}
+
+func (s *overlayStorage) DeleteBlock(ctx context.Context, id string) error {
+	if err := s.upper.DeleteBlock(ctx, id); err != nil {
+		return err
+	}
+
+	if err := s.checkNotDeleted(ctx, id); err != nil {
+		if err == storage.ErrBlockNotFound {
+			// already deleted from the lower storage.
+			return nil
+		}
+
+		return err
+	}
+
+	if _, err := s.lower.GetBlockSize(ctx, id); err != nil {
+		if err == storage.ErrBlockNotFound {
+			return nil
+		}
+
+		return err
+	}
+
+	return s.upper.PutBlock(ctx, tombstonePrefix+id, []byte{})
+}
+
+func (s *overlayStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	deleted := map[string]bool{}
+	if err := s.upper.ListBlocks(ctx, tombstonePrefix+prefix, func(bm storage.BlockMetadata) error {
+		deleted[strings.TrimPrefix(bm.BlockID, tombstonePrefix)] = true
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	inUpper := map[string]bool{}
+	var stopped bool
+
+	if err := s.upper.ListBlocks(ctx, prefix, func(bm storage.BlockMetadata) error {
+		if strings.HasPrefix(bm.BlockID, tombstonePrefix) {
+			return nil
+		}
+
+		inUpper[bm.BlockID] = true
+		err := callback(bm)
+		stopped = err == storage.ErrStopIteration
+		return err
+	}); err != nil || stopped {
+		return err
+	}
+
+	return s.lower.ListBlocks(ctx, prefix, func(bm storage.BlockMetadata) error {
+		if inUpper[bm.BlockID] || deleted[bm.BlockID] {
+			return nil
+		}
+
+		return callback(bm)
+	})
+}
+
+func (s *overlayStorage) Close(ctx context.Context) error {
+	if err := s.upper.Close(ctx); err != nil {
+		return err
+	}
+
+	return s.lower.Close(ctx)
+}
+
+func (s *overlayStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.upper.ConnectionInfo()
+}
+
+// NewWrapper returns a Storage that reads blocks from the upper storage, falling back to the lower one for blocks
+// that don't exist there, and writes all new blocks to the upper storage, which allows incremental migrations.
+// ListBlocks() returns blocks from both storages, blocks present in both are only listed once with the upper metadata.
+//
+// The lower storage is never modified. Deleting a block present in the lower storage records a zero-length tombstone
+// block named with the "overlay-deleted-" prefix in the upper storage, which hides the lower block from reads
+// and listings; each read falling back to the lower storage checks for a tombstone first. Writes of blocks named
+// with the prefix are rejected. ConnectionInfo() describes the upper storage.
+func NewWrapper(upper, lower storage.Storage) storage.Storage {
+	return &overlayStorage{upper: upper, lower: lower}
+}
@@ -0,0 +1,94 @@
+package overlay
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+)
+
+func TestOverlayStorage(t *testing.T) {
+	ctx := context.Background()
+
+	storagetesting.VerifyStorage(ctx, t, NewWrapper(
+		storagetesting.NewMapStorage(map[string][]byte{}, nil, nil),
+		storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)))
+
+	upperData := map[string][]byte{}
+	lowerData := map[string][]byte{}
+	upper := storagetesting.NewMapStorage(upperData, nil, nil)
+	lower := storagetesting.NewMapStorage(lowerData, nil, nil)
+
+	lower.PutBlock(ctx, "block1", []byte{1, 2, 3, 4})    //nolint:errcheck
+	lower.PutBlock(ctx, "block2", []byte{5, 6, 7, 8})    //nolint:errcheck
+	upper.PutBlock(ctx, "block2", []byte{9, 10, 11, 12}) //nolint:errcheck
+
+	st := NewWrapper(upper, lower)
+
+	// reads resolve from both layers, the upper one wins.
+	storagetesting.AssertGetBlock(ctx, t, st, "block1", []byte{1, 2, 3, 4})
+	storagetesting.AssertGetBlock(ctx, t, st, "block2", []byte{9, 10, 11, 12})
+	storagetesting.AssertGetBlockNotFound(ctx, t, st, "block3")
+
+	// writes only touch the upper layer.
+	if err := st.PutBlock(ctx, "block3", []byte{13, 14, 15, 16}); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, st, "block3", []byte{13, 14, 15, 16})
+	storagetesting.AssertGetBlock(ctx, t, upper, "block3", []byte{13, 14, 15, 16})
+	storagetesting.AssertGetBlockNotFound(ctx, t, lower, "block3")
+	if got, want := len(lowerData), 2; got != want {
+		t.Errorf("unexpected number of blocks in lower storage: %v, wanted %v", got, want)
+	}
+
+	// listing merges both layers.
+	storagetesting.AssertListResults(ctx, t, st, "block", "block1", "block2", "block3")
+
+	var listed int
+	if err := st.ListBlocks(ctx, "block2", func(bm storage.BlockMetadata) error {
+		listed++
+		return nil
+	}); err != nil {
+		t.Fatalf("unable to list blocks: %v", err)
+	}
+
+	if listed != 1 {
+		t.Errorf("block present in both layers listed %v times", listed)
+	}
+
+	// deleted blocks don't reappear from the lower layer.
+	if err := st.DeleteBlock(ctx, "block2"); err != nil {
+		t.Fatalf("unable to delete block: %v", err)
+	}
+
+	storagetesting.AssertGetBlockNotFound(ctx, t, st, "block2")
+	storagetesting.AssertListResults(ctx, t, st, "block", "block1", "block3")
+
+	// the lower layer is never modified, deletions are recorded in the upper one.
+	if err := st.DeleteBlock(ctx, "block1"); err != nil {
+		t.Fatalf("unable to delete block: %v", err)
+	}
+
+	storagetesting.AssertGetBlockNotFound(ctx, t, st, "block1")
+	storagetesting.AssertListResults(ctx, t, st, "block", "block3")
+	storagetesting.AssertListResults(ctx, t, st, "", "block3")
+	storagetesting.AssertGetBlock(ctx, t, lower, "block1", []byte{1, 2, 3, 4})
+	storagetesting.AssertGetBlock(ctx, t, lower, "block2", []byte{5, 6, 7, 8})
+	if _, err := st.GetBlockSize(ctx, "block1"); err != storage.ErrBlockNotFound {
+		t.Errorf("unexpected error getting size of deleted block: %v", err)
+	}
+
+	// blocks written again after deletion are visible.
+	if err := st.PutBlock(ctx, "block1", []byte{17, 18}); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, st, "block1", []byte{17, 18})
+	storagetesting.AssertListResults(ctx, t, st, "block", "block1", "block3")
+
+	if err := st.PutBlock(ctx, tombstonePrefix+"block3", []byte{1}); err == nil {
+		t.Errorf("unexpected success writing block with the reserved prefix")
+	}
+}
@@ -0,0 +1,57 @@
+// Package readonly implements wrapper around Storage that prevents any modifications.
+package readonly
+
+import (
+	"context"
+	"time"
+
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+type readOnlyStorage struct {
+	base storage.Storage
+}
+
+func (s *readOnlyStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	return s.base.GetBlock(ctx, id, offset, length)
+}
+
+func (s *readOnlyStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	return s.base.GetBlocks(ctx, reqs)
+}
+
+func (s *readOnlyStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	return s.base.GetBlockSize(ctx, id)
+}
+
+func (s *readOnlyStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	return errors.Wrapf(storage.ErrReadOnly, "TouchBlock(%q)", id)
+}
+
+func (s *readOnlyStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	return errors.Wrapf(storage.ErrReadOnly, "PutBlock(%q)", id)
+}
+
+func (s *readOnlyStorage) DeleteBlock(ctx context.Context, id string) error {
+	return errors.Wrapf(storage.ErrReadOnly, "DeleteBlock(%q)", id)
+}
+
+func (s *readOnlyStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	return s.base.ListBlocks(ctx, prefix, callback)
+}
+
+func (s *readOnlyStorage) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
+
+func (s *readOnlyStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// NewWrapper returns a Storage wrapper that passes reads through to the wrapped storage and rejects PutBlock(),
+// DeleteBlock() and TouchBlock() with ErrReadOnly without calling it, which guarantees that browsing or verifying
+// a repository doesn't write anything to it.
+func NewWrapper(wrapped storage.Storage) storage.Storage {
+	return &readOnlyStorage{base: wrapped}
+}
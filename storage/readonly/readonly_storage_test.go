@@ -0,0 +1,87 @@
+package readonly
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+	"github.com/kopia/repo/storage/caching"
+	"github.com/kopia/repo/storage/filesystem"
+	"github.com/kopia/repo/storage/logging"
+	"github.com/pkg/errors"
+)
+
+var errMutated = errors.New("mutation reached the underlying storage")
+
+func TestReadOnlyStorage(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	base := storagetesting.NewMapStorage(data, nil, nil)
+	for _, id := range []string{"block1", "block2"} {
+		if err := base.PutBlock(ctx, id, []byte{1, 2, 3, 4}); err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+	}
+
+	cacheDir, _ := ioutil.TempDir("", "readonly-cache")
+	defer os.RemoveAll(cacheDir)
+
+	faulty := &storagetesting.FaultyStorage{
+		Base: base,
+		Faults: map[string][]*storagetesting.Fault{
+			"PutBlock":    {{Repeat: 100, Err: errMutated}},
+			"DeleteBlock": {{Repeat: 100, Err: errMutated}},
+			"TouchBlock":  {{Repeat: 100, Err: errMutated}},
+		},
+	}
+
+	cached, err := caching.NewWrapper(ctx, NewWrapper(faulty), cacheDir, 1000)
+	if err != nil {
+		t.Fatalf("unable to create caching wrapper: %v", err)
+	}
+	st := logging.NewWrapper(cached)
+
+	storagetesting.AssertGetBlock(ctx, t, st, "block1", []byte{1, 2, 3, 4})
+	storagetesting.AssertGetBlockSize(ctx, t, st, "block2", 4)
+	storagetesting.AssertGetBlockNotFound(ctx, t, st, "block3")
+	storagetesting.AssertListResults(ctx, t, st, "", "block1", "block2")
+
+	if err := st.PutBlock(ctx, "block3", []byte{1}); errors.Cause(err) != storage.ErrReadOnly {
+		t.Errorf("unexpected error writing block: %v, wanted %v", err, storage.ErrReadOnly)
+	}
+
+	if err := st.PutBlock(ctx, "block1", []byte{5}); errors.Cause(err) != storage.ErrReadOnly {
+		t.Errorf("unexpected error overwriting block: %v, wanted %v", err, storage.ErrReadOnly)
+	}
+
+	if err := st.DeleteBlock(ctx, "block2"); errors.Cause(err) != storage.ErrReadOnly {
+		t.Errorf("unexpected error deleting block: %v, wanted %v", err, storage.ErrReadOnly)
+	}
+
+	if err := st.TouchBlock(ctx, "block2", 0); errors.Cause(err) != storage.ErrReadOnly {
+		t.Errorf("unexpected error touching block: %v, wanted %v", err, storage.ErrReadOnly)
+	}
+
+	if len(data) != 2 {
+		t.Errorf("unexpected blocks in the underlying storage: %v", data)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, st, "block1", []byte{1, 2, 3, 4})
+	storagetesting.AssertGetBlock(ctx, t, base, "block2", []byte{1, 2, 3, 4})
+}
+
+func TestReadOnlyStorageConnectionInfo(t *testing.T) {
+	ctx := context.Background()
+	path, _ := ioutil.TempDir("", "readonly")
+	defer os.RemoveAll(path)
+
+	fs, err := filesystem.New(ctx, &filesystem.Options{Path: path})
+	if err != nil {
+		t.Fatalf("unable to create storage: %v", err)
+	}
+
+	storagetesting.AssertConnectionInfoRoundTrips(ctx, t, NewWrapper(fs))
+}
@@ -0,0 +1,156 @@
+// Package retrying implements wrapper around Storage that retries operations failing with transient errors.
+package retrying
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kopia/repo/internal/retry"
+	"github.com/kopia/repo/storage"
+)
+
+type retryingStorage struct {
+	base        storage.Storage
+	isRetriable func(err error) bool
+	policy      retry.Policy
+}
+
+// isRetriableError determines whether the provided error returned by the wrapped storage should be retried.
+func (s *retryingStorage) isRetriableError(err error) bool {
+	if err == nil || err == storage.ErrBlockNotFound {
+		return false
+	}
+
+	return s.isRetriable(err)
+}
+
+func (s *retryingStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	v, err := retry.WithPolicy(s.policy, fmt.Sprintf("GetBlock(%q,%v,%v)", id, offset, length), func() (interface{}, error) {
+		return s.base.GetBlock(ctx, id, offset, length)
+	}, s.isRetriableError)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]byte), nil
+}
+
+func (s *retryingStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	// each block is retried separately.
+	return storage.GetBlocksInParallel(ctx, s, reqs, storage.DefaultGetBlocksParallelism)
+}
+
+func (s *retryingStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	v, err := retry.WithPolicy(s.policy, fmt.Sprintf("GetBlockSize(%q)", id), func() (interface{}, error) {
+		return s.base.GetBlockSize(ctx, id)
+	}, s.isRetriableError)
+	if err != nil {
+		return 0, err
+	}
+
+	return v.(int64), nil
+}
+
+func (s *retryingStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	_, err := retry.WithPolicy(s.policy, fmt.Sprintf("TouchBlock(%q)", id), func() (interface{}, error) {
+		return nil, s.base.TouchBlock(ctx, id, threshold)
+	}, s.isRetriableError)
+	return err
+}
+
+func (s *retryingStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	_, err := retry.WithPolicy(s.policy, fmt.Sprintf("PutBlock(%q)", id), func() (interface{}, error) {
+		return nil, s.base.PutBlock(ctx, id, data)
+	}, s.isRetriableError)
+	return err
+}
+
+func (s *retryingStorage) DeleteBlock(ctx context.Context, id string) error {
+	_, err := retry.WithPolicy(s.policy, fmt.Sprintf("DeleteBlock(%q)", id), func() (interface{}, error) {
+		return nil, s.base.DeleteBlock(ctx, id)
+	}, s.isRetriableError)
+	return err
+}
+
+// callbackError wraps errors returned by the ListBlocks() callback, which are never retried.
+type callbackError struct {
+	err error
+}
+
+func (e callbackError) Error() string {
+	return e.err.Error()
+}
+
+// ListBlocks retries listing that fails part way, blocks already passed to the callback are not passed again.
+func (s *retryingStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	seen := map[string]bool{}
+
+	_, err := retry.WithPolicy(s.policy, fmt.Sprintf("ListBlocks(%q)", prefix), func() (interface{}, error) {
+		return nil, s.base.ListBlocks(ctx, prefix, func(bm storage.BlockMetadata) error {
+			if seen[bm.BlockID] {
+				return nil
+			}
+			seen[bm.BlockID] = true
+
+			if err := callback(bm); err != nil {
+				if err == storage.ErrStopIteration {
+					return err
+				}
+				return callbackError{err}
+			}
+
+			return nil
+		})
+	}, func(err error) bool {
+		if _, ok := err.(callbackError); ok {
+			return false
+		}
+
+		return s.isRetriableError(err)
+	})
+
+	if ce, ok := err.(callbackError); ok {
+		return ce.err
+	}
+
+	return err
+}
+
+func (s *retryingStorage) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
+
+func (s *retryingStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// Option modifies the behavior of retrying storage wrapper.
+type Option func(s *retryingStorage)
+
+// NewWrapper returns a Storage wrapper that retries operations with exponential backoff as long as they fail
+// with errors deemed retriable by the provided function. storage.ErrBlockNotFound is never retried.
+func NewWrapper(wrapped storage.Storage, isRetriable func(err error) bool, options ...Option) storage.Storage {
+	s := &retryingStorage{base: wrapped, isRetriable: isRetriable}
+	for _, o := range options {
+		o(s)
+	}
+
+	return s
+}
+
+// MaxAttempts is a retrying storage option that sets the maximum number of attempts of each operation.
+func MaxAttempts(n int) Option {
+	return func(s *retryingStorage) {
+		s.policy.MaxAttempts = n
+	}
+}
+
+// SleepBounds is a retrying storage option that sets the sleep duration before the first retry,
+// which doubles with each subsequent retry up to the provided maximum.
+func SleepBounds(initial, max time.Duration) Option {
+	return func(s *retryingStorage) {
+		s.policy.InitialSleep = initial
+		s.policy.MaxSleep = max
+	}
+}
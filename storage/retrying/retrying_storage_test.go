@@ -0,0 +1,106 @@
+package retrying
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+)
+
+var (
+	errTransient = errors.New("transient")
+	errPermanent = errors.New("permanent")
+)
+
+func isTransient(err error) bool {
+	return err == errTransient
+}
+
+func TestRetryingStorage(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	base := &storagetesting.FaultyStorage{
+		Base: storagetesting.NewMapStorage(data, nil, nil),
+	}
+
+	st := NewWrapper(base, isTransient, MaxAttempts(3), SleepBounds(time.Millisecond, 2*time.Millisecond))
+	storagetesting.VerifyStorage(ctx, t, st)
+
+	// operations failing fewer times than the maximum number of attempts succeed.
+	base.Faults = map[string][]*storagetesting.Fault{
+		"PutBlock":    {{Repeat: 1, Err: errTransient}},
+		"GetBlock":    {{Repeat: 1, Err: errTransient}},
+		"DeleteBlock": {{Repeat: 1, Err: errTransient}},
+	}
+
+	if err := st.PutBlock(ctx, "block1", []byte{1, 2, 3}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if b, err := st.GetBlock(ctx, "block1", 0, -1); err != nil || len(b) != 3 {
+		t.Fatalf("unexpected result: %v %v", b, err)
+	}
+
+	if err := st.DeleteBlock(ctx, "block1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// not found and non-retriable errors are returned immediately.
+	base.Faults = map[string][]*storagetesting.Fault{
+		"GetBlock": {{Err: errPermanent}},
+	}
+
+	if _, err := st.GetBlock(ctx, "block1", 0, -1); err != errPermanent {
+		t.Errorf("unexpected error: %v, wanted %v", err, errPermanent)
+	}
+
+	if _, err := st.GetBlock(ctx, "block1", 0, -1); err != storage.ErrBlockNotFound {
+		t.Errorf("unexpected error: %v, wanted %v", err, storage.ErrBlockNotFound)
+	}
+
+	// operations failing more times than the maximum number of attempts fail.
+	base.Faults = map[string][]*storagetesting.Fault{
+		"PutBlock": {{Repeat: 2, Err: errTransient}},
+	}
+
+	if err := st.PutBlock(ctx, "block2", []byte{1}); err == nil {
+		t.Errorf("unexpected success")
+	}
+	storagetesting.AssertGetBlockNotFound(ctx, t, st, "block2")
+}
+
+func TestRetryingStorageListBlocks(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	base := &storagetesting.FaultyStorage{
+		Base: storagetesting.NewMapStorage(data, nil, nil),
+	}
+
+	st := NewWrapper(base, isTransient, SleepBounds(time.Millisecond, 2*time.Millisecond))
+	for _, id := range []string{"a1", "a2", "a3"} {
+		if err := st.PutBlock(ctx, id, []byte{1}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// fail the listing after the first item had been delivered.
+	base.Faults = map[string][]*storagetesting.Fault{
+		"ListBlocks":     {{Err: errTransient}},
+		"ListBlocksItem": {{}, {Err: errTransient}},
+	}
+
+	storagetesting.AssertListResults(ctx, t, st, "a", "a1", "a2", "a3")
+
+	// callback errors are not retried.
+	calls := 0
+	err := st.ListBlocks(ctx, "a", func(storage.BlockMetadata) error {
+		calls++
+		return errTransient
+	})
+	if err != errTransient || calls != 1 {
+		t.Errorf("unexpected result: %v after %v calls", err, calls)
+	}
+}
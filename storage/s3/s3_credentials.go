@@ -0,0 +1,233 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+)
+
+const (
+	defaultSTSEndpoint            = "https://sts.amazonaws.com"
+	defaultRoleSessionName        = "kopia"
+	defaultRoleSessionDuration    = time.Hour
+	stsRequestTimeout             = 30 * time.Second
+	stsDefaultRegion              = "us-east-1"
+	stsCredentialsRefreshFraction = 10 // refresh credentials when less than 1/10th of their duration remains
+)
+
+// newClient returns the client authenticated using the credentials from the options.
+func newClient(opt *Options, secretAccessKey string) (*minio.Client, error) {
+	if opt.RoleARN == "" && opt.SessionToken == "" {
+		// unlike NewWithCredentials(), New() selects the signature version used by the endpoint.
+		return minio.New(opt.Endpoint, opt.AccessKeyID, secretAccessKey, !opt.DoNotUseTLS)
+	}
+
+	return minio.NewWithCredentials(opt.Endpoint, newCredentials(opt, secretAccessKey), !opt.DoNotUseTLS, "")
+}
+
+// newCredentials returns credentials of the client, which are either the static credentials from the options or
+// temporary credentials of the role assumed using them.
+func newCredentials(opt *Options, secretAccessKey string) *credentials.Credentials {
+	if opt.RoleARN == "" {
+		return credentials.NewStaticV4(opt.AccessKeyID, secretAccessKey, opt.SessionToken)
+	}
+
+	p := &assumeRoleProvider{
+		endpoint:        opt.STSEndpoint,
+		roleARN:         opt.RoleARN,
+		sessionName:     opt.RoleSessionName,
+		duration:        time.Duration(opt.RoleSessionDurationSeconds) * time.Second,
+		accessKeyID:     opt.AccessKeyID,
+		secretAccessKey: secretAccessKey,
+		sessionToken:    opt.SessionToken,
+		client:          &http.Client{Timeout: stsRequestTimeout},
+	}
+
+	if p.endpoint == "" {
+		p.endpoint = defaultSTSEndpoint
+	}
+
+	if p.sessionName == "" {
+		p.sessionName = defaultRoleSessionName
+	}
+
+	if p.duration <= 0 {
+		p.duration = defaultRoleSessionDuration
+	}
+
+	return credentials.New(p)
+}
+
+// assumeRoleProvider retrieves temporary credentials of a role using the AssumeRole API of AWS STS.
+// The credentials are considered to expire early, so that they are refreshed before requests start failing.
+type assumeRoleProvider struct {
+	credentials.Expiry
+
+	endpoint    string
+	roleARN     string
+	sessionName string
+	duration    time.Duration
+
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+
+	client *http.Client
+}
+
+type assumeRoleResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleResult>Credentials"`
+}
+
+type stsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// Retrieve implements credentials.Provider.
+func (p *assumeRoleProvider) Retrieve() (credentials.Value, error) {
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {p.roleARN},
+		"RoleSessionName": {p.sessionName},
+		"DurationSeconds": {fmt.Sprintf("%v", int(p.duration.Seconds()))},
+	}
+
+	req, err := p.newSignedRequest(form.Encode(), time.Now().UTC())
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("unable to assume role %v: %v", p.roleARN, err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("unable to read response assuming role %v: %v", p.roleARN, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var er stsErrorResponse
+		if xml.Unmarshal(body, &er) != nil || er.Code == "" {
+			return credentials.Value{}, fmt.Errorf("unable to assume role %v: %v", p.roleARN, resp.Status)
+		}
+
+		return credentials.Value{}, fmt.Errorf("unable to assume role %v: %v: %v", p.roleARN, er.Code, er.Message)
+	}
+
+	var ar assumeRoleResponse
+	if err := xml.Unmarshal(body, &ar); err != nil {
+		return credentials.Value{}, fmt.Errorf("invalid response assuming role %v: %v", p.roleARN, err)
+	}
+
+	c := ar.Credentials
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return credentials.Value{}, fmt.Errorf("invalid response assuming role %v: missing credentials", p.roleARN)
+	}
+
+	p.SetExpiration(c.Expiration, p.duration/stsCredentialsRefreshFraction)
+
+	return credentials.Value{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+// newSignedRequest returns the STS request with the provided form, signed using AWS Signature Version 4.
+func (p *assumeRoleProvider) newSignedRequest(body string, now time.Time) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, p.endpoint, strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid STS endpoint %q: %v", p.endpoint, err)
+	}
+
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	signedHeaders := "content-type;host;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	if p.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.sessionToken)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + p.sessionToken + "\n"
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodPost,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		sha256Hex([]byte(body)),
+	}, "\n")
+
+	region := stsRegion(req.URL.Host)
+	scope := strings.Join([]string{now.Format("20060102"), region, "sts", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + p.secretAccessKey)
+	for _, s := range []string{now.Format("20060102"), region, "sts", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%x",
+		p.accessKeyID, scope, signedHeaders, hmacSHA256(key, stringToSign)))
+
+	return req, nil
+}
+
+// stsRegion returns the region of regional STS endpoints ("sts.<region>.amazonaws.com"), requests to other endpoints,
+// including the global one, are signed for us-east-1.
+func stsRegion(host string) string {
+	parts := strings.Split(host, ".")
+	if len(parts) == 4 && parts[0] == "sts" && parts[2] == "amazonaws" {
+		return parts[1]
+	}
+
+	return stsDefaultRegion
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data)) //nolint:errcheck
+	return h.Sum(nil)
+}
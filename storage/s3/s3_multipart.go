@@ -0,0 +1,157 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/kopia/repo/internal/repologging"
+	"github.com/minio/minio-go"
+)
+
+var log = repologging.Logger("repo/s3")
+
+const (
+	defaultMultipartUploadThreshold = 64 << 20
+	defaultMultipartPartSize        = 16 << 20
+	multipartUploadConcurrency      = 4
+)
+
+func (s *s3Storage) multipartThreshold() int64 {
+	if s.MultipartUploadThresholdBytes > 0 {
+		return s.MultipartUploadThresholdBytes
+	}
+
+	return defaultMultipartUploadThreshold
+}
+
+// putBlockMultipart uploads the provided data in parts using a bounded number of concurrent requests, reporting
+// the combined progress of all parts. If any of the parts fails, the upload is aborted, so that the uploaded parts
+// are not retained (and billed) by S3.
+func (s *s3Storage) putBlockMultipart(ctx context.Context, b string, data []byte, progress *progressReader) error {
+	core := minio.Core{Client: s.cli}
+	objectName := s.getObjectNameString(b)
+
+	uploadID, err := core.NewMultipartUpload(s.BucketName, objectName, s.putObjectOptions())
+	if err != nil {
+		return err
+	}
+
+	parts, err := s.uploadParts(ctx, core, objectName, uploadID, data, progress)
+	if err != nil {
+		if aerr := core.AbortMultipartUpload(s.BucketName, objectName, uploadID); aerr != nil {
+			log.Warningf("unable to abort multipart upload of %v: %v", b, aerr)
+		}
+		return err
+	}
+
+	_, err = core.CompleteMultipartUpload(s.BucketName, objectName, uploadID, parts)
+	return err
+}
+
+func (s *s3Storage) uploadParts(ctx context.Context, core minio.Core, objectName, uploadID string, data []byte, progress *progressReader) ([]minio.CompletePart, error) {
+	partSize := s.multipartPartSize
+	if partSize <= 0 {
+		partSize = defaultMultipartPartSize
+	}
+
+	parts := make([]minio.CompletePart, (int64(len(data))+partSize-1)/partSize)
+	partNumbers := make(chan int, len(parts))
+	for i := range parts {
+		partNumbers <- i + 1
+	}
+	close(partNumbers)
+
+	var mu sync.Mutex
+	var firstErr error
+
+	var wg sync.WaitGroup
+	for w := 0; w < multipartUploadConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for partNumber := range partNumbers {
+				mu.Lock()
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed || ctx.Err() != nil {
+					continue
+				}
+
+				start := int64(partNumber-1) * partSize
+				end := start + partSize
+				if end > int64(len(data)) {
+					end = int64(len(data))
+				}
+
+				part, err := s.uploadPart(ctx, core, objectName, uploadID, partNumber, data[start:end], progress)
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("unable to upload part %v: %v", partNumber, err)
+					}
+				} else {
+					parts[partNumber-1] = minio.CompletePart{PartNumber: partNumber, ETag: part.ETag}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return parts, ctx.Err()
+}
+
+// uploadPart uploads a single part within the request context limited by RequestTimeoutSeconds. Because the minio
+// client doesn't accept a context when uploading parts, the part data stops being read when the context is done,
+// which fails the request, and the part is reported as failed without waiting for the response.
+func (s *s3Storage) uploadPart(ctx context.Context, core minio.Core, objectName, uploadID string, partNumber int, data []byte, progress *progressReader) (minio.ObjectPart, error) {
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+
+	throttled, err := s.uploadThrottler.AddReader(ioutil.NopCloser(&contextReader{ctx, bytes.NewReader(data)}))
+	if err != nil {
+		return minio.ObjectPart{}, err
+	}
+
+	type result struct {
+		part minio.ObjectPart
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		part, err := core.PutObjectPart(s.BucketName, objectName, uploadID, partNumber, progress.wrap(throttled), int64(len(data)), "", "", nil)
+		done <- result{part, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.part, r.err
+	case <-ctx.Done():
+		return minio.ObjectPart{}, ctx.Err()
+	}
+}
+
+// contextReader is an io.Reader that fails reads once the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
@@ -1,5 +1,18 @@
 package s3
 
+import (
+	"fmt"
+	"os"
+
+	"github.com/minio/minio-go/pkg/encrypt"
+)
+
+// Supported values of ServerSideEncryption.
+const (
+	ServerSideEncryptionAES256 = "AES256"
+	ServerSideEncryptionKMS    = "aws:kms"
+)
+
 // Options defines options for S3-based storage.
 type Options struct {
 	// BucketName is the name of the bucket where data is stored.
@@ -14,7 +27,82 @@ type Options struct {
 	AccessKeyID     string `json:"accessKeyID"`
 	SecretAccessKey string `json:"secretAccessKey" kopia:"sensitive"`
 
+	// SessionToken is the token of temporary credentials specified by AccessKeyID and SecretAccessKey.
+	// It's short-lived, so it's not persisted and must be provided again when reconnecting.
+	SessionToken string `json:"-" kopia:"sensitive"`
+
+	// RoleARN, if set, is the ARN of the role assumed using AWS STS with the credentials above. Temporary credentials of
+	// the role are used for all requests and refreshed before they expire.
+	RoleARN string `json:"roleARN,omitempty"`
+
+	// RoleSessionName identifies sessions of the assumed role, defaults to "kopia".
+	RoleSessionName string `json:"roleSessionName,omitempty"`
+
+	// RoleSessionDurationSeconds is the duration of the sessions of the assumed role, defaults to 1 hour.
+	RoleSessionDurationSeconds int `json:"roleSessionDurationSeconds,omitempty"`
+
+	// STSEndpoint is the URL of the STS service used to assume the role, defaults to "https://sts.amazonaws.com".
+	STSEndpoint string `json:"stsEndpoint,omitempty"`
+
+	// SecretAccessKeyFromEnv is the name of the environment variable holding the secret access key, which is
+	// resolved when the storage is opened. It's used when SecretAccessKey is empty, so the secret is never persisted.
+	SecretAccessKeyFromEnv string `json:"secretAccessKeyFromEnv,omitempty"`
+
 	MaxUploadSpeedBytesPerSecond int `json:"maxUploadSpeedBytesPerSecond,omitempty"`
 
 	MaxDownloadSpeedBytesPerSecond int `json:"maxDownloadSpeedBytesPerSecond,omitempty"`
+
+	// ServerSideEncryption requests objects to be encrypted by S3 using keys managed by S3 ("AES256")
+	// or by AWS KMS ("aws:kms"). It's applied to all written objects, including those uploaded in multiple parts,
+	// for which it's specified when the upload is initiated. Reading objects doesn't depend on it, so objects written
+	// with different settings remain readable.
+	ServerSideEncryption string `json:"serverSideEncryption,omitempty"`
+
+	// KMSKeyID is the ID of the KMS key used with "aws:kms" server-side encryption. If empty, the default key is used.
+	KMSKeyID string `json:"kmsKeyID,omitempty"`
+
+	// StorageClass is the storage class of written objects, such as "STANDARD_IA" or "GLACIER". If empty, objects
+	// are stored in the default "STANDARD" class. Reading archived objects fails with ErrBlockArchived until
+	// they are restored.
+	StorageClass string `json:"storageClass,omitempty"`
+
+	// MultipartUploadThresholdBytes is the size of blocks above which they are uploaded in multiple parts,
+	// defaults to 64 MB.
+	MultipartUploadThresholdBytes int64 `json:"multipartUploadThresholdBytes,omitempty"`
+
+	// RequestTimeoutSeconds, if positive, limits the duration of each attempt to read or write a block,
+	// independent of the deadline of the context passed by the caller.
+	RequestTimeoutSeconds int `json:"requestTimeoutSeconds,omitempty"`
+}
+
+// secretAccessKey returns the inline secret access key or resolves the referenced one.
+func (opt *Options) secretAccessKey() (string, error) {
+	if opt.SecretAccessKey != "" || opt.SecretAccessKeyFromEnv == "" {
+		return opt.SecretAccessKey, nil
+	}
+
+	v := os.Getenv(opt.SecretAccessKeyFromEnv)
+	if v == "" {
+		return "", fmt.Errorf("environment variable %v holding the secret access key is not set", opt.SecretAccessKeyFromEnv)
+	}
+
+	return v, nil
+}
+
+// serverSideEncryption returns the server-side encryption of written objects or nil if it's not enabled.
+func (opt *Options) serverSideEncryption() (encrypt.ServerSide, error) {
+	if opt.KMSKeyID != "" && opt.ServerSideEncryption != ServerSideEncryptionKMS {
+		return nil, fmt.Errorf("KMS key ID requires %q server-side encryption", ServerSideEncryptionKMS)
+	}
+
+	switch opt.ServerSideEncryption {
+	case "":
+		return nil, nil
+	case ServerSideEncryptionAES256:
+		return encrypt.NewSSE(), nil
+	case ServerSideEncryptionKMS:
+		return encrypt.NewSSEKMS(opt.KMSKeyID, nil)
+	default:
+		return nil, fmt.Errorf("unsupported server-side encryption %q", opt.ServerSideEncryption)
+	}
 }
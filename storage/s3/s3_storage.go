@@ -8,26 +8,36 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sync"
+	"time"
 
 	"github.com/efarrer/iothrottler"
 	"github.com/kopia/repo/internal/retry"
 	"github.com/kopia/repo/storage"
 	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/encrypt"
 )
 
 const (
 	s3storageType = "s3"
 )
 
+// ErrBlockArchived is returned when reading a block whose object is in an archival storage class, such as GLACIER,
+// and must be restored before it can be read.
+var ErrBlockArchived = errors.New("block is archived and must be restored before reading")
+
 type s3Storage struct {
 	Options
 
 	ctx context.Context
 
 	cli *minio.Client
+	sse encrypt.ServerSide
 
 	downloadThrottler *iothrottler.IOThrottlerPool
 	uploadThrottler   *iothrottler.IOThrottlerPool
+
+	multipartPartSize int64
 }
 
 func (s *s3Storage) GetBlock(ctx context.Context, b string, offset, length int64) ([]byte, error) {
@@ -39,7 +49,10 @@ func (s *s3Storage) GetBlock(ctx context.Context, b string, offset, length int64
 			}
 		}
 
-		o, err := s.cli.GetObject(s.BucketName, s.getObjectNameString(b), opt)
+		ctx, cancel := s.requestContext(ctx)
+		defer cancel()
+
+		o, err := s.cli.GetObjectWithContext(ctx, s.BucketName, s.getObjectNameString(b), opt)
 		if err != nil {
 			return 0, err
 		}
@@ -74,6 +87,67 @@ func (s *s3Storage) GetBlock(ctx context.Context, b string, offset, length int64
 	return v.([]byte), nil
 }
 
+func (s *s3Storage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	return storage.GetBlocksInParallel(ctx, s, reqs, storage.DefaultGetBlocksParallelism)
+}
+
+func (s *s3Storage) GetBlockSize(ctx context.Context, b string) (int64, error) {
+	attempt := func() (interface{}, error) {
+		return s.cli.StatObject(s.BucketName, s.getObjectNameString(b), minio.StatObjectOptions{})
+	}
+
+	v, err := exponentialBackoff(fmt.Sprintf("GetBlockSize(%q)", b), attempt)
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return v.(minio.ObjectInfo).Size, nil
+}
+
+// TouchBlock updates the timestamp of the object by copying it onto itself, which requires replacing its metadata.
+func (s *s3Storage) TouchBlock(ctx context.Context, b string, threshold time.Duration) error {
+	objectName := s.getObjectNameString(b)
+
+	attempt := func() (interface{}, error) {
+		oi, err := s.cli.StatObject(s.BucketName, objectName, minio.StatObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		n := time.Now()
+		if n.Sub(oi.LastModified) < threshold {
+			return nil, nil
+		}
+
+		// the copy replaces the object, so its server-side encryption and storage class must be requested again.
+		meta := map[string]string{
+			"kopia-touched": n.UTC().Format(time.RFC3339Nano),
+		}
+		if s.StorageClass != "" {
+			meta["x-amz-storage-class"] = s.StorageClass
+		}
+
+		dst, err := minio.NewDestinationInfo(s.BucketName, objectName, s.sse, meta)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, s.cli.CopyObject(dst, minio.NewSourceInfo(s.BucketName, objectName, nil))
+	}
+
+	_, err := exponentialBackoff(fmt.Sprintf("TouchBlock(%q)", b), attempt)
+	return translateError(err)
+}
+
+// requestContext returns the context of a single request, which is limited by RequestTimeoutSeconds.
+func (s *s3Storage) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.RequestTimeoutSeconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Duration(s.RequestTimeoutSeconds)*time.Second)
+}
+
 func exponentialBackoff(desc string, att retry.AttemptFunc) (interface{}, error) {
 	return retry.WithExponentialBackoff(desc, att, isRetriableError)
 }
@@ -95,36 +169,47 @@ func translateError(err error) error {
 		if me.StatusCode == 404 {
 			return storage.ErrBlockNotFound
 		}
+		if me.Code == "InvalidObjectState" {
+			return ErrBlockArchived
+		}
 	}
 
 	return err
 }
 
 func (s *s3Storage) PutBlock(ctx context.Context, b string, data []byte) error {
-	throttled, err := s.uploadThrottler.AddReader(ioutil.NopCloser(bytes.NewReader(data)))
-	if err != nil {
-		return err
-	}
-
 	progressCallback := storage.ProgressCallback(ctx)
 	if progressCallback != nil {
 		progressCallback(b, 0, int64(len(data)))
 		defer progressCallback(b, int64(len(data)), int64(len(data)))
 	}
-	n, err := s.cli.PutObject(s.BucketName, s.getObjectNameString(b), throttled, -1, minio.PutObjectOptions{
-		ContentType: "application/x-kopia",
-		Progress:    newProgressReader(progressCallback, b, int64(len(data))),
-	})
-	if err == io.EOF && n == 0 {
-		// special case empty stream
-		_, err = s.cli.PutObject(s.BucketName, s.getObjectNameString(b), bytes.NewBuffer(nil), 0, minio.PutObjectOptions{
-			ContentType: "application/x-kopia",
-		})
+
+	progress := newProgressReader(progressCallback, b, int64(len(data)))
+
+	if int64(len(data)) > s.multipartThreshold() {
+		return translateError(s.putBlockMultipart(ctx, b, data, progress))
+	}
+
+	throttled, err := s.uploadThrottler.AddReader(ioutil.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		return err
 	}
 
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+
+	_, err = s.cli.PutObjectWithContext(ctx, s.BucketName, s.getObjectNameString(b), progress.wrap(throttled), int64(len(data)), s.putObjectOptions())
 	return translateError(err)
 }
 
+func (s *s3Storage) putObjectOptions() minio.PutObjectOptions {
+	return minio.PutObjectOptions{
+		ContentType:          "application/x-kopia",
+		ServerSideEncryption: s.sse,
+		StorageClass:         s.StorageClass,
+	}
+}
+
 func (s *s3Storage) DeleteBlock(ctx context.Context, b string) error {
 	attempt := func() (interface{}, error) {
 		return nil, s.cli.RemoveObject(s.BucketName, s.getObjectNameString(b))
@@ -145,6 +230,10 @@ func (s *s3Storage) ListBlocks(ctx context.Context, prefix string, callback func
 			return err
 		}
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		bm := storage.BlockMetadata{
 			BlockID:   o.Key[len(s.Prefix):],
 			Length:    o.Size,
@@ -152,11 +241,15 @@ func (s *s3Storage) ListBlocks(ctx context.Context, prefix string, callback func
 		}
 
 		if err := callback(bm); err != nil {
+			if err == storage.ErrStopIteration {
+				return nil
+			}
 			return err
 		}
 	}
 
-	return nil
+	// the listing channel is closed without an error when the context is canceled.
+	return ctx.Err()
 }
 
 func (s *s3Storage) ConnectionInfo() storage.ConnectionInfo {
@@ -174,24 +267,58 @@ func (s *s3Storage) String() string {
 	return fmt.Sprintf("s3://%v/%v", s.BucketName, s.Prefix)
 }
 
+// progressReportInterval is the number of uploaded bytes between progress reports.
+const progressReportInterval = 1000000
+
+// progressReader reports the progress of an upload of a block, which may consist of multiple concurrently
+// uploaded parts, as their contents are read by the client.
 type progressReader struct {
-	cb           storage.ProgressFunc
-	blockID      string
+	cb          storage.ProgressFunc
+	blockID     string
+	totalLength int64
+
+	mu           sync.Mutex
 	completed    int64
-	totalLength  int64
 	lastReported int64
 }
 
-func (r *progressReader) Read(b []byte) (int, error) {
-	r.completed += int64(len(b))
-	if r.completed >= r.lastReported+1000000 && r.completed < r.totalLength {
+func (r *progressReader) add(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.completed += n
+	if r.completed > r.totalLength {
+		// contents of failed requests may be read again.
+		r.completed = r.totalLength
+	}
+
+	if r.completed >= r.lastReported+progressReportInterval && r.completed < r.totalLength {
 		r.cb(r.blockID, r.completed, r.totalLength)
 		r.lastReported = r.completed
 	}
-	return len(b), nil
 }
 
-func newProgressReader(cb storage.ProgressFunc, blockID string, totalLength int64) io.Reader {
+// wrap returns a reader that reports the progress when contents are read from the provided reader.
+func (r *progressReader) wrap(rd io.Reader) io.Reader {
+	if r == nil {
+		return rd
+	}
+
+	return &countingReader{rd, r}
+}
+
+type countingReader struct {
+	io.Reader
+	progress *progressReader
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.progress.add(int64(n))
+	return n, err
+}
+
+func newProgressReader(cb storage.ProgressFunc, blockID string, totalLength int64) *progressReader {
 	if cb == nil {
 		return nil
 	}
@@ -210,12 +337,23 @@ func toBandwidth(bytesPerSecond int) iothrottler.Bandwidth {
 // New creates new S3-backed storage with specified options:
 //
 // - the 'BucketName' field is required and all other parameters are optional.
+// - the 'SecretAccessKeyFromEnv' field, if used instead of 'SecretAccessKey', must name a non-empty environment variable.
 func New(ctx context.Context, opt *Options) (storage.Storage, error) {
 	if opt.BucketName == "" {
 		return nil, errors.New("bucket name must be specified")
 	}
 
-	cli, err := minio.New(opt.Endpoint, opt.AccessKeyID, opt.SecretAccessKey, !opt.DoNotUseTLS)
+	secretAccessKey, err := opt.secretAccessKey()
+	if err != nil {
+		return nil, err
+	}
+
+	sse, err := opt.serverSideEncryption()
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := newClient(opt, secretAccessKey)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create client: %v", err)
 	}
@@ -227,6 +365,7 @@ func New(ctx context.Context, opt *Options) (storage.Storage, error) {
 		Options:           *opt,
 		ctx:               ctx,
 		cli:               cli,
+		sse:               sse,
 		downloadThrottler: downloadThrottler,
 		uploadThrottler:   uploadThrottler,
 	}, nil
@@ -1,13 +1,21 @@
 package s3
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -81,6 +89,47 @@ func TestS3Storage(t *testing.T) {
 	}
 }
 
+func TestS3SecretAccessKeyFromEnv(t *testing.T) {
+	ctx := context.Background()
+
+	const envName = "KOPIA_TEST_S3_SECRET_ACCESS_KEY"
+	os.Setenv(envName, secretAccessKey) //nolint:errcheck
+	defer os.Unsetenv(envName)          //nolint:errcheck
+
+	opt := &Options{
+		AccessKeyID:            accessKeyID,
+		SecretAccessKeyFromEnv: envName,
+		Endpoint:               endpoint,
+		BucketName:             bucketName,
+	}
+
+	st, err := New(ctx, opt)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ci := st.ConnectionInfo()
+	if s := ci.InlineSecrets(); len(s) != 0 {
+		t.Errorf("unexpected inline secrets: %v", s)
+	}
+
+	storagetesting.AssertConnectionInfoRoundTrips(ctx, t, st)
+
+	if got, err := ci.Config.(*Options).secretAccessKey(); err != nil || got != secretAccessKey {
+		t.Errorf("unexpected secret access key: %q %v", got, err)
+	}
+
+	inline := storage.ConnectionInfo{Type: s3storageType, Config: &Options{SecretAccessKey: secretAccessKey}}
+	if got, want := inline.InlineSecrets(), []string{"secretAccessKey"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("unexpected inline secrets: %v, wanted %v", got, want)
+	}
+
+	os.Unsetenv(envName) //nolint:errcheck
+	if _, err := New(ctx, opt); err == nil {
+		t.Errorf("unexpected success opening storage with unset environment variable")
+	}
+}
+
 func createBucket(t *testing.T) {
 	minioClient, err := minio.New(endpoint, accessKeyID, secretAccessKey, useSSL)
 	if err != nil {
@@ -109,8 +158,592 @@ func cleanupOldData(ctx context.Context, t *testing.T) {
 				t.Errorf("warning: unable to delete %q: %v", it.BlockID, err)
 			}
 		} else {
-			log.Printf("keeping %v", it.BlockID)
+			t.Logf("keeping %v", it.BlockID)
 		}
 		return nil
 	})
 }
+
+func TestS3ConnectionInfoRedacted(t *testing.T) {
+	opt := &Options{
+		BucketName:      bucketName,
+		Endpoint:        endpoint,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+	}
+	ci := storage.ConnectionInfo{Type: s3storageType, Config: opt}
+
+	redacted := ci.Redacted().Config.(*Options)
+	if got, want := redacted.SecretAccessKey, "***"; got != want {
+		t.Errorf("unexpected redacted secret access key: %q, wanted %q", got, want)
+	}
+
+	if redacted.Endpoint != endpoint || redacted.BucketName != bucketName || redacted.AccessKeyID != accessKeyID {
+		t.Errorf("unexpected redacted options: %+v", redacted)
+	}
+
+	// the original is not modified and can still be used to connect.
+	if opt.SecretAccessKey != secretAccessKey {
+		t.Errorf("secret access key of the original options was modified: %q", opt.SecretAccessKey)
+	}
+
+	for _, s := range []string{ci.String(), fmt.Sprintf("%v", ci)} {
+		if strings.Contains(s, secretAccessKey) {
+			t.Errorf("secret access key is not redacted: %v", s)
+		}
+
+		if !strings.Contains(s, endpoint) || !strings.Contains(s, bucketName) {
+			t.Errorf("endpoint or bucket name are missing: %v", s)
+		}
+	}
+
+	// options without secrets are not copied.
+	noSecrets := storage.ConnectionInfo{Type: s3storageType, Config: &Options{BucketName: bucketName}}
+	if noSecrets.Redacted().Config != noSecrets.Config {
+		t.Errorf("unexpected copy of options without secrets")
+	}
+}
+
+func TestS3ServerSideEncryptionOptions(t *testing.T) {
+	cases := []struct {
+		opt     Options
+		wantErr bool
+	}{
+		{opt: Options{}},
+		{opt: Options{ServerSideEncryption: ServerSideEncryptionAES256}},
+		{opt: Options{ServerSideEncryption: ServerSideEncryptionKMS}},
+		{opt: Options{ServerSideEncryption: ServerSideEncryptionKMS, KMSKeyID: "my-key"}},
+		{opt: Options{ServerSideEncryption: ServerSideEncryptionAES256, KMSKeyID: "my-key"}, wantErr: true},
+		{opt: Options{KMSKeyID: "my-key"}, wantErr: true},
+		{opt: Options{ServerSideEncryption: "rot13"}, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		sse, err := tc.opt.serverSideEncryption()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("unexpected error for %+v: %v", tc.opt, err)
+			continue
+		}
+
+		if err == nil && (sse == nil) != (tc.opt.ServerSideEncryption == "") {
+			t.Errorf("unexpected server-side encryption for %+v: %v", tc.opt, sse)
+		}
+	}
+
+	if _, err := New(context.Background(), &Options{BucketName: bucketName, ServerSideEncryption: "rot13"}); err == nil {
+		t.Errorf("unexpected success opening storage with invalid server-side encryption")
+	}
+}
+
+func TestS3StorageServerSideEncryption(t *testing.T) {
+	if !endpointReachable() {
+		t.Skip("endpoint not reachable")
+	}
+
+	ctx := context.Background()
+	createBucket(t)
+
+	data := make([]byte, 8)
+	rand.Read(data) //nolint:errcheck
+
+	opt := &Options{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		Endpoint:        endpoint,
+		BucketName:      bucketName,
+		Prefix:          fmt.Sprintf("test-sse-%v-%x-", time.Now().Unix(), data),
+	}
+
+	plain, err := New(ctx, opt)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer plain.Close(ctx) //nolint:errcheck
+
+	if err := plain.PutBlock(ctx, "plain", []byte{1, 2, 3}); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	sseOpt := *opt
+	sseOpt.ServerSideEncryption = ServerSideEncryptionAES256
+	st, err := New(ctx, &sseOpt)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer st.Close(ctx) //nolint:errcheck
+
+	if got := st.ConnectionInfo().Config.(*Options).ServerSideEncryption; got != ServerSideEncryptionAES256 {
+		t.Errorf("unexpected server-side encryption in connection info: %q", got)
+	}
+
+	storagetesting.AssertConnectionInfoRoundTrips(ctx, t, st)
+
+	if err := st.PutBlock(ctx, "encrypted", []byte{4, 5, 6}); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	// blocks written with and without server-side encryption are readable by both.
+	for _, s := range []storage.Storage{plain, st} {
+		storagetesting.AssertGetBlock(ctx, t, s, "plain", []byte{1, 2, 3})
+		storagetesting.AssertGetBlock(ctx, t, s, "encrypted", []byte{4, 5, 6})
+	}
+}
+
+// fakeS3Server implements the subset of the S3 API used by the storage, including multipart uploads, and records
+// storage classes of uploaded objects. When archived is set, reads are rejected like S3 does for GLACIER objects.
+type fakeS3Server struct {
+	archived   bool
+	failPartID int
+	stallParts chan struct{} // when set, part uploads wait until the channel is closed
+
+	mu             sync.Mutex
+	objects        map[string][]byte
+	storageClasses map[string]string
+	uploads        map[string]map[int][]byte // parts of pending multipart uploads by upload ID
+	nextUploadID   int
+	abortedUploads int
+	securityTokens []string // security tokens of all requests
+}
+
+func newFakeS3Server() *fakeS3Server {
+	return &fakeS3Server{
+		objects:        map[string][]byte{},
+		storageClasses: map[string]string{},
+		uploads:        map[string]map[int][]byte{},
+	}
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.stallParts != nil && r.Method == http.MethodPut && r.URL.Query().Get("uploadId") != "" {
+		<-s.stallParts
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.securityTokens = append(s.securityTokens, r.Header.Get("X-Amz-Security-Token"))
+
+	q := r.URL.Query()
+	_, location := q["location"]
+	_, uploads := q["uploads"]
+	uploadID := q.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodGet && location:
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint>us-east-1</LocationConstraint>`)
+
+	case r.Method == http.MethodPost && uploads:
+		s.nextUploadID++
+		id := fmt.Sprintf("upload%v", s.nextUploadID)
+		s.uploads[id] = map[int][]byte{}
+		s.storageClasses[r.URL.Path] = r.Header.Get("X-Amz-Storage-Class")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><InitiateMultipartUploadResult><UploadId>%v</UploadId></InitiateMultipartUploadResult>`, id)
+
+	case r.Method == http.MethodPut && uploadID != "":
+		partID, _ := strconv.Atoi(q.Get("partNumber"))
+		if partID == s.failPartID {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>InvalidPart</Code></Error>`)
+			return
+		}
+		if s.uploads[uploadID] == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchUpload</Code></Error>`)
+			return
+		}
+		s.uploads[uploadID][partID] = readRequestBody(r)
+		w.Header().Set("ETag", fmt.Sprintf(`"etag%v"`, partID))
+
+	case r.Method == http.MethodPost && uploadID != "":
+		parts := s.uploads[uploadID]
+		var data []byte
+		for i := 1; i <= len(parts); i++ {
+			data = append(data, parts[i]...)
+		}
+		s.objects[r.URL.Path] = data
+		delete(s.uploads, uploadID)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><CompleteMultipartUploadResult><Bucket>bucket</Bucket><ETag>"etag"</ETag></CompleteMultipartUploadResult>`)
+
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(s.uploads, uploadID)
+		s.abortedUploads++
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		s.objects[r.URL.Path] = readRequestBody(r)
+		s.storageClasses[r.URL.Path] = r.Header.Get("X-Amz-Storage-Class")
+		w.Header().Set("ETag", `"etag"`)
+
+	case r.Method == http.MethodGet && s.archived:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>InvalidObjectState</Code>`+
+			`<Message>The operation is not valid for the object's storage class</Message></Error>`)
+
+	case r.Method == http.MethodGet:
+		b, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(b))
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// readRequestBody returns the payload of the request, which is sent in signed chunks over plain HTTP.
+func readRequestBody(r *http.Request) []byte {
+	b, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return b
+	}
+
+	var result []byte
+	for len(b) > 0 {
+		// each chunk is "<hex length>;chunk-signature=<signature>\r\n<data>\r\n"
+		p := bytes.IndexByte(b, ';')
+		n, _ := strconv.ParseInt(string(b[0:p]), 16, 64)
+		b = b[bytes.Index(b, []byte("\r\n"))+2:]
+		result = append(result, b[0:n]...)
+		b = b[n+2:]
+	}
+
+	return result
+}
+
+func (s *fakeS3Server) newStorage(t *testing.T, server *httptest.Server, opt Options) *s3Storage {
+	t.Helper()
+
+	opt.AccessKeyID = accessKeyID
+	opt.SecretAccessKey = secretAccessKey
+	opt.Endpoint = strings.TrimPrefix(server.URL, "http://")
+	opt.DoNotUseTLS = true
+	opt.BucketName = bucketName
+
+	st, err := New(context.Background(), &opt)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	return st.(*s3Storage)
+}
+
+func TestS3StorageClass(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3Server()
+	fake.archived = true
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	for _, sc := range []string{"", "GLACIER"} {
+		st := fake.newStorage(t, server, Options{StorageClass: sc})
+
+		if got := st.ConnectionInfo().Config.(*Options).StorageClass; got != sc {
+			t.Errorf("unexpected storage class in connection info: %q, wanted %q", got, sc)
+		}
+
+		id := "block-" + sc
+		if err := st.PutBlock(ctx, id, []byte{1, 2, 3}); err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+
+		fake.mu.Lock()
+		got := fake.storageClasses["/"+bucketName+"/"+id]
+		fake.mu.Unlock()
+		if got != sc {
+			t.Errorf("unexpected storage class header: %q, wanted %q", got, sc)
+		}
+
+		if _, err := st.GetBlock(ctx, id, 0, -1); err != ErrBlockArchived {
+			t.Errorf("unexpected error reading archived block: %v, wanted %v", err, ErrBlockArchived)
+		}
+	}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3Server()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	st := fake.newStorage(t, server, Options{MultipartUploadThresholdBytes: 100000, StorageClass: "STANDARD_IA"})
+	st.multipartPartSize = 30000
+
+	data := make([]byte, 250000)
+	rand.Read(data) //nolint:errcheck
+
+	if err := st.PutBlock(ctx, "large", data); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	fake.mu.Lock()
+	got := fake.storageClasses["/"+bucketName+"/large"]
+	pending := len(fake.uploads)
+	fake.mu.Unlock()
+	if got != "STANDARD_IA" || pending != 0 {
+		t.Errorf("unexpected storage class %q or pending uploads %v", got, pending)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, st, "large", data)
+
+	// blocks below the threshold are uploaded in a single request.
+	if err := st.PutBlock(ctx, "small", data[0:100000]); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	fake.mu.Lock()
+	uploads := fake.nextUploadID
+	fake.mu.Unlock()
+	if uploads != 1 {
+		t.Errorf("unexpected number of multipart uploads: %v", uploads)
+	}
+
+	// failed uploads are aborted.
+	fake.failPartID = 3
+	if err := st.PutBlock(ctx, "failed", data); err == nil {
+		t.Errorf("unexpected success writing block with a failing part")
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if _, ok := fake.objects["/"+bucketName+"/failed"]; ok || fake.abortedUploads != 1 || len(fake.uploads) != 0 {
+		t.Errorf("failed upload was not aborted: %v aborted, %v pending", fake.abortedUploads, len(fake.uploads))
+	}
+}
+
+func TestS3MultipartUploadTimeout(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3Server()
+	fake.stallParts = make(chan struct{})
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	defer close(fake.stallParts)
+
+	st := fake.newStorage(t, server, Options{MultipartUploadThresholdBytes: 100000, RequestTimeoutSeconds: 1})
+	st.multipartPartSize = 30000
+
+	data := make([]byte, 250000)
+	rand.Read(data) //nolint:errcheck
+
+	t0 := time.Now()
+	if err := st.PutBlock(ctx, "stalled", data); err == nil {
+		t.Fatalf("unexpected success writing block with stalled parts")
+	}
+
+	if dt := time.Since(t0); dt > 10*time.Second {
+		t.Errorf("stalled upload took too long to fail: %v", dt)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if fake.abortedUploads != 1 {
+		t.Errorf("stalled upload was not aborted: %v aborted", fake.abortedUploads)
+	}
+}
+
+func TestS3SessionToken(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3Server()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	st := fake.newStorage(t, server, Options{SessionToken: "session-token"})
+	if err := st.PutBlock(ctx, "block", []byte{1, 2, 3}); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	fake.mu.Lock()
+	tokens := fake.securityTokens
+	fake.mu.Unlock()
+
+	if len(tokens) == 0 {
+		t.Fatalf("no requests were made")
+	}
+
+	for _, tok := range tokens {
+		if tok != "session-token" {
+			t.Errorf("unexpected security token: %q", tok)
+		}
+	}
+
+	// the session token is short-lived and not persisted.
+	b, err := json.Marshal(st.ConnectionInfo())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if strings.Contains(string(b), "session-token") {
+		t.Errorf("session token is persisted: %s", b)
+	}
+}
+
+// fakeSTSServer issues temporary credentials, which expire after the provided duration.
+type fakeSTSServer struct {
+	validity time.Duration
+
+	mu       sync.Mutex
+	requests []url.Values
+	authz    []string
+}
+
+func (s *fakeSTSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ParseForm() //nolint:errcheck
+	s.requests = append(s.requests, r.PostForm)
+	s.authz = append(s.authz, r.Header.Get("Authorization"))
+
+	fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult><Credentials>`+
+		`<AccessKeyId>ASIATEMP%v</AccessKeyId><SecretAccessKey>temp-secret</SecretAccessKey>`+
+		`<SessionToken>role-session-%v</SessionToken><Expiration>%v</Expiration>`+
+		`</Credentials></AssumeRoleResult></AssumeRoleResponse>`,
+		len(s.requests), len(s.requests), time.Now().Add(s.validity).UTC().Format(time.RFC3339))
+}
+
+func TestS3AssumeRole(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3Server()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// credentials valid for less than the refresh window of the session are refreshed before each request.
+	sts := &fakeSTSServer{validity: time.Minute}
+	stsServer := httptest.NewServer(sts)
+	defer stsServer.Close()
+
+	st := fake.newStorage(t, server, Options{
+		RoleARN:                    "arn:aws:iam::123456789012:role/kopia",
+		RoleSessionDurationSeconds: 3600,
+		STSEndpoint:                stsServer.URL,
+	})
+
+	for _, id := range []string{"block1", "block2"} {
+		if err := st.PutBlock(ctx, id, []byte{1, 2, 3}); err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+	}
+
+	sts.mu.Lock()
+	requests, authz := sts.requests, sts.authz
+	sts.mu.Unlock()
+
+	if len(requests) < 2 {
+		t.Fatalf("credentials were not refreshed, got %v STS requests", len(requests))
+	}
+
+	if got, want := requests[0].Get("RoleArn"), "arn:aws:iam::123456789012:role/kopia"; got != want {
+		t.Errorf("unexpected role: %q, wanted %q", got, want)
+	}
+
+	if got, want := requests[0].Get("DurationSeconds"), "3600"; got != want {
+		t.Errorf("unexpected duration: %q, wanted %q", got, want)
+	}
+
+	if !strings.Contains(authz[0], "Credential="+accessKeyID+"/") {
+		t.Errorf("STS request is not signed with the configured credentials: %v", authz[0])
+	}
+
+	fake.mu.Lock()
+	tokens := fake.securityTokens
+	fake.mu.Unlock()
+
+	if got, want := tokens[len(tokens)-1], fmt.Sprintf("role-session-%v", len(requests)); got != want {
+		t.Errorf("unexpected security token: %q, wanted %q", got, want)
+	}
+
+	// credentials valid for longer than the refresh window are reused.
+	sts.mu.Lock()
+	sts.validity = 2 * time.Hour
+	sts.mu.Unlock()
+	st = fake.newStorage(t, server, Options{RoleARN: "arn:aws:iam::123456789012:role/kopia", STSEndpoint: stsServer.URL})
+	for _, id := range []string{"block3", "block4"} {
+		if err := st.PutBlock(ctx, id, []byte{1, 2, 3}); err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+	}
+
+	sts.mu.Lock()
+	if got, want := len(sts.requests), len(requests)+1; got != want {
+		t.Errorf("unexpected number of STS requests: %v, wanted %v", got, want)
+	}
+	sts.mu.Unlock()
+
+	storagetesting.AssertConnectionInfoRoundTrips(ctx, t, st)
+
+	var ci storage.ConnectionInfo
+	b, _ := json.Marshal(st.ConnectionInfo())
+	if err := json.Unmarshal(b, &ci); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if got := ci.Config.(*Options); got.RoleARN != "arn:aws:iam::123456789012:role/kopia" || got.STSEndpoint != stsServer.URL {
+		t.Errorf("role configuration does not round-trip: %+v", got)
+	}
+}
+
+func TestSTSRegion(t *testing.T) {
+	for host, want := range map[string]string{
+		"sts.amazonaws.com":           "us-east-1",
+		"sts.eu-west-1.amazonaws.com": "eu-west-1",
+		"127.0.0.1:1234":              "us-east-1",
+	} {
+		if got := stsRegion(host); got != want {
+			t.Errorf("unexpected region of %v: %v, wanted %v", host, got, want)
+		}
+	}
+}
+
+func TestS3UploadProgress(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3Server()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	st := fake.newStorage(t, server, Options{MultipartUploadThresholdBytes: 4000000})
+	st.multipartPartSize = 1000000
+
+	for _, length := range []int{3500000, 4500000} {
+		data := make([]byte, length)
+		rand.Read(data) //nolint:errcheck
+
+		var mu sync.Mutex
+		var progress []int64
+		ctx2 := storage.WithUploadProgressCallback(ctx, func(desc string, completed, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if desc != "block" || total != int64(length) {
+				t.Errorf("unexpected progress %v: %v/%v", desc, completed, total)
+			}
+			progress = append(progress, completed)
+		})
+
+		if err := st.PutBlock(ctx2, "block", data); err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+
+		// in addition to the initial and final progress, progress is reported while the block is uploaded.
+		if len(progress) < 4 {
+			t.Errorf("too few progress reports uploading %v bytes: %v", length, progress)
+		}
+
+		for i := 1; i < len(progress); i++ {
+			if progress[i] <= progress[i-1] {
+				t.Errorf("progress uploading %v bytes is not increasing: %v", length, progress)
+				break
+			}
+		}
+
+		if got := progress[len(progress)-1]; got != int64(length) {
+			t.Errorf("unexpected final progress: %v, wanted %v", got, length)
+		}
+
+		storagetesting.AssertGetBlock(ctx, t, st, "block", data)
+	}
+}
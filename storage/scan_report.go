@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Kinds of blocks reported by ScanReport().
+const (
+	BlockKindFormat     = "format"
+	BlockKindIndex      = "index"
+	BlockKindPack       = "pack"
+	BlockKindQuarantine = "quarantine"
+	BlockKindOther      = "other"
+)
+
+// blockNameFormat describes the names of blocks of one kind written by the repository: a prefix followed
+// by a suffix accepted by the provided function.
+type blockNameFormat struct {
+	prefix      string
+	kind        string
+	validSuffix func(s string) bool
+}
+
+// blockNameFormats are sorted by decreasing length of prefixes, so that longer prefixes are matched first.
+var blockNameFormats []blockNameFormat
+
+// RegisterBlockNameFormat registers the format of names of blocks of the provided kind (see BlockKind*), which
+// consist of the prefix followed by a suffix accepted by validSuffix. Packages writing blocks register the formats
+// of their names, so that ScanReport() can classify them. Names are matched against the longest registered
+// prefix they start with.
+func RegisterBlockNameFormat(prefix, kind string, validSuffix func(suffix string) bool) {
+	blockNameFormats = append(blockNameFormats, blockNameFormat{prefix, kind, validSuffix})
+	sort.SliceStable(blockNameFormats, func(i, j int) bool {
+		return len(blockNameFormats[i].prefix) > len(blockNameFormats[j].prefix)
+	})
+}
+
+// blockKind returns the kind of the block with the provided name and whether its name has the expected format.
+// Blocks with unexpected names are of BlockKindOther.
+func blockKind(blockID string) (string, bool) {
+	for _, f := range blockNameFormats {
+		if strings.HasPrefix(blockID, f.prefix) {
+			if f.validSuffix(blockID[len(f.prefix):]) {
+				return f.kind, true
+			}
+
+			break
+		}
+	}
+
+	return BlockKindOther, false
+}
+
+// BlockKindStats summarizes blocks of one kind.
+type BlockKindStats struct {
+	Count       int   `json:"count"`
+	TotalLength int64 `json:"totalLength"`
+}
+
+// ScanResult is the result of ScanReport().
+type ScanResult struct {
+	TotalBlocks int                       `json:"totalBlocks"`
+	TotalLength int64                     `json:"totalLength"`
+	Kinds       map[string]BlockKindStats `json:"kinds"` // by BlockKind*
+
+	// ZeroLength lists blocks without any contents, which the repository never writes.
+	ZeroLength []BlockMetadata `json:"zeroLength,omitempty"`
+
+	// UnexpectedNames lists blocks whose names don't have any of the formats written by the repository.
+	UnexpectedNames []BlockMetadata `json:"unexpectedNames,omitempty"`
+
+	// SuspectedDuplicates lists groups of non-empty blocks of the same kind and length, which may have
+	// the same contents. Since packs are padded, packs of the same length are not necessarily duplicates
+	// and the contents must be compared to confirm.
+	SuspectedDuplicates [][]BlockMetadata `json:"suspectedDuplicates,omitempty"`
+}
+
+// ScanReport lists all blocks in the provided storage and reports the number and total length of blocks of
+// each kind along with anomalies found in the listing. Kinds are determined by the name formats registered
+// using RegisterBlockNameFormat(). The contents of blocks are not read.
+func ScanReport(ctx context.Context, s Storage) (*ScanResult, error) {
+	result := &ScanResult{
+		Kinds: map[string]BlockKindStats{},
+	}
+
+	type sizeKey struct {
+		kind   string
+		length int64
+	}
+
+	bySize := map[sizeKey][]BlockMetadata{}
+
+	err := s.ListBlocks(ctx, "", func(bm BlockMetadata) error {
+		kind, validName := blockKind(bm.BlockID)
+
+		ks := result.Kinds[kind]
+		ks.Count++
+		ks.TotalLength += bm.Length
+		result.Kinds[kind] = ks
+
+		result.TotalBlocks++
+		result.TotalLength += bm.Length
+
+		if !validName {
+			result.UnexpectedNames = append(result.UnexpectedNames, bm)
+		}
+
+		if bm.Length == 0 {
+			result.ZeroLength = append(result.ZeroLength, bm)
+		} else {
+			k := sizeKey{kind, bm.Length}
+			bySize[k] = append(bySize[k], bm)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, blocks := range bySize {
+		if len(blocks) > 1 {
+			sort.Slice(blocks, func(i, j int) bool {
+				return blocks[i].BlockID < blocks[j].BlockID
+			})
+			result.SuspectedDuplicates = append(result.SuspectedDuplicates, blocks)
+		}
+	}
+
+	sort.Slice(result.SuspectedDuplicates, func(i, j int) bool {
+		return result.SuspectedDuplicates[i][0].BlockID < result.SuspectedDuplicates[j][0].BlockID
+	})
+
+	return result, nil
+}
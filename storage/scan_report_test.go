@@ -0,0 +1,88 @@
+package storage_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+
+	// register the name formats of blocks written by the repository.
+	_ "github.com/kopia/repo"
+)
+
+func TestScanReport(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	st := storagetesting.NewMapStorage(data, nil, time.Now)
+
+	blocks := map[string][]byte{
+		"kopia.repository":       {1, 2, 3},
+		"kopia.repository.1":     {1, 2, 3, 4},
+		"kopia.repository.x":     {1},
+		"pdeadbeef":              make([]byte, 100),
+		"pcafe":                  make([]byte, 100),
+		"p0123":                  {}, // zero-length pack
+		"n0123456789":            {1, 2, 3, 4},
+		"x0000000000000001-abcd": {1},
+		"rpdeadbeef":             {1, 2}, // not written by the repository
+		"qrpcafe":                {1, 2, 3, 4, 5},
+		"some-foreign-file.txt":  {1, 2, 3, 4, 5, 6},
+	}
+
+	for k, v := range blocks {
+		if err := st.PutBlock(ctx, k, v); err != nil {
+			t.Fatalf("unable to put block: %v", err)
+		}
+	}
+
+	r, err := storage.ScanReport(ctx, st)
+	if err != nil {
+		t.Fatalf("scan error: %v", err)
+	}
+
+	if got, want := r.TotalBlocks, len(blocks); got != want {
+		t.Errorf("unexpected total blocks: %v, want %v", got, want)
+	}
+
+	if got, want := r.TotalLength, int64(226); got != want {
+		t.Errorf("unexpected total length: %v, want %v", got, want)
+	}
+
+	wantKinds := map[string]storage.BlockKindStats{
+		storage.BlockKindFormat:     {Count: 2, TotalLength: 7},
+		storage.BlockKindPack:       {Count: 3, TotalLength: 200},
+		storage.BlockKindIndex:      {Count: 2, TotalLength: 5},
+		storage.BlockKindQuarantine: {Count: 1, TotalLength: 5},
+		storage.BlockKindOther:      {Count: 3, TotalLength: 9},
+	}
+	if !reflect.DeepEqual(r.Kinds, wantKinds) {
+		t.Errorf("unexpected kinds: %v, want %v", r.Kinds, wantKinds)
+	}
+
+	if got, want := blockIDs(r.ZeroLength), []string{"p0123"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected zero-length blocks: %v, want %v", got, want)
+	}
+
+	if got, want := blockIDs(r.UnexpectedNames), []string{"kopia.repository.x", "rpdeadbeef", "some-foreign-file.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected blocks with unexpected names: %v, want %v", got, want)
+	}
+
+	if len(r.SuspectedDuplicates) != 1 {
+		t.Fatalf("unexpected suspected duplicates: %v", r.SuspectedDuplicates)
+	}
+
+	if got, want := blockIDs(r.SuspectedDuplicates[0]), []string{"pcafe", "pdeadbeef"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected suspected duplicates: %v, want %v", got, want)
+	}
+}
+
+func blockIDs(blocks []storage.BlockMetadata) []string {
+	var result []string
+	for _, b := range blocks {
+		result = append(result, b.BlockID)
+	}
+	return result
+}
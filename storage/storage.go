@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -27,6 +28,8 @@ type Storage interface {
 	PutBlock(ctx context.Context, id string, data []byte) error
 
 	// DeleteBlock removes the block from storage. Future GetBlock() operations will fail with ErrBlockNotFound.
+	// Deleting a block that does not exist is not an error and must return nil. Backends that can't provide
+	// this guarantee natively should be wrapped using storage/deletetolerant.
 	DeleteBlock(ctx context.Context, id string) error
 
 	// GetBlock returns full or partial contents of a block with given ID.
@@ -34,8 +37,26 @@ type Storage interface {
 	// If length<0, the entire block must be fetched.
 	GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error)
 
-	// ListBlocks returns a channel of BlockMetadata that describes storage blocks with existing name prefixes.
-	// Iteration continues until all blocks have been listed or until client code invokes the returned cancellation function.
+	// GetBlocks returns the contents of multiple block ranges, which allows backends to fetch them in parallel.
+	// Results are in the order of the requests and errors reading individual blocks, including ErrBlockNotFound,
+	// are reported in the results. The returned error indicates a failure of the entire batch, such as a canceled
+	// context. Backends that can't batch requests can use GetBlocksInParallel().
+	GetBlocks(ctx context.Context, reqs []BlockRange) ([]BlockResult, error)
+
+	// GetBlockSize returns the length of the block with given ID without fetching its contents.
+	// If the block does not exist, ErrBlockNotFound is returned.
+	GetBlockSize(ctx context.Context, id string) (int64, error)
+
+	// TouchBlock updates the timestamp of the block with given ID reported by ListBlocks() to the current time
+	// if it's older than the provided threshold, which allows marking blocks as recently used without rewriting them.
+	// Backends that can't update timestamps don't do anything and return nil. If the block does not exist,
+	// backends that support it return ErrBlockNotFound.
+	TouchBlock(ctx context.Context, id string, threshold time.Duration) error
+
+	// ListBlocks invokes the provided callback with BlockMetadata of all blocks with given name prefix.
+	// Iteration continues until all blocks have been listed, the callback returns an error or the context is canceled,
+	// in which case the error of the context is returned. When the callback returns ErrStopIteration, iteration
+	// stops and ListBlocks returns nil.
 	ListBlocks(ctx context.Context, prefix string, cb func(bm BlockMetadata) error) error
 
 	// ConnectionInfo returns JSON-serializable data structure containing information required to
@@ -53,9 +74,98 @@ type BlockMetadata struct {
 	Timestamp time.Time
 }
 
+// BlockRange identifies a range of bytes of a block, offset and length have the same meaning as in GetBlock().
+type BlockRange struct {
+	BlockID string
+	Offset  int64
+	Length  int64
+}
+
+// BlockResult is the result of reading a single BlockRange.
+type BlockResult struct {
+	BlockID string
+	Data    []byte
+	Err     error
+}
+
+// DefaultGetBlocksParallelism is the number of blocks fetched in parallel by GetBlocks() of remote backends.
+const DefaultGetBlocksParallelism = 8
+
 // ErrBlockNotFound is returned when a block cannot be found in storage.
 var ErrBlockNotFound = errors.New("block not found")
 
+// ErrReadOnly is returned when attempting to modify a read-only storage.
+var ErrReadOnly = errors.New("storage is read-only")
+
+// ErrStopIteration can be returned by the callback of ListBlocks() to stop iteration without an error.
+var ErrStopIteration = errors.New("stop iteration")
+
+// GetBlockSizeFromList returns the length of the provided block by listing blocks whose names start with its ID,
+// which allows backends that can't retrieve metadata of a single block to implement GetBlockSize().
+func GetBlockSizeFromList(ctx context.Context, st Storage, id string) (int64, error) {
+	length := int64(-1)
+
+	err := st.ListBlocks(ctx, id, func(bm BlockMetadata) error {
+		if bm.BlockID == id {
+			length = bm.Length
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if length < 0 {
+		return 0, ErrBlockNotFound
+	}
+
+	return length, nil
+}
+
+// GetBlocksInParallel implements GetBlocks() by fetching the requested ranges using GetBlock() of the provided
+// storage, with up to parallelism requests in progress at the same time.
+func GetBlocksInParallel(ctx context.Context, st Storage, reqs []BlockRange, parallelism int) ([]BlockResult, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	results := make([]BlockResult, len(reqs))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism && i < len(reqs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				r := reqs[i]
+				data, err := st.GetBlock(ctx, r.BlockID, r.Offset, r.Length)
+				results[i] = BlockResult{BlockID: r.BlockID, Data: data, Err: err}
+			}
+		}()
+	}
+
+feed:
+	for i := range reqs {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(indexes)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
 // ListAllBlocks returns BlockMetadata for all blocks in a given storage that have the provided name prefix.
 func ListAllBlocks(ctx context.Context, st Storage, prefix string) ([]BlockMetadata, error) {
 	var result []BlockMetadata
@@ -1,7 +1,10 @@
 package storage_test
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -55,3 +58,98 @@ func TestListAllBlocksConsistentEmpty(t *testing.T) {
 		t.Errorf("unexpected list result count: %v, want %v", got, want)
 	}
 }
+
+func TestGetBlockSizeFromList(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	st := storagetesting.NewMapStorage(data, nil, time.Now)
+	st.PutBlock(ctx, "foo", []byte{1, 2, 3})     //nolint:errcheck
+	st.PutBlock(ctx, "foo1", []byte{1, 2, 3, 4}) //nolint:errcheck
+
+	if got, err := storage.GetBlockSizeFromList(ctx, st, "foo"); err != nil || got != 3 {
+		t.Errorf("unexpected size: %v %v, want 3", got, err)
+	}
+
+	if got, err := storage.GetBlockSizeFromList(ctx, st, "foo1"); err != nil || got != 4 {
+		t.Errorf("unexpected size: %v %v, want 4", got, err)
+	}
+
+	if _, err := storage.GetBlockSizeFromList(ctx, st, "fo"); err != storage.ErrBlockNotFound {
+		t.Errorf("unexpected error: %v, want %v", err, storage.ErrBlockNotFound)
+	}
+}
+
+// concurrencyTrackingStorage records the maximum number of concurrent GetBlock() calls.
+type concurrencyTrackingStorage struct {
+	storage.Storage
+
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (s *concurrencyTrackingStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	s.mu.Lock()
+	s.current++
+	if s.current > s.max {
+		s.max = s.current
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.current--
+		s.mu.Unlock()
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	return s.Storage.GetBlock(ctx, id, offset, length)
+}
+
+func TestGetBlocksInParallel(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	st := &concurrencyTrackingStorage{Storage: storagetesting.NewMapStorage(data, nil, time.Now)}
+
+	var reqs []storage.BlockRange
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("block%v", i)
+		if i%3 != 0 {
+			st.PutBlock(ctx, id, []byte{byte(i), 2, 3}) //nolint:errcheck
+		}
+		reqs = append(reqs, storage.BlockRange{BlockID: id, Offset: 1, Length: 2})
+	}
+
+	results, err := storage.GetBlocksInParallel(ctx, st, reqs, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, r := range results {
+		if r.BlockID != reqs[i].BlockID {
+			t.Errorf("unexpected block ID of result %v: %v, want %v", i, r.BlockID, reqs[i].BlockID)
+		}
+
+		if i%3 == 0 {
+			if r.Err != storage.ErrBlockNotFound {
+				t.Errorf("unexpected error of result %v: %v, want %v", i, r.Err, storage.ErrBlockNotFound)
+			}
+			continue
+		}
+
+		if r.Err != nil || !bytes.Equal(r.Data, []byte{2, 3}) {
+			t.Errorf("unexpected result %v: %x %v", i, r.Data, r.Err)
+		}
+	}
+
+	if st.max > 4 {
+		t.Errorf("too many concurrent requests: %v", st.max)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := storage.GetBlocksInParallel(canceled, st, reqs, 4); err != context.Canceled {
+		t.Errorf("unexpected error: %v, want %v", err, context.Canceled)
+	}
+}
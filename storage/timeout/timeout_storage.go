@@ -0,0 +1,103 @@
+// Package timeout implements wrapper around Storage that limits the duration of individual requests.
+package timeout
+
+import (
+	"context"
+	"time"
+
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+// ErrRequestTimeout is returned when an individual storage request does not complete within the configured timeout.
+var ErrRequestTimeout = errors.New("storage request timed out")
+
+type timeoutStorage struct {
+	base    storage.Storage
+	timeout time.Duration
+}
+
+func (s *timeoutStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	ctx2, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	result, err := s.base.GetBlock(ctx2, id, offset, length)
+	if err != nil {
+		return nil, s.translateError(ctx, ctx2, err, "GetBlock", id)
+	}
+
+	return result, nil
+}
+
+func (s *timeoutStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	// the timeout applies to each block.
+	return storage.GetBlocksInParallel(ctx, s, reqs, storage.DefaultGetBlocksParallelism)
+}
+
+func (s *timeoutStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	ctx2, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	result, err := s.base.GetBlockSize(ctx2, id)
+	if err != nil {
+		return 0, s.translateError(ctx, ctx2, err, "GetBlockSize", id)
+	}
+
+	return result, nil
+}
+
+func (s *timeoutStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	ctx2, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.base.TouchBlock(ctx2, id, threshold); err != nil {
+		return s.translateError(ctx, ctx2, err, "TouchBlock", id)
+	}
+
+	return nil
+}
+
+func (s *timeoutStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	ctx2, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.translateError(ctx, ctx2, s.base.PutBlock(ctx2, id, data), "PutBlock", id)
+}
+
+func (s *timeoutStorage) DeleteBlock(ctx context.Context, id string) error {
+	ctx2, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.translateError(ctx, ctx2, s.base.DeleteBlock(ctx2, id), "DeleteBlock", id)
+}
+
+// translateError returns ErrRequestTimeout if the request failed because it timed out, but the parent context is still valid.
+func (s *timeoutStorage) translateError(ctx, requestCtx context.Context, err error, method, id string) error {
+	if err == nil || ctx.Err() != nil || requestCtx.Err() != context.DeadlineExceeded {
+		return err
+	}
+
+	return errors.Wrapf(ErrRequestTimeout, "%v(%q) did not complete within %v: %v", method, id, s.timeout, err)
+}
+
+func (s *timeoutStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	return s.base.ListBlocks(ctx, prefix, callback)
+}
+
+func (s *timeoutStorage) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
+
+func (s *timeoutStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// NewWrapper returns a Storage wrapper that limits each GetBlock(), PutBlock() and DeleteBlock() call to the provided
+// duration using a context derived from the one passed to the call, independent of the deadline of the parent context,
+// which allows callers to fail over or retry quickly. Calls that time out fail with ErrRequestTimeout.
+// ListBlocks() is not limited, since the duration of listing depends on the number of blocks.
+//
+// The wrapped storage must honor context cancellation for the timeout to be effective.
+func NewWrapper(wrapped storage.Storage, timeout time.Duration) storage.Storage {
+	return &timeoutStorage{base: wrapped, timeout: timeout}
+}
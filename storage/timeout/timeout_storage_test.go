@@ -0,0 +1,79 @@
+package timeout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+// slowStorage delays all reads and writes until the provided delay elapses or the context is canceled.
+type slowStorage struct {
+	storage.Storage
+	delay time.Duration
+}
+
+func (s slowStorage) wait(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s slowStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return s.Storage.GetBlock(ctx, id, offset, length)
+}
+
+func (s slowStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+
+	return s.Storage.PutBlock(ctx, id, data)
+}
+
+func TestTimeoutStorage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	data := map[string][]byte{}
+	storagetesting.VerifyStorage(ctx, t, NewWrapper(storagetesting.NewMapStorage(data, nil, nil), time.Minute))
+
+	st := NewWrapper(slowStorage{storagetesting.NewMapStorage(data, nil, nil), time.Minute}, 10*time.Millisecond)
+
+	if err := st.PutBlock(ctx, "block1", []byte{1, 2, 3, 4}); errors.Cause(err) != ErrRequestTimeout {
+		t.Errorf("unexpected error from slow PutBlock: %v, wanted %v", err, ErrRequestTimeout)
+	}
+
+	if _, err := st.GetBlock(ctx, "block1", 0, -1); errors.Cause(err) != ErrRequestTimeout {
+		t.Errorf("unexpected error from slow GetBlock: %v, wanted %v", err, ErrRequestTimeout)
+	}
+
+	// the parent context remains valid and can be used for subsequent requests.
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("parent context is no longer valid: %v", err)
+	}
+
+	fast := NewWrapper(slowStorage{storagetesting.NewMapStorage(data, nil, nil), time.Millisecond}, time.Minute)
+	if err := fast.PutBlock(ctx, "block1", []byte{1, 2, 3, 4}); err != nil {
+		t.Errorf("unable to write block: %v", err)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, fast, "block1", []byte{1, 2, 3, 4})
+
+	// cancellation of the parent context is not reported as a request timeout.
+	canceled, cancel2 := context.WithCancel(ctx)
+	cancel2()
+	if _, err := st.GetBlock(canceled, "block1", 0, -1); err != context.Canceled {
+		t.Errorf("unexpected error with canceled parent context: %v, wanted %v", err, context.Canceled)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/kopia/repo/storage"
 	"github.com/studio-b12/gowebdav"
@@ -57,6 +58,26 @@ func (d *davStorage) GetBlock(ctx context.Context, blockID string, offset, lengt
 	return data[0:length], nil
 }
 
+func (d *davStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	return storage.GetBlocksInParallel(ctx, d, reqs, storage.DefaultGetBlocksParallelism)
+}
+
+func (d *davStorage) GetBlockSize(ctx context.Context, blockID string) (int64, error) {
+	_, path := d.getDirPathAndFilePath(blockID)
+
+	fi, err := d.cli.Stat(path)
+	if err != nil {
+		return 0, d.translateError(err)
+	}
+
+	return fi.Size(), nil
+}
+
+// TouchBlock is not supported, WebDAV does not provide a way to update modification times.
+func (d *davStorage) TouchBlock(ctx context.Context, blockID string, threshold time.Duration) error {
+	return nil
+}
+
 func (d *davStorage) translateError(err error) error {
 	switch err := err.(type) {
 	case *os.PathError:
@@ -64,6 +85,10 @@ func (d *davStorage) translateError(err error) error {
 		case "404":
 			return storage.ErrBlockNotFound
 		}
+		if strings.HasPrefix(err.Err.Error(), "404 ") {
+			// PROPFIND errors include the status text of the response.
+			return storage.ErrBlockNotFound
+		}
 		return err
 	default:
 		return err
@@ -96,6 +121,10 @@ func (d *davStorage) ListBlocks(ctx context.Context, prefix string, callback fun
 		})
 
 		for _, e := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			if e.IsDir() {
 				newPrefix := currentPrefix + e.Name()
 				var match bool
@@ -128,7 +157,11 @@ func (d *davStorage) ListBlocks(ctx context.Context, prefix string, callback fun
 		return nil
 	}
 
-	return walkDir("", "")
+	if err := walkDir("", ""); err != storage.ErrStopIteration {
+		return err
+	}
+
+	return nil
 }
 
 func (d *davStorage) PutBlock(ctx context.Context, blockID string, data []byte) error {
@@ -0,0 +1,86 @@
+// Package writeonce implements wrapper around Storage that prevents existing blocks from being overwritten.
+package writeonce
+
+import (
+	"context"
+	"time"
+
+	"github.com/kopia/repo/storage"
+	"github.com/pkg/errors"
+)
+
+// ErrBlockExists is returned when writing a block that already exists.
+var ErrBlockExists = errors.New("block already exists")
+
+type writeOnceStorage struct {
+	base storage.Storage
+}
+
+func (s *writeOnceStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	return s.base.GetBlock(ctx, id, offset, length)
+}
+
+func (s *writeOnceStorage) GetBlocks(ctx context.Context, reqs []storage.BlockRange) ([]storage.BlockResult, error) {
+	return s.base.GetBlocks(ctx, reqs)
+}
+
+func (s *writeOnceStorage) GetBlockSize(ctx context.Context, id string) (int64, error) {
+	return s.base.GetBlockSize(ctx, id)
+}
+
+func (s *writeOnceStorage) TouchBlock(ctx context.Context, id string, threshold time.Duration) error {
+	return s.base.TouchBlock(ctx, id, threshold)
+}
+
+func (s *writeOnceStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	exists, err := s.blockExists(ctx, id)
+	if err != nil {
+		return errors.Wrapf(err, "unable to determine whether %q exists", id)
+	}
+
+	if exists {
+		return errors.Wrapf(ErrBlockExists, "PutBlock(%q)", id)
+	}
+
+	return s.base.PutBlock(ctx, id, data)
+}
+
+func (s *writeOnceStorage) blockExists(ctx context.Context, id string) (bool, error) {
+	_, err := s.base.GetBlockSize(ctx, id)
+	switch err {
+	case nil:
+		return true, nil
+	case storage.ErrBlockNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (s *writeOnceStorage) DeleteBlock(ctx context.Context, id string) error {
+	return s.base.DeleteBlock(ctx, id)
+}
+
+func (s *writeOnceStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	return s.base.ListBlocks(ctx, prefix, callback)
+}
+
+func (s *writeOnceStorage) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
+
+func (s *writeOnceStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// NewWrapper returns a Storage wrapper that rejects PutBlock() calls for blocks that already exist with ErrBlockExists,
+// which enforces immutability of content-addressable blocks. Deleting blocks is still allowed.
+//
+// The existence check is not atomic with the write, so concurrent writers of the same block are not detected.
+// Because storagetesting.VerifyStorage() overwrites blocks, the wrapper is intended for production paths only.
+//
+// Blocks that are rewritten in place, such as the format block rewritten by repo.Repository.Upgrade(),
+// can't be updated through the wrapper, so upgrades must be performed using unwrapped storage.
+func NewWrapper(wrapped storage.Storage) storage.Storage {
+	return &writeOnceStorage{base: wrapped}
+}
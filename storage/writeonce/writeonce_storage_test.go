@@ -0,0 +1,45 @@
+package writeonce
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kopia/repo/internal/storagetesting"
+	"github.com/pkg/errors"
+)
+
+func TestWriteOnceStorage(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	st := NewWrapper(storagetesting.NewMapStorage(data, nil, nil))
+
+	if err := st.PutBlock(ctx, "block1", []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	// blocks sharing the prefix are not affected.
+	if err := st.PutBlock(ctx, "block", []byte{4, 5, 6}); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	if err := st.PutBlock(ctx, "block1", []byte{1, 2, 3, 4}); errors.Cause(err) != ErrBlockExists {
+		t.Errorf("unexpected error when overwriting block: %v, wanted %v", err, ErrBlockExists)
+	}
+
+	if err := st.PutBlock(ctx, "block1", []byte{7, 8, 9, 10}); errors.Cause(err) != ErrBlockExists {
+		t.Errorf("unexpected error when overwriting block with different contents: %v, wanted %v", err, ErrBlockExists)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, st, "block1", []byte{1, 2, 3, 4})
+
+	// deleted blocks can be written again.
+	if err := st.DeleteBlock(ctx, "block1"); err != nil {
+		t.Fatalf("unable to delete block: %v", err)
+	}
+
+	if err := st.PutBlock(ctx, "block1", []byte{7, 8, 9, 10}); err != nil {
+		t.Errorf("unable to write deleted block: %v", err)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, st, "block1", []byte{7, 8, 9, 10})
+}
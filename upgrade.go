@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/kopia/repo/block"
 	"github.com/pkg/errors"
 )
 
-// Upgrade upgrades repository data structures to the latest version.
+// Upgrade upgrades repository data structures to the latest version, which takes effect when the repository
+// is opened again. Upgrading the block format version to block.LatestFormatVersion enables index sets,
+// which breaks compatibility: clients that only support earlier versions can no longer open the repository.
 func (r *Repository) Upgrade(ctx context.Context) error {
 	f := r.formatBlock
 
@@ -19,7 +22,17 @@ func (r *Repository) Upgrade(ctx context.Context) error {
 
 	var migrated bool
 
-	// TODO(jkowalski): add migration code here
+	if v := repoConfig.FormattingOptions.Version; v < block.LatestFormatVersion {
+		if repoConfig.FormattingOptions.BlockFormatVersion == 0 {
+			// blocks keep being written with the format version they were written with so far.
+			repoConfig.FormattingOptions.BlockFormatVersion = byte(v)
+		}
+
+		log.Infof("upgrading block format version from %v to %v", v, block.LatestFormatVersion)
+		repoConfig.FormattingOptions.Version = block.LatestFormatVersion
+		migrated = true
+	}
+
 	if !migrated {
 		log.Infof("nothing to do")
 		return nil
@@ -30,6 +43,11 @@ func (r *Repository) Upgrade(ctx context.Context) error {
 		return fmt.Errorf("unable to encrypt format bytes")
 	}
 
+	copyIDs, err := listFormatBlockCopies(ctx, r.Storage)
+	if err != nil {
+		return err
+	}
+
 	log.Infof("writing updated format block...")
-	return writeFormatBlock(ctx, r.Storage, f)
+	return writeFormatBlock(ctx, r.Storage, f, copyIDs)
 }